@@ -1,17 +1,25 @@
 package main
 
 import (
-	"log"
 	"net/http"
+	"os"
 
 	"github.com/mlatsa/WASAProject/service/api"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	rt := api.NewRouter()
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	rt, err := api.New(api.Config{Logger: logger})
+	if err != nil {
+		logger.WithError(err).Fatal("error creating the API server instance")
+	}
 	addr := ":3000"
-	log.Printf("listening on %s", addr)
+	logger.Infof("listening on %s", addr)
 	if err := http.ListenAndServe(addr, rt.Handler()); err != nil {
-		log.Fatal(err)
+		logger.WithError(err).Fatal("server error")
 	}
 }
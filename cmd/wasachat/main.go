@@ -0,0 +1,96 @@
+/*
+Wasachat is a terminal chat client for WASAText. It talks to the server through the REST API only, using the
+`pkg/client` package, and shows live updates from the event stream.
+
+Usage:
+
+	wasachat [-url <API URL>] [-password-stdin] <username>
+
+Once logged in, lines starting with "/" are commands (type /help for the list); any other line is sent to the open
+conversation.
+
+Return values (exit codes):
+
+	0
+		The program ended successfully (/quit or end of input)
+
+	1
+		The program ended due to an error
+
+	2
+		The command line is invalid
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/mlatsa/WASAProject/pkg/client"
+)
+
+// errUsage is returned for invalid command lines, after printing the usage.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	switch {
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil && !errors.Is(err, context.Canceled):
+		_, _ = fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the command line, logs in and runs the chat until the input ends.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("wasachat", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	baseURL := fs.String("url", "http://localhost:3000", "`URL` of the API")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of the standard input")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(stderr, "usage: wasachat [-url <API URL>] [-password-stdin] <username>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	username := fs.Arg(0)
+
+	c, err := client.New(client.Config{BaseURL: *baseURL})
+	if err != nil {
+		return err
+	}
+	in := bufio.NewScanner(stdin)
+	var password string
+	if *passwordStdin {
+		if !in.Scan() {
+			return errors.New("missing password on the standard input")
+		}
+		password = strings.TrimRight(in.Text(), "\r")
+	}
+	if err := c.Login(ctx, username, password); err != nil {
+		return fmt.Errorf("logging in: %w", err)
+	}
+
+	ui := newUI(c, username, stdout)
+	return ui.run(ctx, in)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mlatsa/WASAProject/pkg/client"
+	"github.com/mlatsa/WASAProject/service/api/types"
+)
+
+// historySize is how many messages are shown when a conversation is opened.
+const historySize = 20
+
+// clearLine moves to the start of the line and erases it, so that live updates don't mix with the prompt.
+const clearLine = "\r\033[K"
+
+const helpText = `commands:
+  /list                  list your conversations
+  /open <id or number>   open a conversation, and show its last messages
+  /react <n> <emoji>     react to message n of the open conversation
+  /delete <n>            delete message n of the open conversation
+  /forward <n> <id>      forward message n to another conversation
+  /help                  show this help
+  /quit                  exit
+any other line is sent to the open conversation`
+
+// ui is the state of the terminal. Output is serialized by mu, as live updates arrive from another goroutine.
+type ui struct {
+	c        *client.Client
+	username string
+
+	mu  sync.Mutex
+	out io.Writer
+
+	// conversations are the ones of the last /list, to open them by number
+	conversations []string
+
+	// open is the open conversation, and messages the IDs of its messages, numbered from 1 on screen
+	open     string
+	messages []string
+}
+
+func newUI(c *client.Client, username string, out io.Writer) *ui {
+	return &ui{c: c, username: username, out: out}
+}
+
+// run reads commands until the input ends or /quit, while live updates are printed as they arrive.
+func (u *ui) run(ctx context.Context, in *bufio.Scanner) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan error, 1)
+	go func() {
+		events <- u.c.Subscribe(ctx, 0, func(e types.Event) error {
+			u.event(e)
+			return nil
+		})
+	}()
+
+	u.printf("logged in as %s, type /help for the commands\n", u.username)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for in.Scan() {
+			select {
+			case lines <- in.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		u.prompt()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				u.printf("\n")
+				return nil
+			}
+			if quit := u.command(ctx, strings.TrimSpace(line)); quit {
+				return nil
+			}
+		case err := <-events:
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			return fmt.Errorf("event stream: %w", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (u *ui) printf(format string, args ...interface{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, _ = fmt.Fprintf(u.out, clearLine+format, args...)
+}
+
+func (u *ui) prompt() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.open != "" {
+		_, _ = fmt.Fprintf(u.out, "%s> ", u.open)
+	} else {
+		_, _ = fmt.Fprint(u.out, "> ")
+	}
+}
+
+// command runs a line of input, and returns true for /quit.
+func (u *ui) command(ctx context.Context, line string) bool {
+	if line == "" {
+		return false
+	}
+	if !strings.HasPrefix(line, "/") {
+		u.send(ctx, line)
+		return false
+	}
+
+	args := strings.Fields(line)
+	var err error
+	switch args[0] {
+	case "/quit":
+		return true
+	case "/help":
+		u.printf("%s\n", helpText)
+	case "/list":
+		err = u.list(ctx)
+	case "/open":
+		if len(args) != 2 {
+			err = errors.New("usage: /open <id or number>")
+			break
+		}
+		err = u.openConversation(ctx, args[1])
+	case "/react":
+		var id string
+		if len(args) != 3 {
+			err = errors.New("usage: /react <n> <emoji>")
+		} else if id, err = u.messageID(args[1]); err == nil {
+			_, err = u.c.React(ctx, id, args[2])
+		}
+	case "/delete":
+		var id string
+		if len(args) != 2 {
+			err = errors.New("usage: /delete <n>")
+		} else if id, err = u.messageID(args[1]); err == nil {
+			err = u.c.DeleteMessage(ctx, id)
+		}
+	case "/forward":
+		var id string
+		if len(args) != 3 {
+			err = errors.New("usage: /forward <n> <id>")
+		} else if id, err = u.messageID(args[1]); err == nil {
+			_, err = u.c.ForwardMessage(ctx, id, args[2])
+		}
+	default:
+		err = fmt.Errorf("unknown command %s, type /help for the list", args[0])
+	}
+	if err != nil {
+		u.printf("! %v\n", err)
+	}
+	return false
+}
+
+func (u *ui) send(ctx context.Context, text string) {
+	u.mu.Lock()
+	open := u.open
+	u.mu.Unlock()
+	if open == "" {
+		u.printf("! no open conversation: use /open first\n")
+		return
+	}
+	// The message is shown when its event arrives, like the messages of the others
+	if _, err := u.c.SendMessage(ctx, open, types.SendMessageInput{Content: text}); err != nil {
+		u.printf("! %v\n", err)
+	}
+}
+
+func (u *ui) list(ctx context.Context) error {
+	convs, err := u.c.Conversations(ctx)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conversations = u.conversations[:0]
+	if len(convs) == 0 {
+		_, _ = fmt.Fprint(u.out, clearLine+"no conversations yet: /open <id> starts one\n")
+	}
+	for i, c := range convs {
+		u.conversations = append(u.conversations, c.ID)
+		title := c.ID
+		if c.Name != "" {
+			title = c.Name + " (" + c.ID + ")"
+		}
+		_, _ = fmt.Fprintf(u.out, clearLine+"%2d. %s  %s  %s\n", i+1, title, c.Timestamp.Local().Format("Jan 2 15:04"), c.LastMessage)
+	}
+	return nil
+}
+
+func (u *ui) openConversation(ctx context.Context, arg string) error {
+	u.mu.Lock()
+	id := arg
+	if n, err := strconv.Atoi(arg); err == nil && n >= 1 && n <= len(u.conversations) {
+		id = u.conversations[n-1]
+	}
+	u.mu.Unlock()
+
+	conv, err := u.c.Conversation(ctx, id)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.open = conv.ID
+	u.messages = u.messages[:0]
+	_, _ = fmt.Fprintf(u.out, clearLine+"— %s, with %s —\n", conv.ID, strings.Join(conv.Participants, ", "))
+	msgs := conv.Messages
+	if len(msgs) > historySize {
+		msgs = msgs[len(msgs)-historySize:]
+	}
+	for _, m := range msgs {
+		u.showLocked(m)
+	}
+	return nil
+}
+
+// messageID returns the ID of the message numbered n on screen.
+func (u *ui) messageID(n string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(u.messages) || u.messages[i-1] == "" {
+		return "", fmt.Errorf("no message %s on screen", n)
+	}
+	return u.messages[i-1], nil
+}
+
+// numberLocked returns the number of a message on screen, or 0.
+func (u *ui) numberLocked(messageID string) int {
+	for i, id := range u.messages {
+		if id == messageID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// showLocked prints a message of the open conversation, numbering it.
+func (u *ui) showLocked(m *types.Message) {
+	u.messages = append(u.messages, m.MessageID)
+	content := m.Content
+	if m.Type == "image" {
+		content = "[image] " + content
+	}
+	if m.ForwardedFrom != "" {
+		content = "(forwarded) " + content
+	}
+	line := fmt.Sprintf("%3d. %s %s: %s", len(u.messages), m.Timestamp.Local().Format("15:04"), m.Sender, content)
+	if m.Type == "system" {
+		// Announcements of the server name whoever caused them
+		line = fmt.Sprintf("%3d. %s * %s", len(u.messages), m.Timestamp.Local().Format("15:04"), content)
+	}
+	if len(m.Reactions) > 0 {
+		emojis := make([]string, len(m.Reactions))
+		for i, r := range m.Reactions {
+			emojis[i] = r.Emoji
+		}
+		line += "  [" + strings.Join(emojis, " ") + "]"
+	}
+	_, _ = fmt.Fprint(u.out, clearLine+line+"\n")
+}
+
+// event prints a live update, then the prompt again.
+func (u *ui) event(e types.Event) {
+	u.mu.Lock()
+	if e.Type == types.EventResync {
+		_, _ = fmt.Fprint(u.out, clearLine+"* some updates were lost: /open the conversation again to reload it\n")
+	} else if e.ConversationID != u.open {
+		if e.Type == types.EventMessageCreated && e.Message.Sender != u.username {
+			_, _ = fmt.Fprintf(u.out, clearLine+"* new message in %s from %s\n", e.ConversationID, e.Message.Sender)
+		}
+	} else {
+		switch e.Type {
+		case types.EventMessageCreated:
+			u.showLocked(e.Message)
+		case types.EventMessageDeleted:
+			if n := u.numberLocked(e.MessageID); n > 0 {
+				u.messages[n-1] = ""
+				_, _ = fmt.Fprintf(u.out, clearLine+"* message %d was deleted\n", n)
+			}
+		case types.EventReactionAdded:
+			if n := u.numberLocked(e.MessageID); n > 0 {
+				_, _ = fmt.Fprintf(u.out, clearLine+"* %s on message %d\n", e.Reaction.Emoji, n)
+			}
+		case types.EventReactionRemoved:
+			if n := u.numberLocked(e.MessageID); n > 0 {
+				_, _ = fmt.Fprintf(u.out, clearLine+"* %s removed from message %d\n", e.Reaction.Emoji, n)
+			}
+		}
+	}
+	u.mu.Unlock()
+	u.prompt()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/mlatsa/WASAProject/pkg/client"
+	"github.com/mlatsa/WASAProject/service/api"
+	"github.com/mlatsa/WASAProject/service/api/types"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestServer starts a server with the memory storage, and returns its URL. A nil clock is the real one.
+func newTestServer(t *testing.T, clock globaltime.Clock) string {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rt, err := api.New(api.Config{Logger: logger, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rt.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		_ = rt.Close()
+	})
+	return srv.URL
+}
+
+// newTestClient logs in to the server at url as username.
+func newTestClient(t *testing.T, url, username string) *client.Client {
+	t.Helper()
+	c, err := client.New(client.Config{BaseURL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(context.Background(), username, ""); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// output returns what the ui printed since the last call.
+func (u *ui) output() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buf := u.out.(*bytes.Buffer)
+	out := strings.ReplaceAll(buf.String(), clearLine, "")
+	buf.Reset()
+	return out
+}
+
+// TestCommand runs commands against a server, and checks what they print and what they change.
+func TestCommand(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	clock := globaltime.NewFake(ts)
+	url := newTestServer(t, clock)
+	alice := newTestClient(t, url, "alice")
+	u := newUI(newTestClient(t, url, "bob"), "bob", &bytes.Buffer{})
+	if u.command(ctx, "/list"); u.output() != "no conversations yet: /open <id> starts one\n" {
+		t.Error("/list without conversations didn't say so")
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := alice.SendMessage(ctx, "chat", types.SendMessageInput{Content: "hello from chat"}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	at := func(minutes int) string { return ts.Add(time.Duration(minutes) * time.Minute).Local().Format("15:04") }
+	message := func(conversationID string, n int) types.Message {
+		t.Helper()
+		conv, err := alice.Conversation(ctx, conversationID)
+		if err != nil || len(conv.Messages) < n {
+			t.Fatalf("conversation %s: got %+v, %v", conversationID, conv, err)
+		}
+		return *conv.Messages[n-1]
+	}
+
+	for _, tc := range []struct {
+		line string
+		want string // printed by the command
+	}{
+		{"", ""},
+		{"hello", "! no open conversation: use /open first\n"},
+		{"/help", helpText + "\n"},
+		{"/what", "! unknown command /what, type /help for the list\n"},
+		{"/open", "! usage: /open <id or number>\n"},
+		{"/open a b", "! usage: /open <id or number>\n"},
+		{"/react 1", "! usage: /react <n> <emoji>\n"},
+		{"/react 1 👍", "! no message 1 on screen\n"},
+		{"/delete", "! usage: /delete <n>\n"},
+		{"/forward 1", "! usage: /forward <n> <id>\n"},
+		{"/open chat", "— chat, with alice —\n  1. " + at(1) + " alice: hello from chat\n"},
+		{"/list", " 1. chat  Jan 1 " + at(1) + "  hello from chat\n"},
+		{"/open 2", "! request validation failed (HTTP 400); conversationId: must match ^[A-Za-z0-9._-]{3,64}$\n"},
+		{"/open 1", "— chat, with alice —\n  1. " + at(1) + " alice: hello from chat\n"},
+		{"/react 0 👍", "! no message 0 on screen\n"},
+		{"/react x 👍", "! no message x on screen\n"},
+		{"/react 1 👍", ""},
+		{"/forward 2 other", "! no message 2 on screen\n"},
+		{"/forward 1 other", ""},
+		{"mine", ""},
+		{"/open chat", "— chat, with alice, bob —\n  1. " + at(1) + " alice: hello from chat  [👍]\n  2. " + at(2) + " bob: mine\n"},
+		{"/delete 1", "! only the sender can delete a message (HTTP 403)\n"},
+		{"/delete 2", ""},
+		{"/quit", ""},
+	} {
+		quit := u.command(ctx, tc.line)
+		if quit != (tc.line == "/quit") {
+			t.Errorf("%q: got quit %t", tc.line, quit)
+		}
+		if out := u.output(); out != tc.want {
+			t.Errorf("%q: got output %q, want %q", tc.line, out, tc.want)
+		}
+	}
+
+	if m := message("other", 1); m.ForwardedFrom != message("chat", 1).MessageID || m.Content != "hello from chat" {
+		t.Errorf("forwarded message: got %+v", m)
+	}
+	if conv, err := alice.Conversation(ctx, "chat"); err != nil || len(conv.Messages) != 1 {
+		t.Errorf("conversation after /delete: got %+v, %v", conv, err)
+	}
+}
+
+// TestEvent checks how live updates are printed, depending on the open conversation.
+func TestEvent(t *testing.T) {
+	ts := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	hour := ts.Local().Format("15:04")
+	msg := func(id, conversationID, sender, content string) *types.Message {
+		return &types.Message{MessageID: id, ConversationID: conversationID, Sender: sender, Content: content,
+			Type: "text", Timestamp: ts}
+	}
+	u := newUI(nil, "bob", &bytes.Buffer{})
+	u.open, u.messages = "chat", []string{"m1"}
+
+	for _, tc := range []struct {
+		name  string
+		event types.Event
+		want  string
+	}{
+		{
+			name:  "message in the open conversation",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "chat", Message: msg("m2", "chat", "alice", "hi")},
+			want:  "  2. " + hour + " alice: hi\n",
+		},
+		{
+			name: "image",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "chat",
+				Message: &types.Message{MessageID: "m3", Sender: "alice", Content: "https://x/a.png", Type: "image", Timestamp: ts}},
+			want: "  3. " + hour + " alice: [image] https://x/a.png\n",
+		},
+		{
+			name: "forward with reactions",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "chat",
+				Message: &types.Message{MessageID: "m4", Sender: "alice", Content: "hi", Type: "text", Timestamp: ts,
+					ForwardedFrom: "m0", Reactions: []types.Reaction{{Emoji: "👍"}, {Emoji: "🎉"}}}},
+			want: "  4. " + hour + " alice: (forwarded) hi  [👍 🎉]\n",
+		},
+		{
+			name: "announcement",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "chat",
+				Message: &types.Message{MessageID: "m5", Content: "alice set the retention", Type: "system", Timestamp: ts}},
+			want: "  5. " + hour + " * alice set the retention\n",
+		},
+		{
+			name:  "reaction",
+			event: types.Event{Type: types.EventReactionAdded, ConversationID: "chat", MessageID: "m2", Reaction: &types.Reaction{Emoji: "👍"}},
+			want:  "* 👍 on message 2\n",
+		},
+		{
+			name:  "reaction removed",
+			event: types.Event{Type: types.EventReactionRemoved, ConversationID: "chat", MessageID: "m2", Reaction: &types.Reaction{Emoji: "👍"}},
+			want:  "* 👍 removed from message 2\n",
+		},
+		{
+			name:  "reaction to a message not on screen",
+			event: types.Event{Type: types.EventReactionAdded, ConversationID: "chat", MessageID: "m0", Reaction: &types.Reaction{Emoji: "👍"}},
+		},
+		{
+			name:  "deletion",
+			event: types.Event{Type: types.EventMessageDeleted, ConversationID: "chat", MessageID: "m1"},
+			want:  "* message 1 was deleted\n",
+		},
+		{
+			name:  "deletion of a deleted message",
+			event: types.Event{Type: types.EventMessageDeleted, ConversationID: "chat", MessageID: "m1"},
+		},
+		{
+			name:  "message in another conversation",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "other", Message: msg("m6", "other", "carol", "hey")},
+			want:  "* new message in other from carol\n",
+		},
+		{
+			name:  "own message in another conversation",
+			event: types.Event{Type: types.EventMessageCreated, ConversationID: "other", Message: msg("m7", "other", "bob", "hey")},
+		},
+		{
+			name:  "reaction in another conversation",
+			event: types.Event{Type: types.EventReactionAdded, ConversationID: "other", MessageID: "m2", Reaction: &types.Reaction{Emoji: "👍"}},
+		},
+		{
+			name:  "resync",
+			event: types.Event{Type: types.EventResync},
+			want:  "* some updates were lost: /open the conversation again to reload it\n",
+		},
+	} {
+		u.event(tc.event)
+		if out := u.output(); out != tc.want+"chat> " {
+			t.Errorf("%s: got %q, want %q", tc.name, out, tc.want+"chat> ")
+		}
+	}
+	if id, err := u.messageID("1"); err == nil {
+		t.Errorf("deleted message 1 is still on screen as %s", id)
+	}
+}
+
+// TestRun chats through run, and checks that the messages of the others show up live.
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	url := newTestServer(t, nil)
+	alice := newTestClient(t, url, "alice")
+	if _, err := alice.SendMessage(ctx, "chat", types.SendMessageInput{Content: "anyone there?"}); err != nil {
+		t.Fatal(err)
+	}
+	// bob takes part in another conversation, to be told about its messages
+	if _, err := newTestClient(t, url, "bob").SendMessage(ctx, "elsewhere", types.SendMessageInput{Content: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, input := io.Pipe()
+	out := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, []string{"-url", url, "bob"}, stdin, out, io.Discard) }()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("got output %q, want it to contain %q", out.String(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	writeLine := func(line string) {
+		t.Helper()
+		if _, err := io.WriteString(input, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor("logged in as bob")
+	writeLine("/open chat")
+	waitFor("alice: anyone there?")
+	writeLine("here!")
+	waitFor("bob: here!")
+	if _, err := alice.SendMessage(ctx, "chat", types.SendMessageInput{Content: "great"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("alice: great")
+	if _, err := alice.SendMessage(ctx, "elsewhere", types.SendMessageInput{Content: "psst"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("* new message in elsewhere from alice")
+
+	writeLine("/quit")
+	if err := <-done; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, as run writes from the goroutine of the event stream.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/backup"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// command is a wasactl command. Names have one or two words, e.g. "stats" or "users list".
+type command struct {
+	name    string
+	args    string // usage of the flags and arguments
+	summary string
+
+	// migrates is true for the commands that run on databases with an outdated schema, which they upgrade
+	migrates bool
+
+	// offline is true for the commands that replace the files of a stopped server: they don't open the database,
+	// which may not exist
+	offline bool
+
+	run func(e *env, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{name: "users list", summary: "List the users.", run: usersList},
+	{name: "users create", args: "[-password-stdin] <name>", summary: "Create a user, optionally with the password read from the standard input.", run: usersCreate},
+	{name: "users delete", args: "[-token-ttl <duration>] <name>", summary: "Delete a user with their sessions and scheduled messages. Their messages are kept.", run: usersDelete},
+	{name: "sessions list", args: "[<user>]", summary: "List the sessions, of every user or of one.", run: sessionsList},
+	{name: "sessions revoke", args: "[-token-ttl <duration>] (-id <session> | <user>)", summary: "Revoke a session, or every session of a user.", run: sessionsRevoke},
+	{name: "conversations list", summary: "List the conversations, most recently active first.", run: conversationsList},
+	{name: "conversations show", args: "[-messages <n>] <id>", summary: "Show a conversation and its last messages.", run: conversationsShow},
+	{name: "messages purge", args: "[-dry-run] [-conversation <id>] [-before <date> | -older-than <duration>] [-all]", summary: "Delete messages, with their reactions.", run: messagesPurge},
+	{name: "migrate", args: "[-status]", summary: "Upgrade the database schema, creating the database if needed.", migrates: true, run: migrate},
+	{name: "stats", summary: "Print statistics about the database.", run: stats},
+	{name: "backup", args: "[-media <dir>] <file>", summary: "Back up the database and the media directory to a tar file (\"-\" for the standard output), even while the server runs.", run: backupCommand},
+	{name: "restore", args: "[-media <dir>] [-force] <file>", summary: "Replace the database and the media directory with a backup (\"-\" for the standard input). The server must be stopped.", offline: true, run: restoreCommand},
+	{name: "help", summary: "Print this help."},
+}
+
+// findCommand returns the command named by the first one or two words of args, and the remaining arguments.
+func findCommand(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		return command{}, nil, errors.New("missing command")
+	}
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], nil
+		}
+	}
+	return command{}, nil, fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func printUsage(w io.Writer) {
+	_, _ = fmt.Fprintln(w, "usage: wasactl [-db <file>] [-storage <backend>] <command> [flags] [arguments]")
+	_, _ = fmt.Fprintln(w, "\nwasactl works only with the sqlite storage backend of the server (CFG_STORAGE_BACKEND=sqlite):")
+	_, _ = fmt.Fprintln(w, "with the memory storage, the default, the server doesn't read the database.")
+	_, _ = fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		_, _ = fmt.Fprintf(w, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+	_, _ = fmt.Fprintln(w, "\nrun \"wasactl <command> -h\" for the flags of a command.")
+}
+
+// parseArgs parses the flags of a command, and checks that the number of arguments is between min and max.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if n := fs.NArg(); n < min || n > max {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// table returns a tabwriter for aligned output. It must be flushed.
+func (e *env) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+}
+
+// formatTime formats the timestamps of the output, or "-" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+/* users */
+
+// usernamePattern matches the valid usernames, as the API does.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,16}$`)
+
+// Bounds of the password length, in bytes, as enforced by the API.
+const (
+	minPasswordSize = 8
+	maxPasswordSize = 72
+)
+
+// defaultTokenTTL is the absolute session TTL of webapi, when it runs with the default configuration.
+const defaultTokenTTL = 720 * time.Hour
+
+// tokenTTLFlag adds the -token-ttl flag, which defaults to the absolute session TTL of webapi: the signed tokens of
+// revoked sessions are rejected until then.
+func tokenTTLFlag(fs *flag.FlagSet) *time.Duration {
+	ttl := defaultTokenTTL
+	if d, err := time.ParseDuration(os.Getenv("CFG_SESSION_ABSOLUTE_TTL")); err == nil {
+		ttl = d
+	}
+	return fs.Duration("token-ttl", ttl, "how long the signed tokens of the server are valid after login, 0 for forever")
+}
+
+func usersList(e *env, fs *flag.FlagSet, args []string) error {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	users, err := e.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	tw := e.table()
+	_, _ = fmt.Fprintln(tw, "NAME\tPASSWORD\tCREATED")
+	for _, u := range users {
+		_, _ = fmt.Fprintf(tw, "%s\t%t\t%s\n", u.Name, u.PasswordHash != nil, formatTime(u.CreatedAt))
+	}
+	return tw.Flush()
+}
+
+func usersCreate(e *env, fs *flag.FlagSet, args []string) error {
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of the standard input")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	u := database.User{Name: args[0], CreatedAt: time.Now().UTC()}
+	if !usernamePattern.MatchString(u.Name) {
+		return fmt.Errorf("invalid username %q: it must match %s", u.Name, usernamePattern)
+	}
+	if *passwordStdin {
+		line, err := bufio.NewReader(e.stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading the password: %w", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if len(password) < minPasswordSize || len(password) > maxPasswordSize {
+			return fmt.Errorf("the password must be between %d and %d bytes long", minPasswordSize, maxPasswordSize)
+		}
+		if u.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("hashing the password: %w", err)
+		}
+	}
+
+	if err := e.db.CreateUser(u); errors.Is(err, database.ErrAlreadyExists) {
+		return fmt.Errorf("user %q already exists", u.Name)
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.stdout, "created user %s\n", u.Name)
+	return err
+}
+
+func usersDelete(e *env, fs *flag.FlagSet, args []string) error {
+	tokenTTL := tokenTTLFlag(fs)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := e.db.DeleteUser(args[0], *tokenTTL); errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("user %q not found", args[0])
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.stdout, "deleted user %s\n", args[0])
+	return err
+}
+
+/* sessions */
+
+func sessionsList(e *env, fs *flag.FlagSet, args []string) error {
+	args, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	var username string
+	if len(args) == 1 {
+		username = args[0]
+	}
+	sessions, err := e.db.ListSessions(username)
+	if err != nil {
+		return err
+	}
+	tw := e.table()
+	_, _ = fmt.Fprintln(tw, "ID\tUSER\tTOKEN\tCREATED\tLAST USED")
+	for _, s := range sessions {
+		token := "opaque"
+		if s.TokenHash == "" {
+			token = "signed"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Username, token, formatTime(s.CreatedAt), formatTime(s.LastUsedAt))
+	}
+	return tw.Flush()
+}
+
+func sessionsRevoke(e *env, fs *flag.FlagSet, args []string) error {
+	id := fs.String("id", "", "revoke only the session with this `ID`")
+	tokenTTL := tokenTTLFlag(fs)
+	args, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *id != "" && len(args) == 0:
+		if err := e.db.RevokeSession(*id, *tokenTTL); errors.Is(err, database.ErrNotFound) {
+			return fmt.Errorf("session %q not found", *id)
+		} else if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.stdout, "revoked session %s\n", *id)
+		return err
+	case *id == "" && len(args) == 1:
+		n, err := e.db.RevokeUserSessions(args[0], *tokenTTL)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.stdout, "revoked %d sessions of %s\n", n, args[0])
+		return err
+	default:
+		fs.Usage()
+		return errUsage
+	}
+}
+
+/* conversations */
+
+func conversationsList(e *env, fs *flag.FlagSet, args []string) error {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	convs, err := e.db.ListConversations()
+	if err != nil {
+		return err
+	}
+	tw := e.table()
+	_, _ = fmt.Fprintln(tw, "ID\tNAME\tPARTICIPANTS\tMESSAGES\tLAST ACTIVITY")
+	for _, c := range convs {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", c.ID, c.Name, len(c.Participants), c.Messages, formatTime(c.Timestamp))
+	}
+	return tw.Flush()
+}
+
+func conversationsShow(e *env, fs *flag.FlagSet, args []string) error {
+	limit := fs.Int("messages", 20, "number of messages to show, the most recent ones")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return errors.New("the number of messages can't be negative")
+	}
+	c, err := e.db.GetConversation(args[0])
+	if errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("conversation %q not found", args[0])
+	} else if err != nil {
+		return err
+	}
+	msgs, err := e.db.ListMessages(c.ID, *limit)
+	if err != nil {
+		return err
+	}
+
+	tw := e.table()
+	_, _ = fmt.Fprintf(tw, "ID:\t%s\n", c.ID)
+	if c.Name != "" {
+		_, _ = fmt.Fprintf(tw, "Name:\t%s\n", c.Name)
+	}
+	if c.Photo != "" {
+		_, _ = fmt.Fprintf(tw, "Photo:\t%s\n", c.Photo)
+	}
+	_, _ = fmt.Fprintf(tw, "Participants:\t%s\n", strings.Join(c.Participants, ", "))
+	_, _ = fmt.Fprintf(tw, "Messages:\t%d\n", c.Messages)
+	_, _ = fmt.Fprintf(tw, "Last activity:\t%s\n", formatTime(c.Timestamp))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	_, _ = fmt.Fprintln(e.stdout)
+	tw = e.table()
+	_, _ = fmt.Fprintln(tw, "ID\tSENT\tSENDER\tTYPE\tCONTENT\tREACTIONS")
+	for _, m := range msgs {
+		content := strings.ReplaceAll(m.Content, "\n", " ")
+		if m.ForwardedFrom != "" {
+			content = "(forwarded) " + content
+		}
+		emojis := make([]string, len(m.Reactions))
+		for i, r := range m.Reactions {
+			emojis[i] = r.Emoji
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			m.ID, formatTime(m.Timestamp), m.Sender, m.Type, content, strings.Join(emojis, " "))
+	}
+	return tw.Flush()
+}
+
+/* messages */
+
+func messagesPurge(e *env, fs *flag.FlagSet, args []string) error {
+	dryRun := fs.Bool("dry-run", false, "only count the messages that would be deleted")
+	convID := fs.String("conversation", "", "purge only the conversation with this `ID`")
+	before := fs.String("before", "", "purge the messages sent before this `date`, as 2006-01-02 or RFC 3339")
+	olderThan := fs.Duration("older-than", 0, "purge the messages older than this `duration`, e.g. 720h")
+	all := fs.Bool("all", false, "allow purging without filters, i.e. every message")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	filter := database.MessageFilter{ConversationID: *convID}
+	switch {
+	case *before != "" && *olderThan != 0:
+		return errors.New("-before and -older-than are mutually exclusive")
+	case *before != "":
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", *before); err != nil {
+				return fmt.Errorf("invalid date %q: use 2006-01-02 or RFC 3339", *before)
+			}
+		}
+		filter.Before = t
+	case *olderThan < 0:
+		return errors.New("-older-than must be positive")
+	case *olderThan > 0:
+		filter.Before = time.Now().Add(-*olderThan)
+	}
+	if filter == (database.MessageFilter{}) && !*all {
+		return errors.New("refusing to purge every message without -all")
+	}
+
+	if *dryRun {
+		n, err := e.db.CountMessages(filter)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.stdout, "would purge %d messages\n", n)
+		return err
+	}
+	n, err := e.db.PurgeMessages(filter)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.stdout, "purged %d messages\n", n)
+	return err
+}
+
+/* database */
+
+func migrate(e *env, fs *flag.FlagSet, args []string) error {
+	status := fs.Bool("status", false, "only print the schema version")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *status {
+		version, err := e.db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.stdout, "schema version %d, latest %d\n", version, database.LatestSchemaVersion())
+		return err
+	}
+
+	applied, err := e.db.Migrate()
+	for _, m := range applied {
+		_, _ = fmt.Fprintf(e.stdout, "applied migration %s\n", m)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		_, err = fmt.Fprintf(e.stdout, "schema is up to date (version %d)\n", database.LatestSchemaVersion())
+	}
+	return err
+}
+
+func stats(e *env, fs *flag.FlagSet, args []string) error {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	s, err := e.db.Stats()
+	if err != nil {
+		return err
+	}
+	indexed := "unavailable"
+	if s.IndexedMessages >= 0 {
+		indexed = fmt.Sprint(s.IndexedMessages)
+	}
+	tw := e.table()
+	_, _ = fmt.Fprintf(tw, "Schema version:\t%d\n", s.SchemaVersion)
+	_, _ = fmt.Fprintf(tw, "Users:\t%d\n", s.Users)
+	_, _ = fmt.Fprintf(tw, "Sessions:\t%d\n", s.Sessions)
+	_, _ = fmt.Fprintf(tw, "Conversations:\t%d\n", s.Conversations)
+	_, _ = fmt.Fprintf(tw, "Messages:\t%d\n", s.Messages)
+	_, _ = fmt.Fprintf(tw, "Reactions:\t%d\n", s.Reactions)
+	_, _ = fmt.Fprintf(tw, "Indexed messages:\t%s\n", indexed)
+	_, _ = fmt.Fprintf(tw, "Oldest message:\t%s\n", formatTime(s.OldestMessage))
+	_, _ = fmt.Fprintf(tw, "Newest message:\t%s\n", formatTime(s.NewestMessage))
+	return tw.Flush()
+}
+
+/* backups */
+
+// mediaFlag adds the -media flag, which defaults to the media directory of webapi.
+func mediaFlag(fs *flag.FlagSet) *string {
+	return fs.String("media", os.Getenv("CFG_MEDIA_DIR"), "media `directory` of the server, if any")
+}
+
+func backupCommand(e *env, fs *flag.FlagSet, args []string) error {
+	mediaDir := mediaFlag(fs)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	b, err := backup.Create(e.db, *mediaDir, time.Now())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = b.Close() }()
+
+	if args[0] == "-" {
+		_, err = b.WriteTo(e.stdout)
+		return err
+	}
+	// The backup is written aside, so that a failure doesn't leave a truncated file in place of a previous one
+	f, err := os.OpenFile(args[0]+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(args[0]+".tmp", args[0])
+	}
+	if err != nil {
+		_ = os.Remove(args[0] + ".tmp")
+		return fmt.Errorf("writing the backup: %w", err)
+	}
+	_, err = fmt.Fprintf(e.stderr, "backed up schema version %d to %s\n", b.Manifest.SchemaVersion, args[0])
+	return err
+}
+
+func restoreCommand(e *env, fs *flag.FlagSet, args []string) error {
+	mediaDir := mediaFlag(fs)
+	force := fs.Bool("force", false, "replace an existing database")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(e.dbFile); err == nil && !*force {
+		return fmt.Errorf("refusing to replace the existing database %s without -force", e.dbFile)
+	}
+	r := e.stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	m, err := backup.Restore(r, e.dbFile, *mediaDir)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(e.stdout, "restored the backup of %s to %s\n", formatTime(m.CreatedAt), e.dbFile)
+	if m.Media && *mediaDir == "" {
+		_, _ = fmt.Fprintln(e.stdout, "skipped the media files: no media directory given")
+	}
+	if m.SchemaVersion < database.LatestSchemaVersion() {
+		_, _ = fmt.Fprintf(e.stdout, "schema version %d is outdated: run wasactl migrate, or start the server, to upgrade it\n", m.SchemaVersion)
+	}
+	return nil
+}
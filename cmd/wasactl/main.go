@@ -0,0 +1,148 @@
+/*
+Wasactl is the administration tool of a WASAText instance. It works directly on the SQLite database of the server,
+through the same `internal/service/database` package.
+
+Usage:
+
+	wasactl [-db <file>] [-storage <backend>] <command> [flags] [arguments]
+
+Wasactl only works with the sqlite storage of the server: with the memory storage, the default of webapi, the server
+doesn't read the database, and changes made by wasactl have no effect. The storage backend is given by -storage or, as
+for webapi, by the CFG_STORAGE_BACKEND environment variable. Wasactl refuses to run with a backend other than sqlite,
+and warns when none is set.
+
+The database defaults to the CFG_DB_FILENAME environment variable, as for webapi, or to /tmp/decaf.db; the media
+directory of backups to CFG_MEDIA_DIR; the lifetime of the signed tokens revoked with sessions to
+CFG_SESSION_ABSOLUTE_TTL, or to 720h. Run `wasactl help` for the list of commands.
+
+Return values (exit codes):
+
+	0
+		The command ended successfully
+
+	1
+		The command failed
+
+	2
+		The command line is invalid
+*/
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// defaultDB is the database of the server, when it runs with the default configuration.
+const defaultDB = "/tmp/decaf.db"
+
+// sqliteStorage is the storage backend of the server that keeps its state in the database.
+const sqliteStorage = "sqlite"
+
+// errUsage is returned for invalid command lines, after printing the usage.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr, os.Stdin)
+	switch {
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil:
+		_, _ = fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// env is what commands work with.
+type env struct {
+	db     database.AppDatabase // nil for offline commands
+	dbFile string
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
+
+// run parses the global flags, opens the database and runs the command.
+func run(args []string, stdout, stderr io.Writer, stdin io.Reader) error {
+	fs := flag.NewFlagSet("wasactl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dbDefault := os.Getenv("CFG_DB_FILENAME")
+	if dbDefault == "" {
+		dbDefault = defaultDB
+	}
+	filename := fs.String("db", dbDefault, "SQLite database `file`")
+	storage := fs.String("storage", os.Getenv("CFG_STORAGE_BACKEND"), "storage `backend` of the server (must be sqlite)")
+	fs.Usage = func() { printUsage(stderr) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+
+	cmd, cmdArgs, err := findCommand(fs.Args())
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		printUsage(stderr)
+		return errUsage
+	}
+	if cmd.name == "help" {
+		printUsage(stdout)
+		return nil
+	}
+	switch *storage {
+	case sqliteStorage:
+	case "":
+		_, _ = fmt.Fprintln(stderr, "warning: the storage backend of the server is not set (-storage or CFG_STORAGE_BACKEND): "+
+			"wasactl has no effect unless the server uses the sqlite storage, as webapi defaults to memory")
+	default:
+		return fmt.Errorf("the server uses the %q storage: wasactl works only with the %s storage", *storage, sqliteStorage)
+	}
+
+	cmdFlags := flag.NewFlagSet("wasactl "+cmd.name, flag.ContinueOnError)
+	cmdFlags.SetOutput(stderr)
+	cmdFlags.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "usage: wasactl %s %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+		cmdFlags.PrintDefaults()
+	}
+	e := &env{dbFile: *filename, stdout: stdout, stderr: stderr, stdin: stdin}
+	if cmd.offline {
+		return cmd.run(e, cmdFlags, cmdArgs)
+	}
+
+	// Only migrate may create the database: a typo in the file name would otherwise leave an empty database around
+	if !cmd.migrates {
+		if _, err := os.Stat(*filename); err != nil {
+			return fmt.Errorf("opening the database: %w", err)
+		}
+	}
+	conn, err := sql.Open("sqlite3", *filename)
+	if err != nil {
+		return fmt.Errorf("opening the database: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	db, err := database.New(conn)
+	if err != nil {
+		return fmt.Errorf("opening the database: %w", err)
+	}
+	if !cmd.migrates {
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return fmt.Errorf("reading the schema version: %w", err)
+		}
+		if version != database.LatestSchemaVersion() {
+			return fmt.Errorf("the database schema is at version %d, version %d is required: run wasactl migrate",
+				version, database.LatestSchemaVersion())
+		}
+	}
+
+	e.db = db
+	return cmd.run(e, cmdFlags, cmdArgs)
+}
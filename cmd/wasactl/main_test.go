@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api"
+	"github.com/sirupsen/logrus"
+)
+
+// TestCommands runs the commands on a fresh database, filled behind their back as the server would.
+func TestCommands(t *testing.T) {
+	t.Setenv("CFG_STORAGE_BACKEND", "sqlite")
+	dbFile := filepath.Join(t.TempDir(), "wasa.db")
+	wasactl := func(stdin string, args ...string) (string, error) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		err := run(append([]string{"-db", dbFile}, args...), &stdout, &stderr, strings.NewReader(stdin))
+		return stdout.String() + stderr.String(), err
+	}
+	mustRun := func(want string, args ...string) {
+		t.Helper()
+		out, err := wasactl("", args...)
+		if err != nil {
+			t.Fatalf("wasactl %s: %v (output: %s)", strings.Join(args, " "), err, out)
+		}
+		if !strings.Contains(out, want) {
+			t.Errorf("wasactl %s: got %q, want it to contain %q", strings.Join(args, " "), out, want)
+		}
+	}
+
+	if _, err := wasactl("", "stats"); err == nil {
+		t.Fatal("stats on a missing database succeeded")
+	}
+	mustRun("applied migration 1", "migrate")
+	mustRun("up to date", "migrate")
+
+	mustRun("created user alice", "users", "create", "alice")
+	if out, err := wasactl("correct-horse\n", "users", "create", "-password-stdin", "bob"); err != nil {
+		t.Fatalf("creating bob: %v (output: %s)", err, out)
+	}
+	if _, err := wasactl("", "users", "create", "alice"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("creating alice twice: got %v", err)
+	}
+	if _, err := wasactl("", "users", "create", "a b"); err == nil {
+		t.Error("created a user with an invalid name")
+	}
+	mustRun("bob    true", "users", "list")
+
+	conn, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Exec(`
+		INSERT INTO sessions VALUES ('s1', 'bob', 'hash', 1, 2), ('s2', 'bob', NULL, 1, 3), ('s3', 'alice', NULL, 1, 3);
+		INSERT INTO conversations (id, name, photo, last_message, ts) VALUES ('chat1', 'Team', '', 'second', 2000000000);
+		INSERT INTO participants VALUES ('chat1', 'alice', 0), ('chat1', 'bob', 1);
+		INSERT INTO messages VALUES
+			('m1', 'chat1', 'alice', 'first', 'text', 'delivered', 1000000000, ''),
+			('m2', 'chat1', 'bob', 'second', 'text', 'delivered', 2000000000, 'm1');
+		INSERT INTO reactions VALUES ('r1', 'm1', '👍', 0);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustRun("chat1  Team  2             2", "conversations", "list")
+	mustRun("(forwarded) second", "conversations", "show", "chat1")
+	mustRun("s2  bob   signed", "sessions", "list", "bob")
+	mustRun("revoked session s3", "sessions", "revoke", "-id", "s3")
+	mustRun("revoked 2 sessions of bob", "sessions", "revoke", "bob")
+
+	if _, err := wasactl("", "messages", "purge"); err == nil {
+		t.Error("purged every message without -all")
+	}
+	mustRun("would purge 1 messages", "messages", "purge", "-dry-run", "-before", "1970-01-01T00:00:01.5Z")
+	mustRun("purged 1 messages", "messages", "purge", "-conversation", "chat1", "-before", "1970-01-01T00:00:01.5Z")
+	mustRun("Reactions:         0", "stats")
+	mustRun("Messages:          1", "stats")
+
+	mustRun("deleted user bob", "users", "delete", "bob")
+	mustRun("Participants:   alice\n", "conversations", "show", "chat1")
+
+	if _, err := wasactl("", "users", "frobnicate"); !errors.Is(err, errUsage) {
+		t.Errorf("unknown command: got %v, want a usage error", err)
+	}
+}
+
+// TestRevokeSignedTokens revokes the sessions of a server with signed tokens behind its back, and checks that the
+// server doesn't restore them from their tokens.
+func TestRevokeSignedTokens(t *testing.T) {
+	t.Setenv("CFG_STORAGE_BACKEND", "sqlite")
+	dbFile := filepath.Join(t.TempDir(), "wasa.db")
+	wasactl := func(args ...string) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := run(append([]string{"-db", dbFile}, args...), &stdout, &stderr, strings.NewReader("")); err != nil {
+			t.Fatalf("wasactl %s: %v (output: %s%s)", strings.Join(args, " "), err, stdout.String(), stderr.String())
+		}
+	}
+	wasactl("migrate")
+	wasactl("users", "create", "bob")
+
+	conn, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rt, err := api.New(api.Config{
+		Logger:   logger,
+		Storage:  api.StorageSQLite,
+		Database: db,
+		Sessions: api.SessionConfig{AbsoluteTTL: time.Hour},
+		Tokens: api.TokenConfig{
+			Mode: api.TokenSigned,
+			Keys: []api.SigningKey{{ID: "test", Secret: []byte("0123456789abcdef0123456789abcdef")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rt.Close() }()
+	srv := httptest.NewServer(rt.Handler())
+	defer srv.Close()
+
+	do := func(method, path, token, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	login := func(name string) string {
+		t.Helper()
+		resp, err := srv.Client().Post(srv.URL+"/session", "application/json", strings.NewReader(`{"name":"`+name+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct{ Identifier string }
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.Identifier == "" {
+			t.Fatalf("logging in as %s: status %d, %v", name, resp.StatusCode, err)
+		}
+		return out.Identifier
+	}
+
+	alice, bob, carol := login("alice"), login("bob"), login("carol")
+	for _, token := range []string{alice, bob, carol} {
+		if status := do(http.MethodGet, "/sessions", token, ""); status != http.StatusOK {
+			t.Fatalf("listing sessions: status %d, want 200", status)
+		}
+	}
+
+	wasactl("sessions", "revoke", "alice")
+	wasactl("users", "delete", "bob")
+	var sessionID string
+	if err := conn.QueryRow(`SELECT id FROM sessions WHERE username = 'carol'`).Scan(&sessionID); err != nil {
+		t.Fatal(err)
+	}
+	wasactl("sessions", "revoke", "-token-ttl", "1h", "-id", sessionID)
+
+	for name, token := range map[string]string{"alice": alice, "bob": bob, "carol": carol} {
+		if status := do(http.MethodGet, "/sessions", token, ""); status != http.StatusUnauthorized {
+			t.Errorf("token of %s after revoking it: status %d, want 401", name, status)
+		}
+	}
+	var forever int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE until = 0`).Scan(&forever); err != nil || forever != 0 {
+		t.Errorf("revocations without expiry: got %d, %v, want 0", forever, err)
+	}
+}
+
+// TestBackupCommands backs up a database, with its media directory, and restores it in place of another.
+func TestBackupCommands(t *testing.T) {
+	t.Setenv("CFG_STORAGE_BACKEND", "sqlite")
+	dir := t.TempDir()
+	wasactl := func(dbFile string, args ...string) (string, error) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		err := run(append([]string{"-db", filepath.Join(dir, dbFile)}, args...), &stdout, &stderr, strings.NewReader(""))
+		return stdout.String() + stderr.String(), err
+	}
+	for _, args := range [][]string{{"migrate"}, {"users", "create", "alice"}} {
+		if out, err := wasactl("source.db", args...); err != nil {
+			t.Fatalf("wasactl %s: %v (output: %s)", strings.Join(args, " "), err, out)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "media", "photos"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "media", "photos", "alice.png"), []byte("png"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "backup.tar")
+	if out, err := wasactl("source.db", "backup", "-media", filepath.Join(dir, "media"), archive); err != nil {
+		t.Fatalf("backing up: %v (output: %s)", err, out)
+	}
+
+	if out, err := wasactl("target.db", "migrate"); err != nil {
+		t.Fatalf("creating the target: %v (output: %s)", err, out)
+	}
+	if _, err := wasactl("target.db", "restore", archive); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("restoring over a database without -force: got %v", err)
+	}
+	out, err := wasactl("target.db", "restore", "-force", "-media", filepath.Join(dir, "restored"), archive)
+	if err != nil || !strings.Contains(out, "restored the backup") {
+		t.Fatalf("restoring: %v (output: %s)", err, out)
+	}
+	if out, _ := wasactl("target.db", "users", "list"); !strings.Contains(out, "alice") {
+		t.Errorf("users of the restored database: %s", out)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "restored", "photos", "alice.png")); err != nil || string(data) != "png" {
+		t.Errorf("restored media file: got %q, %v", data, err)
+	}
+}
+
+// TestStorageBackend checks that wasactl refuses to run when the server doesn't use the database, and warns when the
+// storage of the server is unknown.
+func TestStorageBackend(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "wasa.db")
+	wasactl := func(args ...string) (string, error) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		err := run(append([]string{"-db", dbFile}, args...), &stdout, &stderr, strings.NewReader(""))
+		return stderr.String(), err
+	}
+
+	t.Setenv("CFG_STORAGE_BACKEND", "memory")
+	if _, err := wasactl("migrate"); err == nil || !strings.Contains(err.Error(), `"memory" storage`) {
+		t.Errorf("migrate with the memory storage: got %v", err)
+	}
+	if _, err := os.Stat(dbFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("migrate with the memory storage created the database: %v", err)
+	}
+	if out, err := wasactl("-storage", "sqlite", "migrate"); err != nil || strings.Contains(out, "warning") {
+		t.Errorf("migrate with -storage sqlite: got %v (stderr: %s)", err, out)
+	}
+
+	t.Setenv("CFG_STORAGE_BACKEND", "")
+	if out, err := wasactl("stats"); err != nil || !strings.Contains(out, "warning: the storage backend") {
+		t.Errorf("stats without a storage backend: got %v (stderr: %q)", err, out)
+	}
+}
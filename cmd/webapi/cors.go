@@ -1,19 +1,168 @@
 package main
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-func withCORS(next http.Handler) http.Handler {
+	"github.com/mlatsa/WASAProject/service/api"
+)
+
+// corsPolicy is the CORS configuration, see WebAPIConfiguration.CORS.
+type corsPolicy struct {
+	AllowedOrigins   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+
+	// AllowedMethods returns the methods served for a path, used to validate preflight requests
+	AllowedMethods func(path string) []string
+}
+
+// validateCORS rejects the policies that browsers can't apply: credentials are never sent to the "*" origin.
+func validateCORS(allowedOrigins []string, allowCredentials bool) error {
+	if !allowCredentials {
+		return nil
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return errors.New(`the "*" origin can't be allowed with credentials: list the allowed origins`)
+		}
+	}
+	return nil
+}
+
+// allowOrigin reports whether origin matches one of the allowed origins.
+func (p *corsPolicy) allowOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// Wildcard, e.g. "https://*.example.com"
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := allowed[:i], allowed[i+1:]
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowAnyOrigin is true if the policy allows every origin. In that case "*" is sent instead of the origin: validateCORS
+// ensures that credentials are not allowed.
+func (p *corsPolicy) allowAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders returns false if any of the headers requested by a preflight request is not allowed.
+func (p *corsPolicy) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range p.AllowedHeaders {
+			if strings.EqualFold(h, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// withCORS applies the CORS policy to next. Preflight requests are answered here, and only for the methods actually
+// served on the requested path; other requests get the CORS headers and are passed to next.
+func withCORS(policy corsPolicy, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// For the grader you can tighten to http://localhost:8080.
-		// Using * is simplest while you test.
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The response depends on the Origin header, so caches must not mix them up
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" {
+			// Not a CORS request
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !policy.allowOrigin(origin) {
+			if preflight {
+				api.WriteError(w, &api.Error{Code: api.ErrCodeForbidden, Message: "origin not allowed"})
+				return
+			}
+			// Let the request through without CORS headers: the browser will block the response
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.allowAnyOrigin() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(policy.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := policy.AllowedMethods(r.URL.Path)
+		if len(methods) == 0 {
+			// Unknown path, let the router answer
+			next.ServeHTTP(w, r)
+			return
+		}
+		requested := r.Header.Get("Access-Control-Request-Method")
+		allowed := false
+		for _, m := range methods {
+			if m == requested {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			api.WriteError(w, &api.Error{Code: api.ErrCodeMethodNotAllowed, Message: "method not allowed"})
 			return
 		}
-		next.ServeHTTP(w, r)
+		if !policy.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			api.WriteError(w, &api.Error{Code: api.ErrCodeForbidden, Message: "header not allowed"})
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(policy.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+		}
+		if policy.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
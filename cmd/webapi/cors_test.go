@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveCORS sends a request with the given headers through policy, to a handler that answers 200.
+func serveCORS(policy corsPolicy, method string, headers map[string]string) *httptest.ResponseRecorder {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r := httptest.NewRequest(method, "/conversations/chat", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	withCORS(policy, next).ServeHTTP(w, r)
+	return w
+}
+
+func testPolicy(origins ...string) corsPolicy {
+	return corsPolicy{
+		AllowedOrigins: origins,
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		ExposedHeaders: []string{"X-Request-ID"},
+		MaxAge:         10 * time.Minute,
+		AllowedMethods: func(path string) []string {
+			if path == "/conversations/chat" {
+				return []string{http.MethodGet, http.MethodPost}
+			}
+			return nil
+		},
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	preflight := func(origin, method, headers string) map[string]string {
+		return map[string]string{
+			"Origin":                         origin,
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		}
+	}
+	policy := testPolicy("https://app.example.com", "https://*.example.org")
+
+	w := serveCORS(policy, http.MethodOptions, preflight("https://app.example.com", http.MethodPost, "content-type, Authorization"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight: status %d, want 204", w.Code)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("preflight %s: got %q, want %q", name, got, want)
+		}
+	}
+	if vary := w.Header().Values("Vary"); strings.Join(vary, ",") != "Origin,Access-Control-Request-Method,Access-Control-Request-Headers" {
+		t.Errorf("preflight Vary: got %q", vary)
+	}
+
+	// Rejected preflights get an Error payload
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		status  int
+	}{
+		"origin":  {preflight("https://evil.example.com", http.MethodGet, ""), http.StatusForbidden},
+		"method":  {preflight("https://app.example.com", http.MethodDelete, ""), http.StatusMethodNotAllowed},
+		"headers": {preflight("https://app.example.com", http.MethodGet, "Content-Type, X-Secret"), http.StatusForbidden},
+	} {
+		w := serveCORS(policy, http.MethodOptions, tc.headers)
+		var body struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != tc.status || body.Code == "" {
+			t.Errorf("preflight with a rejected %s: status %d, body %q, want %d and an Error", name, w.Code, w.Body, tc.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("preflight with a rejected %s: methods %q were allowed", name, got)
+		}
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	policy := testPolicy("https://app.example.com", "https://*.example.org")
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":       true,
+		"HTTPS://APP.EXAMPLE.COM":       true,
+		"https://chat.example.org":      true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://.example.org":          false,
+		"http://chat.example.org":       false,
+		"https://chat.example.org.evil": false,
+		"https://other.example.com":     false,
+	} {
+		w := serveCORS(policy, http.MethodGet, map[string]string{"Origin": origin})
+		if w.Code != http.StatusOK {
+			t.Errorf("request from %s: status %d, want 200", origin, w.Code)
+		}
+		got := w.Header().Get("Access-Control-Allow-Origin")
+		if allowed && got != origin || !allowed && got != "" {
+			t.Errorf("request from %s: Access-Control-Allow-Origin %q, allowed %v", origin, got, allowed)
+		}
+		if allowed && w.Header().Get("Access-Control-Expose-Headers") != "X-Request-ID" {
+			t.Errorf("request from %s: exposed headers %q", origin, w.Header().Get("Access-Control-Expose-Headers"))
+		}
+		// Responses depend on the origin, even when it's rejected
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Origin" {
+			t.Errorf("request from %s: Vary %q, want Origin", origin, vary)
+		}
+	}
+
+	// Without credentials, any origin gets "*"
+	w := serveCORS(testPolicy("*"), http.MethodGet, map[string]string{"Origin": "https://app.example.com"})
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("any origin: Access-Control-Allow-Origin %q, want *", got)
+	}
+	if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Origin" {
+		t.Errorf("any origin: Vary %q, want Origin", vary)
+	}
+}
+
+func TestValidateCORS(t *testing.T) {
+	if err := validateCORS([]string{"*"}, true); err == nil {
+		t.Error("the * origin was allowed with credentials")
+	}
+	if err := validateCORS([]string{"*"}, false); err != nil {
+		t.Errorf("the * origin without credentials: %v", err)
+	}
+	if err := validateCORS([]string{"https://app.example.com", "https://*.example.org"}, true); err != nil {
+		t.Errorf("listed origins with credentials: %v", err)
+	}
+}
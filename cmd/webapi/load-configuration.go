@@ -23,10 +23,89 @@ type WebAPIConfiguration struct {
 		WriteTimeout    time.Duration `conf:"default:5s"`
 		ShutdownTimeout time.Duration `conf:"default:5s"`
 	}
+	CORS struct {
+		// AllowedOrigins lists the origins allowed to call the API. Entries may contain a "*" wildcard, e.g.
+		// "https://*.example.com"; a single "*" allows any origin, and can't be used with AllowCredentials.
+		AllowedOrigins   []string      `conf:"default:*"`
+		AllowedHeaders   []string      `conf:"default:Content-Type;Authorization;X-Request-ID"`
+		ExposedHeaders   []string      `conf:"default:X-Request-ID"`
+		AllowCredentials bool          `conf:"default:false"`
+		MaxAge           time.Duration `conf:"default:10m"`
+	}
+	// RateLimit configures the token buckets of each route group: Requests in a burst, refilled in Per. Set Requests
+	// to 0 to disable a group.
+	RateLimit struct {
+		Login struct {
+			Requests int           `conf:"default:10"`
+			Per      time.Duration `conf:"default:1m"`
+		}
+		Messaging struct {
+			Requests int           `conf:"default:60"`
+			Per      time.Duration `conf:"default:1m"`
+		}
+		Reactions struct {
+			Requests int           `conf:"default:120"`
+			Per      time.Duration `conf:"default:1m"`
+		}
+		Uploads struct {
+			Requests int           `conf:"default:10"`
+			Per      time.Duration `conf:"default:1m"`
+		}
+	}
+	// Session configures how long logins last. 0 disables the corresponding expiration.
+	Session struct {
+		IdleTTL         time.Duration `conf:"default:24h"`
+		AbsoluteTTL     time.Duration `conf:"default:720h"`
+		CleanupInterval time.Duration `conf:"default:1m"`
+	}
+	// Token selects the bearer tokens: "opaque" random tokens, or "signed" HMAC tokens, which need a session
+	// AbsoluteTTL and durable storage. SigningKeys are "id:secret" pairs with secrets of at least 32 bytes; the first
+	// key signs new tokens, the others only verify tokens signed before a key rotation.
+	Token struct {
+		Mode        string   `conf:"default:opaque"`
+		SigningKeys []string `conf:"noprint"`
+	}
+	// Auth selects how users log in: "name-only" (any known name logs in, as in the course specification) or
+	// "password" (the password set on the first login is required afterwards).
+	Auth struct {
+		Mode string `conf:"default:name-only"`
+	}
+	// Admin configures the administration API (e.g., chat import). An empty token, the default, disables it.
+	Admin struct {
+		Token string `conf:"noprint"`
+	}
 	Debug bool
-	DB    struct {
+	// DB is the SQLite database. An empty filename disables it. Build with the sqlite_fts5 tag to enable the
+	// full-text index, otherwise message search falls back to memory.
+	DB struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	// Media is the directory of media files kept with the database, saved in backups (GET /admin/backup). Empty,
+	// the default, means none. With the URL it's served under, users can upload images (POST /media), deleted with
+	// the message they were sent in.
+	Media struct {
+		Dir string
+		URL string
+	}
+	// Retention configures how often the messages expired by the retention policy of their conversation are deleted.
+	// 0 keeps them.
+	Retention struct {
+		ReapInterval time.Duration `conf:"default:1m"`
+	}
+	// Scheduler configures how often the scheduled messages due are sent. 0 disables scheduled messages.
+	Scheduler struct {
+		Interval time.Duration `conf:"default:1s"`
+	}
+	// Storage selects where users, sessions and conversations are kept: "memory", lost on restart, or "sqlite", in
+	// the DB database. With a Dir, the memory storage is saved there as snapshots and a log of changes, flushed to
+	// disk according to Sync: "always" (before replying), "interval" (every SyncInterval) or "never".
+	Storage struct {
+		Backend          string `conf:"default:memory"`
+		Dir              string
+		Sync             string        `conf:"default:always"`
+		SyncInterval     time.Duration `conf:"default:1s"`
+		SnapshotInterval time.Duration `conf:"default:10m"`
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
@@ -66,5 +145,8 @@ func loadConfiguration() (WebAPIConfiguration, error) {
 		_ = fp.Close()
 	}
 
+	if err := validateCORS(cfg.CORS.AllowedOrigins, cfg.CORS.AllowCredentials); err != nil {
+		return cfg, fmt.Errorf("invalid CORS configuration: %w", err)
+	}
 	return cfg, nil
 }
@@ -1,18 +1,243 @@
+/*
+Webapi is the executable for the main web server.
+It builds a web server around APIs from `service/api`.
+Everything is served via the API web server, with the web UI (if embedded) mounted on top of it.
+
+Usage:
+
+	webapi [flags]
+
+Flags and configurations are handled automatically by the code in `load-configuration.go`.
+
+Return values (exit codes):
+
+	0
+		The program ended successfully (no errors, stopped by signal)
+
+	> 0
+		The program ended due to an error
+*/
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/ardanlabs/conf"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/internal/service/wal"
 	"github.com/mlatsa/WASAProject/service/api"
+	"github.com/sirupsen/logrus"
 )
 
+// main is the program entry point. The only purpose of this function is to call run() and set the exit code if there is
+// any error
 func main() {
-	rt := api.NewRouter()
-	addr := ":3000"
-	log.Printf("listening on %s\n", addr)
-	h := withCORS(rt.Handler())
-	if err := http.ListenAndServe(addr, h); err != nil {
-		log.Fatal(err)
+	if err := run(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the program. The body of this function should perform the following steps:
+// * reads the configuration
+// * creates and configure the logger
+// * connects to the database, if any
+// * creates the API router
+// * starts the web server (using the router)
+// * waits for any termination event: SIGTERM signal (UNIX), non-recoverable server error, etc.
+// * closes the principal web server
+func run() error {
+	// Load Configuration and defaults
+	cfg, err := loadConfiguration()
+	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			return nil
+		}
+		return err
+	}
+
+	// Init logging
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	if cfg.Debug {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	logger.Infof("application initializing")
+
+	// Start Database. It backs the message search index, and the state of the server with the sqlite storage
+	var db database.AppDatabase
+	if cfg.DB.Filename == "" && api.StorageBackend(cfg.Storage.Backend) == api.StorageSQLite {
+		return errors.New("the sqlite storage needs a database filename")
+	}
+	if cfg.DB.Filename != "" {
+		logger.Println("initializing database support")
+		dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+		if err != nil {
+			logger.WithError(err).Error("error opening SQLite DB")
+			return fmt.Errorf("opening SQLite: %w", err)
+		}
+		// SQLite allows one writer at a time: a single connection queues writes instead of failing them as busy
+		dbconn.SetMaxOpenConns(1)
+		defer func() {
+			logger.Debug("database stopping")
+			_ = dbconn.Close()
+		}()
+		db, err = database.New(dbconn)
+		if err != nil {
+			logger.WithError(err).Error("error creating AppDatabase")
+			return fmt.Errorf("creating AppDatabase: %w", err)
+		}
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			logger.Infof("applied database migration %s", m)
+		}
+		if err != nil {
+			logger.WithError(err).Error("error migrating the database")
+			return fmt.Errorf("migrating the database: %w", err)
+		}
+	}
+
+	// Make a channel to listen for an interrupt or terminate signal from the OS.
+	// Use a buffered channel because the signal package requires it.
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// Start (main) API server
+	logger.Info("initializing API server")
+
+	// Make a channel to listen for errors coming from the listener. Use a
+	// buffered channel so the goroutine can exit if we don't collect this error.
+	serverErrors := make(chan error, 1)
+
+	// Create the API router
+	tokens := api.TokenConfig{Mode: api.TokenMode(cfg.Token.Mode)}
+	for _, k := range cfg.Token.SigningKeys {
+		key, err := api.ParseSigningKey(k)
+		if err != nil {
+			return fmt.Errorf("parsing the token signing keys: %w", err)
+		}
+		tokens.Keys = append(tokens.Keys, key)
+	}
+	apirouter, err := api.New(api.Config{
+		Logger: logger,
+		RateLimits: api.RateLimits{
+			Login:     api.RateLimit{Requests: cfg.RateLimit.Login.Requests, Per: cfg.RateLimit.Login.Per},
+			Messaging: api.RateLimit{Requests: cfg.RateLimit.Messaging.Requests, Per: cfg.RateLimit.Messaging.Per},
+			Reactions: api.RateLimit{Requests: cfg.RateLimit.Reactions.Requests, Per: cfg.RateLimit.Reactions.Per},
+			Uploads:   api.RateLimit{Requests: cfg.RateLimit.Uploads.Requests, Per: cfg.RateLimit.Uploads.Per},
+		},
+		Sessions: api.SessionConfig{
+			IdleTTL:         cfg.Session.IdleTTL,
+			AbsoluteTTL:     cfg.Session.AbsoluteTTL,
+			CleanupInterval: cfg.Session.CleanupInterval,
+		},
+		Tokens:     tokens,
+		Auth:       api.AuthConfig{Mode: api.AuthMode(cfg.Auth.Mode)},
+		AdminToken: cfg.Admin.Token,
+		Database:   db,
+		MediaDir:   cfg.Media.Dir,
+		MediaURL:   cfg.Media.URL,
+		Retention:  api.RetentionConfig{ReapInterval: cfg.Retention.ReapInterval},
+		Scheduler:  api.SchedulerConfig{Interval: cfg.Scheduler.Interval},
+		Storage:    api.StorageBackend(cfg.Storage.Backend),
+		Persistence: api.PersistenceConfig{
+			Dir:              cfg.Storage.Dir,
+			Sync:             wal.SyncPolicy(cfg.Storage.Sync),
+			SyncInterval:     cfg.Storage.SyncInterval,
+			SnapshotInterval: cfg.Storage.SnapshotInterval,
+		},
+		// Event streams must end before the write timeout cuts them; clients then resume with Last-Event-ID
+		EventStreamTTL: cfg.Web.WriteTimeout * 9 / 10,
+	})
+	if err != nil {
+		logger.WithError(err).Error("error creating the API server instance")
+		return fmt.Errorf("creating the API server instance: %w", err)
+	}
+	defer func() {
+		logger.Debug("API router stopping")
+		if err := apirouter.Close(); err != nil {
+			logger.WithError(err).Error("error closing the API router")
+		}
+	}()
+	router := apirouter.Handler()
+
+	router, err = registerWebUI(router)
+	if err != nil {
+		logger.WithError(err).Error("error registering web UI handler")
+		return fmt.Errorf("registering web UI handler: %w", err)
+	}
+
+	router, err = registerAPIDocs(router)
+	if err != nil {
+		logger.WithError(err).Error("error registering API docs handler")
+		return fmt.Errorf("registering API docs handler: %w", err)
+	}
+
+	// Apply CORS policy
+	router = withCORS(corsPolicy{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		ExposedHeaders:   cfg.CORS.ExposedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAge,
+		AllowedMethods:   apirouter.AllowedMethods,
+	}, router)
+
+	// Create the API server
+	apiserver := http.Server{
+		Addr:              cfg.Web.APIHost,
+		Handler:           router,
+		ReadTimeout:       cfg.Web.ReadTimeout,
+		ReadHeaderTimeout: cfg.Web.ReadTimeout,
+		WriteTimeout:      cfg.Web.WriteTimeout,
+		// Backups and exports lift the write timeout of their connection
+		ConnContext: api.ConnContext,
 	}
+
+	// Start the service listening for requests in a separate goroutine
+	go func() {
+		logger.Infof("API listening on %s", apiserver.Addr)
+		serverErrors <- apiserver.ListenAndServe()
+		logger.Infof("stopping API server")
+	}()
+
+	// Waiting for shutdown signal or POSIX signals
+	select {
+	case err := <-serverErrors:
+		// Non-recoverable server error
+		return fmt.Errorf("server error: %w", err)
+
+	case sig := <-shutdown:
+		logger.Infof("signal %v received, start shutdown", sig)
+
+		// Give outstanding requests a deadline for completion.
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
+		defer cancel()
+
+		// Asking listener to shut down and shed load.
+		err := apiserver.Shutdown(ctx)
+		if err != nil {
+			logger.WithError(err).Warning("error during graceful shutdown of HTTP server")
+			err = apiserver.Close()
+		}
+
+		// Log the status of this shutdown.
+		if err != nil {
+			return fmt.Errorf("could not stop server gracefully: %w", err)
+		}
+	}
+
+	return nil
 }
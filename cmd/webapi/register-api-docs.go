@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/mlatsa/WASAProject/doc"
+)
+
+// apiDocsPrefix is where the API explorer is served, next to the web UI.
+const apiDocsPrefix = "/dashboard/api-docs/"
+
+// registerAPIDocs serves the OpenAPI document at /openapi.yaml and /openapi.json, and the API explorer under
+// apiDocsPrefix. Everything else is handled by hdl.
+func registerAPIDocs(hdl http.Handler) (http.Handler, error) {
+	specJSON, err := doc.OpenAPIJSON()
+	if err != nil {
+		return nil, fmt.Errorf("converting OpenAPI document: %w", err)
+	}
+	explorer, err := fs.Sub(doc.Explorer, "explorer")
+	if err != nil {
+		return nil, fmt.Errorf("error embedding API explorer: %w", err)
+	}
+	explorerHandler := http.StripPrefix(apiDocsPrefix, http.FileServer(http.FS(explorer)))
+
+	serve := func(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(body)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/openapi.yaml":
+			serve(w, r, "application/yaml", doc.OpenAPI)
+		case r.URL.Path == "/openapi.json":
+			serve(w, r, "application/json", specJSON)
+		case r.URL.Path == strings.TrimSuffix(apiDocsPrefix, "/"):
+			http.Redirect(w, r, apiDocsPrefix, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, apiDocsPrefix):
+			explorerHandler.ServeHTTP(w, r)
+		default:
+			hdl.ServeHTTP(w, r)
+		}
+	}), nil
+}
@@ -0,0 +1,176 @@
+// API explorer: renders the operations documented in /openapi.json and lets the user call them against this server.
+// It's intentionally dependency-free so that it works offline.
+(function () {
+	"use strict";
+
+	const METHODS = ["get", "post", "put", "delete", "patch"];
+	const tokenInput = document.getElementById("token");
+
+	tokenInput.value = sessionStorage.getItem("api-explorer-token") || "";
+	tokenInput.addEventListener("change", () => sessionStorage.setItem("api-explorer-token", tokenInput.value));
+
+	// resolve follows local "$ref" pointers like "#/components/schemas/Message".
+	function resolve(spec, node) {
+		while (node && node.$ref) {
+			node = node.$ref.replace(/^#\//, "").split("/").reduce((cur, part) => cur && cur[part], spec);
+		}
+		return node;
+	}
+
+	// example builds a sample value for a schema, preferring the examples written in the document.
+	function example(spec, schema, depth) {
+		schema = resolve(spec, schema);
+		if (!schema || depth > 5) {
+			return null;
+		}
+		if (schema.example !== undefined) {
+			return schema.example;
+		}
+		if (schema.allOf) {
+			return Object.assign({}, ...schema.allOf.map((s) => example(spec, s, depth + 1)));
+		}
+		switch (schema.type) {
+			case "object": {
+				const out = {};
+				for (const [name, prop] of Object.entries(schema.properties || {})) {
+					out[name] = example(spec, prop, depth + 1);
+				}
+				return out;
+			}
+			case "array":
+				return [example(spec, schema.items, depth + 1)];
+			case "integer":
+			case "number":
+				return 0;
+			case "boolean":
+				return false;
+			default:
+				return schema.enum ? schema.enum[0] : "";
+		}
+	}
+
+	function render(spec) {
+		document.title = spec.info.title + " – API explorer";
+		document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+		document.getElementById("description").textContent = spec.info.description || "";
+
+		const container = document.getElementById("operations");
+		container.textContent = "";
+		const template = document.getElementById("operation-template");
+
+		for (const [path, item] of Object.entries(spec.paths)) {
+			for (const method of METHODS) {
+				const op = item[method];
+				if (!op) {
+					continue;
+				}
+				const node = template.content.cloneNode(true);
+				const el = node.querySelector(".operation");
+				el.querySelector(".method").textContent = method.toUpperCase();
+				el.querySelector(".method").classList.add(method);
+				el.querySelector(".path").textContent = path;
+				el.querySelector(".summary").textContent = op.summary || op.operationId || "";
+				el.querySelector(".description").textContent = op.description || "";
+
+				const params = (op.parameters || []).map((p) => resolve(spec, p));
+				const paramsDiv = el.querySelector(".params");
+				for (const p of params) {
+					const label = document.createElement("label");
+					label.textContent = p.name + " (" + p.in + (p.required ? ", required" : "") + ")";
+					const input = document.createElement("input");
+					input.name = p.name;
+					input.dataset.in = p.in;
+					input.placeholder = (p.schema && p.schema.example) || "";
+					label.appendChild(document.createElement("br"));
+					label.appendChild(input);
+					paramsDiv.appendChild(label);
+				}
+
+				const bodyDiv = el.querySelector(".request-body");
+				const textarea = bodyDiv.querySelector("textarea");
+				const media = op.requestBody && resolve(spec, op.requestBody).content["application/json"];
+				if (media) {
+					textarea.value = JSON.stringify(example(spec, media.schema, 0), null, 2);
+				} else {
+					bodyDiv.hidden = true;
+				}
+
+				const list = el.querySelector(".documented ul");
+				for (const [code, resp] of Object.entries(op.responses || {})) {
+					const li = document.createElement("li");
+					li.textContent = code + " – " + (resolve(spec, resp).description || "");
+					list.appendChild(li);
+				}
+
+				const form = el.querySelector("form");
+				form.addEventListener("submit", (ev) => {
+					ev.preventDefault();
+					send(el, method, path, params, media ? textarea.value : null, op.operationId);
+				});
+				container.appendChild(node);
+			}
+		}
+	}
+
+	async function send(el, method, path, params, body, operationId) {
+		const query = new URLSearchParams();
+		for (const p of params) {
+			const value = el.querySelector('input[name="' + p.name + '"]').value;
+			if (p.in === "path") {
+				path = path.replace("{" + p.name + "}", encodeURIComponent(value));
+			} else if (p.in === "query" && value !== "") {
+				query.append(p.name, value);
+			}
+		}
+		const url = path + (query.toString() ? "?" + query : "");
+
+		const headers = {};
+		if (tokenInput.value) {
+			headers.Authorization = "Bearer " + tokenInput.value;
+		}
+		if (body !== null) {
+			headers["Content-Type"] = "application/json";
+		}
+
+		const responseDiv = el.querySelector(".response");
+		const status = responseDiv.querySelector(".status");
+		responseDiv.hidden = false;
+		try {
+			const resp = await fetch(url, { method: method.toUpperCase(), headers: headers, body: body });
+			const text = await resp.text();
+			status.textContent = resp.status + " " + resp.statusText;
+			status.className = "status " + (resp.ok ? "ok" : "error");
+			responseDiv.querySelector(".headers").textContent = Array.from(resp.headers.entries())
+				.map(([k, v]) => k + ": " + v).join("\n");
+			let pretty = text;
+			try {
+				const json = JSON.parse(text);
+				pretty = JSON.stringify(json, null, 2);
+				if (operationId === "doLogin" && resp.ok && json.identifier) {
+					tokenInput.value = json.identifier;
+					tokenInput.dispatchEvent(new Event("change"));
+				}
+			} catch (e) {
+				// not JSON, show as-is
+			}
+			responseDiv.querySelector(".payload").textContent = pretty;
+		} catch (e) {
+			status.textContent = "request failed";
+			status.className = "status error";
+			responseDiv.querySelector(".headers").textContent = "";
+			responseDiv.querySelector(".payload").textContent = String(e);
+		}
+	}
+
+	fetch("/openapi.json")
+		.then((resp) => {
+			if (!resp.ok) {
+				throw new Error("GET /openapi.json: " + resp.status);
+			}
+			return resp.json();
+		})
+		.then(render)
+		.catch((e) => {
+			document.getElementById("operations").textContent = "Can't load the API description: " + e.message;
+		});
+})();
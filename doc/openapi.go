@@ -0,0 +1,49 @@
+// Package doc contains the OpenAPI document of the API and the API explorer, for embedding
+package doc
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// OpenAPI is doc/api.yaml, as written.
+//
+//go:embed api.yaml
+var OpenAPI []byte
+
+// Explorer contains the API explorer web page, in the explorer/ directory.
+//
+//go:embed explorer
+var Explorer embed.FS
+
+// OpenAPIJSON returns the OpenAPI document converted to JSON.
+func OpenAPIJSON() ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(OpenAPI, &doc); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI document: %w", err)
+	}
+	return json.Marshal(jsonCompatible(doc))
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced by yaml.v2, which encoding/json refuses to
+// marshal, into map[string]interface{}.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = jsonCompatible(v[i])
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,419 @@
+/*
+Package backup saves and restores the data of a WASAText instance: its SQLite database and, optionally, a directory
+of media files.
+
+A backup is a tar stream of:
+
+	manifest.json   the Manifest, first
+	wasa.db         a consistent copy of the database, taken with database.AppDatabase.Backup
+	media/...       the files of the media directory, if any
+
+Backups are taken while the server runs: the database is copied in a single read transaction, and media files are
+read as they are while the backup is streamed. Restores replace the files of a stopped server, once the backup has
+been read and its database checked. They are extracted next to the files they replace, so that each is put in place
+with a rename.
+*/
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// Identifies the backup format. Backups of other versions are rejected.
+const (
+	FormatName    = "wasatext-backup"
+	FormatVersion = 1
+)
+
+// Names of the entries of the archive.
+const (
+	manifestName = "manifest.json"
+	databaseName = "wasa.db"
+	mediaPrefix  = "media/"
+)
+
+// ContentType is the media type of backups.
+const ContentType = "application/x-tar"
+
+// Manifest describes a backup.
+type Manifest struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+
+	// Media reports whether the backup has a media directory
+	Media bool `json:"media"`
+}
+
+// Backup is a backup being taken. It must be closed.
+type Backup struct {
+	Manifest Manifest
+
+	dir      string // temporary directory of the copy of the database
+	mediaDir string
+}
+
+// Create copies db, and returns the backup of the copy and of mediaDir, if it's not empty. The copy is deleted by
+// Close.
+func Create(db database.AppDatabase, mediaDir string, now time.Time) (*Backup, error) {
+	if mediaDir != "" {
+		if info, err := os.Stat(mediaDir); err != nil {
+			return nil, fmt.Errorf("reading the media directory: %w", err)
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("the media directory %s is not a directory", mediaDir)
+		}
+	}
+	dir, err := os.MkdirTemp("", "wasa-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	b := &Backup{dir: dir, mediaDir: mediaDir}
+	if err := db.Backup(filepath.Join(dir, databaseName)); err != nil {
+		_ = b.Close()
+		return nil, fmt.Errorf("copying the database: %w", err)
+	}
+	version, err := schemaVersion(filepath.Join(dir, databaseName))
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	b.Manifest = Manifest{
+		Format:        FormatName,
+		Version:       FormatVersion,
+		SchemaVersion: version,
+		CreatedAt:     now.UTC(),
+		Media:         mediaDir != "",
+	}
+	return b, nil
+}
+
+// WriteTo writes the backup to w as a tar stream.
+func (b *Backup) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	tw := tar.NewWriter(cw)
+	manifest, err := json.Marshal(b.Manifest)
+	if err != nil {
+		return cw.n, err
+	}
+	hdr := &tar.Header{Name: manifestName, Mode: 0o600, Size: int64(len(manifest)), ModTime: b.Manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return cw.n, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return cw.n, err
+	}
+	if err := addFile(tw, filepath.Join(b.dir, databaseName), databaseName); err != nil {
+		return cw.n, err
+	}
+	if b.mediaDir != "" {
+		err := filepath.WalkDir(b.mediaDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(b.mediaDir, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			name := mediaPrefix + filepath.ToSlash(rel)
+			switch {
+			case d.IsDir():
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()})
+			case d.Type().IsRegular():
+				return addFile(tw, p, name)
+			default:
+				// Symbolic links and special files may point outside the directory: they are not media
+				return nil
+			}
+		})
+		if err != nil {
+			return cw.n, fmt.Errorf("archiving the media directory: %w", err)
+		}
+	}
+	err = tw.Close()
+	return cw.n, err
+}
+
+// Close deletes the copy of the database.
+func (b *Backup) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+// addFile adds the regular file at p to the archive.
+func addFile(tw *tar.Writer, p, name string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// A file that grew since Stat is cut: the header has its size
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// schemaVersion returns the schema version of the database at p.
+func schemaVersion(p string) (int, error) {
+	conn, err := sql.Open("sqlite3", p)
+	if err != nil {
+		return 0, fmt.Errorf("opening the database: %w", err)
+	}
+	defer conn.Close()
+	db, err := database.New(conn)
+	if err != nil {
+		return 0, fmt.Errorf("opening the database: %w", err)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	}
+	return version, nil
+}
+
+/* restore */
+
+// Restore reads a backup from r, and puts it in place of the database at dbPath and of mediaDir. The server must be
+// stopped: Restore fails if another connection is using the database. Nothing is replaced unless the whole backup is
+// read, and its database has a schema this version of the application can use: older schemas are upgraded by the
+// migrations, newer ones are rejected with database.ErrSchemaTooNew.
+//
+// The media directory is replaced only if the backup has one. If mediaDir is empty, the media files of the backup
+// are skipped.
+func Restore(r io.Reader, dbPath, mediaDir string) (Manifest, error) {
+	// The backup is extracted next to the database and to the media directory, so that they can be renamed in place
+	tmp, err := os.MkdirTemp(filepath.Dir(dbPath), ".wasa-restore-")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	var media string
+	if mediaDir != "" {
+		if media, err = os.MkdirTemp(filepath.Dir(mediaDir), ".wasa-restore-media-"); err != nil {
+			return Manifest{}, fmt.Errorf("creating a temporary directory: %w", err)
+		}
+		defer os.RemoveAll(media)
+	}
+
+	m, err := extract(r, tmp, media)
+	if err != nil {
+		return m, err
+	}
+	version, err := schemaVersion(filepath.Join(tmp, databaseName))
+	switch {
+	case err != nil:
+		return m, fmt.Errorf("invalid backup database: %w", err)
+	case version != m.SchemaVersion:
+		return m, fmt.Errorf("invalid backup: the manifest has schema version %d, the database %d", m.SchemaVersion, version)
+	case version <= 0:
+		return m, errors.New("invalid backup: the database was never migrated")
+	case version > database.LatestSchemaVersion():
+		return m, fmt.Errorf("%w: the backup has schema version %d, this version supports up to %d", database.ErrSchemaTooNew, version, database.LatestSchemaVersion())
+	}
+	if err := checkUnused(dbPath); err != nil {
+		return m, err
+	}
+
+	// The journal files belong to the database being replaced
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return m, err
+		}
+	}
+
+	// The media directory is replaced first, so that it can be put back if the database can't be. The old directory
+	// is moved aside, and deleted once the new database is in place.
+	old := mediaDir + ".old"
+	replaceMedia := mediaDir != "" && m.Media
+	if replaceMedia {
+		if err := os.RemoveAll(old); err != nil {
+			return m, err
+		}
+		if err := os.Rename(mediaDir, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return m, fmt.Errorf("replacing the media directory: %w", err)
+		}
+		if err := os.Rename(media, mediaDir); err != nil {
+			_ = os.Rename(old, mediaDir)
+			return m, fmt.Errorf("replacing the media directory: %w", err)
+		}
+	}
+	if err := os.Rename(filepath.Join(tmp, databaseName), dbPath); err != nil {
+		if replaceMedia {
+			_ = os.Rename(mediaDir, media)
+			_ = os.Rename(old, mediaDir)
+		}
+		return m, fmt.Errorf("replacing the database: %w", err)
+	}
+	if err := syncDir(filepath.Dir(dbPath)); err != nil {
+		return m, err
+	}
+	if !replaceMedia {
+		return m, nil
+	}
+	return m, os.RemoveAll(old)
+}
+
+// checkUnused fails if another connection is using the database at dbPath, by taking an exclusive lock of it. A
+// database that can't be read is not in use.
+func checkUnused(dbPath string) error {
+	if _, err := os.Stat(dbPath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	conn, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("opening the database: %w", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	c, err := conn.Conn(ctx)
+	if err == nil {
+		defer c.Close()
+		if _, err = c.ExecContext(ctx, `PRAGMA busy_timeout = 0`); err == nil {
+			if _, err = c.ExecContext(ctx, `BEGIN EXCLUSIVE`); err == nil {
+				_, _ = c.ExecContext(ctx, `ROLLBACK`)
+			}
+		}
+	}
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("the database %s is in use: stop the server first", dbPath)
+	}
+	return nil
+}
+
+// extract reads the backup from r: the database into dir as databaseName, and the media files into mediaDir, unless
+// it's empty.
+func extract(r io.Reader, dir, mediaDir string) (Manifest, error) {
+	var m Manifest
+	var hasManifest, hasDatabase bool
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return m, fmt.Errorf("reading the backup: %w", err)
+		}
+		if !hasManifest && hdr.Name != manifestName {
+			return m, fmt.Errorf("invalid backup: %s must come first", manifestName)
+		}
+		switch {
+		case hdr.Name == manifestName:
+			if hasManifest {
+				return m, fmt.Errorf("invalid backup: duplicate %s", manifestName)
+			}
+			if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&m); err != nil {
+				return m, fmt.Errorf("invalid backup manifest: %w", err)
+			}
+			if m.Format != FormatName || m.Version != FormatVersion {
+				return m, fmt.Errorf("invalid backup: format %s version %d, want %s version %d", m.Format, m.Version, FormatName, FormatVersion)
+			}
+			hasManifest = true
+		case hdr.Name == databaseName:
+			if hasDatabase {
+				return m, fmt.Errorf("invalid backup: duplicate %s", databaseName)
+			}
+			if err := writeFile(filepath.Join(dir, databaseName), tr, 0o600); err != nil {
+				return m, err
+			}
+			hasDatabase = true
+		case strings.HasPrefix(hdr.Name, mediaPrefix):
+			if mediaDir == "" {
+				continue
+			}
+			rel := path.Clean(strings.TrimPrefix(hdr.Name, mediaPrefix))
+			if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+				return m, fmt.Errorf("invalid backup: media file %q is outside of the media directory", hdr.Name)
+			}
+			p := filepath.Join(mediaDir, filepath.FromSlash(rel))
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				if err := os.MkdirAll(p, 0o700); err != nil {
+					return m, err
+				}
+			case tar.TypeReg:
+				if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+					return m, err
+				}
+				if err := writeFile(p, tr, fs.FileMode(hdr.Mode).Perm()|0o600); err != nil {
+					return m, err
+				}
+			default:
+				return m, fmt.Errorf("invalid backup: media file %q is not a regular file", hdr.Name)
+			}
+		default:
+			return m, fmt.Errorf("invalid backup: unexpected file %q", hdr.Name)
+		}
+	}
+	switch {
+	case !hasManifest:
+		return m, fmt.Errorf("invalid backup: no %s", manifestName)
+	case !hasDatabase:
+		return m, fmt.Errorf("invalid backup: no %s", databaseName)
+	}
+	return m, nil
+}
+
+// writeFile writes r to a new file at p, and flushes it to disk.
+func writeFile(p string, r io.Reader, perm fs.FileMode) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("extracting %s: %w", filepath.Base(p), err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
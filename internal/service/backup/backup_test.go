@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// openDatabase opens the database at p, migrated to the latest schema.
+func openDatabase(t *testing.T, p string) (database.AppDatabase, *sql.DB) {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db, conn
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// archive returns a backup made of the given entries, in order.
+func archive(t *testing.T, entries ...[2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0o600, Size: int64(len(e[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	src := t.TempDir()
+	db, _ := openDatabase(t, filepath.Join(src, "wasa.db"))
+	if err := db.CreateUser(database.User{Name: "alice", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, filepath.Join(src, "media"), map[string]string{"photo.png": "png", "groups/chat.jpg": "jpg"})
+
+	b, err := Create(db, filepath.Join(src, "media"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = b.WriteTo(&buf)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Manifest.SchemaVersion != database.LatestSchemaVersion() || !b.Manifest.Media {
+		t.Errorf("manifest: got %+v", b.Manifest)
+	}
+	if _, err := os.Stat(b.dir); !os.IsNotExist(err) {
+		t.Errorf("the copy of the database is still there: %v", err)
+	}
+
+	// The restore replaces the database and the media directory of another instance
+	dst := t.TempDir()
+	dbPath := filepath.Join(dst, "wasa.db")
+	writeFiles(t, dst, map[string]string{"wasa.db": "old database", "wasa.db-journal": "old journal", "media/old.png": "old"})
+	m, err := Restore(bytes.NewReader(buf.Bytes()), dbPath, filepath.Join(dst, "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != b.Manifest {
+		t.Errorf("restored manifest: got %+v, want %+v", m, b.Manifest)
+	}
+	restored, _ := openDatabase(t, dbPath)
+	if _, err := restored.GetUser("alice"); err != nil {
+		t.Errorf("reading the restored database: %v", err)
+	}
+	for name, want := range map[string]string{"media/photo.png": "png", "media/groups/chat.jpg": "jpg", "media/old.png": "", "wasa.db-journal": ""} {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if want == "" && !os.IsNotExist(err) || want != "" && string(got) != want {
+			t.Errorf("%s after the restore: got %q, %v", name, got, err)
+		}
+	}
+	entries, _ := os.ReadDir(dst)
+	if len(entries) != 2 {
+		t.Errorf("files left after the restore: %v", entries)
+	}
+}
+
+func TestRestoreRejectsInvalidBackups(t *testing.T) {
+	src := t.TempDir()
+	db, conn := openDatabase(t, filepath.Join(src, "wasa.db"))
+	valid := func() []byte {
+		b, err := Create(db, "", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		var buf bytes.Buffer
+		if _, err := b.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	manifest := fmt.Sprintf(`{"format":"wasatext-backup","version":1,"schemaVersion":%d}`, database.LatestSchemaVersion())
+	otherManifest := fmt.Sprintf(`{"format":"wasatext-backup","version":1,"schemaVersion":%d}`, database.LatestSchemaVersion()-1)
+	dbData, err := os.ReadFile(filepath.Join(src, "wasa.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Exec(`INSERT INTO schema_version (version, description) VALUES (999, 'from the future')`); err != nil {
+		t.Fatal(err)
+	}
+	tooNew := valid()
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"not a tar":          {[]byte("hello"), "reading the backup"},
+		"no manifest":        {archive(t, [2]string{"wasa.db", string(dbData)}), "must come first"},
+		"other format":       {archive(t, [2]string{"manifest.json", `{"format":"other","version":1}`}), "format other"},
+		"no database":        {archive(t, [2]string{"manifest.json", manifest}), "no wasa.db"},
+		"not a database":     {archive(t, [2]string{"manifest.json", manifest}, [2]string{"wasa.db", "hello"}), "invalid backup database"},
+		"media outside":      {archive(t, [2]string{"manifest.json", manifest}, [2]string{"media/../../evil", "x"}), "outside of the media directory"},
+		"unexpected file":    {archive(t, [2]string{"manifest.json", manifest}, [2]string{"other", "x"}), "unexpected file"},
+		"schema too new":     {tooNew, "newer than this application"},
+		"schema of manifest": {archive(t, [2]string{"manifest.json", otherManifest}, [2]string{"wasa.db", string(dbData)}), "manifest has schema version"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dst := t.TempDir()
+			dbPath := filepath.Join(dst, "wasa.db")
+			writeFiles(t, dst, map[string]string{"wasa.db": "old database"})
+			_, err := Restore(bytes.NewReader(tc.data), dbPath, filepath.Join(dst, "media"))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+			if name == "schema too new" && !errors.Is(err, database.ErrSchemaTooNew) {
+				t.Errorf("got %v, want ErrSchemaTooNew", err)
+			}
+			// Nothing was replaced, nor left behind
+			if got, _ := os.ReadFile(dbPath); string(got) != "old database" {
+				t.Errorf("the database was replaced")
+			}
+			if entries, _ := os.ReadDir(dst); len(entries) != 1 {
+				t.Errorf("files left after a failed restore: %v", entries)
+			}
+		})
+	}
+}
+
+func TestRestoreRefusesDatabaseInUse(t *testing.T) {
+	src := t.TempDir()
+	db, _ := openDatabase(t, filepath.Join(src, "wasa.db"))
+	b, err := Create(db, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server in the middle of a transaction holds a lock of the database
+	dst, media := t.TempDir(), t.TempDir()
+	dbPath := filepath.Join(dst, "wasa.db")
+	old, conn := openDatabase(t, dbPath)
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`INSERT INTO users (name, created_at) VALUES ('bob', 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Restore(bytes.NewReader(buf.Bytes()), dbPath, filepath.Join(media, "media"))
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("got %v, want an error about the database in use", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.GetUser("bob"); err != nil {
+		t.Errorf("the database was replaced: %v", err)
+	}
+	for _, dir := range []string{dst, media} {
+		if entries, _ := os.ReadDir(dir); len(entries) > 1 {
+			t.Errorf("files left in %s after a failed restore: %v", dir, entries)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package database
+
+// Backup writes a consistent copy of the database to a new file at path. It can run while the database is in use:
+// the copy is a snapshot of a single read transaction.
+func (db *appdbimpl) Backup(path string) error {
+	_, err := db.c.Exec(`VACUUM INTO ?`, path)
+	return err
+}
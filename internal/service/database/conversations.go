@@ -0,0 +1,511 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Conversation is a conversation, without its messages.
+type Conversation struct {
+	ID           string
+	Name         string
+	Photo        string
+	LastMessage  string
+	Timestamp    time.Time
+	Participants []string
+
+	// Messages is the number of messages in the conversation
+	Messages int
+
+	Retention Retention
+}
+
+// Retention is the retention policy of a conversation: how long its messages are kept. The zero value keeps them
+// forever. Mode is interpreted by the application, which uses Days or Hours depending on it.
+type Retention struct {
+	Mode  string
+	Days  int
+	Hours int
+}
+
+// Reaction is a reaction to a message.
+type Reaction struct {
+	ID    string
+	Emoji string
+}
+
+// Message is a message of a conversation. ForwardedFrom is the ID of the original message, for forwards.
+type Message struct {
+	ID             string
+	ConversationID string
+	Sender         string
+	Content        string
+	Type           string
+	Status         string
+	Timestamp      time.Time
+	ForwardedFrom  string
+	Reactions      []Reaction
+}
+
+// MessageFilter selects messages. Zero fields match every message.
+type MessageFilter struct {
+	ConversationID string
+
+	// Before selects the messages sent before this time
+	Before time.Time
+}
+
+// where returns the SQL condition of the filter on the messages table, with its arguments.
+func (f MessageFilter) where() (string, []interface{}) {
+	where, args := `1 = 1`, []interface{}{}
+	if f.ConversationID != "" {
+		where += ` AND conversation_id = ?`
+		args = append(args, f.ConversationID)
+	}
+	if !f.Before.IsZero() {
+		where += ` AND ts < ?`
+		args = append(args, f.Before.UnixNano())
+	}
+	return where, args
+}
+
+const conversationColumns = `id, name, photo, last_message, ts, retention_mode, retention_days, retention_hours,
+	(SELECT COUNT(*) FROM messages WHERE messages.conversation_id = conversations.id)`
+
+func scanConversation(row interface{ Scan(...interface{}) error }) (Conversation, error) {
+	var c Conversation
+	var ts int64
+	err := row.Scan(&c.ID, &c.Name, &c.Photo, &c.LastMessage, &ts,
+		&c.Retention.Mode, &c.Retention.Days, &c.Retention.Hours, &c.Messages)
+	c.Timestamp = time.Unix(0, ts).UTC()
+	return c, err
+}
+
+// participants returns the participants of a conversation, in the order they joined.
+func (db *appdbimpl) participants(conversationID string) ([]string, error) {
+	rows, err := db.c.Query(`SELECT username FROM participants WHERE conversation_id = ? ORDER BY position`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// ListConversations returns every conversation, most recently active first.
+func (db *appdbimpl) ListConversations() ([]Conversation, error) {
+	rows, err := db.c.Query(`SELECT ` + conversationColumns + ` FROM conversations ORDER BY ts DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		convs = append(convs, c)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	for i := range convs {
+		if convs[i].Participants, err = db.participants(convs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return convs, nil
+}
+
+// GetConversation returns a conversation, or ErrNotFound.
+func (db *appdbimpl) GetConversation(id string) (Conversation, error) {
+	c, err := scanConversation(db.c.QueryRow(`SELECT `+conversationColumns+` FROM conversations WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrNotFound
+	} else if err != nil {
+		return c, err
+	}
+	c.Participants, err = db.participants(id)
+	return c, err
+}
+
+// ListMessages returns the last limit messages of a conversation, oldest first, with their reactions.
+func (db *appdbimpl) ListMessages(conversationID string, limit int) ([]Message, error) {
+	return db.queryMessages(`SELECT * FROM (
+			SELECT `+messageColumns+` FROM messages WHERE conversation_id = ? ORDER BY ts DESC, id DESC LIMIT ?
+		) ORDER BY ts, id`, conversationID, limit)
+}
+
+const messageColumns = `id, conversation_id, sender, content, type, status, ts, forwarded_from`
+
+// queryMessages runs a query selecting messageColumns, and returns the messages with their reactions.
+func (db *appdbimpl) queryMessages(query string, args ...interface{}) ([]Message, error) {
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		var ts int64
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &m.Type, &m.Status, &ts, &m.ForwardedFrom); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		m.Timestamp = time.Unix(0, ts).UTC()
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	for i := range msgs {
+		if msgs[i].Reactions, err = db.reactions(msgs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (db *appdbimpl) reactions(messageID string) ([]Reaction, error) {
+	rows, err := db.c.Query(`SELECT id, emoji FROM reactions WHERE message_id = ? ORDER BY position`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var reactions []Reaction
+	for rows.Next() {
+		var r Reaction
+		if err := rows.Scan(&r.ID, &r.Emoji); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
+
+// CountMessages returns how many messages match the filter.
+func (db *appdbimpl) CountMessages(f MessageFilter) (int, error) {
+	where, args := f.where()
+	var n int
+	err := db.c.QueryRow(`SELECT COUNT(*) FROM messages WHERE `+where, args...).Scan(&n)
+	return n, err
+}
+
+// PurgeMessages deletes the messages matching the filter, with their reactions and their entries in the full-text
+// index, and returns how many were deleted.
+func (db *appdbimpl) PurgeMessages(f MessageFilter) (int, error) {
+	where, args := f.where()
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	selected := `SELECT id FROM messages WHERE ` + where
+	for _, table := range []string{"reactions", "pinned_messages", "starred_messages"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE message_id IN (`+selected+`)`, args...); err != nil {
+			return 0, err
+		}
+	}
+	if db.fts {
+		if _, err := tx.Exec(`DELETE FROM message_index WHERE message_id IN (`+selected+`)`, args...); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM messages WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	// The preview of the conversations shows the last message left, if any
+	_, err = tx.Exec(`UPDATE conversations SET last_message = COALESCE((SELECT content FROM messages
+		WHERE messages.conversation_id = conversations.id ORDER BY ts DESC, id DESC LIMIT 1), '')`)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// EnsureConversation creates a conversation with username as only participant, unless it exists, and returns it.
+func (db *appdbimpl) EnsureConversation(id, username string, now time.Time) (Conversation, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO conversations (id, ts) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, now.UnixNano())
+	if err != nil {
+		return Conversation{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Conversation{}, err
+	} else if n > 0 {
+		if _, err := tx.Exec(`INSERT INTO participants (conversation_id, username, position) VALUES (?, ?, 0)`, id, username); err != nil {
+			return Conversation{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return db.GetConversation(id)
+}
+
+// SetRetention sets the retention policy of a conversation, or returns ErrNotFound.
+func (db *appdbimpl) SetRetention(conversationID string, r Retention) error {
+	res, err := db.c.Exec(`UPDATE conversations SET retention_mode = ?, retention_days = ?, retention_hours = ?
+		WHERE id = ?`, r.Mode, r.Days, r.Hours, conversationID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ImageInUse reports whether an image message has url as content, or a conversation has it as photo.
+func (db *appdbimpl) ImageInUse(url string) (bool, error) {
+	var used bool
+	err := db.c.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE type = 'image' AND content = ?)
+		OR EXISTS (SELECT 1 FROM conversations WHERE photo = ?)`, url, url).Scan(&used)
+	return used, err
+}
+
+// ParticipantConversations returns the IDs of the conversations of a user.
+func (db *appdbimpl) ParticipantConversations(username string) ([]string, error) {
+	rows, err := db.c.Query(`SELECT conversation_id FROM participants WHERE username = ? ORDER BY conversation_id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// execer is implemented by both sql.DB and sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// join adds a participant to a conversation, after the others, if needed.
+func join(tx execer, conversationID, username string) error {
+	_, err := tx.Exec(`INSERT INTO participants (conversation_id, username, position)
+		SELECT ?, ?, COALESCE(MAX(position) + 1, 0) FROM participants WHERE conversation_id = ?
+		ON CONFLICT DO NOTHING`, conversationID, username, conversationID)
+	return err
+}
+
+// insertMessage inserts m and its reactions.
+func insertMessage(tx execer, m Message) error {
+	_, err := tx.Exec(`INSERT INTO messages (`+messageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.ConversationID, m.Sender, m.Content, m.Type, m.Status, m.Timestamp.UnixNano(), m.ForwardedFrom)
+	if err != nil {
+		return err
+	}
+	for i, r := range m.Reactions {
+		if _, err := tx.Exec(`INSERT INTO reactions (id, message_id, emoji, position) VALUES (?, ?, ?, ?)`, r.ID, m.ID, r.Emoji, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddMessage adds a message to its conversation, creating the conversation if needed, and makes the sender a
+// participant. It returns the conversation.
+func (db *appdbimpl) AddMessage(m Message, author string) (Conversation, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := addMessage(tx, m, author); err != nil {
+		return Conversation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return db.GetConversation(m.ConversationID)
+}
+
+// addMessage adds m to its conversation, which it creates if needed, and makes author a participant.
+func addMessage(tx execer, m Message, author string) error {
+	_, err := tx.Exec(`INSERT INTO conversations (id, last_message, ts) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET last_message = excluded.last_message, ts = excluded.ts`,
+		m.ConversationID, m.Content, m.Timestamp.UnixNano())
+	if err != nil {
+		return err
+	}
+	if err := join(tx, m.ConversationID, author); err != nil {
+		return err
+	}
+	return insertMessage(tx, m)
+}
+
+// GetMessage returns a message with its reactions, or ErrNotFound.
+func (db *appdbimpl) GetMessage(id string) (Message, error) {
+	msgs, err := db.queryMessages(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, id)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(msgs) == 0 {
+		return Message{}, ErrNotFound
+	}
+	return msgs[0], nil
+}
+
+// DeleteMessage deletes a message with its reactions, pin and stars, and returns it, or ErrNotFound. The preview and the timestamp
+// of the conversation become the ones of the last message left, if any.
+func (db *appdbimpl) DeleteMessage(id string) (Message, error) {
+	m, err := db.GetMessage(id)
+	if err != nil {
+		return m, err
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`DELETE FROM messages WHERE id = ?`, id)
+	if err != nil {
+		return m, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return m, err
+	} else if n == 0 {
+		// Deleted in the meantime
+		return m, ErrNotFound
+	}
+	for _, table := range []string{"reactions", "pinned_messages", "starred_messages"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE message_id = ?`, id); err != nil {
+			return m, err
+		}
+	}
+	// The conversation keeps its timestamp if it has no messages left
+	_, err = tx.Exec(`UPDATE conversations SET
+		last_message = COALESCE((SELECT content FROM messages
+			WHERE messages.conversation_id = conversations.id ORDER BY ts DESC, id DESC LIMIT 1), ''),
+		ts = COALESCE((SELECT MAX(ts) FROM messages WHERE messages.conversation_id = conversations.id), ts)
+		WHERE id = ?`, m.ConversationID)
+	if err != nil {
+		return m, err
+	}
+	return m, tx.Commit()
+}
+
+// AddReaction adds a reaction to a message, after the others, or returns ErrNotFound if there's no such message.
+func (db *appdbimpl) AddReaction(messageID string, r Reaction) error {
+	res, err := db.c.Exec(`INSERT INTO reactions (id, message_id, emoji, position)
+		SELECT ?, id, ?, (SELECT COALESCE(MAX(position) + 1, 0) FROM reactions WHERE message_id = ?)
+		FROM messages WHERE id = ?`, r.ID, r.Emoji, messageID, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RemoveReaction deletes a reaction of a message and returns it, or ErrNotFound.
+func (db *appdbimpl) RemoveReaction(messageID, reactionID string) (Reaction, error) {
+	r := Reaction{ID: reactionID}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return r, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = tx.QueryRow(`SELECT emoji FROM reactions WHERE id = ? AND message_id = ?`, reactionID, messageID).Scan(&r.Emoji)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, ErrNotFound
+	} else if err != nil {
+		return r, err
+	}
+	if _, err := tx.Exec(`DELETE FROM reactions WHERE id = ?`, reactionID); err != nil {
+		return r, err
+	}
+	return r, tx.Commit()
+}
+
+// MessagesAfter returns up to limit messages of a conversation after a position, oldest first, with their reactions.
+// A zero position starts from the first message, and a limit of zero or less returns every message.
+func (db *appdbimpl) MessagesAfter(conversationID string, after MessagePosition, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	var ts int64
+	if !after.Timestamp.IsZero() {
+		ts = after.Timestamp.UnixNano()
+	}
+	return db.queryMessages(`SELECT `+messageColumns+` FROM messages
+		WHERE conversation_id = ? AND (? = 0 OR ts > ? OR (ts = ? AND id > ?))
+		ORDER BY ts, id LIMIT ?`, conversationID, ts, ts, ts, after.MessageID, limit)
+}
+
+// ImportConversation creates a conversation with its messages, or fails with ErrAlreadyExists if the ID is taken.
+// Participants and messages keep their order.
+func (db *appdbimpl) ImportConversation(c Conversation, msgs []Message) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO conversations (id, name, photo, last_message, ts, retention_mode, retention_days,
+		retention_hours) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		c.ID, c.Name, c.Photo, c.LastMessage, c.Timestamp.UnixNano(), c.Retention.Mode, c.Retention.Days, c.Retention.Hours)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	for _, p := range c.Participants {
+		if err := join(tx, c.ID, p); err != nil {
+			return err
+		}
+	}
+	for _, m := range msgs {
+		if err := insertMessage(tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
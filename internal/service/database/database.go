@@ -3,7 +3,8 @@ Package database is the middleware between the app database and the code. All da
 persistent database are handled here. Database specific logic should never escape this package.
 
 To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+data source name from config), and then initialize an instance of AppDatabase from the DB connection. Migrations are
+applied by AppDatabase.Migrate; the `wasactl migrate` command runs them on demand.
 
 For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
 main.WebAPIConfiguration structure):
@@ -34,6 +35,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // AppDatabase is the high level interface for the DB
@@ -41,11 +44,204 @@ type AppDatabase interface {
 	GetName() (string, error)
 	SetName(name string) error
 
+	// IndexMessage adds a message to the full-text index, replacing any previous version
+	IndexMessage(m IndexedMessage) error
+
+	// UnindexMessage removes a message from the full-text index
+	UnindexMessage(messageID string) error
+
+	// SearchMessages returns the indexed messages matching every term of the query, newest first
+	SearchMessages(q MessageQuery) ([]MessageHit, error)
+
+	// ClearMessageIndex removes every message from the full-text index
+	ClearMessageIndex() error
+
+	// SchemaVersion returns the version of the database schema, 0 if it was never migrated
+	SchemaVersion() (int, error)
+
+	// Migrate applies the pending migrations, returning their descriptions
+	Migrate() ([]string, error)
+
+	// ListUsers returns every user, by name
+	ListUsers() ([]User, error)
+
+	// GetUser returns a user, or ErrNotFound
+	GetUser(name string) (User, error)
+
+	// CreateUser adds a user, failing with ErrAlreadyExists if the name is taken
+	CreateUser(u User) error
+
+	// DeleteUser removes a user with their sessions, scheduled messages, stars and place in conversations, or returns
+	// ErrNotFound. The signed tokens of the sessions are revoked as by RevokeSession.
+	DeleteUser(name string, tokenTTL time.Duration) error
+
+	// ListSessions returns the sessions of a user, or of every user if username is empty
+	ListSessions(username string) ([]Session, error)
+
+	// RevokeSession deletes a session, or returns ErrNotFound. Its signed tokens are revoked until tokenTTL after
+	// login, when they expire, or forever if tokenTTL is 0.
+	RevokeSession(id string, tokenTTL time.Duration) error
+
+	// RevokeUserSessions deletes every session of a user, returning how many there were. Their signed tokens are
+	// revoked as by RevokeSession.
+	RevokeUserSessions(username string, tokenTTL time.Duration) (int, error)
+
+	// ListConversations returns every conversation, most recently active first
+	ListConversations() ([]Conversation, error)
+
+	// GetConversation returns a conversation, or ErrNotFound
+	GetConversation(id string) (Conversation, error)
+
+	// ListMessages returns the last limit messages of a conversation, oldest first
+	ListMessages(conversationID string, limit int) ([]Message, error)
+
+	// CountMessages returns how many messages match the filter
+	CountMessages(f MessageFilter) (int, error)
+
+	// PurgeMessages deletes the messages matching the filter, returning how many were deleted
+	PurgeMessages(f MessageFilter) (int, error)
+
+	// Stats counts the rows of each table
+	Stats() (Stats, error)
+
+	// Backup writes a consistent copy of the database to a new file at path, while it's in use
+	Backup(path string) error
+
+	// SetPasswordHash sets the password hash of a user who has none, creating the user if needed, and returns the
+	// hash the user has afterwards
+	SetPasswordHash(name string, hash []byte, now time.Time) ([]byte, error)
+
+	// RenameUser moves the sessions, the scheduled messages, the stars, the uploaded media and the password of a user
+	// to a new name, failing with ErrAlreadyExists if the new name has a password. The old name is recorded as given up at now.
+	RenameUser(oldName, newName string, now time.Time) error
+
+	// UserRenamedAt returns when a user was last renamed away from name, or the zero time if no user was
+	UserRenamedAt(name string) (time.Time, error)
+
+	// KnownUsers returns the names of the users, of the users with a session, and of the participants
+	KnownUsers() ([]string, error)
+
+	// CreateSession adds a session, failing with ErrAlreadyExists if its ID is taken
+	CreateSession(s Session) error
+
+	// GetSession returns a session, or ErrNotFound
+	GetSession(id string) (Session, error)
+
+	// GetSessionByToken returns the session of an opaque token hash, or ErrNotFound
+	GetSessionByToken(tokenHash string) (Session, error)
+
+	// TouchSession sets the last use of a session, or returns ErrNotFound
+	TouchSession(id string, t time.Time) error
+
+	// DeleteExpiredSessions deletes and returns the sessions last used before idleBefore or created before
+	// createdBefore; zero times disable the corresponding condition
+	DeleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error)
+
+	// RevokeToken records that the signed tokens of a session are revoked until they expire, forever if until is zero
+	RevokeToken(sessionID string, until time.Time) error
+
+	// IsTokenRevoked reports whether the signed tokens of a session are revoked
+	IsTokenRevoked(sessionID string) (bool, error)
+
+	// ForgetRevokedTokens deletes the revocations of the tokens expired at now
+	ForgetRevokedTokens(now time.Time) error
+
+	// SessionEpoch returns when the database started keeping sessions: now, the first time it's called
+	SessionEpoch(now time.Time) (time.Time, error)
+
+	// EnsureConversation creates a conversation with username as only participant, unless it exists, and returns it
+	EnsureConversation(id, username string, now time.Time) (Conversation, error)
+
+	// ParticipantConversations returns the IDs of the conversations of a user
+	ParticipantConversations(username string) ([]string, error)
+
+	// AddMessage adds a message, creating its conversation if needed and making author a participant, and returns
+	// the conversation. The author is the sender, or the user who forwarded the message.
+	AddMessage(m Message, author string) (Conversation, error)
+
+	// GetMessage returns a message, or ErrNotFound
+	GetMessage(id string) (Message, error)
+
+	// DeleteMessage deletes a message with its pin and stars, and returns it, or ErrNotFound
+	DeleteMessage(id string) (Message, error)
+
+	// AddReaction adds a reaction to a message, or returns ErrNotFound
+	AddReaction(messageID string, r Reaction) error
+
+	// RemoveReaction deletes a reaction of a message and returns it, or ErrNotFound
+	RemoveReaction(messageID, reactionID string) (Reaction, error)
+
+	// MessagesAfter returns up to limit messages of a conversation after a position, oldest first; limit <= 0
+	// returns them all
+	MessagesAfter(conversationID string, after MessagePosition, limit int) ([]Message, error)
+
+	// ImportConversation creates a conversation with its messages, failing with ErrAlreadyExists if the ID is taken
+	ImportConversation(c Conversation, msgs []Message) error
+
+	// SetRetention sets the retention policy of a conversation, or returns ErrNotFound
+	SetRetention(conversationID string, r Retention) error
+
+	// ImageInUse reports whether an image message has url as content, or a conversation has it as photo
+	ImageInUse(url string) (bool, error)
+
+	// AddMedia records a media file uploaded by its owner, failing with ErrAlreadyExists if its URL is taken
+	AddMedia(m Media) error
+
+	// AttachMedia ties the media file at url to the message it was uploaded for, failing with ErrNotFound unless
+	// the file belongs to owner and is tied to no message yet
+	AttachMedia(url, owner, messageID string) error
+
+	// MessageMedia returns the media file tied to a message, or ErrNotFound
+	MessageMedia(messageID string) (Media, error)
+
+	// DeleteMedia forgets a media file, or returns ErrNotFound
+	DeleteMedia(url string) error
+
+	// ScheduleMessage stores a scheduled message, failing with ErrAlreadyExists if its ID is taken, or with
+	// ErrLimitReached if its sender has limit scheduled messages (0 for no limit)
+	ScheduleMessage(m ScheduledMessage, limit int) error
+
+	// ScheduledMessages returns the scheduled messages of a sender, the first to send first
+	ScheduledMessages(sender string) ([]ScheduledMessage, error)
+
+	// DueScheduledMessages returns up to limit scheduled messages to send at now, the first to send first
+	DueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error)
+
+	// CancelScheduledMessage deletes a scheduled message of sender and returns it, or ErrNotFound
+	CancelScheduledMessage(id, sender string) (ScheduledMessage, error)
+
+	// DeliverScheduledMessage replaces a scheduled message with m, or returns ErrNotFound if it's gone
+	DeliverScheduledMessage(id string, m Message) (Conversation, error)
+
+	// PinnedMessages returns the pins of a conversation, the oldest first
+	PinnedMessages(conversationID string) ([]Pin, error)
+
+	// PinMessage pins a message of a conversation, failing with ErrNotFound if the message is not in the
+	// conversation, with ErrAlreadyExists if it's pinned, or with ErrLimitReached if the conversation has limit pins
+	// (0 for no limit)
+	PinMessage(p Pin, limit int) error
+
+	// UnpinMessage unpins a message of a conversation, or returns ErrNotFound if it's not pinned
+	UnpinMessage(conversationID, messageID string) error
+
+	// StarMessage stars a message for a user, failing with ErrNotFound if the message doesn't exist, or with
+	// ErrAlreadyExists if the user starred it already
+	StarMessage(s Star) error
+
+	// UnstarMessage removes the star of a user from a message, or returns ErrNotFound if there is none
+	UnstarMessage(username, messageID string) error
+
+	// StarredMessages returns the messages starred by a user with their reactions, the last starred first
+	StarredMessages(username string) ([]StarredMessage, error)
+
 	Ping() error
 }
 
 type appdbimpl struct {
 	c *sql.DB
+
+	// fts is false if SQLite was built without FTS5: the search methods return ErrSearchUnavailable
+	fts bool
 }
 
 // New returns a new instance of AppDatabase based on the SQLite connection `db`.
@@ -66,8 +262,30 @@ func New(db *sql.DB) (AppDatabase, error) {
 		}
 	}
 
+	// Migrations record the schema version here
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the schema version table: %w", err)
+	}
+
+	// The full-text index needs the FTS5 extension, which go-sqlite3 includes only with the sqlite_fts5 build tag
+	fts := true
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS message_index USING fts5(
+		content, message_id UNINDEXED, conversation_id UNINDEXED, ts UNINDEXED
+	);`)
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		fts = false
+	} else if err != nil {
+		return nil, fmt.Errorf("error creating the message index: %w", err)
+	}
+
 	return &appdbimpl{
-		c: db,
+		c:   db,
+		fts: fts,
 	}, nil
 }
 
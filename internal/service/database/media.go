@@ -0,0 +1,74 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Media is a media file uploaded to the media directory. MessageID is the message that shows it, once sent.
+type Media struct {
+	URL       string
+	Owner     string
+	MessageID string
+	CreatedAt time.Time
+}
+
+// AddMedia records a media file uploaded by its owner, or fails with ErrAlreadyExists if its URL is taken.
+func (db *appdbimpl) AddMedia(m Media) error {
+	res, err := db.c.Exec(`INSERT INTO media (url, owner, message_id, created_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		m.URL, m.Owner, m.MessageID, m.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// AttachMedia ties the media file at url to the message it was uploaded for. It fails with ErrNotFound unless the
+// file belongs to owner and is tied to no message yet.
+func (db *appdbimpl) AttachMedia(url, owner, messageID string) error {
+	res, err := db.c.Exec(`UPDATE media SET message_id = ? WHERE url = ? AND owner = ? AND message_id = ''`, messageID, url, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MessageMedia returns the media file tied to a message, or ErrNotFound.
+func (db *appdbimpl) MessageMedia(messageID string) (Media, error) {
+	m := Media{MessageID: messageID}
+	var createdAt int64
+	err := db.c.QueryRow(`SELECT url, owner, created_at FROM media WHERE message_id = ? AND message_id != ''`, messageID).
+		Scan(&m.URL, &m.Owner, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Media{}, ErrNotFound
+	} else if err != nil {
+		return Media{}, err
+	}
+	m.CreatedAt = time.Unix(0, createdAt).UTC()
+	return m, nil
+}
+
+// DeleteMedia forgets a media file, or returns ErrNotFound.
+func (db *appdbimpl) DeleteMedia(url string) error {
+	res, err := db.c.Exec(`DELETE FROM media WHERE url = ?`, url)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSearchUnavailable is returned by the search methods when SQLite was built without FTS5.
+var ErrSearchUnavailable = errors.New("full-text search is not available: build with the sqlite_fts5 tag")
+
+// Markers around the matched terms in MessageHit.Snippet. They are control characters, removed from the indexed
+// content, so they never clash with the message text.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// SnippetTokens is the maximum number of tokens in MessageHit.Snippet.
+const SnippetTokens = 16
+
+// IndexedMessage is the part of a message stored in the full-text index.
+type IndexedMessage struct {
+	MessageID      string
+	ConversationID string
+	Content        string
+	Timestamp      time.Time
+}
+
+// MessagePosition is a position in the results, ordered by timestamp and then message ID.
+type MessagePosition struct {
+	Timestamp time.Time
+	MessageID string
+}
+
+// MessageQuery selects the messages containing every term, within the given conversations.
+type MessageQuery struct {
+	Terms           []string
+	ConversationIDs []string
+
+	// Before, if not nil, skips the messages up to this position (included), to fetch the next page
+	Before *MessagePosition
+
+	Limit int
+}
+
+// MessageHit is a message matching a MessageQuery.
+type MessageHit struct {
+	MessageID      string
+	ConversationID string
+	Timestamp      time.Time
+
+	// Snippet is an excerpt of the content, with the matched terms between HighlightStart and HighlightEnd
+	Snippet string
+}
+
+// stripMarkers removes the highlight markers from s.
+func stripMarkers(s string) string {
+	return strings.NewReplacer(HighlightStart, "", HighlightEnd, "").Replace(s)
+}
+
+// IndexMessage adds a message to the full-text index, replacing any previous version.
+func (db *appdbimpl) IndexMessage(m IndexedMessage) error {
+	if !db.fts {
+		return ErrSearchUnavailable
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`DELETE FROM message_index WHERE message_id = ?`, m.MessageID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO message_index (content, message_id, conversation_id, ts) VALUES (?, ?, ?, ?)`,
+		stripMarkers(m.Content), m.MessageID, m.ConversationID, m.Timestamp.UnixNano())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnindexMessage removes a message from the full-text index.
+func (db *appdbimpl) UnindexMessage(messageID string) error {
+	if !db.fts {
+		return ErrSearchUnavailable
+	}
+	_, err := db.c.Exec(`DELETE FROM message_index WHERE message_id = ?`, messageID)
+	return err
+}
+
+// ClearMessageIndex removes every message from the full-text index.
+func (db *appdbimpl) ClearMessageIndex() error {
+	if !db.fts {
+		return ErrSearchUnavailable
+	}
+	_, err := db.c.Exec(`DELETE FROM message_index`)
+	return err
+}
+
+// searchBatchSize is the number of conversations searched by a query. Searches with more conversations are split, to
+// stay below the limit of SQLite on the parameters of a statement (999 before SQLite 3.32).
+const searchBatchSize = 500
+
+// SearchMessages returns the indexed messages matching every term of the query, newest first.
+func (db *appdbimpl) SearchMessages(q MessageQuery) ([]MessageHit, error) {
+	if !db.fts {
+		return nil, ErrSearchUnavailable
+	}
+	if len(q.Terms) == 0 || len(q.ConversationIDs) == 0 {
+		return nil, nil
+	}
+
+	// Every batch returns its first q.Limit hits: the first q.Limit hits of all of them are the ones of the query
+	var hits []MessageHit
+	for start := 0; start < len(q.ConversationIDs); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(q.ConversationIDs) {
+			end = len(q.ConversationIDs)
+		}
+		batch, err := db.searchMessages(q, q.ConversationIDs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, batch...)
+	}
+	if len(q.ConversationIDs) > searchBatchSize {
+		sort.Slice(hits, func(i, j int) bool {
+			if !hits[i].Timestamp.Equal(hits[j].Timestamp) {
+				return hits[i].Timestamp.After(hits[j].Timestamp)
+			}
+			return hits[i].MessageID > hits[j].MessageID
+		})
+		if len(hits) > q.Limit {
+			hits = hits[:q.Limit]
+		}
+	}
+	return hits, nil
+}
+
+// searchMessages runs q on the conversations given, which must not be more than searchBatchSize.
+func (db *appdbimpl) searchMessages(q MessageQuery, conversationIDs []string) ([]MessageHit, error) {
+	// Each term is quoted, so that it's matched literally and not parsed as FTS5 syntax
+	quoted := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	args := []interface{}{HighlightStart, HighlightEnd, strings.Join(quoted, " ")}
+	for _, id := range conversationIDs {
+		args = append(args, id)
+	}
+	where := `message_index MATCH ? AND conversation_id IN (?` + strings.Repeat(", ?", len(conversationIDs)-1) + `)`
+	if q.Before != nil {
+		ts := q.Before.Timestamp.UnixNano()
+		where += ` AND (ts < ? OR (ts = ? AND message_id < ?))`
+		args = append(args, ts, ts, q.Before.MessageID)
+	}
+	args = append(args, q.Limit)
+
+	rows, err := db.c.Query(fmt.Sprintf(`SELECT message_id, conversation_id, ts, snippet(message_index, 0, ?, ?, '…', %d)
+		FROM message_index WHERE %s ORDER BY ts DESC, message_id DESC LIMIT ?`, SnippetTokens, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var hits []MessageHit
+	for rows.Next() {
+		var hit MessageHit
+		var ts int64
+		if err := rows.Scan(&hit.MessageID, &hit.ConversationID, &ts, &hit.Snippet); err != nil {
+			return nil, err
+		}
+		hit.Timestamp = time.Unix(0, ts).UTC()
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
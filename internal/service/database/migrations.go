@@ -0,0 +1,185 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version of the application.
+var ErrSchemaTooNew = errors.New("database schema is newer than this application")
+
+// migration upgrades the schema from the previous version to version.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations are applied in order, each in its own transaction. Never edit a released migration: add a new one.
+// Foreign keys are not enforced (SQLite needs a pragma on every connection): rows are deleted explicitly.
+var migrations = []migration{
+	{1, "users, sessions, conversations, messages and reactions", []string{
+		`CREATE TABLE users (
+			name TEXT NOT NULL PRIMARY KEY,
+			password_hash BLOB,
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE TABLE sessions (
+			id TEXT NOT NULL PRIMARY KEY,
+			username TEXT NOT NULL,
+			token_hash TEXT,
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX sessions_username ON sessions (username);`,
+		`CREATE UNIQUE INDEX sessions_token_hash ON sessions (token_hash) WHERE token_hash IS NOT NULL;`,
+		`CREATE TABLE conversations (
+			id TEXT NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			photo TEXT NOT NULL DEFAULT '',
+			last_message TEXT NOT NULL DEFAULT '',
+			ts INTEGER NOT NULL
+		);`,
+		`CREATE TABLE participants (
+			conversation_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (conversation_id, username)
+		);`,
+		`CREATE INDEX participants_username ON participants (username);`,
+		`CREATE TABLE messages (
+			id TEXT NOT NULL PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			content TEXT NOT NULL,
+			type TEXT NOT NULL,
+			status TEXT NOT NULL,
+			ts INTEGER NOT NULL,
+			forwarded_from TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX messages_conversation_ts ON messages (conversation_id, ts, id);`,
+		`CREATE TABLE reactions (
+			id TEXT NOT NULL PRIMARY KEY,
+			message_id TEXT NOT NULL,
+			emoji TEXT NOT NULL,
+			position INTEGER NOT NULL
+		);`,
+		`CREATE INDEX reactions_message ON reactions (message_id);`,
+	}},
+	{2, "revoked signed tokens", []string{
+		// until is when the token expires anyway, 0 if never: the revocation can be forgotten afterwards
+		`CREATE TABLE revoked_tokens (
+			session_id TEXT NOT NULL PRIMARY KEY,
+			until INTEGER NOT NULL
+		);`,
+	}},
+	{3, "retention policies of conversations", []string{
+		`ALTER TABLE conversations ADD COLUMN retention_mode TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE conversations ADD COLUMN retention_days INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE conversations ADD COLUMN retention_hours INTEGER NOT NULL DEFAULT 0;`,
+	}},
+	{4, "scheduled messages", []string{
+		`CREATE TABLE scheduled_messages (
+			id TEXT NOT NULL PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			content TEXT NOT NULL,
+			type TEXT NOT NULL,
+			send_at INTEGER NOT NULL,
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX scheduled_messages_send_at ON scheduled_messages (send_at, id);`,
+		`CREATE INDEX scheduled_messages_sender ON scheduled_messages (sender);`,
+	}},
+	{5, "pinned and starred messages", []string{
+		`CREATE TABLE pinned_messages (
+			message_id TEXT NOT NULL PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			pinned_by TEXT NOT NULL,
+			pinned_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX pinned_messages_conversation ON pinned_messages (conversation_id, pinned_at);`,
+		`CREATE TABLE starred_messages (
+			username TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			starred_at INTEGER NOT NULL,
+			PRIMARY KEY (username, message_id)
+		);`,
+		`CREATE INDEX starred_messages_message ON starred_messages (message_id);`,
+	}},
+	{6, "uploaded media files", []string{
+		// message_id is the message that the file was uploaded for, empty until it's sent
+		`CREATE TABLE media (
+			url TEXT NOT NULL PRIMARY KEY,
+			owner TEXT NOT NULL,
+			message_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX media_message ON media (message_id);`,
+		`CREATE INDEX media_owner ON media (owner);`,
+	}},
+	{7, "restorable sessions", []string{
+		// session_epoch holds a single row: when the database started keeping sessions
+		`CREATE TABLE session_epoch (
+			id INTEGER NOT NULL PRIMARY KEY CHECK (id = 0),
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE TABLE renamed_users (
+			name TEXT NOT NULL PRIMARY KEY,
+			renamed_at INTEGER NOT NULL
+		);`,
+	}},
+}
+
+// LatestSchemaVersion is the schema version Migrate upgrades to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the database schema, 0 if it was never migrated.
+func (db *appdbimpl) SchemaVersion() (int, error) {
+	var version int
+	err := db.c.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies the pending migrations, returning their descriptions.
+func (db *appdbimpl) Migrate() ([]string, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: version %d, latest known %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := db.apply(m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		applied = append(applied, fmt.Sprintf("%d: %s", m.version, m.description))
+	}
+	return applied, nil
+}
+
+func (db *appdbimpl) apply(m migration) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`, m.version, m.description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
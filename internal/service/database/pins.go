@@ -0,0 +1,192 @@
+package database
+
+import "time"
+
+// Pin is a message pinned in its conversation, for every participant.
+type Pin struct {
+	MessageID      string
+	ConversationID string
+	PinnedBy       string
+	PinnedAt       time.Time
+}
+
+// Star is a message starred by a user, for themselves.
+type Star struct {
+	Username  string
+	MessageID string
+	StarredAt time.Time
+}
+
+// StarredMessage is a message starred by a user, with the time of the star.
+type StarredMessage struct {
+	Message   Message
+	StarredAt time.Time
+}
+
+// PinnedMessages returns the pins of a conversation, the oldest first.
+func (db *appdbimpl) PinnedMessages(conversationID string) ([]Pin, error) {
+	rows, err := db.c.Query(`SELECT message_id, pinned_by, pinned_at FROM pinned_messages WHERE conversation_id = ?
+		ORDER BY pinned_at, message_id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var pins []Pin
+	for rows.Next() {
+		p := Pin{ConversationID: conversationID}
+		var pinnedAt int64
+		if err := rows.Scan(&p.MessageID, &p.PinnedBy, &pinnedAt); err != nil {
+			return nil, err
+		}
+		p.PinnedAt = time.Unix(0, pinnedAt).UTC()
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+// PinMessage pins a message of a conversation. It fails with ErrNotFound if the message is not in the conversation,
+// with ErrAlreadyExists if it's pinned, or with ErrLimitReached if the conversation has limit pins. A limit of 0
+// means no limit.
+func (db *appdbimpl) PinMessage(p Pin, limit int) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var found bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND conversation_id = ?)`, p.MessageID, p.ConversationID).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if limit > 0 {
+		var pinned bool
+		var n int
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pinned_messages WHERE conversation_id = ? AND message_id = ?),
+			(SELECT COUNT(*) FROM pinned_messages WHERE conversation_id = ?)`, p.ConversationID, p.MessageID, p.ConversationID).Scan(&pinned, &n)
+		if err != nil {
+			return err
+		}
+		if !pinned && n >= limit {
+			return ErrLimitReached
+		}
+	}
+	res, err := tx.Exec(`INSERT INTO pinned_messages (message_id, conversation_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`, p.MessageID, p.ConversationID, p.PinnedBy, p.PinnedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	return tx.Commit()
+}
+
+// UnpinMessage unpins a message of a conversation, or returns ErrNotFound if it's not pinned.
+func (db *appdbimpl) UnpinMessage(conversationID, messageID string) error {
+	res, err := db.c.Exec(`DELETE FROM pinned_messages WHERE conversation_id = ? AND message_id = ?`, conversationID, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// StarMessage stars a message for a user. It fails with ErrNotFound if the message doesn't exist, or with
+// ErrAlreadyExists if the user starred it already.
+func (db *appdbimpl) StarMessage(s Star) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var found bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = ?)`, s.MessageID).Scan(&found); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	res, err := tx.Exec(`INSERT INTO starred_messages (username, message_id, starred_at) VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING`, s.Username, s.MessageID, s.StarredAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	return tx.Commit()
+}
+
+// UnstarMessage removes the star of a user from a message, or returns ErrNotFound if there is none.
+func (db *appdbimpl) UnstarMessage(username, messageID string) error {
+	res, err := db.c.Exec(`DELETE FROM starred_messages WHERE username = ? AND message_id = ?`, username, messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// StarredMessages returns the messages starred by a user with their reactions, the last starred first.
+func (db *appdbimpl) StarredMessages(username string) ([]StarredMessage, error) {
+	rows, err := db.c.Query(`SELECT message_id, starred_at FROM starred_messages WHERE username = ?
+		ORDER BY starred_at DESC, message_id`, username)
+	if err != nil {
+		return nil, err
+	}
+	var stars []Star
+	for rows.Next() {
+		s := Star{Username: username}
+		var starredAt int64
+		if err := rows.Scan(&s.MessageID, &starredAt); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		s.StarredAt = time.Unix(0, starredAt).UTC()
+		stars = append(stars, s)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+	if len(stars) == 0 {
+		return nil, nil
+	}
+
+	msgs, err := db.queryMessages(`SELECT `+messageColumns+` FROM messages
+		WHERE id IN (SELECT message_id FROM starred_messages WHERE username = ?)`, username)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Message, len(msgs))
+	for _, m := range msgs {
+		byID[m.ID] = m
+	}
+	list := make([]StarredMessage, 0, len(stars))
+	for _, s := range stars {
+		// A message deleted in the meantime takes its stars with it
+		if m, ok := byID[s.MessageID]; ok {
+			list = append(list, StarredMessage{Message: m, StarredAt: s.StarredAt})
+		}
+	}
+	return list, nil
+}
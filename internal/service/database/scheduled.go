@@ -0,0 +1,137 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ScheduledMessage is a message to send to a conversation at SendAt.
+type ScheduledMessage struct {
+	ID             string
+	ConversationID string
+	Sender         string
+	Content        string
+	Type           string
+	SendAt         time.Time
+	CreatedAt      time.Time
+}
+
+const scheduledColumns = `id, conversation_id, sender, content, type, send_at, created_at`
+
+func (db *appdbimpl) queryScheduled(query string, args ...interface{}) ([]ScheduledMessage, error) {
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var list []ScheduledMessage
+	for rows.Next() {
+		var m ScheduledMessage
+		var sendAt, createdAt int64
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &m.Type, &sendAt, &createdAt); err != nil {
+			return nil, err
+		}
+		m.SendAt = time.Unix(0, sendAt).UTC()
+		m.CreatedAt = time.Unix(0, createdAt).UTC()
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// ScheduleMessage stores a scheduled message. It fails with ErrAlreadyExists if its ID is taken, or with
+// ErrLimitReached if its sender has limit scheduled messages. A limit of 0 means no limit.
+func (db *appdbimpl) ScheduleMessage(m ScheduledMessage, limit int) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The limit is checked by the insert itself, so that concurrent inserts can't exceed it
+	res, err := tx.Exec(`INSERT INTO scheduled_messages (`+scheduledColumns+`) SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE ? = 0 OR (SELECT COUNT(*) FROM scheduled_messages WHERE sender = ?) < ?
+		ON CONFLICT DO NOTHING`, m.ID, m.ConversationID, m.Sender, m.Content, m.Type, m.SendAt.UnixNano(), m.CreatedAt.UnixNano(),
+		limit, m.Sender, limit)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM scheduled_messages WHERE id = ?)`, m.ID).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return ErrAlreadyExists
+		}
+		return ErrLimitReached
+	}
+	return tx.Commit()
+}
+
+// ScheduledMessages returns the scheduled messages of a sender, the first to send first.
+func (db *appdbimpl) ScheduledMessages(sender string) ([]ScheduledMessage, error) {
+	return db.queryScheduled(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE sender = ?
+		ORDER BY send_at, id`, sender)
+}
+
+// DueScheduledMessages returns up to limit scheduled messages to send at now, the first to send first.
+func (db *appdbimpl) DueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	return db.queryScheduled(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE send_at <= ?
+		ORDER BY send_at, id LIMIT ?`, now.UnixNano(), limit)
+}
+
+// CancelScheduledMessage deletes a scheduled message of sender and returns it, or ErrNotFound.
+func (db *appdbimpl) CancelScheduledMessage(id, sender string) (ScheduledMessage, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var m ScheduledMessage
+	var sendAt, createdAt int64
+	err = tx.QueryRow(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id = ? AND sender = ?`, id, sender).
+		Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &m.Type, &sendAt, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrNotFound
+	} else if err != nil {
+		return m, err
+	}
+	m.SendAt = time.Unix(0, sendAt).UTC()
+	m.CreatedAt = time.Unix(0, createdAt).UTC()
+	if _, err := tx.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id); err != nil {
+		return m, err
+	}
+	return m, tx.Commit()
+}
+
+// DeliverScheduledMessage replaces a scheduled message with m, like AddMessage does, and returns the conversation. It
+// returns ErrNotFound if the scheduled message was cancelled or delivered already.
+func (db *appdbimpl) DeliverScheduledMessage(id string, m Message) (Conversation, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Conversation{}, err
+	} else if n == 0 {
+		return Conversation{}, ErrNotFound
+	}
+	if err := addMessage(tx, m, m.Sender); err != nil {
+		return Conversation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return db.GetConversation(m.ConversationID)
+}
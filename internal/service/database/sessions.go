@@ -0,0 +1,232 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Session is a login of a user. TokenHash is the hash of the opaque token, empty for signed tokens.
+type Session struct {
+	ID         string
+	Username   string
+	TokenHash  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+const sessionColumns = `id, username, COALESCE(token_hash, ''), created_at, last_used_at`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var s Session
+	var created, used int64
+	err := row.Scan(&s.ID, &s.Username, &s.TokenHash, &created, &used)
+	s.CreatedAt, s.LastUsedAt = time.Unix(0, created).UTC(), time.Unix(0, used).UTC()
+	return s, err
+}
+
+// CreateSession adds a session, failing with ErrAlreadyExists if its ID is taken.
+func (db *appdbimpl) CreateSession(s Session) error {
+	res, err := db.c.Exec(`INSERT INTO sessions (id, username, token_hash, created_at, last_used_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?) ON CONFLICT DO NOTHING`,
+		s.ID, s.Username, s.TokenHash, s.CreatedAt.UnixNano(), s.LastUsedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// GetSession returns a session, or ErrNotFound.
+func (db *appdbimpl) GetSession(id string) (Session, error) {
+	s, err := scanSession(db.c.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrNotFound
+	}
+	return s, err
+}
+
+// GetSessionByToken returns the session of an opaque token hash, or ErrNotFound.
+func (db *appdbimpl) GetSessionByToken(tokenHash string) (Session, error) {
+	s, err := scanSession(db.c.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token_hash = ?`, tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrNotFound
+	}
+	return s, err
+}
+
+// TouchSession sets the last use of a session, or returns ErrNotFound.
+func (db *appdbimpl) TouchSession(id string, t time.Time) error {
+	res, err := db.c.Exec(`UPDATE sessions SET last_used_at = ? WHERE id = ?`, t.UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpiredSessions deletes the sessions last used before idleBefore, or created before createdBefore, and
+// returns them. Zero times disable the corresponding condition.
+func (db *appdbimpl) DeleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error) {
+	where, args := `0 = 1`, []interface{}{}
+	if !idleBefore.IsZero() {
+		where += ` OR last_used_at <= ?`
+		args = append(args, idleBefore.UnixNano())
+	}
+	if !createdBefore.IsZero() {
+		where += ` OR created_at <= ?`
+		args = append(args, createdBefore.UnixNano())
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT `+sessionColumns+` FROM sessions WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var expired []Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		expired = append(expired, s)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE `+where, args...); err != nil {
+		return nil, err
+	}
+	return expired, tx.Commit()
+}
+
+// RevokeToken records that the signed tokens of a session are revoked until they expire; a zero until means forever.
+func (db *appdbimpl) RevokeToken(sessionID string, until time.Time) error {
+	var ts int64
+	if !until.IsZero() {
+		ts = until.UnixNano()
+	}
+	_, err := db.c.Exec(`INSERT INTO revoked_tokens (session_id, until) VALUES (?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET until = excluded.until`, sessionID, ts)
+	return err
+}
+
+// IsTokenRevoked reports whether the signed tokens of a session are revoked.
+func (db *appdbimpl) IsTokenRevoked(sessionID string) (bool, error) {
+	var revoked bool
+	err := db.c.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE session_id = ?)`, sessionID).Scan(&revoked)
+	return revoked, err
+}
+
+// ForgetRevokedTokens deletes the revocations of the tokens expired at now, which are rejected anyway.
+func (db *appdbimpl) ForgetRevokedTokens(now time.Time) error {
+	_, err := db.c.Exec(`DELETE FROM revoked_tokens WHERE until != 0 AND until < ?`, now.UnixNano())
+	return err
+}
+
+// SessionEpoch returns when the database started keeping sessions: now, the first time it's called.
+func (db *appdbimpl) SessionEpoch(now time.Time) (time.Time, error) {
+	_, err := db.c.Exec(`INSERT INTO session_epoch (id, created_at) VALUES (0, ?) ON CONFLICT DO NOTHING`, now.UnixNano())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ts int64
+	if err := db.c.QueryRow(`SELECT created_at FROM session_epoch WHERE id = 0`).Scan(&ts); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts).UTC(), nil
+}
+
+// ListSessions returns the sessions of a user, or of every user if username is empty, most recently used first.
+func (db *appdbimpl) ListSessions(username string) ([]Session, error) {
+	rows, err := db.c.Query(`SELECT `+sessionColumns+` FROM sessions
+		WHERE ? = '' OR username = ? ORDER BY last_used_at DESC, id`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var sessions []Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes a session, or returns ErrNotFound. The signed tokens of the session, valid for tokenTTL after
+// login (forever if 0), are revoked in the same transaction.
+func (db *appdbimpl) RevokeSession(id string, tokenTTL time.Duration) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := revokeSignedTokens(tx, tokenTTL, `id = ?`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// RevokeUserSessions deletes every session of a user, returning how many there were. Their signed tokens are revoked
+// as by RevokeSession.
+func (db *appdbimpl) RevokeUserSessions(username string, tokenTTL time.Duration) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := revokeSignedTokens(tx, tokenTTL, `username = ?`, username); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// revokeSignedTokens revokes, in tx, the signed tokens of the sessions matching where, until they expire tokenTTL
+// after login, or forever if tokenTTL is 0. Sessions with an opaque token need no revocation: deleting them is enough.
+func revokeSignedTokens(tx *sql.Tx, tokenTTL time.Duration, where string, args ...interface{}) error {
+	ttl := tokenTTL.Nanoseconds()
+	_, err := tx.Exec(`INSERT INTO revoked_tokens (session_id, until)
+		SELECT id, CASE WHEN ? > 0 THEN created_at + ? ELSE 0 END FROM sessions WHERE token_hash IS NULL AND (`+where+`)
+		ON CONFLICT (session_id) DO UPDATE SET until = excluded.until`, append([]interface{}{ttl, ttl}, args...)...)
+	return err
+}
@@ -0,0 +1,52 @@
+package database
+
+import "time"
+
+// Stats summarizes the content of the database.
+type Stats struct {
+	SchemaVersion int
+	Users         int
+	Sessions      int
+	Conversations int
+	Messages      int
+	Reactions     int
+
+	// OldestMessage and NewestMessage are zero if there are no messages
+	OldestMessage time.Time
+	NewestMessage time.Time
+
+	// IndexedMessages is the size of the full-text index, -1 if it's not available
+	IndexedMessages int
+}
+
+// Stats counts the rows of each table.
+func (db *appdbimpl) Stats() (Stats, error) {
+	var s Stats
+	var err error
+	if s.SchemaVersion, err = db.SchemaVersion(); err != nil {
+		return s, err
+	}
+
+	var oldest, newest int64
+	err = db.c.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM users),
+		(SELECT COUNT(*) FROM sessions),
+		(SELECT COUNT(*) FROM conversations),
+		(SELECT COUNT(*) FROM messages),
+		(SELECT COUNT(*) FROM reactions),
+		COALESCE((SELECT MIN(ts) FROM messages), 0),
+		COALESCE((SELECT MAX(ts) FROM messages), 0)`,
+	).Scan(&s.Users, &s.Sessions, &s.Conversations, &s.Messages, &s.Reactions, &oldest, &newest)
+	if err != nil {
+		return s, err
+	}
+	if s.Messages > 0 {
+		s.OldestMessage, s.NewestMessage = time.Unix(0, oldest).UTC(), time.Unix(0, newest).UTC()
+	}
+
+	s.IndexedMessages = -1
+	if db.fts {
+		err = db.c.QueryRow(`SELECT COUNT(*) FROM message_index`).Scan(&s.IndexedMessages)
+	}
+	return s, err
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Errors returned by the methods that look up or create a single row.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrLimitReached  = errors.New("limit reached")
+)
+
+// User is a registered user. PasswordHash is the bcrypt hash of the password, nil if the user has none.
+type User struct {
+	Name         string
+	PasswordHash []byte
+	CreatedAt    time.Time
+}
+
+// ListUsers returns every user, by name.
+func (db *appdbimpl) ListUsers() ([]User, error) {
+	rows, err := db.c.Query(`SELECT name, password_hash, created_at FROM users ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var created int64
+		if err := rows.Scan(&u.Name, &u.PasswordHash, &created); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = time.Unix(0, created).UTC()
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// CreateUser adds a user, failing with ErrAlreadyExists if the name is taken.
+func (db *appdbimpl) CreateUser(u User) error {
+	res, err := db.c.Exec(`INSERT INTO users (name, password_hash, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		u.Name, u.PasswordHash, u.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// DeleteUser removes a user with their sessions, their place in conversations, their scheduled messages and their
+// stars. Their messages are kept, as the other participants still see them. The signed tokens of their sessions are
+// revoked as by RevokeSession.
+func (db *appdbimpl) DeleteUser(name string, tokenTTL time.Duration) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`DELETE FROM users WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if err := revokeSignedTokens(tx, tokenTTL, `username = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE username = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM participants WHERE username = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM scheduled_messages WHERE sender = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM starred_messages WHERE username = ?`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUser returns a user, or ErrNotFound.
+func (db *appdbimpl) GetUser(name string) (User, error) {
+	u := User{Name: name}
+	var created int64
+	err := db.c.QueryRow(`SELECT password_hash, created_at FROM users WHERE name = ?`, name).Scan(&u.PasswordHash, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNotFound
+	}
+	u.CreatedAt = time.Unix(0, created).UTC()
+	return u, err
+}
+
+// SetPasswordHash sets the password hash of a user who has none, creating the user if needed, and returns the hash
+// the user has afterwards: the existing one, if any.
+func (db *appdbimpl) SetPasswordHash(name string, hash []byte, now time.Time) ([]byte, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`INSERT INTO users (name, password_hash, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET password_hash = excluded.password_hash WHERE password_hash IS NULL`,
+		name, hash, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	var current []byte
+	if err := tx.QueryRow(`SELECT password_hash FROM users WHERE name = ?`, name).Scan(&current); err != nil {
+		return nil, err
+	}
+	return current, tx.Commit()
+}
+
+// RenameUser moves the sessions, the scheduled messages, the stars, the uploaded media and the password of a user to a
+// new name, and records that the old name was given up at now. It fails with ErrAlreadyExists if the new name has a
+// password, as taking it would mean taking over an account. Messages and conversations are not changed.
+func (db *appdbimpl) RenameUser(oldName, newName string, now time.Time) error {
+	if oldName == newName {
+		return nil
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var taken bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE name = ? AND password_hash IS NOT NULL)`, newName).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrAlreadyExists
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET username = ? WHERE username = ?`, newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE scheduled_messages SET sender = ? WHERE sender = ?`, newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE OR IGNORE starred_messages SET username = ? WHERE username = ?`, newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM starred_messages WHERE username = ?`, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE media SET owner = ? WHERE owner = ?`, newName, oldName); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO renamed_users (name, renamed_at) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET renamed_at = excluded.renamed_at`, oldName, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	var hasUser bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE name = ?)`, oldName).Scan(&hasUser); err != nil {
+		return err
+	}
+	if hasUser {
+		// A user without password may hold the new name: the renamed user replaces it
+		if _, err := tx.Exec(`DELETE FROM users WHERE name = ?`, newName); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET name = ? WHERE name = ?`, newName, oldName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// KnownUsers returns the names of the users, of the users with a session, and of the participants of conversations.
+func (db *appdbimpl) KnownUsers() ([]string, error) {
+	rows, err := db.c.Query(`SELECT name FROM users UNION SELECT username FROM sessions
+		UNION SELECT username FROM participants ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// UserRenamedAt returns when a user was last renamed away from name, or the zero time if no user was.
+func (db *appdbimpl) UserRenamedAt(name string) (time.Time, error) {
+	var ts int64
+	err := db.c.QueryRow(`SELECT renamed_at FROM renamed_users WHERE name = ?`, name).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts).UTC(), nil
+}
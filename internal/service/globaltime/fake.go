@@ -0,0 +1,91 @@
+package globaltime
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock for tests: its time changes only with Advance. Like a time.Ticker, a ticker of a Fake drops the
+// ticks that its reader misses, so it ticks once however far Advance moves past its next tick. A Fake is safe for
+// concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast when the tickers change
+	now     time.Time
+	tickers map[*fakeTicker]struct{}
+}
+
+// NewFake returns a Fake clock set to t.
+func NewFake(t time.Time) *Fake {
+	f := &Fake{now: t, tickers: map[*fakeTicker]struct{}{}}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time of the clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d, and ticks the tickers whose next tick is due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	for t := range f.tickers {
+		if t.next.After(f.now) {
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		// The next tick is the first one after now, as the ticks in between are dropped
+		t.next = t.next.Add((f.now.Sub(t.next)/t.period + 1) * t.period)
+	}
+}
+
+// NewTicker returns a ticker that ticks when Advance moves the clock past d, 2d, ... from now.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), period: d, next: f.now.Add(d)}
+	f.tickers[t] = struct{}{}
+	f.changed.Broadcast()
+	return t
+}
+
+// WaitForTickers blocks until the clock has at least n tickers running. Tests call it before Advance, so that the
+// goroutines that create tickers don't miss the tick.
+func (f *Fake) WaitForTickers(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.tickers) < n {
+		f.changed.Wait()
+	}
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.tickers, t)
+	t.clock.changed.Broadcast()
+}
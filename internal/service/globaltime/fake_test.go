@@ -0,0 +1,50 @@
+package globaltime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	clock := NewFake(t0)
+	ticker := clock.NewTicker(time.Minute)
+	ticked := func() (time.Time, bool) {
+		select {
+		case tick := <-ticker.C():
+			return tick, true
+		default:
+			return time.Time{}, false
+		}
+	}
+
+	clock.Advance(59 * time.Second)
+	if _, ok := ticked(); ok || !clock.Now().Equal(t0.Add(59*time.Second)) {
+		t.Errorf("before the first tick: ticked %v at %v", ok, clock.Now())
+	}
+	clock.Advance(time.Second)
+	if tick, ok := ticked(); !ok || !tick.Equal(t0.Add(time.Minute)) {
+		t.Errorf("first tick: got %v, %v", tick, ok)
+	}
+
+	// The ticks missed by the reader are dropped, and the next one is the first after now
+	clock.Advance(150 * time.Second)
+	clock.Advance(time.Second)
+	if tick, ok := ticked(); !ok || !tick.Equal(t0.Add(210*time.Second)) {
+		t.Errorf("tick after missed ones: got %v, %v", tick, ok)
+	}
+	if _, ok := ticked(); ok {
+		t.Error("the missed ticks were kept")
+	}
+	clock.Advance(29 * time.Second)
+	if _, ok := ticked(); !ok {
+		t.Error("no tick at 4 minutes")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	if _, ok := ticked(); ok {
+		t.Error("a stopped ticker ticked")
+	}
+	clock.WaitForTickers(0)
+}
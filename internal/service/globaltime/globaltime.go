@@ -1,21 +1,51 @@
+/*
+Package globaltime is the clock of the server. Code that needs the current time, or needs to wake up periodically,
+takes a Clock instead of calling the time package: System in production, and a Fake in tests, which stands still until
+the test moves it.
+*/
 package globaltime
 
 import "time"
 
-// FixedTime represent a fixed moment in time. Set this variable to anything different from the default value for
-// time.Time and the value will be returned in Now() function in place of the current time
-var FixedTime time.Time
+// Clock tells the time, and ticks.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
 
-// Now returns the current time (time.Now()) if no FixedTime has been set. Otherwise, it returns FixedTime.
-// Use this in place of time.Now() to allow testing w/ custom time.
-func Now() time.Time {
-	if FixedTime.After(time.Time{}) {
-		return FixedTime
-	}
+	// NewTicker returns a ticker sending the time on its channel every d, like time.NewTicker. It panics if d <= 0.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	// C returns the channel of the ticks.
+	C() <-chan time.Time
+
+	// Stop turns the ticker off. The channel isn't closed.
+	Stop()
+}
+
+// System is the clock of the operating system.
+type System struct{}
+
+// Now returns time.Now().
+func (System) Now() time.Time {
 	return time.Now()
 }
 
-// Since returns the time passed since the parameter tm.
-func Since(tm time.Time) time.Duration {
-	return Now().Sub(tm)
+// NewTicker returns a time.Ticker.
+func (System) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
 }
@@ -0,0 +1,520 @@
+/*
+Package wal keeps a state on disk as snapshots and write-ahead logs, in a directory. The state is owned by the caller:
+this package stores its records and snapshots as opaque bytes.
+
+Records are appended to the current log segment, framed with their length and CRC-32C checksum. Rotate starts a new
+segment, and WriteSnapshot saves the state as it was at the beginning of a segment, then deletes what it makes
+obsolete: taking snapshots compacts the log. The directory holds:
+
+	wal-<generation>.log        records appended since the snapshot of the same generation
+	snapshot-<generation>       the state at the beginning of the segment of the same generation
+
+On startup, Load restores the latest snapshot and replays the records of the segments that follow it. A record cut
+short at the end of the last segment, as left by a crash in the middle of a write, is dropped; a damaged record
+anywhere else fails with ErrCorrupted.
+
+Records are flushed to disk according to a SyncPolicy. With SyncAlways, concurrent appends share their flushes: a
+caller appends under its own lock, to keep records in the order of its changes, then waits for Commit without it.
+*/
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy selects when appended records are flushed to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every record before Commit returns: committed records survive a crash of the machine
+	SyncAlways SyncPolicy = "always"
+
+	// SyncInterval flushes records every Options.SyncInterval: a crash of the machine loses at most the last interval
+	SyncInterval SyncPolicy = "interval"
+
+	// SyncNever leaves flushing to the operating system. Records survive a crash of the process, not of the machine.
+	SyncNever SyncPolicy = "never"
+)
+
+// DefaultSyncInterval is the flush interval of SyncInterval when Options.SyncInterval is zero.
+const DefaultSyncInterval = time.Second
+
+// MaxRecordSize is the size of the largest record.
+const MaxRecordSize = 64 << 20
+
+// headerSize is the size of the frame of a record: its length and its checksum, little-endian.
+const headerSize = 8
+
+// ErrCorrupted is returned by Load when the files are damaged beyond a torn write at the end of the log.
+var ErrCorrupted = errors.New("corrupted log")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a Log. The zero value flushes every record.
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// Recovery describes what Load found.
+type Recovery struct {
+	// Snapshot is the generation of the snapshot restored, zero if there was none
+	Snapshot uint64
+
+	// Records is the number of records replayed
+	Records int
+
+	// Dropped is the size of the torn record dropped from the end of the log, zero if there was none
+	Dropped int64
+}
+
+// Log is a directory of snapshots and log segments. Its methods are safe for concurrent use.
+type Log struct {
+	dir  string
+	opts Options
+
+	// syncMu serializes flushes; it's acquired before mu
+	syncMu sync.Mutex
+	synced uint64 // last record on disk
+
+	mu      sync.Mutex
+	f       *os.File // current segment, nil until Load and after Close
+	gen     uint64   // generation of f
+	written uint64   // last record written to f
+	err     error    // first write error: the segment may end with a partial record, so no more records are taken
+
+	// snapshotMu serializes WriteSnapshot
+	snapshotMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open returns the log in dir, creating the directory if needed. Load must be called before appending records.
+func Open(dir string, opts Options) (*Log, error) {
+	switch opts.Sync {
+	case "":
+		opts.Sync = SyncAlways
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", opts.Sync)
+	}
+	if opts.SyncInterval < 0 {
+		return nil, errors.New("the sync interval can't be negative")
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating the log directory: %w", err)
+	}
+	return &Log{dir: dir, opts: opts}, nil
+}
+
+/* files */
+
+func (l *Log) segmentPath(gen uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("wal-%016d.log", gen))
+}
+
+func (l *Log) snapshotPath(gen uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("snapshot-%016d", gen))
+}
+
+// list returns the generations of the segments and of the snapshots in the directory, in increasing order. It
+// removes the temporary files left by an interrupted WriteSnapshot.
+func (l *Log) list() (segments, snapshots []uint64, err error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the log directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			if err := os.Remove(filepath.Join(l.dir, name)); err != nil {
+				return nil, nil, err
+			}
+		case strings.HasPrefix(name, "wal-") && strings.HasSuffix(name, ".log"):
+			if gen, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"), 10, 64); err == nil {
+				segments = append(segments, gen)
+			}
+		case strings.HasPrefix(name, "snapshot-"):
+			if gen, err := strconv.ParseUint(strings.TrimPrefix(name, "snapshot-"), 10, 64); err == nil {
+				snapshots = append(snapshots, gen)
+			}
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	return segments, snapshots, nil
+}
+
+// syncDir flushes the entries of the directory, so that created, renamed and deleted files survive a crash.
+func (l *Log) syncDir() error {
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+/* loading */
+
+// Load calls restore with the latest snapshot, if any, then replay with every record logged after it, in order.
+// Then the log takes new records. A record torn at the end of the log is dropped, and reported in the Recovery.
+func (l *Log) Load(restore func(io.Reader) error, replay func([]byte) error) (Recovery, error) {
+	var rec Recovery
+	l.mu.Lock()
+	loaded := l.f != nil
+	l.mu.Unlock()
+	if loaded {
+		return rec, errors.New("the log is already loaded")
+	}
+
+	segments, snapshots, err := l.list()
+	if err != nil {
+		return rec, err
+	}
+	if len(snapshots) > 0 {
+		rec.Snapshot = snapshots[len(snapshots)-1]
+		if err := l.restore(rec.Snapshot, restore); err != nil {
+			return rec, err
+		}
+	}
+
+	// The segments from the one of the snapshot on must follow one another. Older ones were left by an interrupted
+	// WriteSnapshot.
+	first := rec.Snapshot
+	if first == 0 {
+		first = 1
+	}
+	var replayed []uint64
+	for _, gen := range segments {
+		if gen < first {
+			continue
+		}
+		if want := first + uint64(len(replayed)); gen != want {
+			return rec, fmt.Errorf("%w: segment %d is missing", ErrCorrupted, want)
+		}
+		replayed = append(replayed, gen)
+	}
+	for i, gen := range replayed {
+		n, dropped, err := l.replay(gen, i == len(replayed)-1, replay)
+		rec.Records += n
+		rec.Dropped += dropped
+		if err != nil {
+			return rec, err
+		}
+	}
+
+	gen := first
+	if len(replayed) > 0 {
+		gen = replayed[len(replayed)-1]
+	}
+	f, err := os.OpenFile(l.segmentPath(gen), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return rec, fmt.Errorf("opening the log: %w", err)
+	}
+	if err := l.syncDir(); err != nil {
+		_ = f.Close()
+		return rec, fmt.Errorf("opening the log: %w", err)
+	}
+	l.mu.Lock()
+	l.f, l.gen = f, gen
+	l.mu.Unlock()
+
+	if l.opts.Sync == SyncInterval {
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go l.syncLoop()
+	}
+	return rec, nil
+}
+
+func (l *Log) restore(gen uint64, restore func(io.Reader) error) error {
+	f, err := os.Open(l.snapshotPath(gen))
+	if err != nil {
+		return fmt.Errorf("opening snapshot %d: %w", gen, err)
+	}
+	defer f.Close()
+	if err := restore(bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("restoring snapshot %d: %w", gen, err)
+	}
+	return nil
+}
+
+// replay replays the records of a segment. If it's the last one, a torn record at its end is truncated away.
+func (l *Log) replay(gen uint64, last bool, replay func([]byte) error) (records int, dropped int64, err error) {
+	path := l.segmentPath(gen)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading segment %d: %w", gen, err)
+	}
+	offset := 0
+	for offset < len(data) {
+		payload, ok := decodeRecord(data[offset:])
+		if !ok {
+			if !last || !tornTail(data[offset:]) {
+				return records, 0, fmt.Errorf("%w: segment %d, offset %d", ErrCorrupted, gen, offset)
+			}
+			if err := os.Truncate(path, int64(offset)); err != nil {
+				return records, 0, fmt.Errorf("truncating segment %d: %w", gen, err)
+			}
+			return records, int64(len(data) - offset), nil
+		}
+		if err := replay(payload); err != nil {
+			return records, 0, fmt.Errorf("replaying segment %d, offset %d: %w", gen, offset, err)
+		}
+		records++
+		offset += headerSize + len(payload)
+	}
+	return records, 0, nil
+}
+
+// decodeRecord returns the payload of the record at the beginning of data, and whether it's whole and intact.
+func decodeRecord(data []byte) ([]byte, bool) {
+	if len(data) < headerSize {
+		return nil, false
+	}
+	size := binary.LittleEndian.Uint32(data[0:4])
+	if size == 0 || size > MaxRecordSize || uint64(len(data)-headerSize) < uint64(size) {
+		return nil, false
+	}
+	payload := data[headerSize : headerSize+int(size)]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:8]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// tornTail reports whether data, which starts with a damaged record, is what an interrupted write leaves: a record
+// that is cut short or that ends the file, or zeros that the file system allocated without writing them.
+func tornTail(data []byte) bool {
+	if len(data) < headerSize {
+		return true
+	}
+	if size := binary.LittleEndian.Uint32(data[0:4]); size > 0 && uint64(len(data)-headerSize) <= uint64(size) {
+		return true
+	}
+	return len(bytes.Trim(data, "\x00")) == 0
+}
+
+/* appending */
+
+// Append writes a record to the log, and returns its position, to be passed to Commit. Records are replayed in the
+// order they are appended. After a failed write, the log takes no more records.
+func (l *Log) Append(record []byte) (uint64, error) {
+	if len(record) == 0 || len(record) > MaxRecordSize {
+		return 0, fmt.Errorf("records must be between 1 and %d bytes long", MaxRecordSize)
+	}
+	frame := make([]byte, headerSize+len(record))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(record, crcTable))
+	copy(frame[headerSize:], record)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.err != nil:
+		return 0, l.err
+	case l.f == nil:
+		return 0, errors.New("the log is not open")
+	}
+	if _, err := l.f.Write(frame); err != nil {
+		l.err = fmt.Errorf("writing to the log: %w", err)
+		return 0, l.err
+	}
+	l.written++
+	return l.written, nil
+}
+
+// Commit waits until the record at position lsn is on disk, with SyncAlways. With the other policies, it returns
+// immediately. Records appended meanwhile, by any caller, are flushed together.
+func (l *Log) Commit(lsn uint64) error {
+	if l.opts.Sync != SyncAlways {
+		return nil
+	}
+	return l.sync(lsn)
+}
+
+// sync flushes the current segment if the record at position lsn isn't on disk yet.
+func (l *Log) sync(lsn uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	if l.synced >= lsn {
+		return nil
+	}
+	l.mu.Lock()
+	f, written, err := l.f, l.written, l.err
+	l.mu.Unlock()
+	switch {
+	case err != nil:
+		return err
+	case f == nil:
+		return errors.New("the log is not open")
+	}
+	// Rotate and Close hold syncMu too: f can't be closed while flushing
+	if err := f.Sync(); err != nil {
+		l.mu.Lock()
+		if l.err == nil {
+			l.err = fmt.Errorf("flushing the log: %w", err)
+		}
+		err = l.err
+		l.mu.Unlock()
+		return err
+	}
+	l.synced = written
+	return nil
+}
+
+func (l *Log) syncLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			written := l.written
+			l.mu.Unlock()
+			// A failure is reported to the next Append
+			_ = l.sync(written)
+		}
+	}
+}
+
+/* snapshots */
+
+// Rotate flushes and closes the current segment, starts a new one, and returns its generation. A snapshot of that
+// generation must hold the state as it was before the first record of the new segment, so records must not be
+// appended between capturing the state and rotating.
+func (l *Log) Rotate() (uint64, error) {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.err != nil:
+		return 0, l.err
+	case l.f == nil:
+		return 0, errors.New("the log is not open")
+	}
+	if err := l.f.Sync(); err != nil {
+		l.err = fmt.Errorf("flushing the log: %w", err)
+		return 0, l.err
+	}
+	l.synced = l.written
+	f, err := os.OpenFile(l.segmentPath(l.gen+1), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("creating a log segment: %w", err)
+	}
+	if err := l.syncDir(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return 0, fmt.Errorf("creating a log segment: %w", err)
+	}
+	if err := l.f.Close(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return 0, fmt.Errorf("closing a log segment: %w", err)
+	}
+	l.f = f
+	l.gen++
+	return l.gen, nil
+}
+
+// WriteSnapshot saves the snapshot of generation gen, returned by Rotate, with write. Once it's on disk, the older
+// snapshots and segments are deleted. A crash in the middle leaves the previous snapshot in place.
+func (l *Log) WriteSnapshot(gen uint64, write func(io.Writer) error) error {
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+
+	path := l.snapshotPath(gen)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating snapshot %d: %w", gen, err)
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = l.syncDir()
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("writing snapshot %d: %w", gen, err)
+	}
+
+	// The new snapshot replaces everything before its segment
+	segments, snapshots, err := l.list()
+	if err != nil {
+		return err
+	}
+	for _, g := range segments {
+		if g < gen {
+			if err := os.Remove(l.segmentPath(g)); err != nil {
+				return fmt.Errorf("compacting the log: %w", err)
+			}
+		}
+	}
+	for _, g := range snapshots {
+		if g < gen {
+			if err := os.Remove(l.snapshotPath(g)); err != nil {
+				return fmt.Errorf("compacting the log: %w", err)
+			}
+		}
+	}
+	return l.syncDir()
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	if err != nil {
+		return fmt.Errorf("closing the log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// load loads the log in dir, and returns its snapshot and records.
+func load(t *testing.T, dir string) (*Log, string, []string, Recovery, error) {
+	t.Helper()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot string
+	var records []string
+	rec, err := l.Load(func(r io.Reader) error {
+		data, err := io.ReadAll(r)
+		snapshot = string(data)
+		return err
+	}, func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	return l, snapshot, records, rec, err
+}
+
+func appendAll(t *testing.T, l *Log, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		lsn, err := l.Append([]byte(r))
+		if err == nil {
+			err = l.Commit(lsn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, _, records, _, err := load(t, dir)
+	if err != nil || records != nil {
+		t.Fatalf("loading an empty log: got %v, %v", records, err)
+	}
+	appendAll(t, l, "one", "two")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, _, records, _, err = load(t, dir)
+	if err != nil || !reflect.DeepEqual(records, []string{"one", "two"}) {
+		t.Fatalf("replaying: got %v, %v", records, err)
+	}
+	appendAll(t, l, "three")
+	_ = l.Close()
+	_, _, records, _, _ = load(t, dir)
+	if !reflect.DeepEqual(records, []string{"one", "two", "three"}) {
+		t.Errorf("replaying after appending again: got %v", records)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _, _, _ := load(t, dir)
+	appendAll(t, l, "one", "two")
+	gen, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, "three")
+	err = l.WriteSnapshot(gen, func(w io.Writer) error {
+		_, err := io.WriteString(w, "one+two")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	// The snapshot replaces the first segment
+	if _, err := os.Stat(l.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("the first segment is still there: %v", err)
+	}
+	_, snapshot, records, rec, err := load(t, dir)
+	if err != nil || snapshot != "one+two" || !reflect.DeepEqual(records, []string{"three"}) || rec.Snapshot != gen {
+		t.Errorf("loading a snapshot: got %q, %v, %+v, %v", snapshot, records, rec, err)
+	}
+}
+
+// TestInterruptedSnapshot loads a log whose last snapshot wasn't written: the records of both segments are replayed.
+func TestInterruptedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _, _, _ := load(t, dir)
+	appendAll(t, l, "one")
+	if _, err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, "two")
+	_ = l.Close()
+	if err := os.WriteFile(filepath.Join(dir, "snapshot-0000000000000002.tmp"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, snapshot, records, _, err := load(t, dir)
+	if err != nil || snapshot != "" || !reflect.DeepEqual(records, []string{"one", "two"}) {
+		t.Errorf("loading after an interrupted snapshot: got %q, %v, %v", snapshot, records, err)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for name, damage := range map[string]func(data []byte) []byte{
+		"cut in the header":  func(data []byte) []byte { return data[:len(data)-len("three")-3] },
+		"cut in the payload": func(data []byte) []byte { return data[:len(data)-2] },
+		"bad checksum":       func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data },
+		"zeros":              func(data []byte) []byte { return append(data, make([]byte, 100)...) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _, _, _, _ := load(t, dir)
+			appendAll(t, l, "one", "two", "three")
+			_ = l.Close()
+			path := l.segmentPath(1)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = damage(data)
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			l, _, records, rec, err := load(t, dir)
+			if err != nil || rec.Dropped == 0 || len(records) < 2 || !reflect.DeepEqual(records[:2], []string{"one", "two"}) {
+				t.Fatalf("loading a torn log: got %v, %+v, %v", records, rec, err)
+			}
+			// The torn record is truncated away, so that new records follow the intact ones
+			appendAll(t, l, "four")
+			_ = l.Close()
+			_, _, after, rec, err := load(t, dir)
+			if err != nil || rec.Dropped != 0 || !reflect.DeepEqual(after, append(records, "four")) {
+				t.Errorf("loading after a repair: got %v, %+v, %v", after, rec, err)
+			}
+		})
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _, _, _ := load(t, dir)
+	appendAll(t, l, "one", "two", "three")
+	_ = l.Close()
+	path := l.segmentPath(1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first record is followed by intact ones: it wasn't torn by a crash
+	data[headerSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := load(t, dir); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("loading a corrupted log: got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestMissingSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _, _, _ := load(t, dir)
+	appendAll(t, l, "one")
+	for i := 0; i < 2; i++ {
+		if _, err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		appendAll(t, l, "more")
+	}
+	_ = l.Close()
+	if err := os.Remove(l.segmentPath(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := load(t, dir); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("loading a log with a missing segment: got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	if _, err := Open(t.TempDir(), Options{Sync: "sometimes"}); err == nil {
+		t.Error("opening with an unknown sync policy: no error")
+	}
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{Sync: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Load(func(io.Reader) error { return nil }, func([]byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		appendAll(t, l, "one")
+		if err := l.Close(); err != nil {
+			t.Errorf("%s: closing: %v", policy, err)
+		}
+		if _, _, records, _, _ := load(t, dir); len(records) != 1 {
+			t.Errorf("%s: got %v after closing", policy, records)
+		}
+	}
+}
@@ -1,7 +0,0 @@
-package main
-
-import "github.com/mlatsa/WASAProject/cmd/webapi"
-
-func main() {
-    webapi.Main()
-}
@@ -0,0 +1,263 @@
+/*
+Package client is a Go client of the WASAText API described in doc/api.yaml. Models are the ones of service/api/types,
+which the server uses too, so that they stay in sync with it.
+
+A Client logs in once, and then sends the bearer token with every request:
+
+	c, err := client.New(client.Config{BaseURL: "http://localhost:3000"})
+	if err != nil {
+		return err
+	}
+	if err := c.Login(ctx, "alice", ""); err != nil {
+		return err
+	}
+	msg, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "hello"})
+
+Every operation of the API has a method, whose request and response bodies are the types of service/api/types. That
+package depends on the standard library only, so the client doesn't pull in the server. Errors returned by the API are
+of type *Error, and match the sentinel errors of this package with errors.Is:
+
+	if errors.Is(err, client.ErrNotFound) {
+		...
+	}
+
+Idempotent calls (GET, PUT and DELETE) are retried on network errors, rate limits and unavailable servers, as
+configured by Config.Retry. Live updates are received with Subscribe, which reconnects to the event stream as needed.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures a Client.
+type Config struct {
+	// BaseURL is the URL of the API, e.g. "http://localhost:3000"
+	BaseURL string
+
+	// HTTPClient sends the requests. Nil means http.DefaultClient. It must not have a timeout shorter than the event
+	// streams, if Subscribe is used: use contexts for the deadlines of the other calls.
+	HTTPClient *http.Client
+
+	// Token is the bearer token of a previous login, if any
+	Token string
+
+	// AdminToken is the token of the administration routes, if any
+	AdminToken string
+
+	// Retry configures the retries of idempotent calls. The zero value means DefaultRetry.
+	Retry RetryPolicy
+}
+
+// RetryPolicy configures how failed idempotent calls are retried. The delay doubles after each attempt, from
+// MinBackoff up to MaxBackoff, unless the server asks for a longer one with a Retry-After header.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one: 1 disables retries
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetry is the retry policy used when Config.Retry is not set.
+var DefaultRetry = RetryPolicy{MaxAttempts: 3, MinBackoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second}
+
+// Client calls the API. It's safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	http       *http.Client
+	adminToken string
+	retry      RetryPolicy
+
+	mu    sync.Mutex
+	token string
+}
+
+// New returns a Client for the API at cfg.BaseURL.
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: the scheme must be http or https", cfg.BaseURL)
+	}
+	c := &Client{base: base, http: cfg.HTTPClient, adminToken: cfg.AdminToken, retry: cfg.Retry, token: cfg.Token}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	if c.retry == (RetryPolicy{}) {
+		c.retry = DefaultRetry
+	}
+	if c.retry.MaxAttempts < 1 {
+		c.retry.MaxAttempts = 1
+	}
+	if c.retry.MinBackoff <= 0 {
+		c.retry.MinBackoff = DefaultRetry.MinBackoff
+	}
+	if c.retry.MaxBackoff < c.retry.MinBackoff {
+		c.retry.MaxBackoff = c.retry.MinBackoff
+	}
+	return c, nil
+}
+
+// Token returns the bearer token sent with the requests, empty before the login.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// SetToken changes the bearer token sent with the requests.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// call is a request to the API. body is encoded as JSON, unless it's an io.Reader, sent as is with contentType.
+type call struct {
+	method      string
+	path        string
+	query       url.Values
+	body        interface{}
+	contentType string
+
+	// admin sends the admin token instead of the session one
+	admin bool
+}
+
+// idempotent reports whether the call can be sent again without side effects.
+func (cl *call) idempotent() bool {
+	switch cl.method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// request builds the HTTP request of cl. Readers can't be sent twice, so calls with one are never retried.
+func (c *Client) request(ctx context.Context, cl *call) (*http.Request, error) {
+	u := *c.base
+	u.Path += cl.path
+	u.RawQuery = cl.query.Encode()
+
+	var rd io.Reader
+	contentType := cl.contentType
+	switch body := cl.body.(type) {
+	case nil:
+	case io.Reader:
+		rd = body
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, cl.method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	token := c.Token()
+	if cl.admin {
+		token = c.adminToken
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// send sends cl, retrying it if it's idempotent. The response has a 2xx status: other statuses are returned as
+// *Error.
+func (c *Client) send(ctx context.Context, cl *call) (*http.Response, error) {
+	_, isReader := cl.body.(io.Reader)
+	attempts := 1
+	if cl.idempotent() && !isReader {
+		attempts = c.retry.MaxAttempts
+	}
+	backoff := c.retry.MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		req, err := c.request(ctx, cl)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			err = decodeError(resp)
+			_ = resp.Body.Close()
+		}
+		if attempt >= attempts || !retryable(ctx, err) {
+			return nil, err
+		}
+
+		delay := backoff
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		if backoff *= 2; backoff > c.retry.MaxBackoff {
+			backoff = c.retry.MaxBackoff
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed call may succeed if sent again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// Network errors: the server may not have received the request, or may be restarting
+	return true
+}
+
+// do sends a call, and decodes the JSON response in out unless it's nil.
+func (c *Client) do(ctx context.Context, cl *call, out interface{}) error {
+	resp, err := c.send(ctx, cl)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding the response of %s %s: %w", cl.method, cl.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/service/api"
+	"github.com/mlatsa/WASAProject/service/api/types"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const testAdminToken = "client-test-admin-token"
+
+// newTestClient returns a client of a new server, not logged in.
+func newTestClient(t *testing.T, cfg api.Config) *Client {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Logger = logger
+	cfg.AdminToken = testAdminToken
+	rt, err := api.New(cfg)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	srv := httptest.NewServer(rt.Handler())
+	t.Cleanup(srv.Close)
+
+	c, err := New(Config{BaseURL: srv.URL, HTTPClient: srv.Client(), AdminToken: testAdminToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// specOperationIDs returns the operationIds of doc/api.yaml.
+func specOperationIDs(t *testing.T) []string {
+	t.Helper()
+	data, err := os.ReadFile("../../doc/api.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			OperationID string `yaml:"operationId"`
+		} `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, methods := range spec.Paths {
+		for _, op := range methods {
+			if op.OperationID != "" {
+				ids = append(ids, op.OperationID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TestOperations calls every operation of doc/api.yaml against a live server.
+func TestOperations(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, api.Config{
+		EventStreamTTL: 50 * time.Millisecond,
+		Scheduler:      api.SchedulerConfig{Interval: time.Hour},
+		MediaDir:       t.TempDir(),
+		MediaURL:       "https://media.example.com/files/",
+	})
+	if err := c.Login(ctx, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second)
+	msg, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "lunch tomorrow?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other logs in too, to have sessions to end
+	other, err := New(Config{BaseURL: c.base.String(), HTTPClient: c.http})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations := map[string]func() error{
+		"getHealth": func() error {
+			h, err := c.Health(ctx)
+			if err == nil && h.Status != "ok" {
+				t.Errorf("got status %q", h.Status)
+			}
+			return err
+		},
+		"doLogin": func() error { return c.Login(ctx, "alice", "") },
+		"doLogout": func() error {
+			if err := other.Login(ctx, "alice", ""); err != nil {
+				return err
+			}
+			return other.Logout(ctx)
+		},
+		"getMySessions": func() error {
+			sessions, err := c.Sessions(ctx)
+			if err == nil && len(sessions) == 0 {
+				t.Error("got no sessions")
+			}
+			return err
+		},
+		"revokeSession": func() error {
+			if err := other.Login(ctx, "alice", ""); err != nil {
+				return err
+			}
+			sessions, err := c.Sessions(ctx)
+			if err != nil {
+				return err
+			}
+			for _, s := range sessions {
+				if !s.Current {
+					return c.RevokeSession(ctx, s.ID)
+				}
+			}
+			return errors.New("no other session to revoke")
+		},
+		"setMyUserName": func() error { return c.SetMyUserName(ctx, "alice") },
+		"setMyPhoto":    func() error { return c.SetMyPhoto(ctx, "https://example.com/alice.png") },
+		"getMyConversations": func() error {
+			convs, err := c.Conversations(ctx)
+			if err == nil && len(convs) == 0 {
+				t.Errorf("got conversations %+v", convs)
+			}
+			return err
+		},
+		"getConversation": func() error {
+			conv, err := c.Conversation(ctx, "chat1")
+			if err == nil && (len(conv.Messages) != 1 || conv.Messages[0].MessageID != msg.MessageID) {
+				t.Errorf("got conversation %+v", conv)
+			}
+			return err
+		},
+		"sendMessage": func() error {
+			_, err := c.SendMessage(ctx, "chat2", types.SendMessageInput{Content: "https://example.com/cat.png", Type: "image"})
+			return err
+		},
+		"searchMessages": func() error {
+			res, err := c.SearchMessages(ctx, SearchOptions{Query: "lunch", Limit: 5})
+			if err == nil && (len(res.Results) == 0 || res.Results[0].Message.Content != "lunch tomorrow?") {
+				t.Errorf("got results %+v", res.Results)
+			}
+			return err
+		},
+		"searchConversation": func() error {
+			_, err := c.SearchConversation(ctx, "chat1", SearchOptions{Query: "lunch"})
+			return err
+		},
+		"exportConversation": func() error {
+			export, err := c.ExportConversation(ctx, "chat1", "txt")
+			if err != nil {
+				return err
+			}
+			defer export.Close()
+			data, err := io.ReadAll(export)
+			if err == nil && !strings.Contains(string(data), "alice: lunch tomorrow?") {
+				t.Errorf("got export %q", data)
+			}
+			return err
+		},
+		"setConversationRetention": func() error {
+			if _, err := c.Conversation(ctx, "chat3"); err != nil {
+				return err
+			}
+			policy := types.RetentionPolicy{Mode: types.RetentionDisappearing, Hours: 24}
+			got, err := c.SetConversationRetention(ctx, "chat3", policy)
+			if err == nil && *got != policy {
+				t.Errorf("got retention policy %+v", got)
+			}
+			return err
+		},
+		"cancelScheduledMessage": func() error {
+			sm, err := c.ScheduleMessage(ctx, "chat1", types.SendMessageInput{Content: "never mind"}, tomorrow)
+			if err != nil {
+				return err
+			}
+			return c.CancelScheduledMessage(ctx, sm.ScheduledID)
+		},
+		"getMyScheduledMessages": func() error {
+			sm, err := c.ScheduleMessage(ctx, "chat1", types.SendMessageInput{Content: "good morning"}, tomorrow)
+			if err != nil {
+				return err
+			}
+			list, err := c.ScheduledMessages(ctx)
+			if err == nil && (len(list) != 1 || list[0].ScheduledID != sm.ScheduledID || !list[0].SendAt.Equal(tomorrow)) {
+				t.Errorf("got scheduled messages %+v", list)
+			}
+			return err
+		},
+		"getEvents": func() error {
+			stream, err := c.Events(ctx, 0)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			if _, err := stream.Next(); err != io.EOF {
+				t.Errorf("got %v from an idle stream, want io.EOF", err)
+			}
+			return nil
+		},
+		"forwardMessage": func() error {
+			fwd, err := c.ForwardMessage(ctx, msg.MessageID, "chat2")
+			if err == nil && fwd.ForwardedFrom != msg.MessageID {
+				t.Errorf("got forwardedFrom %q", fwd.ForwardedFrom)
+			}
+			return err
+		},
+		"commentMessage": func() error {
+			rx, err := c.React(ctx, msg.MessageID, "👍")
+			if err == nil && (rx.Emoji != "👍" || rx.ReactionID == "") {
+				t.Errorf("got reaction %+v", rx)
+			}
+			return err
+		},
+		"uncommentMessage": func() error {
+			rx, err := c.React(ctx, msg.MessageID, "🎉")
+			if err != nil {
+				return err
+			}
+			return c.Unreact(ctx, msg.MessageID, rx.ReactionID)
+		},
+		"deleteMessage": func() error {
+			m, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "oops"})
+			if err != nil {
+				return err
+			}
+			return c.DeleteMessage(ctx, m.MessageID)
+		},
+		"pinMessage": func() error {
+			pin, err := c.PinMessage(ctx, msg.MessageID)
+			if err == nil && (pin.MessageID != msg.MessageID || pin.PinnedBy != "alice") {
+				t.Errorf("got pin %+v", pin)
+			}
+			return err
+		},
+		"unpinMessage": func() error {
+			m, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "for a while"})
+			if err != nil {
+				return err
+			}
+			if _, err := c.PinMessage(ctx, m.MessageID); err != nil {
+				return err
+			}
+			return c.UnpinMessage(ctx, m.MessageID)
+		},
+		"starMessage": func() error { return c.StarMessage(ctx, msg.MessageID) },
+		"unstarMessage": func() error {
+			if err := c.StarMessage(ctx, msg.MessageID); err != nil {
+				return err
+			}
+			return c.UnstarMessage(ctx, msg.MessageID)
+		},
+		"getStarredMessages": func() error {
+			m, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "remember this"})
+			if err != nil {
+				return err
+			}
+			if err := c.StarMessage(ctx, m.MessageID); err != nil {
+				return err
+			}
+			list, err := c.StarredMessages(ctx)
+			if err == nil && (len(list) == 0 || list[0].Message.MessageID != m.MessageID) {
+				t.Errorf("got starred messages %+v", list)
+			}
+			return err
+		},
+		"uploadMedia": func() error {
+			u, err := c.UploadMedia(ctx, strings.NewReader("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png")
+			if err == nil && !strings.HasPrefix(u, "https://media.example.com/files/") {
+				t.Errorf("got media URL %q", u)
+			}
+			return err
+		},
+		"addToGroup":    func() error { return c.AddToGroup(ctx, "chat1", "bob") },
+		"leaveGroup":    func() error { return c.LeaveGroup(ctx, "chat2") },
+		"setGroupName":  func() error { return c.SetGroupName(ctx, "chat1", "Lunch") },
+		"setGroupPhoto": func() error { return c.SetGroupPhoto(ctx, "chat1", "https://example.com/lunch.png") },
+		"importConversation": func() error {
+			archive := "17/10/2026, 09:00 - Jane Doe: hello\n"
+			rep, err := c.ImportConversation(ctx, strings.NewReader(archive), ImportOptions{
+				Format:         "whatsapp",
+				ConversationID: "chat-imported",
+				Senders:        map[string]string{"Jane Doe": "alice"},
+			})
+			if err == nil && (rep.Messages != 1 || rep.ConversationID != "chat-imported") {
+				t.Errorf("got report %+v", rep)
+			}
+			return err
+		},
+		"backupDatabase": func() error {
+			// The server keeps its state in memory: it has no database to back up
+			if _, err := c.Backup(ctx); !errors.Is(err, ErrConflict) {
+				t.Errorf("got %v, want ErrConflict", err)
+			}
+			return nil
+		},
+	}
+
+	// Operations run in the order of their IDs, so some see the state left by the previous ones
+	for _, id := range specOperationIDs(t) {
+		call, ok := operations[id]
+		if !ok {
+			t.Errorf("operation %s is not covered", id)
+			continue
+		}
+		delete(operations, id)
+		if err := call(); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+	for id := range operations {
+		t.Errorf("operation %s is not in the spec", id)
+	}
+}
+
+// TestErrors checks that API errors are decoded, and match the sentinel errors.
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, api.Config{})
+
+	_, err := c.Conversations(ctx)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v without a session, want ErrUnauthorized", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.RequestID == "" {
+		t.Errorf("got %#v, want an *Error with a request ID", err)
+	}
+
+	err = c.Login(ctx, "a", "")
+	if !errors.Is(err, ErrValidation) || !errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for an invalid name, want a validation error", err)
+	}
+	if errors.As(err, &apiErr) && (len(apiErr.Details) != 1 || apiErr.Details[0].Field != "name") {
+		t.Errorf("got details %+v, want the name field", apiErr.Details)
+	}
+
+	if err := c.Login(ctx, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteMessage(ctx, "missing"); err != nil {
+		t.Errorf("deleting a missing message: %v", err)
+	}
+	if _, err := c.ForwardMessage(ctx, "missing", "chat1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v forwarding a missing message, want ErrNotFound", err)
+	}
+}
+
+// TestRetry checks that only idempotent calls are retried.
+func TestRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&calls, 1); n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"ok","conversations":[]}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c, err := New(Config{BaseURL: srv.URL, Retry: RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Health(ctx); err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want success after 3", err, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: "hi"}); !errors.Is(err, ErrServerError) || calls != 1 {
+		t.Errorf("got %v after %d calls, want a server error after 1", err, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	c.retry.MaxAttempts = 2
+	if _, err := c.Conversations(ctx); !errors.Is(err, ErrServerError) || calls != 2 {
+		t.Errorf("got %v after %d calls, want a server error after 2", err, calls)
+	}
+}
+
+// TestSubscribe checks that events keep arriving across the streams ended by the server: the second message is sent
+// between two streams, and received when the client reconnects.
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, api.Config{EventStreamTTL: 300 * time.Millisecond})
+	if err := c.Login(ctx, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan types.Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Subscribe(ctx, 0, func(e types.Event) error {
+			received <- e
+			if len(received) == 2 {
+				return io.EOF
+			}
+			return nil
+		})
+	}()
+
+	for _, content := range []string{"first", "second"} {
+		time.Sleep(200 * time.Millisecond)
+		if _, err := c.SendMessage(ctx, "chat1", types.SendMessageInput{Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != io.EOF {
+		t.Fatalf("Subscribe returned %v, want the error of the handler", err)
+	}
+	close(received)
+	var contents []string
+	for e := range received {
+		if e.Type == types.EventMessageCreated {
+			contents = append(contents, e.Message.Content)
+		}
+	}
+	if got := strings.Join(contents, " "); got != "first second" {
+		t.Errorf("got messages %q", got)
+	}
+
+	c.SetToken("")
+	if err := c.Subscribe(ctx, 0, func(types.Event) error { return nil }); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v without a session, want ErrUnauthorized", err)
+	}
+}
+
+// TestImports checks that the client and its models import the standard library only, so that programs using the
+// client don't pull in the server and its dependencies.
+func TestImports(t *testing.T) {
+	const typesPackage = "github.com/mlatsa/WASAProject/service/api/types"
+	for _, dir := range []string{".", "../../service/api/types"} {
+		pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(fi fs.FileInfo) bool {
+			return !strings.HasSuffix(fi.Name(), "_test.go")
+		}, parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pkg := range pkgs {
+			for name, f := range pkg.Files {
+				for _, imp := range f.Imports {
+					path, _ := strconv.Unquote(imp.Path.Value)
+					if path != typesPackage && strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+						t.Errorf("%s imports %s", name, path)
+					}
+				}
+			}
+		}
+	}
+}
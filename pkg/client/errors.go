@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mlatsa/WASAProject/service/api/types"
+)
+
+// Errors matched by the errors returned by the API, with errors.Is. Other errors of the API, like unsupported media
+// types, are matched by none: see Error.StatusCode.
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrValidation      = errors.New("validation failed")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrNotFound        = errors.New("not found")
+	ErrConflict        = errors.New("conflict")
+	ErrPayloadTooLarge = errors.New("payload too large")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrServerError     = errors.New("server error")
+)
+
+// codeErrors maps the error codes of the API to the sentinel errors.
+var codeErrors = map[types.ErrorCode]error{
+	types.ErrCodeBadRequest:      ErrBadRequest,
+	types.ErrCodeValidation:      ErrValidation,
+	types.ErrCodeUnauthorized:    ErrUnauthorized,
+	types.ErrCodeForbidden:       ErrForbidden,
+	types.ErrCodeNotFound:        ErrNotFound,
+	types.ErrCodeConflict:        ErrConflict,
+	types.ErrCodePayloadTooLarge: ErrPayloadTooLarge,
+	types.ErrCodeTooManyRequests: ErrTooManyRequests,
+	types.ErrCodeInternal:        ErrServerError,
+}
+
+// statusErrors maps HTTP statuses to the sentinel errors, for the responses without an error code.
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrPayloadTooLarge,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+}
+
+// Error is an error returned by the API, decoded from its Error schema.
+type Error struct {
+	StatusCode int
+	Code       types.ErrorCode
+	Message    string
+	Details    []types.FieldError
+
+	// RequestID identifies the request in the server logs
+	RequestID string
+
+	// RetryAfter is the delay asked by the server before trying again, e.g. when rate limited
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+	for _, d := range e.Details {
+		msg += fmt.Sprintf("; %s: %s", d.Field, d.Message)
+	}
+	return msg
+}
+
+// Is matches the sentinel error of the code of e, or of its status if it has no code. Validation errors also match
+// ErrBadRequest, as they have the same status.
+func (e *Error) Is(target error) bool {
+	if target == ErrBadRequest && e.StatusCode == http.StatusBadRequest {
+		return true
+	}
+	if err, ok := codeErrors[e.Code]; ok {
+		return target == err
+	}
+	if err, ok := statusErrors[e.StatusCode]; ok {
+		return target == err
+	}
+	return target == ErrServerError && e.StatusCode >= 500
+}
+
+// decodeError converts an error response. Responses that don't follow the Error schema, e.g. from a proxy, keep the
+// HTTP status text as message.
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    http.StatusText(resp.StatusCode),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		apiErr.RetryAfter = time.Duration(s) * time.Second
+	}
+	var body struct {
+		Message   string             `json:"error"`
+		Code      types.ErrorCode    `json:"code"`
+		Details   []types.FieldError `json:"details"`
+		RequestID string             `json:"requestId"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && json.Unmarshal(data, &body) == nil && body.Message != "" {
+		apiErr.Code, apiErr.Message, apiErr.Details = body.Code, body.Message, body.Details
+		if body.RequestID != "" {
+			apiErr.RequestID = body.RequestID
+		}
+	}
+	return apiErr
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlatsa/WASAProject/service/api/types"
+)
+
+// maxEventSize is the longest event line accepted from the stream.
+const maxEventSize = 1 << 20
+
+// EventStream is a connection to GET /events. The server ends streams periodically: see Subscribe to keep receiving
+// events across reconnections.
+type EventStream struct {
+	body io.ReadCloser
+	sc   *bufio.Scanner
+
+	// lastID is the ID of the last event received, to resume the stream
+	lastID uint64
+
+	// retry is the reconnection delay suggested by the server, zero if none
+	retry time.Duration
+}
+
+// Events opens an event stream. If lastID is not zero, the stream starts with the events after lastID.
+func (c *Client) Events(ctx context.Context, lastID uint64) (*EventStream, error) {
+	req, err := c.request(ctx, &call{method: http.MethodGet, path: "/events"})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		return nil, decodeError(resp)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 4096), maxEventSize)
+	return &EventStream{body: resp.Body, sc: sc, lastID: lastID}, nil
+}
+
+// Next returns the next event. It returns io.EOF when the server ends the stream.
+func (s *EventStream) Next() (types.Event, error) {
+	var data strings.Builder
+	for s.sc.Scan() {
+		line := s.sc.Text()
+		if line == "" {
+			// End of the event: events without data (e.g., the retry hint) are not returned
+			if data.Len() == 0 {
+				continue
+			}
+			var e types.Event
+			if err := json.Unmarshal([]byte(data.String()), &e); err != nil {
+				return e, fmt.Errorf("decoding event: %w", err)
+			}
+			s.lastID = e.ID
+			return e, nil
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				s.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+		// Comments (empty field), and the id and event fields, which repeat the data, are ignored
+	}
+	if err := s.sc.Err(); err != nil {
+		return types.Event{}, err
+	}
+	return types.Event{}, io.EOF
+}
+
+// LastID returns the ID of the last event received, or the one the stream was opened with.
+func (s *EventStream) LastID() uint64 { return s.lastID }
+
+// Close closes the stream.
+func (s *EventStream) Close() error { return s.body.Close() }
+
+// Subscribe calls handle for every event, reconnecting when the stream ends or fails, until ctx is done or handle
+// returns an error. lastID is the ID of the last event already handled, zero to start from now. Resync events mean
+// that events were lost: the handler should reload its state.
+//
+// Streams ended by the server are reopened after the delay it suggests. Failed connections are retried with the
+// backoff of Config.Retry, without limit. API errors, like an expired session, are returned instead of retried,
+// except the ones of unavailable servers.
+func (c *Client) Subscribe(ctx context.Context, lastID uint64, handle func(types.Event) error) error {
+	delay := time.Second
+	backoff := c.retry.MinBackoff
+	for {
+		stream, err := c.Events(ctx, lastID)
+		if err != nil {
+			if !retryable(ctx, err) {
+				return err
+			}
+			var apiErr *Error
+			if errors.As(err, &apiErr) && apiErr.RetryAfter > backoff {
+				backoff = apiErr.RetryAfter
+			}
+			delay = backoff
+			if backoff *= 2; backoff > c.retry.MaxBackoff {
+				backoff = c.retry.MaxBackoff
+			}
+		} else {
+			backoff = c.retry.MinBackoff
+			for {
+				var e types.Event
+				if e, err = stream.Next(); err != nil {
+					break
+				}
+				if err := handle(e); err != nil {
+					_ = stream.Close()
+					return err
+				}
+			}
+			lastID = stream.LastID()
+			if stream.retry > 0 {
+				delay = stream.retry
+			}
+			_ = stream.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mlatsa/WASAProject/service/api/types"
+)
+
+// Health checks that the server is up (getHealth).
+func (c *Client) Health(ctx context.Context) (*types.Health, error) {
+	var out types.Health
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/health"}, &out)
+	return &out, err
+}
+
+// Login logs in as name and keeps the token for the next calls (doLogin). The password is needed only if the server
+// runs in password mode.
+func (c *Client) Login(ctx context.Context, name, password string) error {
+	var out types.LoginResponse
+	body := types.LoginBody{Name: name, Password: password}
+	if err := c.do(ctx, &call{method: http.MethodPost, path: "/session", body: body}, &out); err != nil {
+		return err
+	}
+	c.SetToken(out.Identifier)
+	return nil
+}
+
+// Logout ends the session, and forgets the token (doLogout).
+func (c *Client) Logout(ctx context.Context) error {
+	if err := c.do(ctx, &call{method: http.MethodDelete, path: "/session"}, nil); err != nil {
+		return err
+	}
+	c.SetToken("")
+	return nil
+}
+
+// Sessions returns the active sessions of the user (getMySessions).
+func (c *Client) Sessions(ctx context.Context) ([]types.SessionInfo, error) {
+	var out types.SessionList
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/sessions"}, &out)
+	return out.Sessions, err
+}
+
+// RevokeSession ends a session of the user, e.g. on a lost device (revokeSession).
+func (c *Client) RevokeSession(ctx context.Context, sessionID string) error {
+	return c.do(ctx, &call{method: http.MethodDelete, path: "/sessions/" + url.PathEscape(sessionID)}, nil)
+}
+
+// SetMyUserName renames the user (setMyUserName).
+func (c *Client) SetMyUserName(ctx context.Context, name string) error {
+	body := types.SetNameBody{Name: name}
+	return c.do(ctx, &call{method: http.MethodPut, path: "/user/username", body: body}, nil)
+}
+
+// SetMyPhoto changes the photo of the user (setMyPhoto).
+func (c *Client) SetMyPhoto(ctx context.Context, mediaURL string) error {
+	body := types.PhotoBody{MediaURL: mediaURL}
+	return c.do(ctx, &call{method: http.MethodPut, path: "/user/photo", body: body}, nil)
+}
+
+// Conversations returns the conversations of the user (getMyConversations).
+func (c *Client) Conversations(ctx context.Context) ([]*types.ConversationSummary, error) {
+	var out types.ConversationList
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/conversations"}, &out)
+	return out.Conversations, err
+}
+
+// Conversation returns a conversation with its messages (getConversation).
+func (c *Client) Conversation(ctx context.Context, id string) (*types.ConversationDTO, error) {
+	var out types.ConversationResponse
+	err := c.do(ctx, &call{method: http.MethodGet, path: conversationPath(id)}, &out)
+	return out.Conversation, err
+}
+
+// SendMessage sends a message to a conversation (sendMessage). An empty type means "text". To send it later, use
+// ScheduleMessage.
+func (c *Client) SendMessage(ctx context.Context, conversationID string, in types.SendMessageInput) (*types.Message, error) {
+	var msg types.Message
+	in.SendAt = nil
+	err := c.do(ctx, &call{method: http.MethodPost, path: conversationPath(conversationID) + "/messages", body: in}, &msg)
+	return &msg, err
+}
+
+// ScheduleMessage schedules a message to be sent to a conversation at sendAt (sendMessage). sendAt must be in the
+// future: the server sends the other messages immediately.
+func (c *Client) ScheduleMessage(ctx context.Context, conversationID string, in types.SendMessageInput, sendAt time.Time) (*types.ScheduledMessage, error) {
+	var out types.ScheduledMessage
+	in.SendAt = &sendAt
+	err := c.do(ctx, &call{method: http.MethodPost, path: conversationPath(conversationID) + "/messages", body: in}, &out)
+	return &out, err
+}
+
+// ScheduledMessages returns the scheduled messages of the user that are not sent yet (getMyScheduledMessages).
+func (c *Client) ScheduledMessages(ctx context.Context) ([]types.ScheduledMessage, error) {
+	var out types.ScheduledMessageList
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/scheduled-messages"}, &out)
+	return out.ScheduledMessages, err
+}
+
+// CancelScheduledMessage cancels a scheduled message of the user before it's sent (cancelScheduledMessage).
+func (c *Client) CancelScheduledMessage(ctx context.Context, scheduledID string) error {
+	return c.do(ctx, &call{method: http.MethodDelete, path: "/scheduled-messages/" + url.PathEscape(scheduledID)}, nil)
+}
+
+// SearchOptions are the parameters of the searches.
+type SearchOptions struct {
+	// Query is the words to search, required
+	Query string
+
+	// Limit is the maximum number of results, zero for the default of the server
+	Limit int
+
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+}
+
+func (o SearchOptions) values() url.Values {
+	q := url.Values{"q": {o.Query}}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	return q
+}
+
+// SearchMessages searches the messages of every conversation of the user, newest first (searchMessages).
+func (c *Client) SearchMessages(ctx context.Context, opts SearchOptions) (*types.SearchResults, error) {
+	var out types.SearchResults
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/search", query: opts.values()}, &out)
+	return &out, err
+}
+
+// SearchConversation searches the messages of a conversation (searchConversation).
+func (c *Client) SearchConversation(ctx context.Context, conversationID string, opts SearchOptions) (*types.SearchResults, error) {
+	var out types.SearchResults
+	err := c.do(ctx, &call{method: http.MethodGet, path: conversationPath(conversationID) + "/search", query: opts.values()}, &out)
+	return &out, err
+}
+
+// ExportConversation downloads the history of a conversation (exportConversation). The format is "json", "txt" or
+// "html"; empty means "json". The caller must close the export.
+func (c *Client) ExportConversation(ctx context.Context, conversationID, format string) (io.ReadCloser, error) {
+	var query url.Values
+	if format != "" {
+		query = url.Values{"format": {format}}
+	}
+	resp, err := c.send(ctx, &call{method: http.MethodGet, path: conversationPath(conversationID) + "/export", query: query})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SetConversationRetention sets how long the messages of a conversation are kept (setConversationRetention).
+func (c *Client) SetConversationRetention(ctx context.Context, conversationID string, policy types.RetentionPolicy) (*types.RetentionPolicy, error) {
+	var out types.RetentionPolicy
+	err := c.do(ctx, &call{method: http.MethodPut, path: conversationPath(conversationID) + "/retention", body: policy}, &out)
+	return &out, err
+}
+
+// ForwardMessage copies a message to another conversation (forwardMessage).
+func (c *Client) ForwardMessage(ctx context.Context, messageID, conversationID string) (*types.Message, error) {
+	var msg types.Message
+	body := types.ForwardBody{ConversationID: conversationID}
+	err := c.do(ctx, &call{method: http.MethodPost, path: messagePath(messageID) + "/forward", body: body}, &msg)
+	return &msg, err
+}
+
+// DeleteMessage deletes a message (deleteMessage).
+func (c *Client) DeleteMessage(ctx context.Context, messageID string) error {
+	return c.do(ctx, &call{method: http.MethodDelete, path: messagePath(messageID)}, nil)
+}
+
+// PinMessage pins a message in its conversation (pinMessage).
+func (c *Client) PinMessage(ctx context.Context, messageID string) (*types.Pin, error) {
+	var out types.Pin
+	err := c.do(ctx, &call{method: http.MethodPut, path: messagePath(messageID) + "/pin"}, &out)
+	return &out, err
+}
+
+// UnpinMessage unpins a message (unpinMessage).
+func (c *Client) UnpinMessage(ctx context.Context, messageID string) error {
+	return c.do(ctx, &call{method: http.MethodDelete, path: messagePath(messageID) + "/pin"}, nil)
+}
+
+// StarMessage stars a message for the user (starMessage).
+func (c *Client) StarMessage(ctx context.Context, messageID string) error {
+	return c.do(ctx, &call{method: http.MethodPut, path: messagePath(messageID) + "/star"}, nil)
+}
+
+// UnstarMessage removes the star of the user from a message (unstarMessage).
+func (c *Client) UnstarMessage(ctx context.Context, messageID string) error {
+	return c.do(ctx, &call{method: http.MethodDelete, path: messagePath(messageID) + "/star"}, nil)
+}
+
+// StarredMessages returns the messages starred by the user, the last starred first (getStarredMessages).
+func (c *Client) StarredMessages(ctx context.Context) ([]types.StarredMessage, error) {
+	var out types.StarredMessageList
+	err := c.do(ctx, &call{method: http.MethodGet, path: "/starred"}, &out)
+	return out.Messages, err
+}
+
+// UploadMedia stores an image on the server, and returns its URL to send in an image message (uploadMedia).
+// contentType is informative: the server detects the type of the image.
+func (c *Client) UploadMedia(ctx context.Context, image io.Reader, contentType string) (string, error) {
+	var out types.UploadedMedia
+	err := c.do(ctx, &call{method: http.MethodPost, path: "/media", body: image, contentType: contentType}, &out)
+	return out.MediaURL, err
+}
+
+// React adds a reaction to a message (commentMessage).
+func (c *Client) React(ctx context.Context, messageID, emoji string) (*types.ReactionCreated, error) {
+	var out types.ReactionCreated
+	body := types.ReactionBody{Reaction: emoji}
+	err := c.do(ctx, &call{method: http.MethodPost, path: messagePath(messageID) + "/reactions", body: body}, &out)
+	return &out, err
+}
+
+// Unreact removes a reaction from a message (uncommentMessage).
+func (c *Client) Unreact(ctx context.Context, messageID, reactionID string) error {
+	path := messagePath(messageID) + "/reactions/" + url.PathEscape(reactionID)
+	return c.do(ctx, &call{method: http.MethodDelete, path: path}, nil)
+}
+
+// AddToGroup adds a user to a group (addToGroup).
+func (c *Client) AddToGroup(ctx context.Context, conversationID, username string) error {
+	body := types.GroupAddBody{ID: username}
+	return c.do(ctx, &call{method: http.MethodPost, path: groupPath(conversationID) + "/members", body: body}, nil)
+}
+
+// LeaveGroup removes the user from a group (leaveGroup).
+func (c *Client) LeaveGroup(ctx context.Context, conversationID string) error {
+	return c.do(ctx, &call{method: http.MethodPost, path: groupPath(conversationID) + "/leave"}, nil)
+}
+
+// SetGroupName renames a group (setGroupName).
+func (c *Client) SetGroupName(ctx context.Context, conversationID, name string) error {
+	body := types.GroupNameBody{Name: name}
+	return c.do(ctx, &call{method: http.MethodPut, path: groupPath(conversationID) + "/name", body: body}, nil)
+}
+
+// SetGroupPhoto changes the photo of a group (setGroupPhoto).
+func (c *Client) SetGroupPhoto(ctx context.Context, conversationID, mediaURL string) error {
+	body := types.PhotoBody{MediaURL: mediaURL}
+	return c.do(ctx, &call{method: http.MethodPut, path: groupPath(conversationID) + "/photo", body: body}, nil)
+}
+
+// ImportOptions are the parameters of an import. Zero values mean the defaults of the server.
+type ImportOptions struct {
+	// Format is "json" or "whatsapp"
+	Format         string
+	ConversationID string
+	Name           string
+	DryRun         bool
+
+	// Senders maps the names of the archive to usernames
+	Senders map[string]string
+
+	// Timezone and DateOrder ("dmy" or "mdy") read the dates of WhatsApp archives
+	Timezone  string
+	DateOrder string
+}
+
+// ImportConversation creates a conversation from a chat archive (importConversation). It needs Config.AdminToken.
+func (c *Client) ImportConversation(ctx context.Context, archive io.Reader, opts ImportOptions) (*types.ImportReport, error) {
+	query := url.Values{}
+	contentType := "application/json"
+	if opts.Format != "" {
+		query.Set("format", opts.Format)
+		if opts.Format != "json" {
+			contentType = "text/plain"
+		}
+	}
+	for param, value := range map[string]string{
+		"conversationId": opts.ConversationID,
+		"name":           opts.Name,
+		"timezone":       opts.Timezone,
+		"dateOrder":      opts.DateOrder,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	if opts.DryRun {
+		query.Set("dryRun", "true")
+	}
+	for name, user := range opts.Senders {
+		query.Add("sender", name+"="+user)
+	}
+
+	var out types.ImportReport
+	cl := &call{method: http.MethodPost, path: "/admin/import", query: query, body: archive, contentType: contentType, admin: true}
+	err := c.do(ctx, cl, &out)
+	return &out, err
+}
+
+// Backup downloads a backup of the server, as a tar archive to restore with wasactl (backupDatabase). It needs
+// Config.AdminToken, and a server on the sqlite storage. The caller must close the backup.
+func (c *Client) Backup(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, &call{method: http.MethodGet, path: "/admin/backup", admin: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func conversationPath(id string) string { return "/conversations/" + url.PathEscape(id) }
+func messagePath(id string) string      { return "/messages/" + url.PathEscape(id) }
+func groupPath(id string) string        { return "/groups/" + url.PathEscape(id) }
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// minAdminTokenSize is the minimum length of the admin token.
+const minAdminTokenSize = 16
+
+// authenticateAdmin checks that r carries the admin token. Admin routes are forbidden if no token is configured.
+func (rt *Router) authenticateAdmin(r *http.Request) error {
+	if rt.adminToken == "" {
+		return errForbidden("admin API disabled")
+	}
+	token := bearer(r)
+	if token == "" {
+		return errUnauthorized("missing token")
+	}
+	// Hashing first makes the comparison constant-time regardless of the token length
+	got, want := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(rt.adminToken))
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		return errUnauthorized("invalid admin token")
+	}
+	return nil
+}
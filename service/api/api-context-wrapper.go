@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader is the header used to propagate the request ID between clients, proxies and this server.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the client-supplied request IDs we are willing to propagate (and to write in our logs).
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// connKey is the context key of the connection of a request.
+type connKey struct{}
+
+// ConnContext adds the connection c to ctx. Servers use it as http.Server.ConnContext, so that the downloads that
+// can outlast the write timeout of the server (backups and exports) lift it for their connection.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// clearWriteDeadline lifts the write timeout of the connection of r, if the server used ConnContext. The server sets
+// it again when it reads the next request of the connection.
+func clearWriteDeadline(r *http.Request) {
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		_ = c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// httpRouterHandler is the signature for functions that accepts a reqcontext.RequestContext in addition to those
+// required by the httprouter package.
+type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
+
+// route is a method and path pair registered in the router.
+type route struct {
+	method string
+	path   string
+}
+
+// handle registers fn for the given method and path, wrapped so that it receives a RequestContext.
+func (rt *Router) handle(method, path string, fn httpRouterHandler) {
+	rt.routes = append(rt.routes, route{method: method, path: path})
+	rt.router.Handle(method, path, rt.wrap(path, fn))
+}
+
+// wrap parses the request and adds a reqcontext.RequestContext instance related to the request. Requests with invalid
+// identifiers in their path are rejected before the handler runs. When the handler returns, a log entry with method,
+// route, status, latency and user (as authenticated by the handler) is written.
+func (rt *Router) wrap(route string, fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+
+		reqUUID, err := uuid.NewV4()
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("can't generate a request UUID")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var ctx = reqcontext.RequestContext{
+			ReqUUID:   reqUUID,
+			RequestID: reqUUID.String(),
+			Auth:      &reqcontext.Auth{},
+		}
+
+		// Keep the request ID chosen by the client (or by a proxy in front of us), if it's sane
+		if id := r.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+			ctx.RequestID = id
+		}
+		w.Header().Set(requestIDHeader, ctx.RequestID)
+
+		// Create a request-specific logger
+		ctx.Logger = rt.baseLogger.WithFields(logrus.Fields{
+			"reqid":     ctx.RequestID,
+			"remote-ip": r.RemoteAddr,
+		})
+
+		// Call the next handler in chain (usually, the handler function for the path)
+		sw := &statusWriter{ResponseWriter: w}
+		func() {
+			defer recoverPanic(sw, ctx)
+			if err := validatePath(ps); err != nil {
+				writeError(sw, ctx, err)
+				return
+			}
+			fn(sw, r, ps, ctx)
+		}()
+
+		ctx.Logger.WithFields(logrus.Fields{
+			"method":     r.Method,
+			"route":      route,
+			"status":     sw.statusCode(),
+			"bytes":      sw.bytes,
+			"latency-ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"user":       ctx.Auth.Username,
+		}).Info("request completed")
+	}
+}
+
+// statusWriter is a http.ResponseWriter that records the status code and the size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush sends the buffered data to the client, for streamed responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusCode returns the status code sent to the client. Handlers that never write anything implicitly send 200.
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
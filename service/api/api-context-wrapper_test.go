@@ -0,0 +1,87 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestClearWriteDeadline checks that a download outlasts the write timeout of the server once it lifts it.
+func TestClearWriteDeadline(t *testing.T) {
+	for _, lift := range []bool{false, true} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if lift {
+				clearWriteDeadline(r)
+			}
+			time.Sleep(100 * time.Millisecond)
+			_, _ = io.WriteString(w, "done")
+		}))
+		srv.Config.WriteTimeout = 20 * time.Millisecond
+		srv.Config.ConnContext = ConnContext
+		srv.Start()
+
+		resp, err := http.Get(srv.URL)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+		srv.Close()
+		if done := err == nil && string(body) == "done"; done != lift {
+			t.Errorf("lifting the deadline %v: got %q, %v", lift, body, err)
+		}
+	}
+}
+
+// TestRequestLogUser checks that requests are logged with the user authenticated by the handler, and that resolving
+// the user for the rate limits doesn't change the sessions.
+func TestRequestLogUser(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	logger, hook := test.NewNullLogger()
+	rt, err := New(Config{Logger: logger, Clock: clock, Sessions: SessionConfig{IdleTTL: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &conformanceFixture{t: t, server: httptest.NewServer(rt.Handler())}
+	t.Cleanup(f.server.Close)
+	token := f.login("alice")
+
+	loggedUser := func(path, token string) interface{} {
+		t.Helper()
+		hook.Reset()
+		f.do(http.MethodGet, path, token, "")
+		for _, e := range hook.AllEntries() {
+			if e.Message == "request completed" {
+				return e.Data["user"]
+			}
+		}
+		t.Fatalf("GET %s wasn't logged", path)
+		return nil
+	}
+	if user := loggedUser("/conversations", token); user != "alice" {
+		t.Errorf("got user %q for an authenticated request, want alice", user)
+	}
+	if user := loggedUser("/health", token); user != "" {
+		t.Errorf("got user %q for a route without authentication, want none", user)
+	}
+
+	// The session expires: looking its user up keeps it, authenticating revokes it
+	clock.Advance(2 * time.Hour)
+	if user := rt.sessionUser(token); user != "alice" {
+		t.Errorf("got user %q for the expired session, want alice", user)
+	}
+	if _, err := rt.store.sessionByToken(hashToken(token)); err != nil {
+		t.Fatalf("the lookup of the user removed the expired session: %v", err)
+	}
+	if user := loggedUser("/conversations", token); user != "" {
+		t.Errorf("got user %q for an expired session, want none", user)
+	}
+	if _, err := rt.store.sessionByToken(hashToken(token)); err == nil {
+		t.Error("authenticating kept the expired session")
+	}
+}
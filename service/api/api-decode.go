@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxBodySize is the maximum size of a JSON request body. The largest documented field (a message content) is 4096
+// characters long, so this leaves plenty of room for escaping and multibyte characters.
+const maxBodySize = 64 * 1024
+
+// validateBody checks the constraints of the request bodies that have some beyond their JSON shape. The bodies are
+// defined in the types package, so their validation functions are listed here rather than being methods.
+func validateBody(v interface{}) []FieldError {
+	switch b := v.(type) {
+	case *LoginBody:
+		return validateLoginBody(b)
+	case *SetNameBody:
+		return validateSetNameBody(b)
+	case *PhotoBody:
+		return validatePhotoBody(b)
+	case *SendMessageInput:
+		return validateSendMessageInput(b)
+	case *ForwardBody:
+		return validateForwardBody(b)
+	case *ReactionBody:
+		return validateReactionBody(b)
+	case *GroupAddBody:
+		return validateGroupAddBody(b)
+	case *GroupNameBody:
+		return validateGroupNameBody(b)
+	case *RetentionPolicy:
+		return validateRetentionPolicy(b)
+	}
+	return nil
+}
+
+// decodeJSON decodes the request body into v. Unknown fields, trailing data, malformed JSON and bodies larger than
+// maxBodySize are rejected. The decoded value is validated as well, by validateBody.
+func decodeJSON(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/json" {
+			return &Error{Code: ErrCodeUnsupportedMediaType, Message: "request body must be application/json"}
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return errBadRequest("can't read request body")
+	}
+	if len(body) > maxBodySize {
+		return &Error{Code: ErrCodePayloadTooLarge, Message: fmt.Sprintf("request body exceeds %d bytes", maxBodySize)}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errBadRequest("request body is required")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errBadRequest("request body must contain a single JSON object")
+	}
+
+	if details := validateBody(v); len(details) > 0 {
+		return errValidation(details...)
+	}
+	return nil
+}
+
+// decodeError translates errors from encoding/json into client errors.
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return errBadRequest(fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errBadRequest("malformed JSON: unexpected end of input")
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return errBadRequest(fmt.Sprintf("request body must be a JSON object, not %s", typeErr.Value))
+		}
+		return errValidation(FieldError{Field: typeErr.Field, Message: "must be of type " + jsonType(typeErr.Type.Kind().String())})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for this case
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return errValidation(FieldError{Field: field, Message: "unknown field"})
+	}
+	return errBadRequest("malformed JSON")
+}
+
+// jsonType returns the JSON name for a Go kind, as clients know nothing about Go types.
+func jsonType(kind string) string {
+	switch kind {
+	case "string":
+		return "string"
+	case "bool":
+		return "boolean"
+	case "slice", "array":
+		return "array"
+	case "map", "struct", "ptr":
+		return "object"
+	}
+	return "number"
+}
+
+/* validation helpers, mirroring the keywords used in doc/api.yaml */
+
+var (
+	// idPattern is the pattern of conversation, message, reaction and user identifiers
+	idPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+	// usernamePattern is the pattern of SetNameBody.name
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,16}$`)
+)
+
+// validator collects validation failures for a request body.
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required checks that value is not empty. It returns false (and records the failure) if it is, so that callers can
+// skip further checks on the same field.
+func (v *validator) required(field, value string) bool {
+	if value == "" {
+		v.fail(field, "required")
+		return false
+	}
+	return true
+}
+
+// length checks minLength and maxLength, counted in characters as JSON Schema does.
+func (v *validator) length(field, value string, min, max int) {
+	if n := utf8.RuneCountInString(value); n < min || n > max {
+		v.fail(field, "must be between %d and %d characters long", min, max)
+	}
+}
+
+// between checks minimum and maximum, for integers.
+func (v *validator) between(field string, value, min, max int) {
+	if value < min || value > max {
+		v.fail(field, "must be between %d and %d", min, max)
+	}
+}
+
+func (v *validator) pattern(field, value string, re *regexp.Regexp) {
+	if !re.MatchString(value) {
+		v.fail(field, "must match %s", re.String())
+	}
+}
+
+// validatePath checks the identifiers in the path of a request against idPattern, as doc/api.yaml declares for every
+// path parameter.
+func validatePath(ps httprouter.Params) error {
+	var v validator
+	for _, p := range ps {
+		v.pattern(p.Key, p.Value, idPattern)
+	}
+	if len(v.errs) > 0 {
+		return errValidation(v.errs...)
+	}
+	return nil
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, "must be one of: %s", strings.Join(allowed, ", "))
+}
+
+// uri checks for an absolute http(s) URL, which is what `format: uri` means for the photo endpoints.
+func (v *validator) uri(field, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail(field, "must be an absolute http(s) URL")
+	}
+}
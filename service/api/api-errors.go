@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// httpStatus maps each error code to the HTTP status code used in the response.
+var httpStatus = map[ErrorCode]int{
+	ErrCodeBadRequest:           http.StatusBadRequest,
+	ErrCodeValidation:           http.StatusBadRequest,
+	ErrCodeUnauthorized:         http.StatusUnauthorized,
+	ErrCodeForbidden:            http.StatusForbidden,
+	ErrCodeNotFound:             http.StatusNotFound,
+	ErrCodeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	ErrCodeConflict:             http.StatusConflict,
+	ErrCodePayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	ErrCodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	ErrCodeTooManyRequests:      http.StatusTooManyRequests,
+	ErrCodeInternal:             http.StatusInternalServerError,
+}
+
+// Error is an error that can be returned to the client. The message is shown to the client, while the wrapped error
+// (if any) is only logged.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details []FieldError
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Status returns the HTTP status code for the error.
+func (e *Error) Status() int {
+	if code, ok := httpStatus[e.Code]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
+
+func errBadRequest(msg string) *Error   { return &Error{Code: ErrCodeBadRequest, Message: msg} }
+func errUnauthorized(msg string) *Error { return &Error{Code: ErrCodeUnauthorized, Message: msg} }
+func errForbidden(msg string) *Error    { return &Error{Code: ErrCodeForbidden, Message: msg} }
+func errNotFound(msg string) *Error     { return &Error{Code: ErrCodeNotFound, Message: msg} }
+func errConflict(msg string) *Error     { return &Error{Code: ErrCodeConflict, Message: msg} }
+
+// errValidation returns an error listing the fields that failed validation.
+func errValidation(details ...FieldError) *Error {
+	return &Error{Code: ErrCodeValidation, Message: "request validation failed", Details: details}
+}
+
+// errInternal wraps an unexpected error. The cause is logged but never sent to the client.
+func errInternal(err error) *Error {
+	return &Error{Code: ErrCodeInternal, Message: "internal server error", Err: err}
+}
+
+// errorResponse is the JSON payload described by the Error schema in doc/api.yaml.
+type errorResponse struct {
+	Error     string       `json:"error"`
+	Code      ErrorCode    `json:"code"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+// writeError sends err to the client as an Error payload. Errors that are not of type *Error are considered internal
+// errors.
+func writeError(w http.ResponseWriter, ctx reqcontext.RequestContext, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = errInternal(err)
+	}
+
+	status := apiErr.Status()
+	if status >= http.StatusInternalServerError && ctx.Logger != nil {
+		ctx.Logger.WithError(err).Error("request failed")
+	}
+
+	writeJSON(w, status, errorResponse{
+		Error:     apiErr.Message,
+		Code:      apiErr.Code,
+		Details:   apiErr.Details,
+		RequestID: ctx.RequestID,
+	})
+}
+
+// WriteError sends err to the client as an Error payload, for the handlers that wrap the router (e.g., the CORS
+// policy of the server).
+func WriteError(w http.ResponseWriter, err *Error) {
+	writeError(w, reqcontext.RequestContext{RequestID: w.Header().Get(requestIDHeader)}, err)
+}
+
+// recoverPanic converts a panic in a handler into a 500 Error payload, unless the handler already started the
+// response. It must be deferred.
+func recoverPanic(w *statusWriter, ctx reqcontext.RequestContext) {
+	if rec := recover(); rec != nil {
+		ctx.Logger.WithField("stack", string(debug.Stack())).Errorf("panic: %v", rec)
+		if w.status == 0 {
+			writeError(w, ctx, errInternal(fmt.Errorf("panic: %v", rec)))
+		}
+	}
+}
+
+// registerErrorHandlers replaces the plain-text responses of httprouter with Error payloads.
+func (rt *Router) registerErrorHandlers() {
+	notFound := rt.wrap("", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+		writeError(w, ctx, &Error{Code: ErrCodeNotFound, Message: "no such endpoint"})
+	})
+	rt.router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notFound(w, r, nil)
+	})
+
+	// httprouter fills the Allow header before calling this handler
+	methodNotAllowed := rt.wrap("", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+		writeError(w, ctx, &Error{Code: ErrCodeMethodNotAllowed, Message: "method not allowed"})
+	})
+	rt.router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methodNotAllowed(w, r, nil)
+	})
+
+	// Handlers recover their own panics (see wrap), this is the last line of defense
+	rt.router.PanicHandler = func(w http.ResponseWriter, r *http.Request, rec interface{}) {
+		rt.baseLogger.WithField("stack", string(debug.Stack())).Errorf("panic: %v", rec)
+		writeError(w, reqcontext.RequestContext{RequestID: w.Header().Get(requestIDHeader)}, errInternal(fmt.Errorf("panic: %v", rec)))
+	}
+}
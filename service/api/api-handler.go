@@ -1,23 +1,309 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/sirupsen/logrus"
 )
 
+// Config is used to provide dependencies and configuration to the New function.
+type Config struct {
+	// Logger where log entries are sent
+	Logger logrus.FieldLogger
+
+	// RateLimits configures request rate limits per route group. The zero value disables rate limiting.
+	RateLimits RateLimits
+
+	// Sessions configures session expiration. The zero value means sessions never expire.
+	Sessions SessionConfig
+
+	// Tokens configures bearer tokens. The zero value issues opaque tokens.
+	Tokens TokenConfig
+
+	// Auth configures how users log in. The zero value is the name-only mode.
+	Auth AuthConfig
+
+	// EventStreamTTL is how long a GET /events stream lasts before the server ends it, and clients reconnect. It must
+	// be shorter than the write timeout of the HTTP server, which applies to streams too. Zero means no limit.
+	EventStreamTTL time.Duration
+
+	// AdminToken is the bearer token of the admin routes. Empty disables them.
+	AdminToken string
+
+	// Database is optional. If set, message search uses its full-text index (when available) instead of memory.
+	Database database.AppDatabase
+
+	// Storage selects where users, sessions and conversations are kept. The zero value keeps them in memory; the
+	// SQLite backend needs Database.
+	Storage StorageBackend
+
+	// Persistence makes the memory storage durable. The zero value keeps its state in memory only.
+	Persistence PersistenceConfig
+
+	// MediaDir is a directory of media files kept with the database (e.g., photos served next to the API), saved in
+	// backups. Empty means none.
+	MediaDir string
+
+	// MediaURL is the URL under which MediaDir is served. It enables uploads to MediaDir (POST /media): an uploaded
+	// file is deleted with the message it was sent in, unless other messages or photos show it. Empty disables uploads.
+	MediaURL string
+
+	// Retention configures the deletion of the messages expired by the retention policy of their conversation
+	Retention RetentionConfig
+
+	// Scheduler configures the delivery of scheduled messages. The zero value disables them.
+	Scheduler SchedulerConfig
+
+	// Clock tells the time to the router: timestamps, expirations, rate limits, event streams and background tasks.
+	// Nil means the system clock; tests use a globaltime.Fake. I/O keeps the system clock: request latencies and disk
+	// flushes.
+	Clock globaltime.Clock
+}
+
 type Router struct {
 	router *httprouter.Router
-	store  *Store
+	store  repository
+	clock  globaltime.Clock
+
+	// routes lists the method and path of every registered route, in registration order
+	routes []route
+
+	// search is the full-text index of messages
+	search messageIndex
+
+	// backupDB is the database of the sqlite storage, nil with the other backends; mediaDir is saved with it
+	backupDB database.AppDatabase
+	mediaDir string
+
+	// mediaURL is the URL of mediaDir, ending with a slash, or empty
+	mediaURL string
+
+	retentionCfg RetentionConfig
+	schedulerCfg SchedulerConfig
+
+	// events delivers the changes of conversations to the GET /events streams
+	events         *eventHub
+	eventStreamTTL time.Duration
+
+	sessionCfg SessionConfig
+	tokenCfg   TokenConfig
+
+	// sessionEpoch is when the store started keeping sessions, in signed mode: older tokens are never restored
+	sessionEpoch time.Time
+
+	authCfg    AuthConfig
+	adminToken string
+
+	// shutdown is closed by Close to stop background tasks, which are tracked by background
+	shutdown   chan struct{}
+	background sync.WaitGroup
+
+	// limiters are the rate limiters of each route group (nil if disabled)
+	limiters struct {
+		login, messaging, reactions, uploads *rateLimiter
+	}
+
+	// baseLogger is a logger for non-requests contexts, like goroutines or background tasks not started by a request.
+	// Use context logger if available (e.g., in requests) instead of this logger.
+	baseLogger logrus.FieldLogger
 }
 
-func NewRouter() *Router {
+// New returns a new Router instance
+func New(cfg Config) (*Router, error) {
+	// Check if the configuration is correct
+	if cfg.Logger == nil {
+		return nil, errors.New("logger is required")
+	}
+	if err := cfg.Tokens.validate(); err != nil {
+		return nil, fmt.Errorf("token configuration: %w", err)
+	}
+	if cfg.Tokens.Mode == TokenSigned {
+		// Revocations must outlive the tokens they reject
+		if cfg.Sessions.AbsoluteTTL <= 0 {
+			return nil, errors.New("signed tokens require an absolute session TTL")
+		}
+		if cfg.Storage != StorageSQLite && cfg.Persistence.Dir == "" {
+			return nil, errors.New("signed tokens require durable storage: the sqlite storage, or persistence")
+		}
+	}
+	if err := cfg.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("authentication configuration: %w", err)
+	}
+	if cfg.MediaURL != "" {
+		if u, err := url.Parse(cfg.MediaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("media URL must be an absolute http(s) URL")
+		}
+		if cfg.MediaDir == "" {
+			return nil, errors.New("media URL requires a media directory")
+		}
+		if !strings.HasSuffix(cfg.MediaURL, "/") {
+			cfg.MediaURL += "/"
+		}
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = globaltime.System{}
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < minAdminTokenSize {
+		return nil, fmt.Errorf("admin token must be at least %d characters long", minAdminTokenSize)
+	}
+
+	store, err := newRepository(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+
 	rt := &Router{
-		router: httprouter.New(),
-		store:  newStore(),
+		router:     httprouter.New(),
+		store:      store,
+		clock:      cfg.Clock,
+		baseLogger: cfg.Logger,
+		sessionCfg: cfg.Sessions,
+		tokenCfg:   cfg.Tokens,
+		authCfg:    cfg.Auth,
+		adminToken: cfg.AdminToken,
+		mediaDir:   cfg.MediaDir,
+		mediaURL:   cfg.MediaURL,
+		shutdown:   make(chan struct{}),
+
+		events:         newEventHub(cfg.Clock.Now()),
+		eventStreamTTL: cfg.EventStreamTTL,
+		retentionCfg:   cfg.Retention,
+		schedulerCfg:   cfg.Scheduler,
+	}
+	if cfg.Storage == StorageSQLite {
+		rt.backupDB = cfg.Database
+	}
+	if cfg.Tokens.Mode == TokenSigned {
+		if rt.sessionEpoch, err = store.sessionEpoch(rt.clock.Now().UTC()); err != nil {
+			_ = rt.Close()
+			return nil, fmt.Errorf("reading the session epoch: %w", err)
+		}
+	}
+	if err := rt.openMessageIndex(cfg); err != nil {
+		_ = rt.Close()
+		return nil, err
 	}
+	rt.limiters.login = newRateLimiter(cfg.RateLimits.Login)
+	rt.limiters.messaging = newRateLimiter(cfg.RateLimits.Messaging)
+	rt.limiters.reactions = newRateLimiter(cfg.RateLimits.Reactions)
+	rt.limiters.uploads = newRateLimiter(cfg.RateLimits.Uploads)
+	rt.registerErrorHandlers()
 	rt.registerRoutes()
+
+	if cfg.Sessions.CleanupInterval > 0 && (cfg.Sessions.IdleTTL > 0 || cfg.Sessions.AbsoluteTTL > 0) {
+		rt.background.Add(1)
+		go rt.sessionCleanup()
+	}
+	if cfg.Retention.ReapInterval > 0 {
+		rt.background.Add(1)
+		go rt.messageReaper()
+	}
+	if cfg.Scheduler.Interval > 0 {
+		rt.background.Add(1)
+		go rt.messageScheduler()
+	}
+	return rt, nil
+}
+
+// openMessageIndex sets rt.search: the full-text index of cfg.Database if it's available, the in-memory index
+// otherwise. The index must hold the messages of the store, no more.
+func (rt *Router) openMessageIndex(cfg Config) error {
+	rt.search = newMemoryIndex()
+	if cfg.Database != nil {
+		var err error
+		if cfg.Storage == StorageSQLite {
+			// The messages and their index are in the same database: they are already consistent
+			_, err = cfg.Database.SearchMessages(database.MessageQuery{Limit: 1})
+		} else {
+			// Messages are kept in memory, so the persistent index is rebuilt from the store, like the in-memory one
+			err = cfg.Database.ClearMessageIndex()
+		}
+		switch {
+		case errors.Is(err, database.ErrSearchUnavailable):
+			cfg.Logger.WithError(err).Warn("message search falls back to the in-memory index")
+		case err != nil:
+			return fmt.Errorf("opening the message index: %w", err)
+		default:
+			rt.search = dbIndex{db: cfg.Database}
+			if cfg.Storage == StorageSQLite {
+				return nil
+			}
+		}
+	}
+
+	// The index starts empty, but the store may not (e.g., if it was restored from disk)
+	convs, err := rt.store.listConversations()
+	if err != nil {
+		return fmt.Errorf("indexing messages: %w", err)
+	}
+	for _, c := range convs {
+		msgs, err := rt.store.messagesAfter(c.ID, database.MessagePosition{}, 0)
+		if err != nil {
+			return fmt.Errorf("indexing messages: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Type != "text" {
+				continue
+			}
+			err := rt.search.index(database.IndexedMessage{
+				MessageID:      m.MessageID,
+				ConversationID: m.ConversationID,
+				Content:        m.Content,
+				Timestamp:      m.Timestamp,
+			})
+			if err != nil {
+				return fmt.Errorf("indexing messages: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewRouter returns a Router with the default configuration, logging to the standard logrus logger.
+func NewRouter() *Router {
+	rt, err := New(Config{Logger: logrus.StandardLogger()})
+	if err != nil {
+		// Unreachable: the default configuration is always valid
+		panic(err)
+	}
 	return rt
 }
 
 func (rt *Router) Handler() http.Handler { return rt.router }
+
+// Close stops the background tasks of the router and waits for them to finish, then closes the storage if it needs
+// to (e.g., the durable memory storage saves a snapshot).
+func (rt *Router) Close() error {
+	close(rt.shutdown)
+	rt.background.Wait()
+	if c, ok := rt.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// AllowedMethods returns the methods registered for path, in registration order. It returns nil if no route matches.
+func (rt *Router) AllowedMethods(path string) []string {
+	var methods []string
+	seen := map[string]bool{}
+	for _, r := range rt.routes {
+		if seen[r.method] {
+			continue
+		}
+		seen[r.method] = true
+		if h, _, _ := rt.router.Lookup(r.method, path); h != nil {
+			methods = append(methods, r.method)
+		}
+	}
+	return methods
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// RateLimit configures a token bucket: at most Requests requests in a burst, with the bucket refilled completely in
+// Per. A zero RateLimit disables limiting.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// RateLimits configures the limit of each route group. Requests are counted per authenticated user, or per client IP
+// for anonymous requests.
+type RateLimits struct {
+	// Login applies to POST /session
+	Login RateLimit
+
+	// Messaging applies to sending and forwarding messages
+	Messaging RateLimit
+
+	// Reactions applies to adding and removing reactions
+	Reactions RateLimit
+
+	// Uploads applies to user and group photo changes
+	Uploads RateLimit
+}
+
+// sweepInterval is how often idle buckets are dropped from memory.
+const sweepInterval = time.Minute
+
+// rateLimiter is a set of token buckets sharing the same configuration, one per client key.
+type rateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil if the limit is disabled.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Requests <= 0 || limit.Per <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit, buckets: map[string]*tokenBucket{}}
+}
+
+// ratePerSecond is the number of tokens added to a bucket every second.
+func (l *rateLimiter) ratePerSecond() float64 {
+	return float64(l.limit.Requests) / l.limit.Per.Seconds()
+}
+
+// allow takes a token from the bucket of key, if any. It returns the tokens left and how long the client has to wait
+// for the next token (zero if the request is allowed) and for a full bucket.
+func (l *rateLimiter) allow(key string, now time.Time) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweepLocked(now)
+	}
+
+	rate := l.ratePerSecond()
+	burst := float64(l.limit.Requests)
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	reset = time.Duration((burst - b.tokens) / rate * float64(time.Second))
+	return ok, int(b.tokens), retryAfter, reset
+}
+
+// sweepLocked drops the buckets that are full again: they are indistinguishable from new ones.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// limited applies limiter to fn. A nil limiter (disabled) returns fn unchanged.
+func (rt *Router) limited(limiter *rateLimiter, fn httpRouterHandler) httpRouterHandler {
+	if limiter == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		key := "ip:" + clientIP(r)
+		if user := rt.sessionUser(bearer(r)); user != "" {
+			key = "user:" + user
+		}
+
+		ok, remaining, retryAfter, reset := limiter.allow(key, rt.clock.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.limit.Requests))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			ctx.Logger.WithField("ratelimit-key", key).Debug("rate limit exceeded")
+			writeError(w, ctx, &Error{
+				Code:    ErrCodeTooManyRequests,
+				Message: fmt.Sprintf("too many requests, retry in %d seconds", ceilSeconds(retryAfter)),
+			})
+			return
+		}
+		fn(w, r, ps, ctx)
+	}
+}
+
+// clientIP returns the IP address of the client. Proxy headers are not trusted, so behind a reverse proxy all
+// anonymous clients share the proxy address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+)
+
+// TestRateLimiter takes tokens from the buckets of a limiter allowing 4 requests in 16 seconds: a token every 4
+// seconds, so that every value is exact.
+func TestRateLimiter(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	l := newRateLimiter(RateLimit{Requests: 4, Per: 16 * time.Second})
+
+	check := func(key string, wantOK bool, wantRemaining int, wantRetryAfter, wantReset time.Duration) {
+		t.Helper()
+		ok, remaining, retryAfter, reset := l.allow(key, clock.Now())
+		if ok != wantOK || remaining != wantRemaining || retryAfter != wantRetryAfter || reset != wantReset {
+			t.Fatalf("%s at %v: got %v, %d remaining, retry after %v, reset %v; want %v, %d, %v, %v",
+				key, clock.Now(), ok, remaining, retryAfter, reset, wantOK, wantRemaining, wantRetryAfter, wantReset)
+		}
+	}
+
+	// A burst takes the whole bucket
+	check("alice", true, 3, 0, 4*time.Second)
+	check("alice", true, 2, 0, 8*time.Second)
+	check("alice", true, 1, 0, 12*time.Second)
+	check("alice", true, 0, 0, 16*time.Second)
+	check("alice", false, 0, 4*time.Second, 16*time.Second)
+
+	// Other keys have their own bucket
+	check("bob", true, 3, 0, 4*time.Second)
+
+	// Rejected requests don't take tokens, and the bucket refills continuously
+	clock.Advance(time.Second)
+	check("alice", false, 0, 3*time.Second, 15*time.Second)
+	clock.Advance(3 * time.Second)
+	check("alice", true, 0, 0, 16*time.Second)
+	check("alice", false, 0, 4*time.Second, 16*time.Second)
+
+	// The bucket never holds more than a burst
+	clock.Advance(time.Hour)
+	check("alice", true, 3, 0, 4*time.Second)
+
+	// Full buckets are dropped by the sweep, and start full again
+	clock.Advance(time.Hour)
+	check("carol", true, 3, 0, 4*time.Second)
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after the sweep, want only the one of carol", len(l.buckets))
+	}
+	check("alice", true, 3, 0, 4*time.Second)
+
+	if newRateLimiter(RateLimit{}) != nil || newRateLimiter(RateLimit{Requests: 1}) != nil {
+		t.Error("a zero limit doesn't disable limiting")
+	}
+}
+
+// TestRateLimitHeaders checks the headers of limited routes: requests are counted per user, and the clients are told
+// when to retry.
+func TestRateLimitHeaders(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	f := newConformanceFixture(t, Config{
+		Clock:      clock,
+		RateLimits: RateLimits{Messaging: RateLimit{Requests: 2, Per: 8 * time.Second}},
+	})
+	alice, bob := f.login("alice"), f.login("bob")
+
+	send := func(token string, status int, want map[string]int) {
+		t.Helper()
+		resp, data := f.do(http.MethodPost, "/conversations/chat/messages", token, `{"content":"hi"}`)
+		if resp.StatusCode != status {
+			t.Fatalf("sending: status %d, want %d (body: %s)", resp.StatusCode, status, data)
+		}
+		for name, value := range want {
+			if got := resp.Header.Get(name); got != strconv.Itoa(value) {
+				t.Errorf("got %s %q, want %d", name, got, value)
+			}
+		}
+		if _, limited := want["Retry-After"]; !limited && resp.Header.Get("Retry-After") != "" {
+			t.Errorf("got Retry-After %q on an allowed request", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	send(alice, http.StatusCreated, map[string]int{
+		"X-RateLimit-Limit": 2, "X-RateLimit-Remaining": 1, "X-RateLimit-Reset": 4,
+	})
+	send(alice, http.StatusCreated, map[string]int{"X-RateLimit-Remaining": 0, "X-RateLimit-Reset": 8})
+	send(alice, http.StatusTooManyRequests, map[string]int{
+		"X-RateLimit-Remaining": 0, "X-RateLimit-Reset": 8, "Retry-After": 4,
+	})
+	send(bob, http.StatusCreated, map[string]int{"X-RateLimit-Remaining": 1, "X-RateLimit-Reset": 4})
+
+	// Partial waits are rounded up
+	clock.Advance(1500 * time.Millisecond)
+	send(alice, http.StatusTooManyRequests, map[string]int{"X-RateLimit-Reset": 7, "Retry-After": 3})
+	clock.Advance(2500 * time.Millisecond)
+	send(alice, http.StatusCreated, map[string]int{"X-RateLimit-Remaining": 0, "X-RateLimit-Reset": 8})
+}
@@ -1,27 +1,45 @@
 package api
 
+import "net/http"
 
 func (rt *Router) registerRoutes() {
-	r := rt.router
+	rt.handle(http.MethodGet, "/health", rt.health)
+	rt.handle(http.MethodPost, "/session", rt.limited(rt.limiters.login, rt.doLogin))
+	rt.handle(http.MethodDelete, "/session", rt.doLogout)
+	rt.handle(http.MethodGet, "/sessions", rt.getMySessions)
+	rt.handle(http.MethodDelete, "/sessions/:sessionId", rt.deleteSession)
 
-	r.GET("/health", rt.health)
-	r.POST("/session", rt.doLogin)
+	rt.handle(http.MethodPut, "/user/username", rt.putUserUsername)
+	rt.handle(http.MethodPut, "/user/photo", rt.limited(rt.limiters.uploads, rt.putUserPhoto))
 
-	r.PUT("/user/username", rt.putUserUsername)
-	r.PUT("/user/photo", rt.putUserPhoto)
+	rt.handle(http.MethodGet, "/conversations", rt.getMyConversations)
+	rt.handle(http.MethodGet, "/conversations/:conversationId", rt.getConversation)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/search", rt.searchConversation)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/export", rt.exportConversation)
+	rt.handle(http.MethodPut, "/conversations/:conversationId/retention", rt.putConversationRetention)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/messages", rt.limited(rt.limiters.messaging, rt.sendMessage))
+	rt.handle(http.MethodGet, "/scheduled-messages", rt.getMyScheduledMessages)
+	rt.handle(http.MethodDelete, "/scheduled-messages/:scheduledId", rt.cancelScheduledMessage)
+	rt.handle(http.MethodGet, "/search", rt.searchMessages)
+	rt.handle(http.MethodGet, "/events", rt.getEvents)
 
-	r.GET("/conversations", rt.getMyConversations)
-	r.GET("/conversations/:conversationId", rt.getConversation)
-	r.POST("/conversations/:conversationId/messages", rt.sendMessage)
+	rt.handle(http.MethodPost, "/messages/:messageId/forward", rt.limited(rt.limiters.messaging, rt.postMessageForward))
+	rt.handle(http.MethodPost, "/messages/:messageId/reactions", rt.limited(rt.limiters.reactions, rt.postMessageReaction))
+	rt.handle(http.MethodDelete, "/messages/:messageId/reactions/:reactionId", rt.limited(rt.limiters.reactions, rt.deleteMessageReaction))
+	rt.handle(http.MethodDelete, "/messages/:messageId", rt.deleteMessage)
+	rt.handle(http.MethodPut, "/messages/:messageId/pin", rt.limited(rt.limiters.messaging, rt.pinMessage))
+	rt.handle(http.MethodDelete, "/messages/:messageId/pin", rt.limited(rt.limiters.messaging, rt.unpinMessage))
+	rt.handle(http.MethodPut, "/messages/:messageId/star", rt.starMessage)
+	rt.handle(http.MethodDelete, "/messages/:messageId/star", rt.unstarMessage)
+	rt.handle(http.MethodGet, "/starred", rt.getStarredMessages)
+	rt.handle(http.MethodPost, "/media", rt.limited(rt.limiters.uploads, rt.postMedia))
 
-	r.POST("/messages/:messageId/forward", rt.postMessageForward)
-	r.POST("/messages/:messageId/reactions", rt.postMessageReaction)
-	r.DELETE("/messages/:messageId/reactions/:reactionId", rt.deleteMessageReaction)
-	r.DELETE("/messages/:messageId", rt.deleteMessage)
+	rt.handle(http.MethodPost, "/admin/import", rt.importConversation)
+	rt.handle(http.MethodGet, "/admin/backup", rt.backupDatabase)
 
 	// group stubs
-	r.POST("/groups/:conversationId/members", rt.postGroupMember)
-	r.POST("/groups/:conversationId/leave", rt.postGroupLeave)
-	r.PUT("/groups/:conversationId/name", rt.putGroupName)
-	r.PUT("/groups/:conversationId/photo", rt.putGroupPhoto)
+	rt.handle(http.MethodPost, "/groups/:conversationId/members", rt.postGroupMember)
+	rt.handle(http.MethodPost, "/groups/:conversationId/leave", rt.postGroupLeave)
+	rt.handle(http.MethodPut, "/groups/:conversationId/name", rt.putGroupName)
+	rt.handle(http.MethodPut, "/groups/:conversationId/photo", rt.limited(rt.limiters.uploads, rt.putGroupPhoto))
 }
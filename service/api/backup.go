@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/backup"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) backupDatabase(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	if err := rt.authenticateAdmin(r); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	if rt.backupDB == nil {
+		writeError(w, ctx, errConflict(fmt.Sprintf("only the %s storage can be backed up", StorageSQLite)))
+		return
+	}
+
+	// The database is copied before the status is sent, so that failures are reported
+	b, err := backup.Create(rt.backupDB, rt.mediaDir, rt.clock.Now())
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("creating a backup: %w", err)))
+		return
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			ctx.Logger.WithError(err).Warn("deleting the copy of the database")
+		}
+	}()
+
+	w.Header().Set("Content-Type", backup.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "wasatext-backup-" + b.Manifest.CreatedAt.Format("20060102T150405Z") + ".tar",
+	}))
+	w.WriteHeader(http.StatusOK)
+	clearWriteDeadline(r)
+
+	// The status is sent: from now on, errors can only be logged, and the client gets a truncated archive
+	if _, err := b.WriteTo(w); err != nil {
+		ctx.Logger.WithError(err).Error("streaming a backup")
+	}
+}
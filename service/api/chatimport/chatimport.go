@@ -0,0 +1,95 @@
+/*
+Package chatimport reads chat archives to be imported in a conversation. Two formats are supported:
+
+  - FormatJSON, the JSON export of this server (GET /conversations/:conversationId/export?format=json);
+  - FormatWhatsApp, the plain-text export of WhatsApp, in both the Android ("18/10/2026, 19:27 - Alice: hi") and the
+    iOS ("[18/10/2026, 19:27:48] Alice: hi") variants.
+
+Archives are read one message at a time through a Reader, so that they can be validated while they are read.
+*/
+package chatimport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Supported archive formats.
+const (
+	FormatJSON     = "json"
+	FormatWhatsApp = "whatsapp"
+)
+
+// Header describes the archived conversation. Fields are empty when the format doesn't carry them.
+type Header struct {
+	ID           string
+	Name         string
+	Participants []string
+}
+
+// Message is an archived message. Senders are the names found in the archive, not necessarily existing users.
+type Message struct {
+	// ID is the identifier of the message in the archive, empty if the format has none
+	ID string
+
+	Sender    string
+	Content   string
+	Type      string // "text" or "image"
+	Timestamp time.Time
+	Reactions []string // emojis
+
+	// ForwardedFrom is the ID of the original message in the archive, for forwards
+	ForwardedFrom string
+
+	// Line is the line of the message in the archive, for error messages. Zero if unknown.
+	Line int
+}
+
+// Reader reads the messages of an archive. Next returns io.EOF after the last message.
+type Reader interface {
+	Header() Header
+	Next() (Message, error)
+}
+
+// Options configures the parsing of formats that need it.
+type Options struct {
+	// Location is the time zone of WhatsApp timestamps, which are in the local time of the exporting phone. Nil means
+	// UTC.
+	Location *time.Location
+
+	// MonthFirst parses WhatsApp dates as month/day/year, as US phones write them. The default is day/month/year.
+	MonthFirst bool
+}
+
+// ErrUnknownFormat is returned by NewReader for unsupported formats.
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// NewReader returns a Reader for an archive in the given format.
+func NewReader(r io.Reader, format string, opts Options) (Reader, error) {
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	switch format {
+	case FormatJSON:
+		return newJSONReader(r)
+	case FormatWhatsApp:
+		return newWhatsAppReader(r, opts), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+	}
+}
+
+// SyntaxError is a malformed archive.
+type SyntaxError struct {
+	Line int // zero if unknown
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
@@ -0,0 +1,137 @@
+package chatimport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Identifies the JSON export format of the server. Exports of other versions are rejected.
+const (
+	JSONFormatName    = "wasatext-export"
+	JSONFormatVersion = 1
+)
+
+// jsonMessage is a message of the JSON export. Unknown fields (e.g., the status) are ignored.
+type jsonMessage struct {
+	MessageID string    `json:"messageId"`
+	Sender    string    `json:"sender"`
+	Content   string    `json:"content"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Reactions []struct {
+		Emoji string `json:"emoji"`
+	} `json:"reactions"`
+	ForwardedFrom string `json:"forwardedFrom"`
+}
+
+// jsonReader decodes the messages array of an export one element at a time. The format, version and conversation
+// fields must come before the messages, as the server writes them.
+type jsonReader struct {
+	dec    *json.Decoder
+	header Header
+	count  int
+	done   bool
+}
+
+func newJSONReader(r io.Reader) (*jsonReader, error) {
+	jr := &jsonReader{dec: json.NewDecoder(r)}
+	if err := jr.expect(json.Delim('{')); err != nil {
+		return nil, err
+	}
+
+	var format string
+	var version int
+	for jr.dec.More() {
+		tok, err := jr.dec.Token()
+		if err != nil {
+			return nil, jr.syntaxError(err)
+		}
+		switch tok {
+		case "format":
+			err = jr.dec.Decode(&format)
+		case "version":
+			err = jr.dec.Decode(&version)
+		case "conversation":
+			var conv struct {
+				ID           string   `json:"id"`
+				Name         string   `json:"name"`
+				Participants []string `json:"participants"`
+			}
+			err = jr.dec.Decode(&conv)
+			jr.header = Header{ID: conv.ID, Name: conv.Name, Participants: conv.Participants}
+		case "messages":
+			if format != JSONFormatName || version != JSONFormatVersion {
+				return nil, &SyntaxError{Msg: fmt.Sprintf("not a %s version %d archive", JSONFormatName, JSONFormatVersion)}
+			}
+			if err := jr.expect(json.Delim('[')); err != nil {
+				return nil, err
+			}
+			return jr, nil
+		default:
+			var skip json.RawMessage
+			err = jr.dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, jr.syntaxError(err)
+		}
+	}
+	return nil, &SyntaxError{Msg: "missing messages"}
+}
+
+func (jr *jsonReader) Header() Header { return jr.header }
+
+func (jr *jsonReader) Next() (Message, error) {
+	if jr.done {
+		return Message{}, io.EOF
+	}
+	if !jr.dec.More() {
+		// The rest of the object, if any, is ignored
+		jr.done = true
+		if err := jr.expect(json.Delim(']')); err != nil {
+			return Message{}, err
+		}
+		return Message{}, io.EOF
+	}
+
+	jr.count++
+	var m jsonMessage
+	if err := jr.dec.Decode(&m); err != nil {
+		return Message{}, jr.syntaxError(err)
+	}
+	msg := Message{
+		ID:            m.MessageID,
+		Sender:        m.Sender,
+		Content:       m.Content,
+		Type:          m.Type,
+		Timestamp:     m.Timestamp,
+		ForwardedFrom: m.ForwardedFrom,
+	}
+	for _, rx := range m.Reactions {
+		msg.Reactions = append(msg.Reactions, rx.Emoji)
+	}
+	return msg, nil
+}
+
+func (jr *jsonReader) expect(delim json.Delim) error {
+	tok, err := jr.dec.Token()
+	if err != nil {
+		return jr.syntaxError(err)
+	}
+	if tok != delim {
+		return jr.syntaxError(fmt.Errorf("expected %s, found %v", delim, tok))
+	}
+	return nil
+}
+
+// syntaxError reports err at the current message, as JSON archives are usually on a single line.
+func (jr *jsonReader) syntaxError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if jr.count > 0 {
+		return &SyntaxError{Msg: fmt.Sprintf("message %d: %v", jr.count, err)}
+	}
+	return &SyntaxError{Msg: err.Error()}
+}
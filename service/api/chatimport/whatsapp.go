@@ -0,0 +1,141 @@
+package chatimport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineSize is the longest line accepted in WhatsApp archives.
+const maxLineSize = 1 << 20
+
+// whatsAppLine matches the first line of a message, or of a system notice: date, time (with optional seconds and
+// AM/PM), then the rest of the line. Android exports separate the timestamp with " - ", iOS exports put it in brackets.
+var whatsAppLine = regexp.MustCompile(
+	`^\[?(\d{1,2})[./-](\d{1,2})[./-](\d{2,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?(?: ?([AaPp])\.? ?[Mm]\.?)?(?:\] | - )(.*)$`)
+
+// invisibleMarks are written by WhatsApp around names and timestamps, and are dropped.
+var invisibleMarks = strings.NewReplacer("\ufeff", "", "\u200e", "", "\u200f", "", "\u202f", " ", "\u00a0", " ")
+
+// whatsAppReader parses a WhatsApp export. Lines that don't start with a timestamp continue the previous message;
+// notices without a sender (e.g., "Alice added Bob") are skipped. Media appear as the placeholder text of the export,
+// e.g. "<Media omitted>".
+type whatsAppReader struct {
+	sc   *bufio.Scanner
+	opts Options
+	line int
+
+	// pending is the message being read: it's complete when the next one starts
+	pending *Message
+	err     error
+}
+
+func newWhatsAppReader(r io.Reader, opts Options) *whatsAppReader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLineSize)
+	return &whatsAppReader{sc: sc, opts: opts}
+}
+
+// Header is empty: WhatsApp exports carry no information about the chat.
+func (wr *whatsAppReader) Header() Header { return Header{} }
+
+func (wr *whatsAppReader) Next() (Message, error) {
+	for wr.err == nil && wr.sc.Scan() {
+		wr.line++
+		text := invisibleMarks.Replace(wr.sc.Text())
+
+		parts := whatsAppLine.FindStringSubmatch(text)
+		if parts == nil {
+			if wr.pending != nil {
+				wr.pending.Content += "\n" + text
+			}
+			continue
+		}
+		ts, err := wr.parseTimestamp(parts[1:8])
+		if err != nil {
+			wr.err = &SyntaxError{Line: wr.line, Msg: err.Error()}
+			break
+		}
+		i := strings.Index(parts[8], ": ")
+		if i < 0 {
+			// A notice: it ends the previous message, but it's not a message itself
+			if msg, ok := wr.flush(nil); ok {
+				return msg, nil
+			}
+			continue
+		}
+
+		next := &Message{
+			Sender:    strings.TrimSpace(parts[8][:i]),
+			Content:   parts[8][i+2:],
+			Type:      "text",
+			Timestamp: ts,
+			Line:      wr.line,
+		}
+		if msg, ok := wr.flush(next); ok {
+			return msg, nil
+		}
+	}
+	if wr.err == nil {
+		wr.err = wr.sc.Err()
+		if wr.err == bufio.ErrTooLong {
+			wr.err = &SyntaxError{Line: wr.line + 1, Msg: fmt.Sprintf("line longer than %d bytes", maxLineSize)}
+		}
+	}
+	if msg, ok := wr.flush(nil); ok {
+		return msg, nil
+	}
+	if wr.err != nil {
+		return Message{}, wr.err
+	}
+	return Message{}, io.EOF
+}
+
+// flush replaces the pending message with next, returning the previous one if any.
+func (wr *whatsAppReader) flush(next *Message) (Message, bool) {
+	prev := wr.pending
+	wr.pending = next
+	if prev == nil {
+		return Message{}, false
+	}
+	return *prev, true
+}
+
+// parseTimestamp converts the day, month, year, hour, minute, second and AM/PM parts of a line.
+func (wr *whatsAppReader) parseTimestamp(parts []string) (time.Time, error) {
+	n := make([]int, 6)
+	for i, p := range parts[:6] {
+		if p != "" {
+			n[i], _ = strconv.Atoi(p) // the regular expression allows only digits
+		}
+	}
+	day, month, year, hour, minute, second := n[0], n[1], n[2], n[3], n[4], n[5]
+	if wr.opts.MonthFirst {
+		day, month = month, day
+	}
+	if year < 100 {
+		year += 2000
+	}
+	if ampm := strings.ToLower(parts[6]); ampm != "" {
+		if hour < 1 || hour > 12 {
+			return time.Time{}, fmt.Errorf("invalid hour %d", hour)
+		}
+		hour %= 12
+		if ampm == "p" {
+			hour += 12
+		}
+	}
+
+	if hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, fmt.Errorf("invalid time %02d:%02d:%02d", hour, minute, second)
+	}
+	// time.Date normalizes out of range dates, e.g. 31/02 becomes 03/03: that's a date in the other order, or garbage
+	if d := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC); d.Day() != day || int(d.Month()) != month {
+		return time.Time{}, fmt.Errorf("invalid date %02d/%02d/%d", day, month, year)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, wr.opts.Location).UTC(), nil
+}
@@ -0,0 +1,142 @@
+package chatimport
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readWhatsApp reads every message of a WhatsApp archive, up to the first error.
+func readWhatsApp(t *testing.T, archive string, opts Options) ([]Message, error) {
+	t.Helper()
+	r, err := NewReader(strings.NewReader(archive), FormatWhatsApp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []Message
+	for {
+		m, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		} else if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestWhatsApp(t *testing.T) {
+	at := func(month time.Month, day, hour, minute, second int) time.Time {
+		return time.Date(2026, month, day, hour, minute, second, 0, time.UTC)
+	}
+	for name, tc := range map[string]struct {
+		archive string
+		opts    Options
+		want    []Message
+	}{
+		"android": {
+			archive: "17/10/2026, 09:00 - Alice: hello\n17/10/26, 9:01 - Bob: hi\n",
+			want: []Message{
+				{Sender: "Alice", Content: "hello", Type: "text", Timestamp: at(10, 17, 9, 0, 0), Line: 1},
+				{Sender: "Bob", Content: "hi", Type: "text", Timestamp: at(10, 17, 9, 1, 0), Line: 2},
+			},
+		},
+		"ios": {
+			archive: "\ufeff[17/10/2026, 09:01:30] Alice: hello\n\u200e[17.10.26, 09.02.05] \u200eBob: \u200e<Media omitted>\n",
+			want: []Message{
+				{Sender: "Alice", Content: "hello", Type: "text", Timestamp: at(10, 17, 9, 1, 30), Line: 1},
+				{Sender: "Bob", Content: "<Media omitted>", Type: "text", Timestamp: at(10, 17, 9, 2, 5), Line: 2},
+			},
+		},
+		"am and pm": {
+			archive: "17/10/2026, 12:05 AM - Alice: midnight\n17/10/2026, 12:05 PM - Alice: noon\n" +
+				"[17/10/2026, 1:05:09 p. m.] Alice: afternoon\n17/10/2026, 11:59 am - Alice: morning\n",
+			want: []Message{
+				{Sender: "Alice", Content: "midnight", Type: "text", Timestamp: at(10, 17, 0, 5, 0), Line: 1},
+				{Sender: "Alice", Content: "noon", Type: "text", Timestamp: at(10, 17, 12, 5, 0), Line: 2},
+				{Sender: "Alice", Content: "afternoon", Type: "text", Timestamp: at(10, 17, 13, 5, 9), Line: 3},
+				{Sender: "Alice", Content: "morning", Type: "text", Timestamp: at(10, 17, 11, 59, 0), Line: 4},
+			},
+		},
+		"month first": {
+			archive: "10/17/26, 9:00 PM - Alice: hello\n",
+			opts:    Options{MonthFirst: true},
+			want:    []Message{{Sender: "Alice", Content: "hello", Type: "text", Timestamp: at(10, 17, 21, 0, 0), Line: 1}},
+		},
+		"local time": {
+			archive: "17/10/2026, 09:00 - Alice: hello\n",
+			opts:    Options{Location: time.FixedZone("CEST", 2*60*60)},
+			want:    []Message{{Sender: "Alice", Content: "hello", Type: "text", Timestamp: at(10, 17, 7, 0, 0), Line: 1}},
+		},
+		"continuation lines and notices": {
+			archive: "dropped: before the first message\n" +
+				"17/10/2026, 09:00 - Alice: first line\nsecond line\n\nafter a blank line\n" +
+				"17/10/2026, 09:01 - Alice added Bob\ndropped: after a notice\n" +
+				"17/10/2026, 09:02 - Bob: time: 09:02\n17/10/2026, 09:03 - Messages are end-to-end encrypted\n",
+			want: []Message{
+				{
+					Sender: "Alice", Content: "first line\nsecond line\n\nafter a blank line", Type: "text",
+					Timestamp: at(10, 17, 9, 0, 0), Line: 2,
+				},
+				{Sender: "Bob", Content: "time: 09:02", Type: "text", Timestamp: at(10, 17, 9, 2, 0), Line: 8},
+			},
+		},
+		"empty": {archive: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := readWhatsApp(t, tc.archive, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d messages %+v, want %d", len(got), got, len(tc.want))
+			}
+			for i := range got {
+				if g, w := got[i], tc.want[i]; g.Sender != w.Sender || g.Content != w.Content || g.Type != w.Type ||
+					!g.Timestamp.Equal(w.Timestamp) || g.Line != w.Line {
+					t.Errorf("message %d: got %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestWhatsAppErrors(t *testing.T) {
+	long := "17/10/2026, 09:01 - Alice: " + strings.Repeat("x", maxLineSize) + "\n"
+	for name, tc := range map[string]struct {
+		archive string
+		opts    Options
+		read    int // messages read before the error
+		line    int
+		msg     string
+	}{
+		"invalid date": {
+			archive: "17/10/2026, 09:00 - Alice: hello\n31/02/2026, 09:01 - Alice: hi\n",
+			read:    1, line: 2, msg: "invalid date 31/02/2026",
+		},
+		"day first in month first": {
+			archive: "17/10/2026, 09:00 - Alice: hello\n", opts: Options{MonthFirst: true},
+			line: 1, msg: "invalid date",
+		},
+		"invalid time":         {archive: "17/10/2026, 24:00 - Alice: hello\n", line: 1, msg: "invalid time"},
+		"invalid hour with pm": {archive: "17/10/2026, 13:05 PM - Alice: hello\n", line: 1, msg: "invalid hour 13"},
+		"zero hour with am":    {archive: "17/10/2026, 0:05 AM - Alice: hello\n", line: 1, msg: "invalid hour 0"},
+		"over-long line": {
+			archive: "17/10/2026, 09:00 - Alice: hello\n" + long,
+			read:    1, line: 2, msg: "line longer than",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := readWhatsApp(t, tc.archive, tc.opts)
+			var serr *SyntaxError
+			if !errors.As(err, &serr) || serr.Line != tc.line || !strings.Contains(serr.Msg, tc.msg) {
+				t.Fatalf("got %v, want a syntax error on line %d containing %q", err, tc.line, tc.msg)
+			}
+			if len(got) != tc.read {
+				t.Errorf("read %d messages before the error, want %d", len(got), tc.read)
+			}
+		})
+	}
+}
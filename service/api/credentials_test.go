@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/sirupsen/logrus"
+)
+
+// newPasswordRouters returns a router in password mode for every storage backend.
+func newPasswordRouters(t *testing.T) map[string]*Router {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	configs := map[string]Config{
+		"memory":  {},
+		"sqlite":  {Database: newTestDatabase(t), Storage: StorageSQLite},
+		"durable": {Persistence: PersistenceConfig{Dir: t.TempDir()}},
+	}
+	routers := map[string]*Router{}
+	for name, cfg := range configs {
+		cfg.Logger, cfg.Auth = logger, testPasswordAuth
+		rt, err := New(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { _ = rt.Close() })
+		routers[name] = rt
+	}
+	return routers
+}
+
+// errorCode returns the code of an *Error, or "" for nil.
+func errorCode(t *testing.T, err error) ErrorCode {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+	return apiErr.Code
+}
+
+// TestCheckPasswordFirstLoginRace logs in a new user concurrently with different passwords: only one of them must
+// become the password.
+func TestCheckPasswordFirstLoginRace(t *testing.T) {
+	for name, rt := range newPasswordRouters(t) {
+		rt := rt
+		t.Run(name, func(t *testing.T) {
+			const logins = 8
+			errs := make([]error, logins)
+			var wg sync.WaitGroup
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = rt.checkPassword("alice", fmt.Sprintf("password-%d", i))
+				}(i)
+			}
+			wg.Wait()
+
+			winner := -1
+			for i, err := range errs {
+				switch code := errorCode(t, err); code {
+				case "":
+					if winner >= 0 {
+						t.Fatalf("passwords %d and %d were both accepted", winner, i)
+					}
+					winner = i
+				case ErrCodeUnauthorized:
+				default:
+					t.Errorf("login %d: got %v", i, err)
+				}
+			}
+			if winner < 0 {
+				t.Fatal("no password was accepted")
+			}
+			for i := range errs {
+				err := rt.checkPassword("alice", fmt.Sprintf("password-%d", i))
+				if (i == winner) != (err == nil) {
+					t.Errorf("logging in again with password %d (winner %d): got %v", i, winner, err)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckPasswordSize checks the bounds of the password length, the upper one being where bcrypt stops reading.
+func TestCheckPasswordSize(t *testing.T) {
+	rt := newPasswordRouters(t)["memory"]
+	for _, tc := range []struct {
+		size int
+		code ErrorCode
+	}{
+		{0, ErrCodeValidation},
+		{minPasswordSize - 1, ErrCodeValidation},
+		{minPasswordSize, ""},
+		{maxPasswordSize, ""},
+		{maxPasswordSize + 1, ErrCodeValidation},
+	} {
+		user := fmt.Sprintf("user%d", tc.size)
+		if code := errorCode(t, rt.checkPassword(user, strings.Repeat("p", tc.size))); code != tc.code {
+			t.Errorf("password of %d bytes: got %q, want %q", tc.size, code, tc.code)
+		}
+	}
+
+	// A password differing only past the limit would be accepted by bcrypt: it's rejected for its length instead
+	password := strings.Repeat("p", maxPasswordSize)
+	if err := rt.checkPassword("longer", password); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(t, rt.checkPassword("longer", password+"x")); code != ErrCodeValidation {
+		t.Errorf("password extending the one of the user past the limit: got %q", code)
+	}
+}
+
+// TestCheckPasswordRename checks that a rename moves the password to the new name, and that the old name can't be
+// claimed by a first login.
+func TestCheckPasswordRename(t *testing.T) {
+	for name, rt := range newPasswordRouters(t) {
+		rt := rt
+		t.Run(name, func(t *testing.T) {
+			if err := rt.checkPassword("alice", "alice-password"); err != nil {
+				t.Fatal(err)
+			}
+			if err := rt.checkPassword("bob", "bob-password"); err != nil {
+				t.Fatal(err)
+			}
+			if err := rt.store.renameUser("alice", "bob", time.Now()); !errors.Is(err, database.ErrAlreadyExists) {
+				t.Errorf("taking the name of a user with a password: got %v", err)
+			}
+			if err := rt.store.renameUser("alice", "carol", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := rt.checkPassword("carol", "alice-password"); err != nil {
+				t.Errorf("password after the rename: %v", err)
+			}
+			if code := errorCode(t, rt.checkPassword("carol", "other-password")); code != ErrCodeUnauthorized {
+				t.Errorf("wrong password after the rename: got %q", code)
+			}
+			for _, password := range []string{"alice-password", "other-password"} {
+				if code := errorCode(t, rt.checkPassword("alice", password)); code != ErrCodeUnauthorized {
+					t.Errorf("claiming the old name with %s: got %q", password, code)
+				}
+			}
+			if hash, err := rt.store.passwordHash("alice"); err != nil || hash != nil {
+				t.Errorf("password of the old name: got %q, %v", hash, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+const (
+	// eventBacklog is how many recent events are kept, for the clients that reconnect with Last-Event-ID
+	eventBacklog = 1024
+
+	// eventBuffer is how many events a subscriber can lag behind before it's disconnected
+	eventBuffer = 64
+
+	// eventHeartbeat is the interval of the comments that keep idle streams open through proxies
+	eventHeartbeat = 15 * time.Second
+
+	// eventRetry is the reconnection delay suggested to clients, in milliseconds
+	eventRetry = 1000
+
+	// eventIDsPerMillisecond is how many event IDs a hub has for every millisecond between its start and the start of
+	// the next process: the IDs of a process start after its start time in milliseconds, times this
+	eventIDsPerMillisecond = 1000
+)
+
+// sentEvent is an event of the backlog, with the users who received it.
+type sentEvent struct {
+	Event
+
+	// recipients are the users who receive the event
+	recipients []string
+}
+
+func (e *sentEvent) sentTo(username string) bool {
+	for _, r := range e.recipients {
+		if r == username {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSub is a stream subscribed to the events of a user. ch is closed if the stream falls too far behind.
+type eventSub struct {
+	username string
+	ch       chan Event
+}
+
+// eventHub fans events out to the subscribers, and keeps the last eventBacklog events to resume streams. Event IDs
+// are unique across restarts: they start after the epoch of the hub, taken from the clock, so that the IDs sent by a
+// previous process are below it. IDs stay below 2^53, so that JavaScript clients read them exactly.
+type eventHub struct {
+	mu     sync.Mutex
+	epoch  uint64
+	lastID uint64
+	recent []sentEvent
+	subs   map[*eventSub]struct{}
+}
+
+// newEventHub returns a hub started at now.
+func newEventHub(now time.Time) *eventHub {
+	epoch := uint64(now.UnixNano()/int64(time.Millisecond)) * eventIDsPerMillisecond
+	return &eventHub{epoch: epoch, lastID: epoch, subs: map[*eventSub]struct{}{}}
+}
+
+// publish assigns an ID to e and delivers it to recipients. It never blocks: subscribers that can't keep up are
+// dropped, and resume from the backlog when they reconnect.
+func (h *eventHub) publish(e Event, recipients []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e.ID = h.lastID
+	sent := sentEvent{Event: e, recipients: recipients}
+	if len(h.recent) == eventBacklog {
+		copy(h.recent, h.recent[1:])
+		h.recent = h.recent[:eventBacklog-1]
+	}
+	h.recent = append(h.recent, sent)
+
+	for sub := range h.subs {
+		if !sent.sentTo(sub.username) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			close(sub.ch)
+			delete(h.subs, sub)
+		}
+	}
+}
+
+// subscribe starts a stream for username. If lastID is not zero, the events of username after lastID are returned
+// to be sent first. If some of them are no longer in the backlog, or lastID was sent by another process, a resync
+// event at now is returned instead.
+func (h *eventHub) subscribe(username string, lastID uint64, now time.Time) (sub *eventSub, missed []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &eventSub{username: username, ch: make(chan Event, eventBuffer)}
+	h.subs[sub] = struct{}{}
+	if lastID == 0 {
+		return sub, nil
+	}
+	if lastID < h.epoch || lastID > h.lastID || (len(h.recent) > 0 && h.recent[0].ID > lastID+1) {
+		// An ID of another process, or events dropped from the backlog: the stream resumes from now
+		return sub, []Event{{ID: h.lastID, Type: EventResync, Timestamp: now}}
+	}
+	for _, e := range h.recent {
+		if e.ID > lastID && e.sentTo(username) {
+			missed = append(missed, e.Event)
+		}
+	}
+	return sub, missed
+}
+
+func (h *eventHub) unsubscribe(sub *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+/* helpers bound to Router */
+
+// publish sends an event to the participants of conversation c. Messages and reactions must be copies.
+func (rt *Router) publish(c Conversation, e Event) {
+	e.ConversationID = c.ID
+	e.Timestamp = rt.clock.Now().UTC()
+	rt.events.publish(e, append([]string(nil), c.Participants...))
+}
+
+/* ROUTE HANDLERS */
+
+// getEvents streams the events of the conversations of the user as server-sent events. Streams end after the
+// configured EventStreamTTL: clients reconnect with the Last-Event-ID header and get the events they missed.
+func (rt *Router) getEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	var lastID uint64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		if lastID, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, ctx, errBadRequest("invalid Last-Event-ID header"))
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, ctx, errInternal(fmt.Errorf("streaming not supported by %T", w)))
+		return
+	}
+
+	sub, missed := rt.events.subscribe(sess.Username, lastID, rt.clock.Now().UTC())
+	defer rt.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disables the buffering of nginx
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", eventRetry); err != nil {
+		return
+	}
+	for _, e := range missed {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	// The stream ends at the first tick of expiry after the deadline, i.e. after EventStreamTTL
+	var expired <-chan time.Time
+	var deadline time.Time
+	if rt.eventStreamTTL > 0 {
+		deadline = rt.clock.Now().Add(rt.eventStreamTTL)
+		expiry := rt.clock.NewTicker(rt.eventStreamTTL)
+		defer expiry.Stop()
+		expired = expiry.C()
+	}
+	heartbeat := rt.clock.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				ctx.Logger.Debug("event stream too slow, disconnected")
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C():
+			// The session may have been revoked or have expired since the stream started
+			if _, err := rt.authenticate(r, ctx); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case now := <-expired:
+			if !now.Before(deadline) {
+				return
+			}
+		case <-rt.shutdown:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes e in the server-sent events format. The JSON encoding has no newlines, so it fits in one data
+// line.
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+)
+
+// streamEvents opens GET /events and returns the events of the stream, which ends after the configured TTL.
+func streamEvents(f *conformanceFixture, token string, lastID uint64) ([]Event, error) {
+	req, err := http.NewRequest(http.MethodGet, f.server.URL+"/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	resp, err := f.server.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /events: status %d", resp.StatusCode)
+	}
+
+	var events []Event
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+			var e Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return nil, fmt.Errorf("invalid event %s: %w", data, err)
+			}
+			events = append(events, e)
+		}
+	}
+	return events, sc.Err()
+}
+
+func readEvents(t *testing.T, f *conformanceFixture, token string, lastID uint64) []Event {
+	t.Helper()
+	events, err := streamEvents(f, token, lastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func eventTypes(events []Event) string {
+	types := make([]string, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return strings.Join(types, " ")
+}
+
+// TestEvents checks who receives the events, and that streams resume from Last-Event-ID.
+func TestEvents(t *testing.T) {
+	f := newConformanceFixture(t, Config{EventStreamTTL: 200 * time.Millisecond})
+	alice := f.login("alice")
+	bob := f.login("bob")
+	carol := f.login("carol")
+
+	// Events sent while the stream is open are delivered live
+	type result struct {
+		events []Event
+		err    error
+	}
+	live := make(chan result)
+	go func() {
+		events, err := streamEvents(f, bob, 0)
+		live <- result{events, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f.sendMessage(alice, "chat-events", "before bob joins")
+	f.sendMessage(bob, "chat-events", "bob joins")
+	first := f.sendMessage(alice, "chat-events", "hello bob")
+	res := <-live
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	events := res.events
+	if got := eventTypes(events); got != "message.created message.created" {
+		t.Fatalf("got events %q, want the two messages sent after bob joined", got)
+	}
+	if m := events[1].Message; m == nil || m.MessageID != first || events[1].ConversationID != "chat-events" {
+		t.Errorf("got %+v, want the message of alice", events[1])
+	}
+
+	// Reconnecting with the last ID returns the missed events, only to the participants
+	rxID := f.react(alice, first)
+	if resp, _ := f.do(http.MethodDelete, "/messages/"+first+"/reactions/"+rxID, alice, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("removing reaction: status %d", resp.StatusCode)
+	}
+	if resp, _ := f.do(http.MethodDelete, "/messages/"+first, alice, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting message: status %d", resp.StatusCode)
+	}
+	missed := readEvents(t, f, bob, events[1].ID)
+	if got := eventTypes(missed); got != "reaction.added reaction.removed message.deleted" {
+		t.Fatalf("got missed events %q", got)
+	}
+	if missed[0].Reaction == nil || missed[0].Reaction.ReactionID != rxID || missed[2].MessageID != first {
+		t.Errorf("got %+v", missed)
+	}
+	if got := readEvents(t, f, carol, events[0].ID-1); len(got) != 0 {
+		t.Errorf("carol got %q, want no events of a conversation she's not in", eventTypes(got))
+	}
+
+	// IDs unknown to the server, e.g. from before a restart, ask the client to reload
+	if got := readEvents(t, f, bob, 1000); eventTypes(got) != "resync" {
+		t.Errorf("got %q after an unknown ID, want resync", eventTypes(got))
+	}
+}
+
+// TestEventHubRestart checks that a client resuming with an ID of a previous process is asked to reload, even when
+// the new process already sent more events than the previous one.
+func TestEventHubRestart(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	publish := func(h *eventHub, n int) []uint64 {
+		sub, _ := h.subscribe("alice", 0, t0)
+		defer h.unsubscribe(sub)
+		var ids []uint64
+		for i := 0; i < n; i++ {
+			h.publish(Event{Type: EventMessageDeleted, MessageID: fmt.Sprint("m", i)}, []string{"alice"})
+			ids = append(ids, (<-sub.ch).ID)
+		}
+		return ids
+	}
+
+	before := publish(newEventHub(t0), 3)
+	after := newEventHub(t0.Add(time.Second))
+	if ids := publish(after, 5); ids[0] <= before[2] {
+		t.Fatalf("got IDs %v after the restart, want them above the IDs %v of the previous process", ids, before)
+	}
+	for _, id := range before {
+		sub, missed := after.subscribe("alice", id, t0.Add(time.Minute))
+		after.unsubscribe(sub)
+		if eventTypes(missed) != "resync" {
+			t.Errorf("resuming from %d of the previous process: got %q, want resync", id, eventTypes(missed))
+		}
+	}
+
+	// IDs of the process resume the stream, including the ID of a resync sent before any event
+	fresh := newEventHub(t0.Add(time.Hour))
+	sub, missed := fresh.subscribe("alice", 1, t0.Add(time.Hour))
+	fresh.unsubscribe(sub)
+	if len(missed) != 1 || missed[0].Type != EventResync {
+		t.Fatalf("got %+v, want a resync", missed)
+	}
+	publish(fresh, 2)
+	sub, missed = fresh.subscribe("alice", missed[0].ID, t0.Add(time.Hour))
+	fresh.unsubscribe(sub)
+	if eventTypes(missed) != "message.deleted message.deleted" {
+		t.Errorf("resuming from the resync: got %q, want the two events sent since", eventTypes(missed))
+	}
+}
+
+// TestEventStreamExpiry checks that streams send heartbeats, and end after EventStreamTTL, on the clock of the router.
+func TestEventStreamExpiry(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	f := newConformanceFixture(t, Config{Clock: clock, EventStreamTTL: time.Minute})
+	token := f.login("alice")
+
+	req, err := http.NewRequest(http.MethodGet, f.server.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := f.server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if sc.Text() != "" {
+				lines <- sc.Text()
+			}
+		}
+	}()
+	next := func() (string, bool) {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			return line, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream is stuck")
+			return "", false
+		}
+	}
+	if line, _ := next(); line != fmt.Sprintf("retry: %d", eventRetry) {
+		t.Fatalf("first line: got %q", line)
+	}
+
+	// The heartbeat and the expiry of the stream
+	clock.WaitForTickers(2)
+	for elapsed := eventHeartbeat; elapsed < time.Minute; elapsed += eventHeartbeat {
+		clock.Advance(eventHeartbeat)
+		if line, ok := next(); !ok || line != ": heartbeat" {
+			t.Fatalf("after %v: got %q, %v, want a heartbeat", elapsed, line, ok)
+		}
+	}
+	clock.Advance(eventHeartbeat)
+	for {
+		line, ok := next()
+		if !ok {
+			break
+		}
+		if line != ": heartbeat" {
+			t.Fatalf("after the expiry: got %q", line)
+		}
+	}
+}
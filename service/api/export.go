@@ -0,0 +1,281 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/chatimport"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// exportBatchSize is how many messages are read from the store at a time. The store isn't held while a batch is
+// written to the client, so a slow download doesn't block the other requests.
+const exportBatchSize = 100
+
+// exportHeader describes the exported conversation.
+type exportHeader struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	Participants []string  `json:"participants"`
+	ExportedAt   time.Time `json:"exportedAt"`
+}
+
+// title is how the conversation is called in text and HTML exports.
+func (h exportHeader) title() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.ID
+}
+
+// exportWriter writes a conversation in an export format. Calls are begin, message for each message, and end.
+type exportWriter interface {
+	begin(h exportHeader) error
+	message(m Message) error
+	end() error
+}
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer) exportWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"json": {"application/json", "json", func(w io.Writer) exportWriter { return &jsonExport{w: w} }},
+	"txt":  {"text/plain; charset=utf-8", "txt", func(w io.Writer) exportWriter { return &textExport{w: w} }},
+	"html": {"text/html; charset=utf-8", "html", func(w io.Writer) exportWriter { return &htmlExport{w: w} }},
+}
+
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* JSON */
+
+// jsonExport writes {"format":…,"version":…,"conversation":{…},"messages":[…]}, one message at a time.
+type jsonExport struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExport) begin(h exportHeader) error {
+	head, err := json.Marshal(struct {
+		Format       string       `json:"format"`
+		Version      int          `json:"version"`
+		Conversation exportHeader `json:"conversation"`
+	}{chatimport.JSONFormatName, chatimport.JSONFormatVersion, h})
+	if err != nil {
+		return err
+	}
+	// Reopen the object to append the messages array
+	_, err = fmt.Fprintf(e.w, `%s,"messages":[`, head[:len(head)-1])
+	return err
+}
+
+func (e *jsonExport) message(m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		data = append([]byte(","), data...)
+	}
+	e.count++
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+/* Plain text */
+
+// textTimeLayout is the timestamp format of text exports. Timestamps are in UTC.
+const textTimeLayout = "2006-01-02 15:04:05"
+
+// textExport writes one line per message, as "[timestamp] sender: content". Continuation lines of multi-line messages
+// and reactions are indented.
+type textExport struct {
+	w io.Writer
+}
+
+func (e *textExport) begin(h exportHeader) error {
+	_, err := fmt.Fprintf(e.w, "Conversation: %s\nParticipants: %s\nExported at: %s UTC\n\n",
+		h.title(), strings.Join(h.Participants, ", "), h.ExportedAt.UTC().Format(textTimeLayout))
+	return err
+}
+
+func (e *textExport) message(m Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", m.Timestamp.UTC().Format(textTimeLayout), m.Sender)
+	if m.ForwardedFrom != "" {
+		b.WriteString(" (forwarded)")
+	}
+	b.WriteString(": ")
+	if m.Type == "image" {
+		b.WriteString("[image] ")
+	}
+	b.WriteString(strings.ReplaceAll(m.Content, "\n", "\n    "))
+	b.WriteString("\n")
+	if len(m.Reactions) > 0 {
+		emojis := make([]string, len(m.Reactions))
+		for i, rx := range m.Reactions {
+			emojis[i] = rx.Emoji
+		}
+		fmt.Fprintf(&b, "    reactions: %s\n", strings.Join(emojis, " "))
+	}
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *textExport) end() error { return nil }
+
+/* HTML */
+
+// The HTML export is a single page without external resources, so that it can be viewed offline. Images are linked,
+// not embedded: they are hosted elsewhere.
+var htmlExportTemplates = template.Must(template.New("begin").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format(textTimeLayout) + " UTC" },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f4f4f6; color: #1d1d1f; margin: 0 auto; max-width: 48rem; padding: 1rem; }
+header { border-bottom: 1px solid #d0d0d6; margin-bottom: 1rem; }
+header p { color: #6e6e73; margin: .25rem 0; }
+article { background: #fff; border-radius: .5rem; margin: .5rem 0; padding: .5rem .75rem; }
+.meta { color: #6e6e73; font-size: .85rem; }
+.sender { color: #1d1d1f; font-weight: 600; }
+.content { margin: .25rem 0; white-space: pre-wrap; word-wrap: break-word; }
+.reactions { font-size: .9rem; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p>Participants: {{range $i, $p := .Header.Participants}}{{if $i}}, {{end}}{{$p}}{{end}}</p>
+<p>Exported at {{time .Header.ExportedAt}}</p>
+</header>
+<main>
+{{define "message"}}<article id="m-{{.MessageID}}">
+<div class="meta"><span class="sender">{{.Sender}}</span> · <time datetime="{{.Timestamp.Format "2006-01-02T15:04:05Z07:00"}}">{{time .Timestamp}}</time>{{if .ForwardedFrom}} · forwarded{{end}}</div>
+{{if eq .Type "image"}}<p class="content">🖼 <a href="{{.Content}}">{{.Content}}</a></p>{{else}}<p class="content">{{.Content}}</p>{{end}}
+{{with .Reactions}}<div class="reactions">{{range .}}{{.Emoji}} {{end}}</div>{{end}}
+</article>
+{{end}}{{define "end"}}</main>
+</body>
+</html>
+{{end}}`))
+
+type htmlExport struct {
+	w io.Writer
+}
+
+func (e *htmlExport) begin(h exportHeader) error {
+	return htmlExportTemplates.ExecuteTemplate(e.w, "begin", struct {
+		Title  string
+		Header exportHeader
+	}{h.title(), h})
+}
+
+func (e *htmlExport) message(m Message) error {
+	return htmlExportTemplates.ExecuteTemplate(e.w, "message", m)
+}
+
+func (e *htmlExport) end() error {
+	return htmlExportTemplates.ExecuteTemplate(e.w, "end", nil)
+}
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) exportConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if _, err := rt.authenticate(r, ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		writeError(w, ctx, errValidation(FieldError{
+			Field:   "format",
+			Message: "must be one of: " + strings.Join(exportFormatNames(), ", "),
+		}))
+		return
+	}
+	convID := ps.ByName("conversationId")
+
+	c, err := rt.store.conversation(convID)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("conversation not found"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+		return
+	}
+	header := exportHeader{
+		ID:           c.ID,
+		Name:         c.Name,
+		Participants: c.Participants,
+		ExportedAt:   rt.clock.Now().UTC(),
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": convID + "." + format.extension,
+	}))
+	w.WriteHeader(http.StatusOK)
+	clearWriteDeadline(r)
+
+	// The status is sent: from now on, errors can only be logged, and the client gets a truncated file
+	ew := format.newWriter(w)
+	err = ew.begin(header)
+	// Messages may be deleted while the export runs: the cursor is a position, not an index
+	var cur database.MessagePosition
+	for err == nil {
+		var batch []Message
+		batch, err = rt.store.messagesAfter(convID, cur, exportBatchSize)
+		if err != nil || len(batch) == 0 {
+			break
+		}
+		last := batch[len(batch)-1]
+		cur = database.MessagePosition{Timestamp: last.Timestamp, MessageID: last.MessageID}
+		for _, m := range batch {
+			if err = ew.message(m); err != nil {
+				break
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if err == nil {
+		err = ew.end()
+	}
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("conversation export interrupted")
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+)
+
+// TestExportFormats checks the content of the text and HTML exports, including the escaping of user content in HTML.
+func TestExportFormats(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	clock := globaltime.NewFake(t0)
+	f := newConformanceFixture(t, Config{Clock: clock})
+	alice, bob := f.login("alice"), f.login("bob")
+	send := func(token, conversationID, content string) string {
+		t.Helper()
+		clock.Advance(time.Second)
+		return f.sendMessage(token, conversationID, content)
+	}
+
+	hello := send(alice, "chat-export", "hello\nsecond line")
+	send(bob, "chat-export", `<script>alert("hi")</script> & more`)
+	other := send(bob, "chat-other", "forward me")
+	clock.Advance(time.Second)
+	resp, data := f.do(http.MethodPost, "/messages/"+other+"/forward", alice, `{"conversationId":"chat-export"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("forwarding: status %d (body: %s)", resp.StatusCode, data)
+	}
+	f.react(bob, hello)
+	clock.Advance(time.Hour)
+
+	export := func(format string) string {
+		t.Helper()
+		resp, data := f.do(http.MethodGet, "/conversations/chat-export/export?format="+format, alice, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("exporting as %s: status %d (body: %s)", format, resp.StatusCode, data)
+		}
+		if got, want := resp.Header.Get("Content-Disposition"), `attachment; filename=chat-export.`+format; got != want {
+			t.Errorf("got Content-Disposition %q, want %q", got, want)
+		}
+		return string(data)
+	}
+
+	want := "Conversation: chat-export\nParticipants: alice, bob\nExported at: 2030-01-01 09:00:04 UTC\n\n" +
+		"[2030-01-01 08:00:01] alice: hello\n    second line\n    reactions: 👍\n" +
+		"[2030-01-01 08:00:02] bob: <script>alert(\"hi\")</script> & more\n" +
+		"[2030-01-01 08:00:04] bob (forwarded): forward me\n"
+	if got := export("txt"); got != want {
+		t.Errorf("got text export:\n%s\nwant:\n%s", got, want)
+	}
+
+	page := export("html")
+	for _, want := range []string{
+		"<title>chat-export</title>",
+		"<p>Participants: alice, bob</p>",
+		"<p>Exported at 2030-01-01 09:00:04 UTC</p>",
+		`<article id="m-` + hello + `">`,
+		`<time datetime="2030-01-01T08:00:01Z">2030-01-01 08:00:01 UTC</time>`,
+		"<p class=\"content\">hello\nsecond line</p>",
+		`<div class="reactions">👍 </div>`,
+		`<p class="content">&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt; &amp; more</p>`,
+		"</time> · forwarded</div>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML export lacks %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Errorf("HTML export has an unescaped script:\n%s", page)
+	}
+	if !strings.HasSuffix(page, "</main>\n</body>\n</html>\n") {
+		t.Errorf("HTML export isn't complete:\n%s", page)
+	}
+}
+
+// TestExportPagination exports a conversation longer than a batch of the store, and checks that every message is
+// exported once, in order.
+func TestExportPagination(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	for _, storage := range []StorageBackend{StorageMemory, StorageSQLite} {
+		t.Run(string(storage), func(t *testing.T) {
+			clock := globaltime.NewFake(t0)
+			cfg := Config{Storage: storage, Clock: clock}
+			if storage == StorageSQLite {
+				cfg.Database = newTestDatabase(t)
+			}
+			f := newConformanceFixture(t, cfg)
+			alice := f.login("alice")
+
+			const count = 2*exportBatchSize + 51
+			for i := 0; i < count; i++ {
+				clock.Advance(time.Second)
+				f.sendMessage(alice, "chat-long", fmt.Sprintf("message %d", i))
+			}
+
+			resp, data := f.do(http.MethodGet, "/conversations/chat-long/export", alice, "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("exporting: status %d (body: %s)", resp.StatusCode, data)
+			}
+			var out exportedMessages
+			f.decodeInto(data, &out)
+			if len(out.Messages) != count {
+				t.Fatalf("got %d messages, want %d", len(out.Messages), count)
+			}
+			for i, m := range out.Messages {
+				if want := fmt.Sprintf("message %d", i); m.Content != want {
+					t.Fatalf("message %d is %q, want %q", i, m.Content, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/chatimport"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// Import limits.
+const (
+	maxImportSize     = 16 << 20
+	maxImportWarnings = 100
+)
+
+// addImportWarning adds a warning to rep, up to maxImportWarnings.
+func addImportWarning(rep *ImportReport, format string, args ...interface{}) {
+	if len(rep.Warnings) < maxImportWarnings {
+		rep.Warnings = append(rep.Warnings, fmt.Sprintf(format, args...))
+	}
+}
+
+// importRequest is the parsed query string of an import.
+type importRequest struct {
+	format         string
+	conversationID string
+	name           string
+	dryRun         bool
+	senders        map[string]string // archive name -> username
+	opts           chatimport.Options
+}
+
+// parseImportRequest reads the query parameters of an import. The format defaults to the one of the Content-Type.
+func parseImportRequest(r *http.Request) (importRequest, error) {
+	query := r.URL.Query()
+	req := importRequest{format: query.Get("format"), senders: map[string]string{}}
+	var v validator
+
+	if req.format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			req.format = chatimport.FormatJSON
+		case "text/plain":
+			req.format = chatimport.FormatWhatsApp
+		default:
+			v.fail("format", "required, unless the Content-Type is application/json or text/plain")
+		}
+	} else {
+		v.oneOf("format", req.format, chatimport.FormatJSON, chatimport.FormatWhatsApp)
+	}
+	if req.conversationID = query.Get("conversationId"); req.conversationID != "" {
+		v.pattern("conversationId", req.conversationID, idPattern)
+	}
+	if req.name = query.Get("name"); req.name != "" {
+		v.length("name", req.name, 3, 32)
+	}
+	if s := query.Get("dryRun"); s != "" {
+		var err error
+		if req.dryRun, err = strconv.ParseBool(s); err != nil {
+			v.fail("dryRun", "must be true or false")
+		}
+	}
+	for _, s := range query["sender"] {
+		// Usernames can't contain "=", archive names can
+		i := strings.LastIndexByte(s, '=')
+		if i <= 0 || !usernamePattern.MatchString(s[i+1:]) {
+			v.fail("sender", "must be in the <archive name>=<username> format, with a valid username")
+			continue
+		}
+		req.senders[s[:i]] = s[i+1:]
+	}
+	if tz := query.Get("timezone"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			v.fail("timezone", "unknown time zone")
+		}
+		req.opts.Location = loc
+	}
+	if order := query.Get("dateOrder"); order != "" {
+		v.oneOf("dateOrder", order, "dmy", "mdy")
+		req.opts.MonthFirst = order == "mdy"
+	}
+
+	if len(v.errs) > 0 {
+		return req, errValidation(v.errs...)
+	}
+	return req, nil
+}
+
+// readArchive reads and checks the messages of an archive, oldest first. Invalid messages are skipped with a warning.
+func readArchive(ar chatimport.Reader, rep *ImportReport) ([]chatimport.Message, error) {
+	var msgs []chatimport.Message
+	for n := 1; ; n++ {
+		m, err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		where := fmt.Sprintf("message %d", n)
+		if m.Line > 0 {
+			where = fmt.Sprintf("line %d", m.Line)
+		}
+		if m.Type == "" {
+			m.Type = "text"
+		}
+		var problem string
+		switch {
+		case m.Sender == "":
+			problem = "no sender"
+		case m.Content == "":
+			problem = "no content"
+		case utf8.RuneCountInString(m.Content) > 4096:
+			problem = "content longer than 4096 characters"
+		case m.Type != "text" && m.Type != "image":
+			problem = fmt.Sprintf("unknown type %q", m.Type)
+		case m.Timestamp.IsZero():
+			problem = "no timestamp"
+		}
+		if problem != "" {
+			rep.Skipped++
+			addImportWarning(rep, "%s skipped: %s", where, problem)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Timestamp.Before(msgs[j].Timestamp) })
+	return msgs, nil
+}
+
+// placeholderName turns an archive name into a valid username that isn't taken.
+func placeholderName(name string, taken map[string]bool) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	base := strings.TrimRight(b.String(), "_")
+	if len(base) < 3 {
+		base = "user"
+	}
+	if len(base) > 16 {
+		base = base[:16]
+	}
+	candidate := base
+	for n := 2; taken[candidate]; n++ {
+		suffix := "-" + strconv.Itoa(n)
+		if len(base)+len(suffix) > 16 {
+			candidate = base[:16-len(suffix)] + suffix
+		} else {
+			candidate = base + suffix
+		}
+	}
+	return candidate
+}
+
+// mapSenders fills rep.Senders, attributing each name of the archive to a user: the one chosen in the request, the
+// known user with the same name, or a new placeholder user.
+func mapSenders(req importRequest, header chatimport.Header, msgs []chatimport.Message, known map[string]bool, rep *ImportReport) map[string]string {
+	taken := map[string]bool{}
+	for name := range known {
+		taken[name] = true
+	}
+
+	users := map[string]string{}
+	index := map[string]int{}
+	add := func(name string) {
+		if _, ok := users[name]; ok {
+			return
+		}
+		user, ok := req.senders[name]
+		if !ok && known[name] && usernamePattern.MatchString(name) {
+			user = name
+		} else if !ok {
+			user = placeholderName(name, taken)
+		}
+		taken[user] = true
+		users[name] = user
+		index[name] = len(rep.Senders)
+		rep.Senders = append(rep.Senders, ImportSender{Name: name, User: user, Placeholder: !known[user]})
+	}
+	for _, name := range header.Participants {
+		add(name)
+	}
+	for _, m := range msgs {
+		add(m.Sender)
+		rep.Senders[index[m.Sender]].Messages++
+	}
+	return users
+}
+
+/* helpers bound to Router */
+
+// conversationExists reports whether conversation id is stored.
+func (rt *Router) conversationExists(id string) (bool, error) {
+	_, err := rt.store.conversation(id)
+	if errors.Is(err, database.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) importConversation(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	if err := rt.authenticateAdmin(r); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	req, err := parseImportRequest(r)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+	if err != nil {
+		writeError(w, ctx, errBadRequest("cannot read request body"))
+		return
+	}
+	if len(body) > maxImportSize {
+		writeError(w, ctx, &Error{Code: ErrCodePayloadTooLarge, Message: fmt.Sprintf("archive exceeds %d bytes", maxImportSize)})
+		return
+	}
+
+	rep := ImportReport{DryRun: req.dryRun}
+	ar, err := chatimport.NewReader(bytes.NewReader(body), req.format, req.opts)
+	var msgs []chatimport.Message
+	if err == nil {
+		msgs, err = readArchive(ar, &rep)
+	}
+	var syntaxErr *chatimport.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		writeError(w, ctx, errValidation(FieldError{Field: "body", Message: "invalid archive: " + syntaxErr.Error()}))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(err))
+		return
+	}
+	header := ar.Header()
+	rep.Name = req.name
+	if rep.Name == "" && utf8.RuneCountInString(header.Name) >= 3 && utf8.RuneCountInString(header.Name) <= 32 {
+		rep.Name = header.Name
+	}
+
+	// The archive goes in a new conversation: the requested ID must be free, the archived one is used only if free.
+	// The conversation may be taken before it's stored: that's detected by importConversation.
+	switch {
+	case req.conversationID != "":
+		rep.ConversationID = req.conversationID
+	case idPattern.MatchString(header.ID):
+		rep.ConversationID = header.ID
+	}
+	if rep.ConversationID != "" {
+		exists, err := rt.conversationExists(rep.ConversationID)
+		switch {
+		case err != nil:
+			writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+			return
+		case exists && req.conversationID != "":
+			writeError(w, ctx, errConflict("conversation already exists"))
+			return
+		case exists:
+			rep.ConversationID = ""
+		}
+	}
+	if rep.ConversationID == "" {
+		rep.ConversationID = "import-" + uuid.Must(uuid.NewV4()).String()[:8]
+	}
+	known, err := rt.store.knownUsers()
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("listing users: %w", err)))
+		return
+	}
+	users := mapSenders(req, header, msgs, known, &rep)
+	rep.Messages = len(msgs)
+
+	if req.dryRun {
+		writeJSON(w, http.StatusOK, rep)
+		return
+	}
+
+	c := Conversation{
+		ID:           rep.ConversationID,
+		Participants: []string{},
+		Messages:     make([]*Message, 0, len(msgs)),
+		Timestamp:    rt.clock.Now().UTC(),
+		Name:         rep.Name,
+	}
+	for _, s := range rep.Senders {
+		join(&c, s.User)
+	}
+	newIDs := map[string]string{} // archive message ID -> new ID, to link forwards
+	for _, m := range msgs {
+		msg := &Message{
+			MessageID:      uuid.Must(uuid.NewV4()).String(),
+			ConversationID: c.ID,
+			Sender:         users[m.Sender],
+			Content:        m.Content,
+			Type:           m.Type,
+			Status:         "delivered",
+			Timestamp:      m.Timestamp.UTC(),
+			ForwardedFrom:  newIDs[m.ForwardedFrom],
+		}
+		for _, emoji := range m.Reactions {
+			msg.Reactions = append(msg.Reactions, Reaction{ReactionID: uuid.Must(uuid.NewV4()).String(), Emoji: emoji})
+		}
+		if m.ID != "" {
+			newIDs[m.ID] = msg.MessageID
+		}
+		c.Messages = append(c.Messages, msg)
+		c.LastMessage = msg.Content
+		c.Timestamp = msg.Timestamp
+	}
+	err = rt.store.importConversation(c)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		writeError(w, ctx, errConflict("conversation already exists"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("storing conversation: %w", err)))
+		return
+	}
+	for _, msg := range c.Messages {
+		rt.indexMessage(ctx, msg)
+	}
+
+	ctx.Logger.WithFields(map[string]interface{}{
+		"conversation": c.ID,
+		"messages":     rep.Messages,
+		"skipped":      rep.Skipped,
+	}).Info("conversation imported")
+	writeJSON(w, http.StatusCreated, rep)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type importResult struct {
+	DryRun         bool
+	ConversationID string
+	Messages       int
+	Skipped        int
+	Senders        []ImportSender
+	Warnings       []string
+}
+
+type exportedMessages struct {
+	Messages []struct {
+		MessageID     string
+		Sender        string
+		Content       string
+		Type          string
+		Timestamp     time.Time
+		ForwardedFrom string
+		Reactions     []Reaction
+	}
+}
+
+// TestImport imports archives in both formats, and reads them back through the export.
+func TestImport(t *testing.T) {
+	f := newConformanceFixture(t, testAdminConfig)
+	tester := f.login("Tester")
+
+	post := func(query, body string, status int) importResult {
+		t.Helper()
+		resp, data := f.do(http.MethodPost, "/admin/import?"+query, testAdminToken, body)
+		if resp.StatusCode != status {
+			t.Fatalf("POST /admin/import?%s: status %d, want %d (body: %s)", query, resp.StatusCode, status, data)
+		}
+		var rep importResult
+		f.decodeInto(data, &rep)
+		return rep
+	}
+	export := func(convID string) exportedMessages {
+		t.Helper()
+		resp, data := f.do(http.MethodGet, "/conversations/"+convID+"/export", tester, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("exporting %s: status %d (body: %s)", convID, resp.StatusCode, data)
+		}
+		var out exportedMessages
+		f.decodeInto(data, &out)
+		return out
+	}
+
+	// A dry run reports the import without creating anything
+	rep := post("dryRun=true", testArchive, http.StatusOK)
+	want := []ImportSender{
+		{Name: "Tester", User: "Tester", Messages: 1},
+		{Name: "Jane Doe", User: "Jane_Doe", Placeholder: true, Messages: 1},
+	}
+	if !rep.DryRun || rep.ConversationID != "chat-archived" || rep.Messages != 2 || len(rep.Senders) != 2 ||
+		rep.Senders[0] != want[0] || rep.Senders[1] != want[1] {
+		t.Fatalf("dry run: got %+v, want senders %+v", rep, want)
+	}
+	if resp, _ := f.do(http.MethodGet, "/conversations/chat-archived/export", tester, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("dry run created the conversation: export status %d", resp.StatusCode)
+	}
+
+	// Timestamps, forwards and reactions are kept; IDs are new
+	rep = post("sender=Jane%20Doe%3Djane", testArchive, http.StatusCreated)
+	if rep.ConversationID != "chat-archived" || rep.Senders[1].User != "jane" {
+		t.Fatalf("got %+v, want chat-archived with Jane Doe as jane", rep)
+	}
+	msgs := export("chat-archived").Messages
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	first, second := msgs[0], msgs[1]
+	if first.Sender != "jane" || !first.Timestamp.Equal(time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)) || first.MessageID == "m1" {
+		t.Errorf("first message: got %+v", first)
+	}
+	if second.ForwardedFrom != first.MessageID || len(second.Reactions) != 1 || second.Reactions[0].Emoji != "👍" {
+		t.Errorf("second message: got %+v, want a forward of %s with a reaction", second, first.MessageID)
+	}
+
+	// The archived ID is taken now: a new one is generated, unless one is requested
+	if rep := post("", testArchive, http.StatusCreated); !strings.HasPrefix(rep.ConversationID, "import-") {
+		t.Errorf("got conversation %q, want a generated ID", rep.ConversationID)
+	}
+	post("conversationId=chat-archived", testArchive, http.StatusConflict)
+
+	// WhatsApp timestamps are local times; notices are skipped and continuation lines kept. Placeholders never take
+	// the name of an existing user, such as the placeholder of the previous import
+	rep = post("format=whatsapp&timezone=Europe/Rome&conversationId=chat-whatsapp", testWhatsAppArchive, http.StatusCreated)
+	if rep.Messages != 2 || rep.Senders[0].User != "Jane_Doe-2" || !rep.Senders[0].Placeholder {
+		t.Fatalf("got %+v, want 2 messages with Jane Doe as the new Jane_Doe-2", rep)
+	}
+	msgs = export("chat-whatsapp").Messages
+	if len(msgs) != 2 || msgs[0].Content != "hello\nsecond line" ||
+		!msgs[1].Timestamp.Equal(time.Date(2026, 10, 17, 7, 1, 30, 0, time.UTC)) {
+		t.Errorf("got %+v", msgs)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// maxMediaSize is the size limit of an uploaded media file
+const maxMediaSize = 8 << 20
+
+// mediaTypes are the content types of the media files that can be uploaded, with the extension of their files.
+var mediaTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+/* helpers bound to Router */
+
+// attachMedia binds the media file uploaded by the sender of an image message to the message, so that the file is
+// deleted with it. Files uploaded by other users, or already shown by another message, are left alone.
+func (rt *Router) attachMedia(ctx reqcontext.RequestContext, m *Message) {
+	if m.Type != "image" || rt.mediaURL == "" || !strings.HasPrefix(m.Content, rt.mediaURL) {
+		return
+	}
+	err := rt.store.attachMedia(m.Content, m.Sender, m.MessageID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		ctx.Logger.WithError(err).WithField("media", m.Content).Warn("attaching a media file to its message")
+	}
+}
+
+/* ROUTE HANDLERS */
+
+// postMedia stores an image in the media directory, for the user to send it in an image message.
+func (rt *Router) postMedia(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	if rt.mediaURL == "" {
+		writeError(w, ctx, errConflict("media uploads are disabled"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMediaSize+1))
+	if err != nil {
+		writeError(w, ctx, errBadRequest("cannot read request body"))
+		return
+	}
+	if len(body) > maxMediaSize {
+		writeError(w, ctx, &Error{Code: ErrCodePayloadTooLarge, Message: fmt.Sprintf("media file exceeds %d bytes", maxMediaSize)})
+		return
+	}
+	// The type is the one of the content, whatever the Content-Type says
+	ext, ok := mediaTypes[http.DetectContentType(body)]
+	if !ok {
+		writeError(w, ctx, &Error{Code: ErrCodeUnsupportedMediaType, Message: "media files must be PNG, JPEG, GIF or WebP images"})
+		return
+	}
+
+	tmp, err := os.CreateTemp(rt.mediaDir, ".upload-*")
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("creating media file: %w", err)))
+		return
+	}
+	_, err = tmp.Write(body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	name := uuid.Must(uuid.NewV4()).String() + ext
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(rt.mediaDir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		writeError(w, ctx, errInternal(fmt.Errorf("writing media file: %w", err)))
+		return
+	}
+
+	m := Media{URL: rt.mediaURL + name, Owner: sess.Username, CreatedAt: rt.clock.Now().UTC()}
+	if err := rt.store.addMedia(m); err != nil {
+		_ = os.Remove(filepath.Join(rt.mediaDir, name))
+		writeError(w, ctx, errInternal(fmt.Errorf("storing media: %w", err)))
+		return
+	}
+	writeJSON(w, http.StatusCreated, UploadedMedia{MediaURL: m.URL})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMedia uploads images, sends them, and checks that a file goes only with the message of its uploader, and only
+// when the sender deletes it.
+func TestMedia(t *testing.T) {
+	for _, storage := range []StorageBackend{StorageMemory, StorageSQLite} {
+		t.Run(string(storage), func(t *testing.T) {
+			media := t.TempDir()
+			cfg := Config{Storage: storage, MediaDir: media, MediaURL: "https://chat.example.com/media/"}
+			if storage == StorageSQLite {
+				cfg.Database = newTestDatabase(t)
+			}
+			_, f := newRetentionFixture(t, cfg)
+			alice, bob := f.login("alice"), f.login("bob")
+
+			upload := func(token string) string {
+				t.Helper()
+				resp, data := f.do(http.MethodPost, "/media", token, testPNG)
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("uploading: status %d, want 201 (body: %s)", resp.StatusCode, data)
+				}
+				var out UploadedMedia
+				f.decodeInto(data, &out)
+				return out.MediaURL
+			}
+			file := func(u string) string {
+				return filepath.Join(media, strings.TrimPrefix(u, cfg.MediaURL))
+			}
+			exists := func(u string) bool {
+				t.Helper()
+				_, err := os.Stat(file(u))
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+				return err == nil
+			}
+			sendImage := func(token, u string) string {
+				t.Helper()
+				body := fmt.Sprintf(`{"content":%q,"type":"image"}`, u)
+				_, data := f.do(http.MethodPost, "/conversations/chat/messages", token, body)
+				var out Message
+				f.decodeInto(data, &out)
+				return out.MessageID
+			}
+			deleteMessage := func(token, id string, status int) {
+				t.Helper()
+				if resp, data := f.do(http.MethodDelete, "/messages/"+id, token, ""); resp.StatusCode != status {
+					t.Fatalf("deleting %s: status %d, want %d (body: %s)", id, resp.StatusCode, status, data)
+				}
+			}
+
+			photo := upload(alice)
+			if !strings.HasPrefix(photo, cfg.MediaURL) || !strings.HasSuffix(photo, ".png") || !exists(photo) {
+				t.Fatalf("uploaded media: got %q", photo)
+			}
+			if data, err := os.ReadFile(file(photo)); err != nil || string(data) != testPNG {
+				t.Errorf("uploaded file: got %q, %v", data, err)
+			}
+
+			// Only the sender deletes a message, and the file goes with the message of its uploader
+			mine := sendImage(alice, photo)
+			reused := sendImage(bob, photo)
+			deleteMessage(bob, mine, http.StatusForbidden)
+			deleteMessage(bob, reused, http.StatusNoContent)
+			if !exists(photo) {
+				t.Fatal("the media file went with the message of another user")
+			}
+			deleteMessage(alice, mine, http.StatusNoContent)
+			if exists(photo) {
+				t.Error("the media file of a deleted message is still there")
+			}
+
+			// Files that weren't uploaded are never deleted
+			untracked := cfg.MediaURL + "logo.png"
+			if err := os.WriteFile(file(untracked), []byte("logo"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			deleteMessage(alice, sendImage(alice, untracked), http.StatusNoContent)
+			if !exists(untracked) {
+				t.Error("a file that wasn't uploaded was deleted")
+			}
+
+			// Uploads are limited in size and type
+			resp, _ := f.do(http.MethodPost, "/media", alice, testPNG+strings.Repeat("x", maxMediaSize))
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("uploading a large file: status %d, want 413", resp.StatusCode)
+			}
+			if resp, _ := f.do(http.MethodPost, "/media", alice, "<html></html>"); resp.StatusCode != http.StatusUnsupportedMediaType {
+				t.Errorf("uploading a page: status %d, want 415", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,868 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// specPath is the OpenAPI document the router must conform to, relative to this package.
+const specPath = "../../doc/api.yaml"
+
+/* OpenAPI document loading */
+
+// openAPISpec is a loosely typed view of doc/api.yaml. YAML maps are converted to map[string]interface{} so that
+// schemas and decoded JSON responses can be walked with the same code.
+type openAPISpec struct {
+	root map[string]interface{}
+}
+
+// specOperation is a single method+path documented in the spec.
+type specOperation struct {
+	method string // upper case, e.g. "GET"
+	path   string // OpenAPI template, e.g. "/conversations/{conversationId}"
+	id     string
+	node   map[string]interface{}
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	raw, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatalf("reading %s: %v", specPath, err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("parsing %s: %v", specPath, err)
+	}
+	root, ok := normalizeYAML(doc).(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s: top level is not an object", specPath)
+	}
+	return &openAPISpec{root: root}
+}
+
+// normalizeYAML converts the map[interface{}]interface{} produced by yaml.v2 into JSON-like maps.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeYAML(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// operations returns the documented operations, sorted by path and method.
+func (s *openAPISpec) operations() []specOperation {
+	var ops []specOperation
+	paths, _ := s.root["paths"].(map[string]interface{})
+	for path, item := range paths {
+		methods, _ := item.(map[string]interface{})
+		for method, node := range methods {
+			switch method {
+			case "get", "put", "post", "delete", "patch", "head", "options":
+			default:
+				continue
+			}
+			opNode, _ := node.(map[string]interface{})
+			id, _ := opNode["operationId"].(string)
+			ops = append(ops, specOperation{method: strings.ToUpper(method), path: path, id: id, node: opNode})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].path != ops[j].path {
+			return ops[i].path < ops[j].path
+		}
+		return ops[i].method < ops[j].method
+	})
+	return ops
+}
+
+// deref follows $ref pointers (local ones only, which is all doc/api.yaml uses).
+func (s *openAPISpec) deref(node map[string]interface{}) map[string]interface{} {
+	for node != nil {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		var cur interface{} = s.root
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			m, _ := cur.(map[string]interface{})
+			cur = m[part]
+		}
+		node, _ = cur.(map[string]interface{})
+	}
+	return nil
+}
+
+// response returns the documented response for status, and whether it is documented at all.
+func (s *openAPISpec) response(op specOperation, status int) (map[string]interface{}, bool) {
+	responses, _ := op.node["responses"].(map[string]interface{})
+	resp, ok := responses[fmt.Sprint(status)].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return s.deref(resp), true
+}
+
+// flatten resolves references and merges allOf sub-schemas into a single schema.
+func (s *openAPISpec) flatten(schema map[string]interface{}) map[string]interface{} {
+	schema = s.deref(schema)
+	allOf, ok := schema["allOf"].([]interface{})
+	if !ok {
+		return schema
+	}
+	merged := map[string]interface{}{"type": "object"}
+	props := map[string]interface{}{}
+	var required []interface{}
+	for _, sub := range allOf {
+		subSchema, _ := sub.(map[string]interface{})
+		subSchema = s.flatten(subSchema)
+		if p, ok := subSchema["properties"].(map[string]interface{}); ok {
+			for k, v := range p {
+				props[k] = v
+			}
+		}
+		if r, ok := subSchema["required"].([]interface{}); ok {
+			required = append(required, r...)
+		}
+	}
+	merged["properties"] = props
+	merged["required"] = required
+	return merged
+}
+
+// validate checks value against schema and returns a description of every mismatch. Objects are validated strictly:
+// properties not declared in the schema are reported, unless additionalProperties allows them.
+func (s *openAPISpec) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	schema = s.flatten(schema)
+	if schema == nil {
+		return []string{at + ": schema not found"}
+	}
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %T", value)
+			return errs
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := obj[fmt.Sprint(r)]; !ok {
+				fail("missing required property %q", r)
+			}
+		}
+		additional, _ := schema["additionalProperties"].(bool)
+		for k, v := range obj {
+			propSchema, ok := props[k].(map[string]interface{})
+			if !ok {
+				if !additional {
+					fail("undocumented property %q", k)
+				}
+				continue
+			}
+			errs = append(errs, s.validate(propSchema, v, at+"."+k)...)
+		}
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			fail("expected array, got %T", value)
+			return errs
+		}
+		if min, ok := schema["minItems"].(int); ok && len(arr) < min {
+			fail("%d items, want at least %d", len(arr), min)
+		}
+		if max, ok := schema["maxItems"].(int); ok && len(arr) > max {
+			fail("%d items, want at most %d", len(arr), max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range arr {
+				errs = append(errs, s.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("expected string, got %T", value)
+			return errs
+		}
+		n := utf8.RuneCountInString(str)
+		if min, ok := schema["minLength"].(int); ok && n < min {
+			fail("%q is shorter than %d characters", str, min)
+		}
+		if max, ok := schema["maxLength"].(int); ok && n > max {
+			fail("%q is longer than %d characters", str, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			fail("%q does not match %s", str, pattern)
+		}
+		switch schema["format"] {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				fail("%q is not a date-time", str)
+			}
+		case "uri":
+			if u, err := url.Parse(str); err != nil || u.Scheme == "" {
+				fail("%q is not an URI", str)
+			}
+		}
+
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			fail("expected number, got %T", value)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected boolean, got %T", value)
+		}
+	}
+	return errs
+}
+
+/* Test fixture */
+
+// conformanceFixture is a running server plus helpers to build the state needed by the test cases.
+type conformanceFixture struct {
+	t      *testing.T
+	server *httptest.Server
+	config Config
+}
+
+func newConformanceFixture(t *testing.T, cfg Config) *conformanceFixture {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Logger = logger
+	rt, err := New(cfg)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	srv := httptest.NewServer(rt.Handler())
+	t.Cleanup(srv.Close)
+	return &conformanceFixture{t: t, server: srv, config: cfg}
+}
+
+// do sends a request and returns the response with its body already read.
+func (f *conformanceFixture) do(method, path, token, body string) (*http.Response, []byte) {
+	f.t.Helper()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, f.server.URL+path, rd)
+	if err != nil {
+		f.t.Fatalf("building request: %v", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := f.server.Client().Do(req)
+	if err != nil {
+		f.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		f.t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// decodeInto is used by fixture helpers to extract identifiers from setup responses.
+func (f *conformanceFixture) decodeInto(data []byte, v interface{}) {
+	f.t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		f.t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+// login logs in as name, with testPassword in password mode.
+func (f *conformanceFixture) login(name string) string {
+	f.t.Helper()
+	body := fmt.Sprintf(`{"name":%q}`, name)
+	if f.config.Auth.Mode == AuthPassword {
+		body = fmt.Sprintf(`{"name":%q,"password":%q}`, name, testPassword)
+	}
+	_, data := f.do(http.MethodPost, "/session", "", body)
+	var out struct{ Identifier string }
+	f.decodeInto(data, &out)
+	return out.Identifier
+}
+
+func (f *conformanceFixture) sendMessage(token, conversationID, content string) string {
+	f.t.Helper()
+	_, data := f.do(http.MethodPost, "/conversations/"+conversationID+"/messages", token, fmt.Sprintf(`{"content":%q}`, content))
+	var out struct{ MessageID string }
+	f.decodeInto(data, &out)
+	return out.MessageID
+}
+
+func (f *conformanceFixture) react(token, messageID string) string {
+	f.t.Helper()
+	_, data := f.do(http.MethodPost, "/messages/"+messageID+"/reactions", token, `{"reaction":"👍"}`)
+	var out struct{ ReactionID string }
+	f.decodeInto(data, &out)
+	return out.ReactionID
+}
+
+/* Test cases */
+
+// conformanceCase is a request against a documented operation and the status it's expected to produce.
+type conformanceCase struct {
+	name        string
+	operationID string
+	status      int
+	anonymous   bool   // don't send the bearer token
+	admin       bool   // send testAdminToken instead of the user token
+	body        string // request body, if any
+	query       string // query string, if any
+	config      Config // router configuration, the logger is set by the fixture
+	database    bool   // store the state in a test database, with the sqlite storage
+
+	// params returns the path parameters, creating the needed state through the fixture
+	params func(f *conformanceFixture, token string) map[string]string
+}
+
+func conversationParam(f *conformanceFixture, token string) map[string]string {
+	f.sendMessage(token, "chat-conformance", "hello")
+	return map[string]string{"conversationId": "chat-conformance"}
+}
+
+func messageParam(f *conformanceFixture, token string) map[string]string {
+	return map[string]string{"messageId": f.sendMessage(token, "chat-conformance", "hello")}
+}
+
+// searchParams sends two messages to search for, and returns the conversation they are in.
+func searchParams(f *conformanceFixture, token string) map[string]string {
+	f.sendMessage(token, "chat-conformance", "Hello, world!")
+	return conversationParam(f, token)
+}
+
+func missingConversationParam(*conformanceFixture, string) map[string]string {
+	return map[string]string{"conversationId": "no-such-chat"}
+}
+
+func missingMessageParam(*conformanceFixture, string) map[string]string {
+	return map[string]string{"messageId": "no-such-message"}
+}
+
+// invalidConversationParam returns an identifier too short for idPattern.
+func invalidConversationParam(*conformanceFixture, string) map[string]string {
+	return map[string]string{"conversationId": "no"}
+}
+
+func invalidMessageParam(*conformanceFixture, string) map[string]string {
+	return map[string]string{"messageId": "no"}
+}
+
+func reactionParams(f *conformanceFixture, token string) map[string]string {
+	msgID := f.sendMessage(token, "chat-conformance", "hello")
+	return map[string]string{"messageId": msgID, "reactionId": f.react(token, msgID)}
+}
+
+// otherSessionParam logs in again as the same user, and returns the ID of the new session.
+func otherSessionParam(f *conformanceFixture, token string) map[string]string {
+	f.login("Tester")
+	_, data := f.do(http.MethodGet, "/sessions", token, "")
+	var out struct {
+		Sessions []struct {
+			ID      string
+			Current bool
+		}
+	}
+	f.decodeInto(data, &out)
+	for _, s := range out.Sessions {
+		if !s.Current {
+			return map[string]string{"sessionId": s.ID}
+		}
+	}
+	f.t.Fatalf("second session not listed: %s", data)
+	return nil
+}
+
+var testSignedTokens = TokenConfig{
+	Mode: TokenSigned,
+	Keys: []SigningKey{{ID: "test", Secret: []byte("0123456789abcdef0123456789abcdef")}},
+}
+
+// testSignedConfig issues signed tokens; the cases using it need the database.
+var testSignedConfig = Config{Tokens: testSignedTokens, Sessions: SessionConfig{AbsoluteTTL: time.Hour}}
+
+const testPassword = "conformance-password"
+
+// testPasswordAuth uses the minimum bcrypt cost, to keep the tests fast.
+var testPasswordAuth = AuthConfig{Mode: AuthPassword, PasswordCost: bcrypt.MinCost}
+
+const testAdminToken = "conformance-admin-token"
+
+var testAdminConfig = Config{AdminToken: testAdminToken}
+
+// testSchedulerConfig enables scheduled messages; the test messages are due long after the tests end.
+var testSchedulerConfig = Config{Scheduler: SchedulerConfig{Interval: time.Hour}}
+
+// testMediaConfig enables media uploads; the fixture sets the media directory.
+var testMediaConfig = Config{MediaURL: "https://media.example.com/files/"}
+
+// testPNG is the start of a PNG image, enough for its type to be detected.
+const testPNG = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+const testScheduledBody = `{"content":"good morning","sendAt":"2100-01-01T08:00:00Z"}`
+
+// pinnedParam sends a message and pins it.
+func pinnedParam(f *conformanceFixture, token string) map[string]string {
+	params := messageParam(f, token)
+	f.do(http.MethodPut, "/messages/"+params["messageId"]+"/pin", token, "")
+	return params
+}
+
+// starredParam sends a message and stars it.
+func starredParam(f *conformanceFixture, token string) map[string]string {
+	params := messageParam(f, token)
+	f.do(http.MethodPut, "/messages/"+params["messageId"]+"/star", token, "")
+	return params
+}
+
+// tooManyPinsParam pins as many messages as allowed, and returns another message.
+func tooManyPinsParam(f *conformanceFixture, token string) map[string]string {
+	for i := 0; i < maxPinnedMessages; i++ {
+		pinnedParam(f, token)
+	}
+	return messageParam(f, token)
+}
+
+// otherMessageParam sends a message as another user.
+func otherMessageParam(f *conformanceFixture, _ string) map[string]string {
+	return messageParam(f, f.login("Other"))
+}
+
+func scheduledParam(f *conformanceFixture, token string) map[string]string {
+	conversationParam(f, token)
+	_, data := f.do(http.MethodPost, "/conversations/chat-conformance/messages", token, testScheduledBody)
+	var out ScheduledMessage
+	f.decodeInto(data, &out)
+	return map[string]string{"scheduledId": out.ScheduledID}
+}
+
+// testArchive is a JSON export with a forward and a reaction, by a known user and an unknown one.
+const testArchive = `{"format":"wasatext-export","version":1,
+	"conversation":{"id":"chat-archived","name":"Archived chat","participants":["Tester","Jane Doe"],"exportedAt":"2026-10-18T10:00:00Z"},
+	"messages":[
+		{"messageId":"m1","sender":"Jane Doe","content":"hello","type":"text","timestamp":"2026-10-17T09:00:00Z"},
+		{"messageId":"m2","sender":"Tester","content":"hello","type":"text","timestamp":"2026-10-17T09:01:00Z",
+			"forwardedFrom":"m1","reactions":[{"reactionId":"r1","emoji":"👍"}]}
+	]}`
+
+const testWhatsAppArchive = "17/10/2026, 09:00 - Jane Doe created group \"Archived chat\"\n" +
+	"17/10/2026, 09:00 - Jane Doe: hello\nsecond line\n" +
+	"[17/10/2026, 09:01:30] Tester: <Media omitted>\n"
+
+var conformanceCases = []conformanceCase{
+	{name: "health", operationID: "getHealth", status: http.StatusOK, anonymous: true},
+
+	{name: "login", operationID: "doLogin", status: http.StatusCreated, anonymous: true, body: `{"name":"Alex"}`},
+	{name: "login without name", operationID: "doLogin", status: http.StatusBadRequest, anonymous: true, body: `{}`},
+	{name: "login with malformed JSON", operationID: "doLogin", status: http.StatusBadRequest, anonymous: true, body: `{"name":`},
+	{name: "login rate limited", operationID: "doLogin", status: http.StatusTooManyRequests, anonymous: true, body: `{"name":"Alex"}`,
+		config: Config{RateLimits: RateLimits{Login: RateLimit{Requests: 1, Per: time.Hour}}}},
+	{name: "login with signed tokens", operationID: "doLogin", status: http.StatusCreated, anonymous: true, body: `{"name":"Alex"}`,
+		config: testSignedConfig, database: true},
+	{name: "login with password", operationID: "doLogin", status: http.StatusCreated, anonymous: true,
+		body: `{"name":"Tester","password":"` + testPassword + `"}`, config: Config{Auth: testPasswordAuth}},
+	{name: "login with wrong password", operationID: "doLogin", status: http.StatusUnauthorized, anonymous: true,
+		body: `{"name":"Tester","password":"wrong-password"}`, config: Config{Auth: testPasswordAuth}},
+	{name: "login without password", operationID: "doLogin", status: http.StatusBadRequest, anonymous: true,
+		body: `{"name":"Alex"}`, config: Config{Auth: testPasswordAuth}},
+
+	{name: "logout", operationID: "doLogout", status: http.StatusNoContent},
+	{name: "logout anonymously", operationID: "doLogout", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "list sessions", operationID: "getMySessions", status: http.StatusOK, params: func(f *conformanceFixture, _ string) map[string]string {
+		f.login("Tester") // a second device
+		return nil
+	}},
+	{name: "list sessions anonymously", operationID: "getMySessions", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "revoke session", operationID: "revokeSession", status: http.StatusNoContent, params: otherSessionParam},
+	{name: "revoke missing session", operationID: "revokeSession", status: http.StatusNotFound, params: func(*conformanceFixture, string) map[string]string {
+		return map[string]string{"sessionId": "no-such-session"}
+	}},
+	{name: "revoke session with signed tokens", operationID: "revokeSession", status: http.StatusNoContent, params: otherSessionParam,
+		config: testSignedConfig, database: true},
+	{name: "revoke session anonymously", operationID: "revokeSession", status: http.StatusUnauthorized, anonymous: true, params: otherSessionParam},
+
+	{name: "set username", operationID: "setMyUserName", status: http.StatusOK, body: `{"name":"alex_01"}`},
+	{name: "set invalid username", operationID: "setMyUserName", status: http.StatusBadRequest, body: `{"name":"a b"}`},
+	{name: "set username anonymously", operationID: "setMyUserName", status: http.StatusUnauthorized, anonymous: true, body: `{"name":"alex_01"}`},
+	{name: "set username of a registered user", operationID: "setMyUserName", status: http.StatusConflict, body: `{"name":"alex_01"}`,
+		config: Config{Auth: testPasswordAuth}, params: func(f *conformanceFixture, _ string) map[string]string {
+			f.login("alex_01")
+			return nil
+		}},
+
+	{name: "set photo", operationID: "setMyPhoto", status: http.StatusOK, body: `{"mediaUrl":"https://example.com/me.jpg"}`},
+	{name: "set invalid photo", operationID: "setMyPhoto", status: http.StatusBadRequest, body: `{"mediaUrl":"not a url"}`},
+	{name: "set photo anonymously", operationID: "setMyPhoto", status: http.StatusUnauthorized, anonymous: true, body: `{"mediaUrl":"https://example.com/me.jpg"}`},
+
+	{name: "list conversations", operationID: "getMyConversations", status: http.StatusOK, params: conversationParam},
+	{name: "list conversations anonymously", operationID: "getMyConversations", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "get conversation", operationID: "getConversation", status: http.StatusOK, params: func(f *conformanceFixture, token string) map[string]string {
+		f.react(token, f.sendMessage(token, "chat-conformance", "hello"))
+		return map[string]string{"conversationId": "chat-conformance"}
+	}},
+	{name: "get conversation with pinned messages", operationID: "getConversation", status: http.StatusOK, params: func(f *conformanceFixture, token string) map[string]string {
+		pinnedParam(f, token)
+		return map[string]string{"conversationId": "chat-conformance"}
+	}},
+	{name: "get conversation with pinned messages in the database", operationID: "getConversation", status: http.StatusOK, params: func(f *conformanceFixture, token string) map[string]string {
+		pinnedParam(f, token)
+		return map[string]string{"conversationId": "chat-conformance"}
+	}, database: true},
+	{name: "get conversation anonymously", operationID: "getConversation", status: http.StatusUnauthorized, anonymous: true, params: conversationParam},
+	{name: "get conversation with invalid ID", operationID: "getConversation", status: http.StatusBadRequest, params: invalidConversationParam},
+
+	{name: "export as JSON", operationID: "exportConversation", status: http.StatusOK, params: conversationParam},
+	{name: "export as text", operationID: "exportConversation", status: http.StatusOK, query: "format=txt", params: conversationParam},
+	{name: "export as HTML", operationID: "exportConversation", status: http.StatusOK, query: "format=html", params: conversationParam},
+	{name: "export in unknown format", operationID: "exportConversation", status: http.StatusBadRequest, query: "format=pdf", params: conversationParam},
+	{name: "export missing conversation", operationID: "exportConversation", status: http.StatusNotFound,
+		params: missingConversationParam},
+	{name: "export conversation with invalid ID", operationID: "exportConversation", status: http.StatusBadRequest,
+		params: invalidConversationParam},
+	{name: "export anonymously", operationID: "exportConversation", status: http.StatusUnauthorized, anonymous: true, params: conversationParam},
+
+	{name: "set disappearing messages", operationID: "setConversationRetention", status: http.StatusOK,
+		body: `{"mode":"disappearing","hours":24}`, params: conversationParam},
+	{name: "set retention in days", operationID: "setConversationRetention", status: http.StatusOK,
+		body: `{"mode":"delete-after","days":30}`, params: conversationParam, database: true},
+	{name: "set retention without period", operationID: "setConversationRetention", status: http.StatusBadRequest,
+		body: `{"mode":"delete-after"}`, params: conversationParam},
+	{name: "set retention with the wrong period", operationID: "setConversationRetention", status: http.StatusBadRequest,
+		body: `{"mode":"keep","hours":2}`, params: conversationParam},
+	{name: "set retention of missing conversation", operationID: "setConversationRetention", status: http.StatusNotFound,
+		body: `{"mode":"keep"}`, params: missingConversationParam},
+	{name: "set retention anonymously", operationID: "setConversationRetention", status: http.StatusUnauthorized, anonymous: true,
+		body: `{"mode":"keep"}`, params: conversationParam},
+
+	{name: "send message", operationID: "sendMessage", status: http.StatusCreated, body: `{"content":"hi","type":"text"}`, params: conversationParam},
+	{name: "send empty message", operationID: "sendMessage", status: http.StatusBadRequest, body: `{"content":""}`, params: conversationParam},
+	{name: "send message with unknown field", operationID: "sendMessage", status: http.StatusBadRequest, body: `{"content":"hi","text":"hi"}`, params: conversationParam},
+	{name: "send message rate limited", operationID: "sendMessage", status: http.StatusTooManyRequests, body: `{"content":"hi"}`, params: conversationParam,
+		config: Config{RateLimits: RateLimits{Messaging: RateLimit{Requests: 1, Per: time.Hour}}}},
+	{name: "send message anonymously", operationID: "sendMessage", status: http.StatusUnauthorized, anonymous: true, body: `{"content":"hi"}`, params: conversationParam},
+	{name: "schedule message", operationID: "sendMessage", status: http.StatusAccepted, body: testScheduledBody, params: conversationParam,
+		config: testSchedulerConfig},
+	{name: "schedule message in the database", operationID: "sendMessage", status: http.StatusAccepted, body: testScheduledBody, params: conversationParam,
+		config: testSchedulerConfig, database: true},
+	{name: "send message at a past time", operationID: "sendMessage", status: http.StatusCreated, body: `{"content":"hi","sendAt":"2000-01-01T00:00:00Z"}`,
+		params: conversationParam, config: testSchedulerConfig},
+	{name: "send message at an invalid time", operationID: "sendMessage", status: http.StatusBadRequest, body: `{"content":"hi","sendAt":"tomorrow"}`,
+		params: conversationParam, config: testSchedulerConfig},
+	{name: "schedule message while disabled", operationID: "sendMessage", status: http.StatusConflict, body: testScheduledBody, params: conversationParam},
+
+	{name: "list scheduled messages", operationID: "getMyScheduledMessages", status: http.StatusOK, params: scheduledParam, config: testSchedulerConfig},
+	{name: "list no scheduled messages", operationID: "getMyScheduledMessages", status: http.StatusOK},
+	{name: "list scheduled messages anonymously", operationID: "getMyScheduledMessages", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "cancel scheduled message", operationID: "cancelScheduledMessage", status: http.StatusNoContent, params: scheduledParam, config: testSchedulerConfig},
+	{name: "cancel scheduled message in the database", operationID: "cancelScheduledMessage", status: http.StatusNoContent, params: scheduledParam,
+		config: testSchedulerConfig, database: true},
+	{name: "cancel missing scheduled message", operationID: "cancelScheduledMessage", status: http.StatusNotFound, params: func(*conformanceFixture, string) map[string]string {
+		return map[string]string{"scheduledId": "no-such-message"}
+	}},
+	{name: "cancel scheduled message anonymously", operationID: "cancelScheduledMessage", status: http.StatusUnauthorized, anonymous: true,
+		params: scheduledParam, config: testSchedulerConfig},
+
+	{name: "search", operationID: "searchMessages", status: http.StatusOK, query: "q=HELLO&limit=1", params: searchParams},
+	{name: "search next page", operationID: "searchMessages", status: http.StatusOK, params: func(f *conformanceFixture, token string) map[string]string {
+		searchParams(f, token)
+		_, data := f.do(http.MethodGet, "/search?q=hello&limit=1", token, "")
+		var out struct{ NextCursor string }
+		f.decodeInto(data, &out)
+		return map[string]string{"cursor": out.NextCursor}
+	}, query: "q=hello&cursor={cursor}"},
+	{name: "search without query", operationID: "searchMessages", status: http.StatusBadRequest},
+	{name: "search with invalid cursor", operationID: "searchMessages", status: http.StatusBadRequest, query: "q=hello&cursor=%21"},
+	{name: "search anonymously", operationID: "searchMessages", status: http.StatusUnauthorized, anonymous: true, query: "q=hello"},
+
+	{name: "search conversation", operationID: "searchConversation", status: http.StatusOK, query: "q=hello", params: searchParams},
+	{name: "search conversation with invalid limit", operationID: "searchConversation", status: http.StatusBadRequest, query: "q=hello&limit=0", params: searchParams},
+	{name: "search missing conversation", operationID: "searchConversation", status: http.StatusNotFound, query: "q=hello",
+		params: missingConversationParam},
+	{name: "search conversation anonymously", operationID: "searchConversation", status: http.StatusUnauthorized, anonymous: true, query: "q=hello", params: searchParams},
+
+	{name: "import JSON archive", operationID: "importConversation", status: http.StatusCreated, admin: true, body: testArchive,
+		config: testAdminConfig},
+	{name: "import dry run", operationID: "importConversation", status: http.StatusOK, admin: true, body: testArchive,
+		query: "dryRun=true&sender=Jane%20Doe%3Djane", config: testAdminConfig},
+	{name: "import WhatsApp archive", operationID: "importConversation", status: http.StatusCreated, admin: true, body: testWhatsAppArchive,
+		query: "format=whatsapp&timezone=Europe/Rome&name=Archived%20chat", config: testAdminConfig},
+	{name: "import invalid archive", operationID: "importConversation", status: http.StatusBadRequest, admin: true,
+		body: `{"format":"other","messages":[]}`, config: testAdminConfig},
+	{name: "import into existing conversation", operationID: "importConversation", status: http.StatusConflict, admin: true, body: testArchive,
+		query: "conversationId=chat-conformance", config: testAdminConfig, params: conversationParam},
+	{name: "import with user token", operationID: "importConversation", status: http.StatusUnauthorized, body: testArchive,
+		config: testAdminConfig},
+	{name: "import with admin API disabled", operationID: "importConversation", status: http.StatusForbidden, admin: true, body: testArchive},
+
+	{name: "back up", operationID: "backupDatabase", status: http.StatusOK, admin: true, database: true, params: messageParam,
+		config: testAdminConfig},
+	{name: "back up without database", operationID: "backupDatabase", status: http.StatusConflict, admin: true, config: testAdminConfig},
+	{name: "back up with user token", operationID: "backupDatabase", status: http.StatusUnauthorized, database: true,
+		config: testAdminConfig},
+	{name: "back up with admin API disabled", operationID: "backupDatabase", status: http.StatusForbidden, admin: true, database: true},
+
+	{name: "stream events", operationID: "getEvents", status: http.StatusOK, params: conversationParam,
+		config: Config{EventStreamTTL: 50 * time.Millisecond}},
+	{name: "stream events anonymously", operationID: "getEvents", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "forward message", operationID: "forwardMessage", status: http.StatusCreated, body: `{"conversationId":"chat-other"}`, params: messageParam},
+	{name: "forward to invalid conversation", operationID: "forwardMessage", status: http.StatusBadRequest, body: `{"conversationId":"c"}`, params: messageParam},
+	{name: "forward missing message", operationID: "forwardMessage", status: http.StatusNotFound, body: `{"conversationId":"chat-other"}`, params: missingMessageParam},
+	{name: "forward anonymously", operationID: "forwardMessage", status: http.StatusUnauthorized, anonymous: true, body: `{"conversationId":"chat-other"}`, params: messageParam},
+
+	{name: "react", operationID: "commentMessage", status: http.StatusCreated, body: `{"reaction":"👍"}`, params: messageParam},
+	{name: "react without reaction", operationID: "commentMessage", status: http.StatusBadRequest, body: `{}`, params: messageParam},
+	{name: "react to missing message", operationID: "commentMessage", status: http.StatusNotFound, body: `{"reaction":"👍"}`, params: missingMessageParam},
+	{name: "react anonymously", operationID: "commentMessage", status: http.StatusUnauthorized, anonymous: true, body: `{"reaction":"👍"}`, params: messageParam},
+
+	{name: "remove reaction", operationID: "uncommentMessage", status: http.StatusNoContent, params: reactionParams},
+	{name: "remove reaction anonymously", operationID: "uncommentMessage", status: http.StatusUnauthorized, anonymous: true, params: reactionParams},
+
+	{name: "delete message", operationID: "deleteMessage", status: http.StatusNoContent, params: messageParam},
+	{name: "delete message anonymously", operationID: "deleteMessage", status: http.StatusUnauthorized, anonymous: true, params: messageParam},
+	{name: "delete message of another user", operationID: "deleteMessage", status: http.StatusForbidden, params: otherMessageParam},
+	{name: "delete missing message", operationID: "deleteMessage", status: http.StatusNoContent, params: missingMessageParam},
+	{name: "delete message with invalid ID", operationID: "deleteMessage", status: http.StatusBadRequest, params: invalidMessageParam},
+
+	{name: "pin message", operationID: "pinMessage", status: http.StatusOK, params: messageParam},
+	{name: "pin message in the database", operationID: "pinMessage", status: http.StatusOK, params: messageParam, database: true},
+	{name: "pin pinned message", operationID: "pinMessage", status: http.StatusOK, params: pinnedParam},
+	{name: "pin too many messages", operationID: "pinMessage", status: http.StatusConflict, params: tooManyPinsParam},
+	{name: "pin missing message", operationID: "pinMessage", status: http.StatusNotFound, params: missingMessageParam},
+	{name: "pin message with invalid ID", operationID: "pinMessage", status: http.StatusBadRequest, params: invalidMessageParam},
+	{name: "pin message rate limited", operationID: "pinMessage", status: http.StatusTooManyRequests, params: messageParam,
+		config: Config{RateLimits: RateLimits{Messaging: RateLimit{Requests: 1, Per: time.Hour}}}},
+	{name: "pin message anonymously", operationID: "pinMessage", status: http.StatusUnauthorized, anonymous: true, params: messageParam},
+
+	{name: "unpin message", operationID: "unpinMessage", status: http.StatusNoContent, params: pinnedParam},
+	{name: "unpin message in the database", operationID: "unpinMessage", status: http.StatusNoContent, params: pinnedParam, database: true},
+	{name: "unpin message not pinned", operationID: "unpinMessage", status: http.StatusNoContent, params: messageParam},
+	{name: "unpin missing message", operationID: "unpinMessage", status: http.StatusNotFound, params: missingMessageParam},
+	{name: "unpin message anonymously", operationID: "unpinMessage", status: http.StatusUnauthorized, anonymous: true, params: pinnedParam},
+
+	{name: "star message", operationID: "starMessage", status: http.StatusNoContent, params: messageParam},
+	{name: "star message in the database", operationID: "starMessage", status: http.StatusNoContent, params: messageParam, database: true},
+	{name: "star starred message", operationID: "starMessage", status: http.StatusNoContent, params: starredParam},
+	{name: "star missing message", operationID: "starMessage", status: http.StatusNotFound, params: missingMessageParam},
+	{name: "star message anonymously", operationID: "starMessage", status: http.StatusUnauthorized, anonymous: true, params: messageParam},
+
+	{name: "unstar message", operationID: "unstarMessage", status: http.StatusNoContent, params: starredParam},
+	{name: "unstar message in the database", operationID: "unstarMessage", status: http.StatusNoContent, params: starredParam, database: true},
+	{name: "unstar message not starred", operationID: "unstarMessage", status: http.StatusNoContent, params: missingMessageParam},
+	{name: "unstar message anonymously", operationID: "unstarMessage", status: http.StatusUnauthorized, anonymous: true, params: starredParam},
+
+	{name: "list starred messages", operationID: "getStarredMessages", status: http.StatusOK, params: starredParam},
+	{name: "list starred messages in the database", operationID: "getStarredMessages", status: http.StatusOK, params: starredParam, database: true},
+	{name: "list no starred messages", operationID: "getStarredMessages", status: http.StatusOK},
+	{name: "list starred messages anonymously", operationID: "getStarredMessages", status: http.StatusUnauthorized, anonymous: true},
+
+	{name: "upload media", operationID: "uploadMedia", status: http.StatusCreated, body: testPNG, config: testMediaConfig},
+	{name: "upload media in the database", operationID: "uploadMedia", status: http.StatusCreated, body: testPNG, config: testMediaConfig,
+		database: true},
+	{name: "upload media of another type", operationID: "uploadMedia", status: http.StatusUnsupportedMediaType, body: "plain text",
+		config: testMediaConfig},
+	{name: "upload media with uploads disabled", operationID: "uploadMedia", status: http.StatusConflict, body: testPNG},
+	{name: "upload media anonymously", operationID: "uploadMedia", status: http.StatusUnauthorized, anonymous: true, body: testPNG,
+		config: testMediaConfig},
+
+	{name: "add group member", operationID: "addToGroup", status: http.StatusOK, body: `{"id":"charlie"}`, params: conversationParam},
+	{name: "add invalid group member", operationID: "addToGroup", status: http.StatusBadRequest, body: `{"id":"c"}`, params: conversationParam},
+	{name: "add group member anonymously", operationID: "addToGroup", status: http.StatusUnauthorized, anonymous: true, body: `{"id":"charlie"}`, params: conversationParam},
+
+	{name: "leave group", operationID: "leaveGroup", status: http.StatusOK, params: conversationParam},
+	{name: "leave group anonymously", operationID: "leaveGroup", status: http.StatusUnauthorized, anonymous: true, params: conversationParam},
+
+	{name: "set group name", operationID: "setGroupName", status: http.StatusOK, body: `{"name":"Chat Group"}`, params: conversationParam},
+	{name: "set invalid group name", operationID: "setGroupName", status: http.StatusBadRequest, body: `{"name":"x"}`, params: conversationParam},
+	{name: "set group name anonymously", operationID: "setGroupName", status: http.StatusUnauthorized, anonymous: true, body: `{"name":"Chat Group"}`, params: conversationParam},
+
+	{name: "set group photo", operationID: "setGroupPhoto", status: http.StatusOK, body: `{"mediaUrl":"https://example.com/group.jpg"}`, params: conversationParam},
+	{name: "set invalid group photo", operationID: "setGroupPhoto", status: http.StatusBadRequest, body: `{"mediaUrl":"ftp://x"}`, params: conversationParam},
+	{name: "set group photo anonymously", operationID: "setGroupPhoto", status: http.StatusUnauthorized, anonymous: true, body: `{"mediaUrl":"https://example.com/group.jpg"}`, params: conversationParam},
+}
+
+// TestOpenAPIRoutes checks that the router serves exactly the documented operations.
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	documented := map[string]bool{}
+	for _, op := range spec.operations() {
+		documented[op.method+" "+op.path] = true
+	}
+
+	rt := NewRouter()
+	registered := map[string]bool{}
+	for _, r := range rt.routes {
+		// httprouter uses :name for parameters, OpenAPI uses {name}
+		parts := strings.Split(r.path, "/")
+		for i, p := range parts {
+			if strings.HasPrefix(p, ":") {
+				parts[i] = "{" + p[1:] + "}"
+			}
+		}
+		registered[r.method+" "+strings.Join(parts, "/")] = true
+	}
+
+	for k := range registered {
+		if !documented[k] {
+			t.Errorf("route %s is not documented in %s", k, specPath)
+		}
+	}
+	for k := range documented {
+		if !registered[k] {
+			t.Errorf("operation %s is documented but not served", k)
+		}
+	}
+}
+
+// TestOpenAPIConformance runs every case against a live server and validates the responses against the spec.
+func TestOpenAPIConformance(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	ops := map[string]specOperation{}
+	for _, op := range spec.operations() {
+		if op.id == "" {
+			t.Errorf("%s %s has no operationId", op.method, op.path)
+			continue
+		}
+		ops[op.id] = op
+	}
+
+	exercised := map[string]bool{}
+	for _, tc := range conformanceCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			op, ok := ops[tc.operationID]
+			if !ok {
+				t.Fatalf("operation %q is not documented", tc.operationID)
+			}
+			exercised[tc.operationID] = true
+
+			cfg := tc.config
+			if cfg.MediaURL != "" {
+				cfg.MediaDir = t.TempDir()
+			}
+			if tc.database {
+				cfg.Database, cfg.Storage = newTestDatabase(t), StorageSQLite
+			}
+			f := newConformanceFixture(t, cfg)
+			token := f.login("Tester")
+
+			path := op.path
+			if tc.query != "" {
+				path += "?" + tc.query
+			}
+			if tc.params != nil {
+				for k, v := range tc.params(f, token) {
+					path = strings.ReplaceAll(path, "{"+k+"}", url.PathEscape(v))
+				}
+			}
+			if strings.Contains(path, "{") {
+				t.Fatalf("unresolved path parameters in %s", path)
+			}
+			if tc.anonymous {
+				token = ""
+			} else if tc.admin {
+				token = testAdminToken
+			}
+
+			resp, data := f.do(op.method, path, token, tc.body)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("%s %s: got status %d, want %d (body: %s)", op.method, path, resp.StatusCode, tc.status, data)
+			}
+
+			doc, ok := spec.response(op, resp.StatusCode)
+			if !ok {
+				t.Fatalf("%s %s: status %d is not documented", op.method, path, resp.StatusCode)
+			}
+			content, _ := doc["content"].(map[string]interface{})
+			if len(content) == 0 {
+				if len(data) != 0 {
+					t.Errorf("%s %s: documented without content, got body %s", op.method, path, data)
+				}
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("%s %s: invalid Content-Type %q: %v", op.method, path, resp.Header.Get("Content-Type"), err)
+			}
+			media, ok := content[mediaType].(map[string]interface{})
+			if !ok {
+				t.Fatalf("%s %s: no %s content documented for %d", op.method, path, mediaType, resp.StatusCode)
+			}
+			if mediaType != "application/json" {
+				// Only JSON bodies are validated against the schema
+				return
+			}
+			var body interface{}
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Fatalf("%s %s: invalid JSON body %s: %v", op.method, path, data, err)
+			}
+			schema, _ := media["schema"].(map[string]interface{})
+			for _, e := range spec.validate(schema, body, "body") {
+				t.Errorf("%s %s: %s", op.method, path, e)
+			}
+		})
+	}
+
+	for id := range ops {
+		if !exercised[id] {
+			t.Errorf("operation %s has no conformance case", id)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+const (
+	// maxPinnedMessages is how many messages a conversation can have pinned
+	maxPinnedMessages = 3
+
+	// pinPreviewLength is how many characters of a text message the pin announcements quote
+	pinPreviewLength = 40
+)
+
+// pinAnnouncement returns the content of the system message that announces that username pinned, or unpinned, m.
+func pinAnnouncement(username, action string, m *Message) string {
+	if m.Type == "image" {
+		return fmt.Sprintf("%s %s an image", username, action)
+	}
+	preview := []rune(m.Content)
+	if len(preview) > pinPreviewLength {
+		preview = append(preview[:pinPreviewLength], '…')
+	}
+	return fmt.Sprintf("%s %s a message: \"%s\"", username, action, string(preview))
+}
+
+/* helpers bound to Router */
+
+// findMessage returns the message id, or an error for writeError if it doesn't exist.
+func (rt *Router) findMessage(id string) (Message, error) {
+	m, err := rt.store.message(id)
+	if errors.Is(err, database.ErrNotFound) {
+		return Message{}, errNotFound("message not found")
+	} else if err != nil {
+		return Message{}, errInternal(fmt.Errorf("reading message: %w", err))
+	}
+	return m, nil
+}
+
+/* ROUTE HANDLERS */
+
+// pinMessage pins a message in its conversation, and announces it there. Pinning a pinned message changes nothing.
+func (rt *Router) pinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	m, err := rt.findMessage(ps.ByName("messageId"))
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	pin := Pin{MessageID: m.MessageID, PinnedBy: sess.Username, PinnedAt: rt.clock.Now().UTC()}
+	err = rt.store.pinMessage(m.ConversationID, pin, maxPinnedMessages)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("message not found"))
+		return
+	} else if errors.Is(err, database.ErrLimitReached) {
+		writeError(w, ctx, errConflict(fmt.Sprintf("at most %d messages can be pinned", maxPinnedMessages)))
+		return
+	} else if errors.Is(err, database.ErrAlreadyExists) {
+		// The message keeps its pin, unless it was unpinned in the meantime
+		pins, err := rt.store.pins(m.ConversationID)
+		if err != nil {
+			writeError(w, ctx, errInternal(fmt.Errorf("reading pins: %w", err)))
+			return
+		}
+		for _, p := range pins {
+			if p.MessageID == m.MessageID {
+				pin = p
+			}
+		}
+		writeJSON(w, http.StatusOK, pin)
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("pinning message: %w", err)))
+		return
+	}
+	c, err := rt.store.conversation(m.ConversationID)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+		return
+	}
+	rt.publish(c, Event{Type: EventMessagePinned, MessageID: m.MessageID})
+	if err := rt.announce(m.ConversationID, sess.Username, pinAnnouncement(sess.Username, "pinned", &m)); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("storing message: %w", err)))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pin)
+}
+
+// unpinMessage unpins a message, and announces it in its conversation. Unpinning a message that isn't pinned
+// succeeds without an announcement.
+func (rt *Router) unpinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	m, err := rt.findMessage(ps.ByName("messageId"))
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	err = rt.store.unpinMessage(m.ConversationID, m.MessageID)
+	if errors.Is(err, database.ErrNotFound) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("unpinning message: %w", err)))
+		return
+	}
+	c, err := rt.store.conversation(m.ConversationID)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+		return
+	}
+	rt.publish(c, Event{Type: EventMessageUnpinned, MessageID: m.MessageID})
+	if err := rt.announce(m.ConversationID, sess.Username, pinAnnouncement(sess.Username, "unpinned", &m)); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("storing message: %w", err)))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// starMessage stars a message for the user. Starring a starred message changes nothing.
+func (rt *Router) starMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	m, err := rt.findMessage(ps.ByName("messageId"))
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	err = rt.store.starMessage(sess.Username, m.MessageID, rt.clock.Now().UTC())
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("message not found"))
+		return
+	} else if err != nil && !errors.Is(err, database.ErrAlreadyExists) {
+		writeError(w, ctx, errInternal(fmt.Errorf("starring message: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unstarMessage removes the star of the user from a message. Removing a missing star succeeds.
+func (rt *Router) unstarMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	err = rt.store.unstarMessage(sess.Username, ps.ByName("messageId"))
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errInternal(fmt.Errorf("unstarring message: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getStarredMessages lists the messages starred by the user, the last starred first.
+func (rt *Router) getStarredMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	starred, err := rt.store.starredMessages(sess.Username)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("listing starred messages: %w", err)))
+		return
+	}
+	if starred == nil {
+		starred = []StarredMessage{}
+	}
+	writeJSON(w, http.StatusOK, StarredMessageList{Messages: starred})
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+)
+
+// TestPinnedAndStarredMessages pins messages for the participants of a conversation, stars them for one user, and
+// checks that both go with a deleted message.
+func TestPinnedAndStarredMessages(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	for _, storage := range []StorageBackend{StorageMemory, StorageSQLite} {
+		t.Run(string(storage), func(t *testing.T) {
+			clock := globaltime.NewFake(t0)
+			cfg := Config{Storage: storage, Clock: clock}
+			if storage == StorageSQLite {
+				cfg.Database = newTestDatabase(t)
+			}
+			rt, f := newRetentionFixture(t, cfg)
+			alice, bob, carol := f.login("alice"), f.login("bob"), f.login("carol")
+			// The messages are sent a second apart, so that they have an order
+			send := func(token, conversationID, content string) string {
+				t.Helper()
+				clock.Advance(time.Second)
+				return f.sendMessage(token, conversationID, content)
+			}
+			hello := send(alice, "chat", "hello")
+			long := send(bob, "chat", strings.Repeat("la ", 20))
+			other := send(bob, "chat", "other")
+			send(carol, "elsewhere", "hi")
+
+			conversation := func() *ConversationDTO {
+				t.Helper()
+				_, data := f.do(http.MethodGet, "/conversations/chat", alice, "")
+				var out ConversationResponse
+				f.decodeInto(data, &out)
+				return out.Conversation
+			}
+			lastMessage := func() *Message {
+				t.Helper()
+				msgs := conversation().Messages
+				return msgs[len(msgs)-1]
+			}
+			pin := func(token, id string, status int) {
+				t.Helper()
+				clock.Advance(time.Second)
+				if resp, data := f.do(http.MethodPut, "/messages/"+id+"/pin", token, ""); resp.StatusCode != status {
+					t.Fatalf("pinning %s: status %d, want %d (body: %s)", id, resp.StatusCode, status, data)
+				}
+			}
+
+			// Pins are announced once, and pushed to the participants
+			sub, _ := rt.events.subscribe("bob", 0, clock.Now())
+			defer rt.events.unsubscribe(sub)
+			pin(bob, hello, http.StatusOK)
+			pin(bob, hello, http.StatusOK)
+			c := conversation()
+			if len(c.Pinned) != 1 || c.Pinned[0].MessageID != hello || c.Pinned[0].PinnedBy != "bob" || !c.Pinned[0].PinnedAt.Equal(t0.Add(5*time.Second)) {
+				t.Errorf("pinned messages: got %+v", c.Pinned)
+			}
+			if len(c.Messages) != 4 {
+				t.Fatalf("messages after pinning twice: got %d, want 4", len(c.Messages))
+			}
+			if m := c.Messages[3]; m.Type != "system" || m.Content != `bob pinned a message: "hello"` {
+				t.Errorf("announcement of the pin: got %+v", m)
+			}
+			select {
+			case e := <-sub.ch:
+				if e.Type != EventMessagePinned || e.MessageID != hello || e.ConversationID != "chat" {
+					t.Errorf("event of the pin: got %+v", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event for the pin")
+			}
+			pin(carol, "missing", http.StatusNotFound)
+
+			// The pins are limited, and long messages are cut in the announcements
+			pin(alice, long, http.StatusOK)
+			if m := lastMessage(); m.Content != `alice pinned a message: "`+strings.Repeat("la ", 13)+`l…"` {
+				t.Errorf("announcement of a long message: got %q", m.Content)
+			}
+			pin(alice, other, http.StatusOK)
+			pin(alice, send(alice, "chat", "one more"), http.StatusConflict)
+
+			clock.Advance(time.Second)
+			if resp, _ := f.do(http.MethodDelete, "/messages/"+other+"/pin", alice, ""); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("unpinning: status %d, want 204", resp.StatusCode)
+			}
+			if m := lastMessage(); m.Content != `alice unpinned a message: "other"` {
+				t.Errorf("announcement of the unpin: got %q", m.Content)
+			}
+			if resp, _ := f.do(http.MethodDelete, "/messages/"+other+"/pin", alice, ""); resp.StatusCode != http.StatusNoContent {
+				t.Errorf("unpinning a message not pinned: status %d, want 204", resp.StatusCode)
+			}
+			if m := lastMessage(); m.Content != `alice unpinned a message: "other"` {
+				t.Errorf("unpinning a message not pinned was announced: got %q", m.Content)
+			}
+
+			// Stars are for the user only, the last starred first
+			star := func(token, id string, status int) {
+				t.Helper()
+				if resp, data := f.do(http.MethodPut, "/messages/"+id+"/star", token, ""); resp.StatusCode != status {
+					t.Fatalf("starring %s: status %d, want %d (body: %s)", id, resp.StatusCode, status, data)
+				}
+			}
+			starred := func(token string) []StarredMessage {
+				t.Helper()
+				resp, data := f.do(http.MethodGet, "/starred", token, "")
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("listing starred messages: status %d (body: %s)", resp.StatusCode, data)
+				}
+				var out StarredMessageList
+				f.decodeInto(data, &out)
+				return out.Messages
+			}
+			starredAt := clock.Now()
+			star(bob, hello, http.StatusNoContent)
+			clock.Advance(time.Minute)
+			star(bob, other, http.StatusNoContent)
+			star(bob, hello, http.StatusNoContent)
+			star(carol, "missing", http.StatusNotFound)
+			list := starred(bob)
+			if len(list) != 2 || list[0].Message.MessageID != other || list[1].Message.MessageID != hello || !list[1].StarredAt.Equal(starredAt) {
+				t.Errorf("starred messages of bob: got %+v", list)
+			}
+			if list[1].Message.Content != "hello" || list[1].Message.Sender != "alice" {
+				t.Errorf("starred message: got %+v", list[1].Message)
+			}
+			if list := starred(alice); len(list) != 0 {
+				t.Errorf("starred messages of alice: got %+v", list)
+			}
+
+			// Deleting a message unpins and unstars it
+			if resp, _ := f.do(http.MethodDelete, "/messages/"+hello, alice, ""); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("deleting a message: status %d, want 204", resp.StatusCode)
+			}
+			if c := conversation(); len(c.Pinned) != 1 || c.Pinned[0].MessageID != long {
+				t.Errorf("pinned messages after deleting a message: got %+v", c.Pinned)
+			}
+			if list := starred(bob); len(list) != 1 || list[0].Message.MessageID != other {
+				t.Errorf("starred messages after deleting a message: got %+v", list)
+			}
+			if resp, _ := f.do(http.MethodDelete, "/messages/"+other+"/star", bob, ""); resp.StatusCode != http.StatusNoContent {
+				t.Errorf("unstarring: status %d, want 204", resp.StatusCode)
+			}
+			if list := starred(bob); len(list) != 0 {
+				t.Errorf("starred messages after unstarring: got %+v", list)
+			}
+		})
+	}
+}
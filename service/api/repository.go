@@ -0,0 +1,188 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// StorageBackend selects where the router keeps users, sessions, conversations and messages.
+type StorageBackend string
+
+const (
+	// StorageMemory keeps the state in memory: it's lost on restart, unless Config.Persistence saves it on disk
+	StorageMemory StorageBackend = "memory"
+
+	// StorageSQLite keeps the state in Config.Database, which must be migrated to the latest schema
+	StorageSQLite StorageBackend = "sqlite"
+)
+
+// repository stores the state of the router. Implementations are safe for concurrent use, and share no memory with
+// their callers: values are copied in and out. Like the database package, whose errors they use, they report missing
+// rows with database.ErrNotFound, and taken keys with database.ErrAlreadyExists.
+type repository interface {
+	// passwordHash returns the bcrypt hash of the password of username, nil if they have none
+	passwordHash(username string) ([]byte, error)
+
+	// setPasswordHash sets the password of username if they have none, and returns the hash they have afterwards
+	setPasswordHash(username string, hash []byte, now time.Time) ([]byte, error)
+
+	// renameUser moves the sessions, the scheduled messages, the stars, the media and the password of oldName to
+	// newName, and records that oldName was given up at at. It fails with ErrAlreadyExists if newName has a password.
+	renameUser(oldName, newName string, at time.Time) error
+
+	// userRenamedAt returns when a user was last renamed away from name, or the zero time if no user was
+	userRenamedAt(name string) (time.Time, error)
+
+	// knownUsers returns the users with a session, a password or a place in a conversation
+	knownUsers() (map[string]bool, error)
+
+	createSession(s Session) error
+	session(id string) (Session, error)
+	sessionByToken(tokenHash string) (Session, error)
+	touchSession(id string, t time.Time) error
+	deleteSession(id string) error
+
+	// userSessions returns the sessions of username
+	userSessions(username string) ([]Session, error)
+
+	// deleteExpiredSessions deletes and returns the sessions unused since idleBefore, or created before
+	// createdBefore. Zero times disable the corresponding condition.
+	deleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error)
+
+	// revokeToken rejects the signed tokens of a session until they expire, forever if until is zero
+	revokeToken(sessionID string, until time.Time) error
+	isTokenRevoked(sessionID string) (bool, error)
+
+	// forgetRevokedTokens forgets the revocations of the tokens expired at now
+	forgetRevokedTokens(now time.Time) error
+
+	// sessionEpoch returns when the store started keeping sessions: now, the first time it's called
+	sessionEpoch(now time.Time) (time.Time, error)
+
+	// listConversations returns every conversation, without messages
+	listConversations() ([]Conversation, error)
+
+	// conversation returns a conversation without messages
+	conversation(id string) (Conversation, error)
+
+	// openConversation returns a conversation with its messages, creating it with username as only participant if
+	// it doesn't exist
+	openConversation(id, username string, now time.Time) (Conversation, error)
+
+	// participantConversations returns the IDs of the conversations of username
+	participantConversations(username string) ([]string, error)
+
+	// addMessage appends m to its conversation, creating it if needed, and makes author a participant: the sender,
+	// or the user who forwarded m. It returns the conversation, without messages.
+	addMessage(m Message, author string) (Conversation, error)
+
+	message(id string) (Message, error)
+
+	// deleteMessage deletes a message, and returns the conversation it was in, without messages
+	deleteMessage(id string) (Conversation, error)
+
+	// addReaction adds rx to a message, and returns the conversation of the message, without messages
+	addReaction(messageID string, rx Reaction) (Conversation, error)
+
+	// removeReaction deletes a reaction, and returns it with the conversation of the message, without messages
+	removeReaction(messageID, reactionID string) (Reaction, Conversation, error)
+
+	// messagesAfter returns up to limit messages of a conversation that come after the given position, oldest
+	// first; a limit of zero or less returns them all. A zero position starts from the first message. If the message
+	// at the position was deleted, paging resumes after it in (timestamp, ID) order.
+	messagesAfter(conversationID string, after database.MessagePosition, limit int) ([]Message, error)
+
+	// importConversation stores c with its messages, or fails with ErrAlreadyExists if its ID is taken
+	importConversation(c Conversation) error
+
+	// setRetention sets the retention policy of a conversation, and returns the conversation, without messages
+	setRetention(conversationID string, p RetentionPolicy) (Conversation, error)
+
+	// imageInUse reports whether an image message has url as content, or a conversation has it as photo
+	imageInUse(url string) (bool, error)
+
+	// addMedia records a media file uploaded by its owner, or fails with ErrAlreadyExists if its URL is taken
+	addMedia(m Media) error
+
+	// attachMedia ties the media file at url to the message it was uploaded for, or fails with ErrNotFound unless the
+	// file belongs to owner and is tied to no message yet
+	attachMedia(url, owner, messageID string) error
+
+	// messageMedia returns the media file tied to a message, or fails with ErrNotFound
+	messageMedia(messageID string) (Media, error)
+
+	// deleteMedia forgets a media file, or fails with ErrNotFound
+	deleteMedia(url string) error
+
+	// scheduleMessage stores a scheduled message, or fails with ErrAlreadyExists if its ID is taken, or with
+	// ErrLimitReached if its sender has limit scheduled messages (0 for no limit)
+	scheduleMessage(sm ScheduledMessage, limit int) error
+
+	// scheduledMessages returns the scheduled messages of sender, the first to send first
+	scheduledMessages(sender string) ([]ScheduledMessage, error)
+
+	// dueScheduledMessages returns up to limit scheduled messages to send at now, the first to send first
+	dueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error)
+
+	// cancelScheduledMessage deletes a scheduled message of sender, and returns it
+	cancelScheduledMessage(id, sender string) (ScheduledMessage, error)
+
+	// deliverScheduledMessage replaces a scheduled message with m, which is added like addMessage does, by its
+	// sender. It fails with ErrNotFound if the scheduled message is gone: cancelled, or delivered already.
+	deliverScheduledMessage(id string, m Message) (Conversation, error)
+
+	// pins returns the pins of a conversation, the oldest first
+	pins(conversationID string) ([]Pin, error)
+
+	// pinMessage pins a message of a conversation, or fails with ErrNotFound if the message is not in the
+	// conversation, with ErrAlreadyExists if it's pinned, or with ErrLimitReached if the conversation has limit pins
+	// (0 for no limit). Pins go with their message when it's deleted.
+	pinMessage(conversationID string, p Pin, limit int) error
+
+	// unpinMessage unpins a message of a conversation, or fails with ErrNotFound if it's not pinned
+	unpinMessage(conversationID, messageID string) error
+
+	// starMessage stars a message for username at t, or fails with ErrNotFound if the message doesn't exist, or with
+	// ErrAlreadyExists if username starred it already. Stars go with their message when it's deleted.
+	starMessage(username, messageID string, t time.Time) error
+
+	// unstarMessage removes the star of username from a message, or fails with ErrNotFound if there is none
+	unstarMessage(username, messageID string) error
+
+	// starredMessages returns the messages starred by username, the last starred first
+	starredMessages(username string) ([]StarredMessage, error)
+}
+
+// newRepository returns the repository selected by cfg.
+func newRepository(cfg Config) (repository, error) {
+	switch cfg.Storage {
+	case "", StorageMemory:
+		if cfg.Persistence.Dir != "" {
+			d, err := openDurableStore(cfg.Persistence, cfg.Clock, cfg.Logger)
+			if err != nil {
+				return nil, fmt.Errorf("persistence: %w", err)
+			}
+			return d, nil
+		}
+		return newStore(), nil
+	case StorageSQLite:
+		if cfg.Persistence.Dir != "" {
+			return nil, fmt.Errorf("the %s storage is durable already: persistence is for the %s storage", cfg.Storage, StorageMemory)
+		}
+		if cfg.Database == nil {
+			return nil, fmt.Errorf("the %s storage needs a database", cfg.Storage)
+		}
+		version, err := cfg.Database.SchemaVersion()
+		if err != nil {
+			return nil, fmt.Errorf("reading the schema version: %w", err)
+		}
+		if version != database.LatestSchemaVersion() {
+			return nil, fmt.Errorf("the database schema is at version %d, version %d is required", version, database.LatestSchemaVersion())
+		}
+		return &dbStore{db: cfg.Database, tokenTTL: cfg.Sessions.AbsoluteTTL}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+}
@@ -0,0 +1,663 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/mlatsa/WASAProject/internal/service/wal"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestDatabase returns a database in a temporary file, migrated to the latest schema.
+func newTestDatabase(t *testing.T) database.AppDatabase {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "wasa.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	conn.SetMaxOpenConns(1)
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestRepository runs the same scenario on every storage backend.
+func TestRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testRepository(t, newStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		repo, err := newRepository(Config{Database: newTestDatabase(t), Storage: StorageSQLite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRepository(t, repo)
+	})
+	t.Run("durable", func(t *testing.T) {
+		testRepository(t, newTestDurableStore(t, PersistenceConfig{Dir: t.TempDir()}))
+	})
+}
+
+// TestScheduleMessageLimit schedules messages concurrently on every storage backend: the limit of each sender must
+// hold.
+func TestScheduleMessageLimit(t *testing.T) {
+	repos := map[string]func(t *testing.T) repository{
+		"memory": func(*testing.T) repository { return newStore() },
+		"sqlite": func(t *testing.T) repository {
+			repo, err := newRepository(Config{Database: newTestDatabase(t), Storage: StorageSQLite})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+		"durable": func(t *testing.T) repository {
+			return newTestDurableStore(t, PersistenceConfig{Dir: t.TempDir()})
+		},
+	}
+	for name, newRepo := range repos {
+		newRepo := newRepo
+		t.Run(name, func(t *testing.T) {
+			repo := newRepo(t)
+			t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+			const limit, attempts = 10, 30
+			errs := make(chan error, 2*attempts)
+			var wg sync.WaitGroup
+			for i := 0; i < attempts; i++ {
+				for _, sender := range []string{"alice", "bob"} {
+					wg.Add(1)
+					go func(id, sender string) {
+						defer wg.Done()
+						errs <- repo.scheduleMessage(ScheduledMessage{ScheduledID: id, ConversationID: "chat", Sender: sender,
+							Content: "hi", Type: "text", SendAt: t0.Add(time.Hour), CreatedAt: t0}, limit)
+					}(fmt.Sprintf("%s-%d", sender, i), sender)
+				}
+			}
+			wg.Wait()
+			close(errs)
+
+			stored, limited := 0, 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					stored++
+				case errors.Is(err, database.ErrLimitReached):
+					limited++
+				default:
+					t.Errorf("scheduling a message: %v", err)
+				}
+			}
+			if stored != 2*limit || limited != 2*(attempts-limit) {
+				t.Errorf("got %d messages stored and %d over the limit, want %d and %d", stored, limited, 2*limit, 2*(attempts-limit))
+			}
+			for _, sender := range []string{"alice", "bob"} {
+				if list, err := repo.scheduledMessages(sender); err != nil || len(list) != limit {
+					t.Errorf("scheduled messages of %s: got %d, %v, want %d", sender, len(list), err, limit)
+				}
+			}
+		})
+	}
+}
+
+// newTestDurableStore opens the durable store saved in cfg.Dir. It isn't closed: tests close it, or leave it open as
+// if the server crashed.
+func newTestDurableStore(t *testing.T, cfg PersistenceConfig) *durableStore {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	d, err := openDurableStore(cfg, globaltime.System{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// encodedState returns the state of s as JSON, in a stable order. Restored stores may differ in ways that JSON
+// doesn't show (e.g., nil and empty slices).
+func encodedState(t *testing.T, s *Store) string {
+	t.Helper()
+	st := s.state()
+	sort.Slice(st.Sessions, func(i, j int) bool { return st.Sessions[i].ID < st.Sessions[j].ID })
+	sort.Slice(st.Conversations, func(i, j int) bool { return st.Conversations[i].ID < st.Conversations[j].ID })
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestDurableStore checks that the durable store is restored as it was, from its log after a crash, and from its
+// snapshot after Close.
+func TestDurableStore(t *testing.T) {
+	for _, policy := range []wal.SyncPolicy{wal.SyncAlways, wal.SyncInterval, wal.SyncNever} {
+		t.Run(string(policy), func(t *testing.T) {
+			cfg := PersistenceConfig{Dir: t.TempDir(), Sync: policy}
+			d := newTestDurableStore(t, cfg)
+			testRepository(t, d)
+			want := encodedState(t, d.Store)
+
+			// The state is replayed from the log, as the store wasn't closed
+			crashed := newTestDurableStore(t, cfg)
+			if got := encodedState(t, crashed.Store); got != want {
+				t.Fatalf("state after a crash:\n got %s\nwant %s", got, want)
+			}
+			_ = d.log.Close()
+			if err := crashed.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The state is read from the snapshot taken by Close, with an empty log
+			restarted := newTestDurableStore(t, cfg)
+			defer restarted.Close()
+			if got := encodedState(t, restarted.Store); got != want {
+				t.Errorf("state after a restart:\n got %s\nwant %s", got, want)
+			}
+			if restarted.changes != 0 {
+				t.Errorf("records replayed after a snapshot: got %d, want 0", restarted.changes)
+			}
+		})
+	}
+}
+
+// TestDurableStoreSnapshots checks that snapshots are taken on the ticks of the clock.
+func TestDurableStoreSnapshots(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	d, err := openDurableStore(PersistenceConfig{Dir: t.TempDir(), SnapshotInterval: time.Minute}, clock, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.setPasswordHash("alice", []byte("hash"), clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	changes := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.changes
+	}
+
+	clock.WaitForTickers(1)
+	clock.Advance(59 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if n := changes(); n != 1 {
+		t.Fatalf("changes before the first tick: got %d, want 1", n)
+	}
+	clock.Advance(time.Second)
+	for deadline := time.Now().Add(5 * time.Second); changes() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot on the tick of the clock")
+		}
+	}
+}
+
+func testRepository(t *testing.T, repo repository) {
+	// SQLite keeps nanoseconds, but not the monotonic clock nor the location
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	check := func(what string, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	}
+
+	// Passwords are set once
+	hash, err := repo.passwordHash("alice")
+	check("reading a missing password", err)
+	if hash != nil {
+		t.Errorf("password of a new user: got %q, want none", hash)
+	}
+	hash, err = repo.setPasswordHash("alice", []byte("first"), t0)
+	check("setting the password", err)
+	if string(hash) != "first" {
+		t.Errorf("setting the password: got %q", hash)
+	}
+	hash, err = repo.setPasswordHash("alice", []byte("second"), t0)
+	check("setting the password again", err)
+	if string(hash) != "first" {
+		t.Errorf("setting the password again: got %q, want the first one", hash)
+	}
+
+	// Sessions
+	check("creating a session", repo.createSession(Session{ID: "s1", Username: "alice", CreatedAt: t0, LastUsedAt: t0, TokenHash: "h1"}))
+	check("creating a session", repo.createSession(Session{ID: "s2", Username: "alice", CreatedAt: t0, LastUsedAt: t0.Add(time.Hour)}))
+	if err := repo.createSession(Session{ID: "s1", Username: "bob", CreatedAt: t0, LastUsedAt: t0}); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("creating a session twice: got %v, want ErrAlreadyExists", err)
+	}
+	sess, err := repo.sessionByToken("h1")
+	check("reading a session by token", err)
+	if sess.ID != "s1" || sess.Username != "alice" || !sess.CreatedAt.Equal(t0) {
+		t.Errorf("reading a session by token: got %+v", sess)
+	}
+	check("touching a session", repo.touchSession("s1", t0.Add(2*time.Hour)))
+	sess, err = repo.session("s1")
+	check("reading a session", err)
+	if !sess.LastUsedAt.Equal(t0.Add(2 * time.Hour)) {
+		t.Errorf("touching a session: last used at %v", sess.LastUsedAt)
+	}
+	if err := repo.touchSession("missing", t0); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("touching a missing session: got %v, want ErrNotFound", err)
+	}
+
+	// The session epoch is set once
+	for _, now := range []time.Time{t0, t0.Add(time.Hour)} {
+		if epoch, err := repo.sessionEpoch(now); err != nil || !epoch.Equal(t0) {
+			t.Errorf("session epoch: got %v, %v, want %v", epoch, err, t0)
+		}
+	}
+
+	// Renaming moves the sessions and the password, unless the new name has a password, and records the old name
+	check("renaming", repo.renameUser("alice", "alicia", t0.Add(time.Hour)))
+	if at, err := repo.userRenamedAt("alice"); err != nil || !at.Equal(t0.Add(time.Hour)) {
+		t.Errorf("rename of alice: got %v, %v", at, err)
+	}
+	if at, err := repo.userRenamedAt("alicia"); err != nil || !at.IsZero() {
+		t.Errorf("rename of alicia: got %v, %v, want the zero time", at, err)
+	}
+	sessions, err := repo.userSessions("alicia")
+	check("listing sessions", err)
+	if len(sessions) != 2 {
+		t.Errorf("sessions after renaming: got %d, want 2", len(sessions))
+	}
+	if hash, _ := repo.passwordHash("alicia"); string(hash) != "first" {
+		t.Errorf("password after renaming: got %q", hash)
+	}
+	_, _ = repo.setPasswordHash("bob", []byte("bob's"), t0)
+	if err := repo.renameUser("alicia", "bob", t0); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("renaming to a registered user: got %v, want ErrAlreadyExists", err)
+	}
+
+	// Expiration
+	expired, err := repo.deleteExpiredSessions(t0.Add(90*time.Minute), time.Time{})
+	check("deleting expired sessions", err)
+	if len(expired) != 1 || expired[0].ID != "s2" {
+		t.Errorf("deleting expired sessions: got %+v, want s2", expired)
+	}
+	check("deleting a session", repo.deleteSession("s1"))
+	if _, err := repo.sessionByToken("h1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("reading a deleted session: got %v, want ErrNotFound", err)
+	}
+
+	// Revoked signed tokens are remembered until they expire
+	check("revoking a token", repo.revokeToken("s3", t0.Add(time.Hour)))
+	check("revoking a token", repo.revokeToken("s4", time.Time{}))
+	check("forgetting revoked tokens", repo.forgetRevokedTokens(t0.Add(2*time.Hour)))
+	for id, want := range map[string]bool{"s3": false, "s4": true, "s5": false} {
+		if revoked, err := repo.isTokenRevoked(id); err != nil || revoked != want {
+			t.Errorf("%s revoked: got %v, %v, want %v", id, revoked, err, want)
+		}
+	}
+
+	// Conversations are created by the first message, or when opened
+	c, err := repo.openConversation("empty", "carol", t0)
+	check("opening a conversation", err)
+	if c.ID != "empty" || !reflect.DeepEqual(c.Participants, []string{"carol"}) || len(c.Messages) != 0 {
+		t.Errorf("opening a new conversation: got %+v", c)
+	}
+	messages := []Message{
+		{MessageID: "m1", ConversationID: "chat", Sender: "alicia", Content: "one", Type: "text", Status: "delivered", Timestamp: t0},
+		{MessageID: "m2", ConversationID: "chat", Sender: "bob", Content: "two", Type: "text", Status: "delivered", Timestamp: t0.Add(time.Minute)},
+		{MessageID: "m3", ConversationID: "chat", Sender: "alicia", Content: "three", Type: "text", Status: "delivered", Timestamp: t0.Add(time.Minute)},
+	}
+	for _, m := range messages {
+		c, err = repo.addMessage(m, m.Sender)
+		check("adding a message", err)
+	}
+	if c.LastMessage != "three" || !c.Timestamp.Equal(t0.Add(time.Minute)) || len(c.Messages) != 0 {
+		t.Errorf("conversation after adding messages: got %+v", c)
+	}
+	participants := append([]string(nil), c.Participants...)
+	sort.Strings(participants)
+	if !reflect.DeepEqual(participants, []string{"alicia", "bob"}) {
+		t.Errorf("participants: got %v", c.Participants)
+	}
+	ids, err := repo.participantConversations("bob")
+	check("listing the conversations of a user", err)
+	if !reflect.DeepEqual(ids, []string{"chat"}) {
+		t.Errorf("conversations of bob: got %v", ids)
+	}
+	known, err := repo.knownUsers()
+	check("listing users", err)
+	for _, name := range []string{"alicia", "bob", "carol"} {
+		if !known[name] {
+			t.Errorf("%s is not a known user", name)
+		}
+	}
+
+	// Reactions
+	rx := Reaction{ReactionID: "r1", Emoji: "👍"}
+	_, err = repo.addReaction("m1", rx)
+	check("adding a reaction", err)
+	if _, err := repo.addReaction("missing", rx); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("reacting to a missing message: got %v, want ErrNotFound", err)
+	}
+	m, err := repo.message("m1")
+	check("reading a message", err)
+	if !reflect.DeepEqual(m.Reactions, []Reaction{rx}) {
+		t.Errorf("reactions: got %+v", m.Reactions)
+	}
+	removed, c, err := repo.removeReaction("m1", "r1")
+	check("removing a reaction", err)
+	if removed != rx || c.ID != "chat" {
+		t.Errorf("removing a reaction: got %+v in %q", removed, c.ID)
+	}
+	if _, _, err := repo.removeReaction("m1", "r1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("removing a reaction twice: got %v, want ErrNotFound", err)
+	}
+
+	// Paging resumes after the position, even if its message was deleted
+	page, err := repo.messagesAfter("chat", database.MessagePosition{}, 2)
+	check("paging", err)
+	if len(page) != 2 || page[0].MessageID != "m1" || page[1].MessageID != "m2" {
+		t.Fatalf("first page: got %+v", page)
+	}
+	c, err = repo.deleteMessage("m2")
+	check("deleting a message", err)
+	if c.LastMessage != "three" {
+		t.Errorf("preview after deleting a message: got %q", c.LastMessage)
+	}
+	page, err = repo.messagesAfter("chat", database.MessagePosition{Timestamp: page[1].Timestamp, MessageID: "m2"}, 2)
+	check("paging", err)
+	if len(page) != 1 || page[0].MessageID != "m3" {
+		t.Errorf("page after a deleted message: got %+v, want m3", page)
+	}
+	if _, err := repo.deleteMessage("m2"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("deleting a message twice: got %v, want ErrNotFound", err)
+	}
+	c, err = repo.deleteMessage("m3")
+	check("deleting a message", err)
+	if c.LastMessage != "one" || !c.Timestamp.Equal(t0) {
+		t.Errorf("preview after deleting the last message: got %q at %v", c.LastMessage, c.Timestamp)
+	}
+
+	// Retention policies, and the images shown by messages
+	policy := RetentionPolicy{Mode: RetentionDisappearing, Hours: 12}
+	c, err = repo.setRetention("chat", policy)
+	check("setting the retention policy", err)
+	if c.Retention != policy {
+		t.Errorf("setting the retention policy: got %+v", c.Retention)
+	}
+	if c, _ := repo.conversation("chat"); c.Retention != policy {
+		t.Errorf("retention policy: got %+v, want %+v", c.Retention, policy)
+	}
+	if _, err := repo.setRetention("missing", policy); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("setting the retention policy of a missing conversation: got %v, want ErrNotFound", err)
+	}
+	image := Message{MessageID: "m4", ConversationID: "chat", Sender: "bob", Content: "https://example.com/cat.png", Type: "image", Status: "delivered", Timestamp: t0.Add(2 * time.Minute)}
+	_, err = repo.addMessage(image, image.Sender)
+	check("adding an image", err)
+	if used, err := repo.imageInUse(image.Content); err != nil || !used {
+		t.Errorf("image in use: got %v, %v, want true", used, err)
+	}
+	_, err = repo.deleteMessage(image.MessageID)
+	check("deleting an image", err)
+	if used, err := repo.imageInUse(image.Content); err != nil || used {
+		t.Errorf("image in use after deleting its message: got %v, %v, want false", used, err)
+	}
+
+	// Scheduled messages are listed by sender, and delivered once
+	for _, sm := range []ScheduledMessage{
+		{ScheduledID: "s2", ConversationID: "chat", Sender: "bob", Content: "later", Type: "text", SendAt: t0.Add(2 * time.Hour), CreatedAt: t0},
+		{ScheduledID: "s1", ConversationID: "chat", Sender: "bob", Content: "soon", Type: "text", SendAt: t0.Add(time.Hour), CreatedAt: t0},
+		{ScheduledID: "s3", ConversationID: "chat", Sender: "carol", Content: "hi", Type: "text", SendAt: t0.Add(time.Hour), CreatedAt: t0},
+	} {
+		check("scheduling a message", repo.scheduleMessage(sm, 2))
+	}
+	if err := repo.scheduleMessage(ScheduledMessage{ScheduledID: "s1", ConversationID: "chat", Sender: "bob", Content: "again", Type: "text", SendAt: t0, CreatedAt: t0}, 0); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("scheduling a message twice: got %v, want ErrAlreadyExists", err)
+	}
+	if err := repo.scheduleMessage(ScheduledMessage{ScheduledID: "s4", ConversationID: "chat", Sender: "bob", Content: "more", Type: "text", SendAt: t0, CreatedAt: t0}, 2); !errors.Is(err, database.ErrLimitReached) {
+		t.Errorf("scheduling a message over the limit: got %v, want ErrLimitReached", err)
+	}
+	scheduled, err := repo.scheduledMessages("bob")
+	check("listing scheduled messages", err)
+	if len(scheduled) != 2 || scheduled[0].ScheduledID != "s1" || scheduled[1].ScheduledID != "s2" || !scheduled[0].SendAt.Equal(t0.Add(time.Hour)) {
+		t.Errorf("scheduled messages of bob: got %+v, want s1, s2", scheduled)
+	}
+	due, err := repo.dueScheduledMessages(t0.Add(time.Hour), 10)
+	check("listing due scheduled messages", err)
+	if len(due) != 2 || due[0].ScheduledID != "s1" || due[1].ScheduledID != "s3" {
+		t.Errorf("due scheduled messages: got %+v, want s1, s3", due)
+	}
+	if due, _ := repo.dueScheduledMessages(t0.Add(time.Hour), 1); len(due) != 1 {
+		t.Errorf("due scheduled messages with a limit: got %d, want 1", len(due))
+	}
+	if _, err := repo.cancelScheduledMessage("s3", "bob"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("cancelling the scheduled message of another user: got %v, want ErrNotFound", err)
+	}
+	cancelled, err := repo.cancelScheduledMessage("s3", "carol")
+	check("cancelling a scheduled message", err)
+	if cancelled.Content != "hi" {
+		t.Errorf("cancelled message: got %+v", cancelled)
+	}
+	delivered := deliveredMessage(&scheduled[0], t0.Add(time.Hour))
+	c, err = repo.deliverScheduledMessage("s1", delivered)
+	check("delivering a scheduled message", err)
+	if c.LastMessage != "soon" || !isParticipant(&c, "bob") {
+		t.Errorf("conversation after a delivery: got %+v", c)
+	}
+	if m, err := repo.message("s1"); err != nil || m.Content != "soon" {
+		t.Errorf("delivered message: got %+v, %v", m, err)
+	}
+	if _, err := repo.deliverScheduledMessage("s1", delivered); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("delivering a scheduled message twice: got %v, want ErrNotFound", err)
+	}
+	if scheduled, _ := repo.scheduledMessages("bob"); len(scheduled) != 1 || scheduled[0].ScheduledID != "s2" {
+		t.Errorf("scheduled messages after a delivery: got %+v, want s2", scheduled)
+	}
+
+	// Pins and stars go with their message
+	check("pinning a message", repo.pinMessage("chat", Pin{MessageID: "s1", PinnedBy: "bob", PinnedAt: t0.Add(time.Hour)}, 0))
+	if err := repo.pinMessage("chat", Pin{MessageID: "m1", PinnedBy: "alicia", PinnedAt: t0}, 1); !errors.Is(err, database.ErrLimitReached) {
+		t.Errorf("pinning a message over the limit: got %v, want ErrLimitReached", err)
+	}
+	check("pinning a message", repo.pinMessage("chat", Pin{MessageID: "m1", PinnedBy: "alicia", PinnedAt: t0}, 2))
+	if err := repo.pinMessage("chat", Pin{MessageID: "m1", PinnedBy: "bob", PinnedAt: t0}, 0); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("pinning a message twice: got %v, want ErrAlreadyExists", err)
+	}
+	if err := repo.pinMessage("empty", Pin{MessageID: "m1", PinnedBy: "carol", PinnedAt: t0}, 0); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("pinning a message of another conversation: got %v, want ErrNotFound", err)
+	}
+	if err := repo.pinMessage("chat", Pin{MessageID: "m1", PinnedBy: "bob", PinnedAt: t0}, 2); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("pinning a pinned message at the limit: got %v, want ErrAlreadyExists", err)
+	}
+	pins, err := repo.pins("chat")
+	check("listing pins", err)
+	if len(pins) != 2 || pins[0].MessageID != "m1" || pins[1].MessageID != "s1" || pins[1].PinnedBy != "bob" || !pins[1].PinnedAt.Equal(t0.Add(time.Hour)) {
+		t.Errorf("pins: got %+v, want m1, s1", pins)
+	}
+	if err := repo.unpinMessage("chat", "m2"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("unpinning a message not pinned: got %v, want ErrNotFound", err)
+	}
+	for _, star := range []struct {
+		username, messageID string
+		t                   time.Time
+	}{{"bob", "m1", t0}, {"bob", "s1", t0.Add(time.Hour)}, {"erin", "m1", t0}, {"erin", "s1", t0}, {"frank", "s1", t0.Add(2 * time.Hour)}} {
+		check("starring a message", repo.starMessage(star.username, star.messageID, star.t))
+	}
+	if err := repo.starMessage("bob", "m1", t0); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("starring a message twice: got %v, want ErrAlreadyExists", err)
+	}
+	if err := repo.starMessage("bob", "missing", t0); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("starring a missing message: got %v, want ErrNotFound", err)
+	}
+	starred, err := repo.starredMessages("bob")
+	check("listing starred messages", err)
+	if len(starred) != 2 || starred[0].Message.MessageID != "s1" || starred[1].Message.MessageID != "m1" || starred[1].Message.Content != "one" || !starred[1].StarredAt.Equal(t0) {
+		t.Errorf("starred messages of bob: got %+v, want s1, m1", starred)
+	}
+	check("unstarring a message", repo.unstarMessage("bob", "s1"))
+	if err := repo.unstarMessage("bob", "s1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("unstarring a message twice: got %v, want ErrNotFound", err)
+	}
+
+	// Renaming merges the stars, keeping those of the new name
+	check("renaming", repo.renameUser("erin", "frank", t0))
+	starred, err = repo.starredMessages("frank")
+	check("listing starred messages", err)
+	if len(starred) != 2 || starred[0].Message.MessageID != "s1" || !starred[0].StarredAt.Equal(t0.Add(2*time.Hour)) || starred[1].Message.MessageID != "m1" {
+		t.Errorf("starred messages after renaming: got %+v, want s1, m1", starred)
+	}
+	if starred, _ := repo.starredMessages("erin"); len(starred) != 0 {
+		t.Errorf("starred messages of the old name: got %+v", starred)
+	}
+
+	_, err = repo.deleteMessage("m1")
+	check("deleting a pinned and starred message", err)
+	if pins, _ := repo.pins("chat"); len(pins) != 1 || pins[0].MessageID != "s1" {
+		t.Errorf("pins after deleting a message: got %+v, want s1", pins)
+	}
+	for _, name := range []string{"bob", "frank"} {
+		starred, err := repo.starredMessages(name)
+		check("listing starred messages", err)
+		for _, s := range starred {
+			if s.Message.MessageID == "m1" {
+				t.Errorf("starred messages of %s after deleting m1: got %+v", name, starred)
+			}
+		}
+	}
+	if err := repo.unpinMessage("chat", "m1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("unpinning a deleted message: got %v, want ErrNotFound", err)
+	}
+
+	// Imports don't overwrite conversations
+	imported := Conversation{
+		ID:           "imported",
+		Participants: []string{"dave"},
+		Messages: []*Message{
+			{MessageID: "i1", ConversationID: "imported", Sender: "dave", Content: "old", Type: "text", Status: "delivered", Timestamp: t0},
+		},
+		LastMessage: "old",
+		Timestamp:   t0,
+		Name:        "Archive",
+		Photo:       "https://example.com/archive.png",
+	}
+	check("importing", repo.importConversation(imported))
+	if err := repo.importConversation(imported); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("importing twice: got %v, want ErrAlreadyExists", err)
+	}
+	c, err = repo.openConversation("imported", "eve", t0)
+	check("opening an imported conversation", err)
+	if c.Name != "Archive" || len(c.Messages) != 1 || c.Messages[0].Content != "old" || isParticipant(&c, "eve") {
+		t.Errorf("imported conversation: got %+v", c)
+	}
+	convs, err := repo.listConversations()
+	check("listing conversations", err)
+	if len(convs) != 3 {
+		t.Errorf("conversations: got %d, want 3", len(convs))
+	}
+	if used, err := repo.imageInUse(imported.Photo); err != nil || !used {
+		t.Errorf("conversation photo in use: got %v, %v, want true", used, err)
+	}
+
+	// Uploaded media is bound once to a message of its owner, and moves with renames
+	upload := Media{URL: "https://example.com/media/a.png", Owner: "dave", CreatedAt: t0}
+	check("adding media", repo.addMedia(upload))
+	check("adding more media", repo.addMedia(Media{URL: "https://example.com/media/b.png", Owner: "dave", CreatedAt: t0}))
+	if err := repo.addMedia(upload); !errors.Is(err, database.ErrAlreadyExists) {
+		t.Errorf("adding media twice: got %v, want ErrAlreadyExists", err)
+	}
+	if err := repo.attachMedia(upload.URL, "frank", "i1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("attaching the media of another user: got %v, want ErrNotFound", err)
+	}
+	check("attaching media", repo.attachMedia(upload.URL, "dave", "i1"))
+	if err := repo.attachMedia(upload.URL, "dave", "s1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("attaching media twice: got %v, want ErrNotFound", err)
+	}
+	if _, err := repo.messageMedia(""); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("media of no message: got %v, want ErrNotFound", err)
+	}
+	check("renaming the owner of media", repo.renameUser("dave", "grace", t0))
+	md, err := repo.messageMedia("i1")
+	check("reading the media of a message", err)
+	if md.URL != upload.URL || md.Owner != "grace" || md.MessageID != "i1" || !md.CreatedAt.Equal(t0) {
+		t.Errorf("media of i1: got %+v", md)
+	}
+	check("deleting media", repo.deleteMedia(upload.URL))
+	if err := repo.deleteMedia(upload.URL); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("deleting media twice: got %v, want ErrNotFound", err)
+	}
+	if _, err := repo.messageMedia("i1"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("media of i1 after deleting it: got %v, want ErrNotFound", err)
+	}
+}
+
+// TestDurableStorage checks that the state of a router on the durable memory storage survives a crash.
+func TestDurableStorage(t *testing.T) {
+	cfg := Config{Persistence: PersistenceConfig{Dir: t.TempDir(), SnapshotInterval: time.Hour}}
+	f := newConformanceFixture(t, cfg)
+	alice := f.login("alice")
+	msgID := f.sendMessage(alice, "chat", "hello there")
+	f.react(alice, msgID)
+	f.sendMessage(alice, "chat", "deleted soon")
+	deleted := f.sendMessage(alice, "chat", "deleted")
+	if resp, data := f.do(http.MethodDelete, "/messages/"+deleted, alice, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting a message: status %d (body: %s)", resp.StatusCode, data)
+	}
+
+	restarted := newConformanceFixture(t, cfg)
+	resp, data := restarted.do(http.MethodGet, "/conversations/chat", alice, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reading the conversation after a restart: status %d (body: %s)", resp.StatusCode, data)
+	}
+	var out ConversationResponse
+	restarted.decodeInto(data, &out)
+	msgs := out.Conversation.Messages
+	if len(msgs) != 2 || msgs[0].MessageID != msgID || len(msgs[0].Reactions) != 1 {
+		t.Errorf("conversation after a restart: got %s", data)
+	}
+
+	resp, data = restarted.do(http.MethodGet, "/search?q=hello", alice, "")
+	var page searchPage
+	restarted.decodeInto(data, &page)
+	if resp.StatusCode != http.StatusOK || len(page.Results) != 1 {
+		t.Errorf("searching after a restart: status %d (body: %s)", resp.StatusCode, data)
+	}
+}
+
+// TestSQLiteStorage checks that the state of a router on the sqlite storage survives a restart.
+func TestSQLiteStorage(t *testing.T) {
+	cfg := Config{Database: newTestDatabase(t), Storage: StorageSQLite}
+	f := newConformanceFixture(t, cfg)
+	alice := f.login("alice")
+	msgID := f.sendMessage(alice, "chat", "hello there")
+	f.react(alice, msgID)
+
+	restarted := newConformanceFixture(t, cfg)
+	resp, data := restarted.do(http.MethodGet, "/conversations/chat", alice, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reading the conversation after a restart: status %d (body: %s)", resp.StatusCode, data)
+	}
+	var out ConversationResponse
+	restarted.decodeInto(data, &out)
+	msgs := out.Conversation.Messages
+	if len(msgs) != 1 || msgs[0].MessageID != msgID || len(msgs[0].Reactions) != 1 {
+		t.Errorf("conversation after a restart: got %s", data)
+	}
+
+	resp, data = restarted.do(http.MethodGet, "/search?q=hello", alice, "")
+	var page searchPage
+	restarted.decodeInto(data, &page)
+	if resp.StatusCode != http.StatusOK || len(page.Results) != 1 {
+		t.Errorf("searching after a restart: status %d (body: %s)", resp.StatusCode, data)
+	}
+}
@@ -16,6 +16,20 @@ type RequestContext struct {
 	// ReqUUID is the request unique ID
 	ReqUUID uuid.UUID
 
+	// RequestID is the ID propagated in the X-Request-ID header. It's the one supplied by the client, if any, or
+	// ReqUUID otherwise.
+	RequestID string
+
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// Auth is filled in by the handler once it authenticated the request. It's shared by the copies of the context,
+	// so that the log entry written when the handler returns names the user.
+	Auth *Auth
+}
+
+// Auth is the identity of the user who made a request.
+type Auth struct {
+	// Username is empty until the request is authenticated
+	Username string
 }
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+const (
+	// maxRetentionDays and maxRetentionHours bound the periods of the delete-after and disappearing modes
+	maxRetentionDays  = 3650
+	maxRetentionHours = 720
+
+	// reapBatchSize is how many messages of a conversation the reaper reads at once
+	reapBatchSize = 100
+)
+
+// RetentionConfig configures the deletion of the messages expired by the retention policy of their conversation.
+type RetentionConfig struct {
+	// ReapInterval is how often expired messages are deleted. Zero disables the deletion: policies can be set, but
+	// messages are kept.
+	ReapInterval time.Duration
+}
+
+func validateRetentionPolicy(p *RetentionPolicy) []FieldError {
+	var v validator
+	if v.required("mode", p.Mode) {
+		v.oneOf("mode", p.Mode, RetentionKeep, RetentionDeleteAfter, RetentionDisappearing)
+	}
+	unexpected := func(field string, value int) {
+		if value != 0 {
+			v.fail(field, "not allowed with mode %s", p.Mode)
+		}
+	}
+	switch p.Mode {
+	case RetentionKeep:
+		unexpected("days", p.Days)
+		unexpected("hours", p.Hours)
+	case RetentionDeleteAfter:
+		v.between("days", p.Days, 1, maxRetentionDays)
+		unexpected("hours", p.Hours)
+	case RetentionDisappearing:
+		v.between("hours", p.Hours, 1, maxRetentionHours)
+		unexpected("days", p.Days)
+	}
+	return v.errs
+}
+
+// retentionWithDefault returns p with its mode, which the zero value leaves empty.
+func retentionWithDefault(p RetentionPolicy) RetentionPolicy {
+	if p.Mode == "" {
+		p.Mode = RetentionKeep
+	}
+	return p
+}
+
+// retentionTTL returns how long messages are kept under p, zero if forever.
+func retentionTTL(p RetentionPolicy) time.Duration {
+	switch p.Mode {
+	case RetentionDeleteAfter:
+		return time.Duration(p.Days) * 24 * time.Hour
+	case RetentionDisappearing:
+		return time.Duration(p.Hours) * time.Hour
+	}
+	return 0
+}
+
+// retentionAnnouncement returns the content of the system message announcing that username set p.
+func retentionAnnouncement(p RetentionPolicy, username string) string {
+	count := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch p.Mode {
+	case RetentionDeleteAfter:
+		return fmt.Sprintf("%s set messages to be deleted %s after they're sent", username, count(p.Days, "day"))
+	case RetentionDisappearing:
+		return fmt.Sprintf("%s turned on disappearing messages: messages disappear %s after they're sent", username, count(p.Hours, "hour"))
+	}
+	return fmt.Sprintf("%s set messages to be kept forever", username)
+}
+
+/* helpers bound to Router */
+
+// announce adds a system message with content to a conversation, on behalf of username, and publishes it.
+func (rt *Router) announce(conversationID, username, content string) error {
+	msg := Message{
+		MessageID:      uuid.Must(uuid.NewV4()).String(),
+		ConversationID: conversationID,
+		Sender:         username,
+		Content:        content,
+		Type:           "system",
+		Status:         "delivered",
+		Timestamp:      rt.clock.Now().UTC(),
+	}
+	c, err := rt.store.addMessage(msg, username)
+	if err != nil {
+		return err
+	}
+	cp := cloneMessage(&msg)
+	rt.publish(c, Event{Type: EventMessageCreated, Message: &cp})
+	return nil
+}
+
+// messageReaper deletes expired messages periodically, until the router is closed.
+func (rt *Router) messageReaper() {
+	defer rt.background.Done()
+
+	ticker := rt.clock.NewTicker(rt.retentionCfg.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rt.shutdown:
+			return
+		case <-ticker.C():
+			if n, err := rt.reapExpiredMessages(rt.clock.Now().UTC()); err != nil {
+				rt.baseLogger.WithError(err).Error("deleting expired messages")
+			} else if n > 0 {
+				rt.baseLogger.WithField("messages", n).Debug("expired messages deleted")
+			}
+		}
+	}
+}
+
+// reapExpiredMessages deletes the messages expired at now by the retention policy of their conversation, and returns
+// how many were deleted.
+func (rt *Router) reapExpiredMessages(now time.Time) (int, error) {
+	convs, err := rt.store.listConversations()
+	if err != nil {
+		return 0, fmt.Errorf("listing conversations: %w", err)
+	}
+	ctx := reqcontext.RequestContext{Logger: rt.baseLogger}
+	n := 0
+	for _, c := range convs {
+		ttl := retentionTTL(c.Retention)
+		if ttl == 0 {
+			continue
+		}
+		cutoff := now.Add(-ttl)
+		// Expired messages come first: every batch starts from the first message left
+		for {
+			msgs, err := rt.store.messagesAfter(c.ID, database.MessagePosition{}, reapBatchSize)
+			if err != nil {
+				return n, fmt.Errorf("reading messages of %s: %w", c.ID, err)
+			}
+			expired := 0
+			for _, m := range msgs {
+				if m.Timestamp.After(cutoff) {
+					break
+				}
+				err := rt.removeMessage(ctx, m.MessageID)
+				if err != nil && !errors.Is(err, database.ErrNotFound) {
+					return n, fmt.Errorf("deleting message %s: %w", m.MessageID, err)
+				}
+				expired++
+				if err == nil {
+					n++
+				}
+			}
+			if expired < reapBatchSize {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// removeMessage deletes a message with its media file, and publishes the deletion. The message leaves the search
+// index even if it was already deleted from the store.
+func (rt *Router) removeMessage(ctx reqcontext.RequestContext, id string) error {
+	m, err := rt.store.message(id)
+	if err == nil {
+		var c Conversation
+		if c, err = rt.store.deleteMessage(id); err == nil {
+			rt.publish(c, Event{Type: EventMessageDeleted, MessageID: id})
+			rt.removeMedia(ctx, m)
+		}
+	}
+	if err == nil || errors.Is(err, database.ErrNotFound) {
+		rt.unindexMessage(ctx, id)
+	}
+	return err
+}
+
+// removeMedia deletes the media file uploaded for a deleted image message, unless other messages (e.g., forwards) or
+// photos show it too. Files that weren't uploaded for the message are kept. Failures are logged.
+func (rt *Router) removeMedia(ctx reqcontext.RequestContext, m Message) {
+	if m.Type != "image" {
+		return
+	}
+	md, err := rt.store.messageMedia(m.MessageID)
+	if errors.Is(err, database.ErrNotFound) {
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).WithField("message", m.MessageID).Warn("reading the media file of a message")
+		return
+	}
+	file := rt.mediaFile(m)
+	if file == "" || md.URL != m.Content {
+		return
+	}
+	if used, err := rt.store.imageInUse(m.Content); err != nil {
+		ctx.Logger.WithError(err).WithField("media", m.Content).Warn("looking for the messages of a media file")
+		return
+	} else if used {
+		return
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		ctx.Logger.WithError(err).WithField("media", m.Content).Warn("deleting a media file")
+		return
+	}
+	if err := rt.store.deleteMedia(md.URL); err != nil && !errors.Is(err, database.ErrNotFound) {
+		ctx.Logger.WithError(err).WithField("media", m.Content).Warn("forgetting a media file")
+	}
+}
+
+// mediaFile returns the path of the file of the media directory shown by an image message, or an empty string if
+// the message shows none: only the URLs under Config.MediaURL are files of ours.
+func (rt *Router) mediaFile(m Message) string {
+	if m.Type != "image" || rt.mediaDir == "" || rt.mediaURL == "" || !strings.HasPrefix(m.Content, rt.mediaURL) {
+		return ""
+	}
+	rel := strings.TrimPrefix(m.Content, rt.mediaURL)
+	if i := strings.IndexAny(rel, "?#"); i >= 0 {
+		rel = rel[:i]
+	}
+	rel, err := url.PathUnescape(rel)
+	if err != nil {
+		return ""
+	}
+	// Cleaning a rooted path drops the ".." that would leave the directory
+	if rel = path.Clean("/" + rel); rel == "/" {
+		return ""
+	}
+	return filepath.Join(rt.mediaDir, filepath.FromSlash(rel))
+}
+
+/* ROUTE HANDLERS */
+
+// putConversationRetention sets the retention policy of a conversation, and announces it in the conversation.
+// Setting the current policy again changes nothing.
+func (rt *Router) putConversationRetention(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	convId := ps.ByName("conversationId")
+	var body RetentionPolicy
+	if err := decodeJSON(r, &body); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	c, err := rt.store.conversation(convId)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("conversation not found"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+		return
+	}
+	if retentionWithDefault(c.Retention) == body {
+		writeJSON(w, http.StatusOK, body)
+		return
+	}
+
+	if _, err := rt.store.setRetention(convId, body); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("setting retention policy: %w", err)))
+		return
+	}
+	if err := rt.announce(convId, sess.Username, retentionAnnouncement(body, sess.Username)); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("storing message: %w", err)))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/sirupsen/logrus"
+)
+
+// newRetentionFixture returns a router, whose store the test fills directly, with the fixture serving it.
+func newRetentionFixture(t *testing.T, cfg Config) (*Router, *conformanceFixture) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Logger = logger
+	rt, err := New(cfg)
+	if err != nil {
+		t.Fatalf("creating router: %v", err)
+	}
+	t.Cleanup(func() { _ = rt.Close() })
+	srv := httptest.NewServer(rt.Handler())
+	t.Cleanup(srv.Close)
+	return rt, &conformanceFixture{t: t, server: srv, config: cfg}
+}
+
+// TestRetention sets the retention policy of a conversation, and deletes its expired messages with their media.
+func TestRetention(t *testing.T) {
+	for _, storage := range []StorageBackend{StorageMemory, StorageSQLite} {
+		t.Run(string(storage), func(t *testing.T) {
+			media := t.TempDir()
+			cfg := Config{Storage: storage, MediaDir: media, MediaURL: "https://chat.example.com/media"}
+			if storage == StorageSQLite {
+				cfg.Database = newTestDatabase(t)
+			}
+			rt, f := newRetentionFixture(t, cfg)
+			alice, bob := f.login("alice"), f.login("bob")
+			f.sendMessage(alice, "chat", "fresh")
+			conversation := func() *ConversationDTO {
+				t.Helper()
+				_, data := f.do(http.MethodGet, "/conversations/chat", alice, "")
+				var out ConversationResponse
+				f.decodeInto(data, &out)
+				return out.Conversation
+			}
+			if c := conversation(); c.Retention != (RetentionPolicy{Mode: RetentionKeep}) {
+				t.Errorf("default retention policy: got %+v", c.Retention)
+			}
+
+			// The change is announced once
+			body := `{"mode":"disappearing","hours":24}`
+			for i := 0; i < 2; i++ {
+				if resp, data := f.do(http.MethodPut, "/conversations/chat/retention", alice, body); resp.StatusCode != http.StatusOK {
+					t.Fatalf("setting the retention policy: status %d (body: %s)", resp.StatusCode, data)
+				}
+			}
+			c := conversation()
+			if c.Retention != (RetentionPolicy{Mode: RetentionDisappearing, Hours: 24}) || len(c.Messages) != 2 {
+				t.Fatalf("conversation after setting the retention policy: got %+v", c)
+			}
+			if m := c.Messages[1]; m.Type != "system" || m.Content != "alice turned on disappearing messages: messages disappear 24 hours after they're sent" {
+				t.Errorf("announcement: got %+v", m)
+			}
+			if resp, _ := f.do(http.MethodPut, "/conversations/nowhere/retention", bob, body); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("setting the retention policy of a missing conversation: status %d, want 404", resp.StatusCode)
+			}
+
+			// Expired messages go with the media files uploaded for them, unless other messages show them: the
+			// files that the server didn't track are kept
+			old := time.Now().UTC().Add(-25 * time.Hour)
+			for i, m := range []Message{
+				{ConversationID: "chat", Content: "old"},
+				{ConversationID: "chat", Content: "https://chat.example.com/media/dog.png", Type: "image"},
+				{ConversationID: "chat", Content: "https://chat.example.com/media/cat.png", Type: "image"},
+				{ConversationID: "kept", Content: "https://chat.example.com/media/cat.png", Type: "image"},
+				{ConversationID: "chat", Content: "https://elsewhere.example.com/media/dog.png", Type: "image"},
+				{ConversationID: "chat", Content: "https://chat.example.com/media/bird.png", Type: "image"},
+			} {
+				m.MessageID = "old-" + string(rune('a'+i))
+				m.Sender = "alice"
+				m.Status = "delivered"
+				m.Timestamp = old
+				if m.Type == "" {
+					m.Type = "text"
+				}
+				if _, err := rt.store.addMessage(m, m.Sender); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"dog.png", "cat.png", "bird.png"} {
+				if err := os.WriteFile(filepath.Join(media, name), []byte(name), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, id := range map[string]string{"dog.png": "old-b", "cat.png": "old-c"} {
+				u := "https://chat.example.com/media/" + name
+				if err := rt.store.addMedia(Media{URL: u, Owner: "alice", CreatedAt: old}); err != nil {
+					t.Fatal(err)
+				}
+				if err := rt.store.attachMedia(u, "alice", id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := rt.reapExpiredMessages(time.Now().UTC())
+			if err != nil || n != 5 {
+				t.Fatalf("deleting expired messages: got %d, %v, want 5", n, err)
+			}
+			var contents []string
+			for _, m := range conversation().Messages {
+				contents = append(contents, m.Content)
+			}
+			if got := strings.Join(contents, " | "); len(contents) != 2 || !strings.HasPrefix(got, "fresh | alice turned on") {
+				t.Errorf("messages left: got %s", got)
+			}
+			if _, err := os.Stat(filepath.Join(media, "dog.png")); !os.IsNotExist(err) {
+				t.Errorf("the media file of an expired message is still there: %v", err)
+			}
+			if _, err := rt.store.messageMedia("old-b"); !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("the media of an expired message is still tracked: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(media, "cat.png")); err != nil {
+				t.Errorf("the media file of a message left: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(media, "bird.png")); err != nil {
+				t.Errorf("an untracked media file was deleted: %v", err)
+			}
+			if n, err := rt.reapExpiredMessages(time.Now().UTC()); err != nil || n != 0 {
+				t.Errorf("deleting expired messages again: got %d, %v, want 0", n, err)
+			}
+		})
+	}
+}
+
+func TestMediaFile(t *testing.T) {
+	rt := &Router{mediaDir: "/srv/media", mediaURL: "https://chat.example.com/media/"}
+	for content, want := range map[string]string{
+		"https://chat.example.com/media/cat.png":           "/srv/media/cat.png",
+		"https://chat.example.com/media/a%20b/cat.png?v=2": "/srv/media/a b/cat.png",
+		"https://chat.example.com/media/../../etc/passwd":  "/srv/media/etc/passwd",
+		"https://chat.example.com/media/%2e%2e/etc/passwd": "/srv/media/etc/passwd",
+		"https://chat.example.com/media/":                  "",
+		"https://chat.example.com/mediafiles/cat.png":      "",
+		"https://elsewhere.example.com/media/cat.png":      "",
+	} {
+		if got := rt.mediaFile(Message{Type: "image", Content: content}); got != filepath.FromSlash(want) {
+			t.Errorf("%s: got %q, want %q", content, got, want)
+		}
+	}
+	if got := rt.mediaFile(Message{Type: "text", Content: "https://chat.example.com/media/cat.png"}); got != "" {
+		t.Errorf("text message: got %q", got)
+	}
+}
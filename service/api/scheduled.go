@@ -0,0 +1,156 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+const (
+	// maxScheduledMessages is how many scheduled messages a user can have waiting
+	maxScheduledMessages = 100
+
+	// deliveryBatchSize is how many scheduled messages the scheduler reads at once
+	deliveryBatchSize = 100
+)
+
+// SchedulerConfig configures the delivery of scheduled messages.
+type SchedulerConfig struct {
+	// Interval is how often the scheduled messages due are delivered. Zero disables scheduled messages.
+	Interval time.Duration
+}
+
+// deliveredMessage returns the message of sm delivered at t.
+func deliveredMessage(sm *ScheduledMessage, t time.Time) Message {
+	return Message{
+		MessageID:      sm.ScheduledID,
+		ConversationID: sm.ConversationID,
+		Sender:         sm.Sender,
+		Content:        sm.Content,
+		Type:           sm.Type,
+		Status:         "delivered",
+		Timestamp:      t,
+	}
+}
+
+/* helpers bound to Router */
+
+// messageScheduler delivers the scheduled messages when they are due, until the router is closed. The messages due
+// while the server was down are delivered on the first run.
+func (rt *Router) messageScheduler() {
+	defer rt.background.Done()
+
+	ticker := rt.clock.NewTicker(rt.schedulerCfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rt.shutdown:
+			return
+		case <-ticker.C():
+			if n, err := rt.deliverDueMessages(rt.clock.Now().UTC()); err != nil {
+				rt.baseLogger.WithError(err).Error("delivering scheduled messages")
+			} else if n > 0 {
+				rt.baseLogger.WithField("messages", n).Debug("scheduled messages delivered")
+			}
+		}
+	}
+}
+
+// deliverDueMessages sends the scheduled messages due at now, with now as timestamp, and returns how many were sent.
+func (rt *Router) deliverDueMessages(now time.Time) (int, error) {
+	ctx := reqcontext.RequestContext{Logger: rt.baseLogger}
+	n := 0
+	for {
+		due, err := rt.store.dueScheduledMessages(now, deliveryBatchSize)
+		if err != nil {
+			return n, fmt.Errorf("reading scheduled messages: %w", err)
+		}
+		for _, sm := range due {
+			msg := deliveredMessage(&sm, now)
+			c, err := rt.store.deliverScheduledMessage(sm.ScheduledID, msg)
+			if errors.Is(err, database.ErrNotFound) {
+				// Cancelled in the meantime
+				continue
+			} else if err != nil {
+				return n, fmt.Errorf("delivering scheduled message %s: %w", sm.ScheduledID, err)
+			}
+			rt.attachMedia(ctx, &msg)
+			rt.indexMessage(ctx, &msg)
+			cp := cloneMessage(&msg)
+			rt.publish(c, Event{Type: EventMessageCreated, Message: &cp})
+			n++
+		}
+		if len(due) < deliveryBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// scheduleMessage stores the message of body, to send at body.SendAt, and writes it.
+func (rt *Router) scheduleMessage(w http.ResponseWriter, ctx reqcontext.RequestContext, username, convId string, body SendMessageInput, now time.Time) {
+	if rt.schedulerCfg.Interval <= 0 {
+		writeError(w, ctx, errConflict("scheduled messages are disabled"))
+		return
+	}
+	sm := ScheduledMessage{
+		ScheduledID:    uuid.Must(uuid.NewV4()).String(),
+		ConversationID: convId,
+		Sender:         username,
+		Content:        body.Content,
+		Type:           body.Type,
+		SendAt:         body.SendAt.UTC(),
+		CreatedAt:      now,
+	}
+	err := rt.store.scheduleMessage(sm, maxScheduledMessages)
+	if errors.Is(err, database.ErrLimitReached) {
+		writeError(w, ctx, errConflict(fmt.Sprintf("at most %d messages can be scheduled", maxScheduledMessages)))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("storing scheduled message: %w", err)))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, sm)
+}
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) getMyScheduledMessages(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	list, err := rt.store.scheduledMessages(sess.Username)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("listing scheduled messages: %w", err)))
+		return
+	}
+	if list == nil {
+		list = []ScheduledMessage{}
+	}
+	writeJSON(w, http.StatusOK, ScheduledMessageList{ScheduledMessages: list})
+}
+
+// cancelScheduledMessage deletes a scheduled message of the user, before it's sent.
+func (rt *Router) cancelScheduledMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	_, err = rt.store.cancelScheduledMessage(ps.ByName("scheduledId"), sess.Username)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("scheduled message not found"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("cancelling scheduled message: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
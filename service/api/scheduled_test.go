@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+)
+
+// TestScheduledMessages schedules messages, and delivers them when they are due, after a restart if the storage
+// persists them.
+func TestScheduledMessages(t *testing.T) {
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	for _, storage := range []string{"memory", "durable", "sqlite"} {
+		t.Run(storage, func(t *testing.T) {
+			clock := globaltime.NewFake(t0)
+			cfg := Config{Scheduler: SchedulerConfig{Interval: time.Minute}, Clock: clock}
+			switch storage {
+			case "durable":
+				cfg.Persistence = PersistenceConfig{Dir: t.TempDir()}
+			case "sqlite":
+				cfg.Storage, cfg.Database = StorageSQLite, newTestDatabase(t)
+			}
+			rt, f := newRetentionFixture(t, cfg)
+			alice, bob := f.login("alice"), f.login("bob")
+			f.sendMessage(alice, "chat", "hello")
+
+			schedule := func(body string, status int) ScheduledMessage {
+				t.Helper()
+				resp, data := f.do(http.MethodPost, "/conversations/chat/messages", alice, body)
+				if resp.StatusCode != status {
+					t.Fatalf("sending %s: status %d, want %d (body: %s)", body, resp.StatusCode, status, data)
+				}
+				var sm ScheduledMessage
+				f.decodeInto(data, &sm)
+				return sm
+			}
+			morning := schedule(`{"content":"good morning","sendAt":"2030-01-01T10:00:00+01:00"}`, http.StatusAccepted)
+			if !morning.SendAt.Equal(t0.Add(time.Hour)) || morning.Sender != "alice" || !morning.CreatedAt.Equal(t0) {
+				t.Errorf("scheduled message: got %+v", morning)
+			}
+			cancelled := schedule(`{"content":"never mind","sendAt":"2030-01-01T10:00:00Z"}`, http.StatusAccepted)
+			schedule(`{"content":"right now","sendAt":"2030-01-01T08:00:00Z"}`, http.StatusCreated)
+
+			scheduled := func(f *conformanceFixture, token string) []ScheduledMessage {
+				t.Helper()
+				resp, data := f.do(http.MethodGet, "/scheduled-messages", token, "")
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("listing scheduled messages: status %d (body: %s)", resp.StatusCode, data)
+				}
+				var out ScheduledMessageList
+				f.decodeInto(data, &out)
+				return out.ScheduledMessages
+			}
+			if list := scheduled(f, alice); len(list) != 2 || list[0].ScheduledID != morning.ScheduledID {
+				t.Errorf("scheduled messages of alice: got %+v", list)
+			}
+			if list := scheduled(f, bob); len(list) != 0 {
+				t.Errorf("scheduled messages of bob: got %+v", list)
+			}
+
+			// Only the sender cancels a scheduled message
+			if resp, _ := f.do(http.MethodDelete, "/scheduled-messages/"+cancelled.ScheduledID, bob, ""); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("cancelling the scheduled message of another user: status %d, want 404", resp.StatusCode)
+			}
+			if resp, data := f.do(http.MethodDelete, "/scheduled-messages/"+cancelled.ScheduledID, alice, ""); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("cancelling a scheduled message: status %d (body: %s)", resp.StatusCode, data)
+			}
+
+			// Renaming the sender moves their scheduled messages
+			if resp, data := f.do(http.MethodPut, "/user/username", alice, `{"name":"alicia"}`); resp.StatusCode != http.StatusOK {
+				t.Fatalf("renaming: status %d (body: %s)", resp.StatusCode, data)
+			}
+			if list := scheduled(f, alice); len(list) != 1 || list[0].ScheduledID != morning.ScheduledID || list[0].Sender != "alicia" {
+				t.Errorf("scheduled messages after renaming: got %+v", list)
+			}
+			if n, err := rt.deliverDueMessages(t0.Add(30 * time.Minute)); err != nil || n != 0 {
+				t.Errorf("delivering before the time: got %d, %v, want 0", n, err)
+			}
+
+			// The router restarts, as if the server crashed: the scheduled messages are stored with the rest. The
+			// clock of the crashed router stands still, so its scheduler doesn't run anymore.
+			if storage != "memory" {
+				clock = globaltime.NewFake(t0)
+				cfg.Clock = clock
+				rt, f = newRetentionFixture(t, cfg)
+			}
+
+			// The scheduler delivers the message on its first tick after the time
+			sub, _ := rt.events.subscribe("alicia", 0, clock.Now())
+			defer rt.events.unsubscribe(sub)
+			clock.WaitForTickers(1)
+			clock.Advance(2 * time.Hour)
+			select {
+			case e := <-sub.ch:
+				if e.Type != EventMessageCreated || e.Message == nil || e.Message.MessageID != morning.ScheduledID {
+					t.Errorf("event of the delivery: got %+v", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the scheduler didn't deliver the message")
+			}
+			if n, err := rt.deliverDueMessages(clock.Now()); err != nil || n != 0 {
+				t.Errorf("delivering the due messages again: got %d, %v, want 0", n, err)
+			}
+
+			_, data := f.do(http.MethodGet, "/conversations/chat", alice, "")
+			var out ConversationResponse
+			f.decodeInto(data, &out)
+			msgs := out.Conversation.Messages
+			if len(msgs) != 3 {
+				t.Fatalf("messages after the delivery: got %s", data)
+			}
+			if m := msgs[2]; m.MessageID != morning.ScheduledID || m.Content != "good morning" || m.Sender != "alicia" || !m.Timestamp.Equal(t0.Add(2*time.Hour)) {
+				t.Errorf("delivered message: got %+v", m)
+			}
+			if list := scheduled(f, alice); len(list) != 0 {
+				t.Errorf("scheduled messages after the delivery: got %+v", list)
+			}
+			if resp, _ := f.do(http.MethodDelete, "/scheduled-messages/"+morning.ScheduledID, alice, ""); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("cancelling a delivered message: status %d, want 404", resp.StatusCode)
+			}
+		})
+	}
+}
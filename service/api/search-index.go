@@ -0,0 +1,235 @@
+package api
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// messageIndex is the full-text index of messages. Queries and hits use the types of the database package, so that
+// the SQLite index can be used as is.
+type messageIndex interface {
+	index(m database.IndexedMessage) error
+	remove(messageID string) error
+	search(q database.MessageQuery) ([]database.MessageHit, error)
+}
+
+// dbIndex is the FTS5 index of the database.
+type dbIndex struct {
+	db database.AppDatabase
+}
+
+func (i dbIndex) index(m database.IndexedMessage) error { return i.db.IndexMessage(m) }
+func (i dbIndex) remove(messageID string) error         { return i.db.UnindexMessage(messageID) }
+func (i dbIndex) search(q database.MessageQuery) ([]database.MessageHit, error) {
+	return i.db.SearchMessages(q)
+}
+
+// memoryIndex is an inverted index, used when there's no database. Tokens are split and matched like the FTS5
+// unicode61 tokenizer does, except that diacritics are not removed.
+type memoryIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{} // term -> IDs of the messages containing it
+	docs     map[string]database.IndexedMessage
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{
+		postings: map[string]map[string]struct{}{},
+		docs:     map[string]database.IndexedMessage{},
+	}
+}
+
+// span is the position of a token in a string, in bytes.
+type span struct{ start, end int }
+
+// tokenize splits s into runs of letters and digits.
+func tokenize(s string) []span {
+	var spans []span
+	start := -1
+	for i, r := range s {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		} else if !word && start >= 0 {
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(s)})
+	}
+	return spans
+}
+
+// searchTerms returns the distinct lowercase terms of s.
+func searchTerms(s string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, sp := range tokenize(s) {
+		t := strings.ToLower(s[sp.start:sp.end])
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func (i *memoryIndex) index(m database.IndexedMessage) error {
+	m.Content = strings.NewReplacer(database.HighlightStart, "", database.HighlightEnd, "").Replace(m.Content)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removeLocked(m.MessageID)
+	i.docs[m.MessageID] = m
+	for _, t := range searchTerms(m.Content) {
+		ids := i.postings[t]
+		if ids == nil {
+			ids = map[string]struct{}{}
+			i.postings[t] = ids
+		}
+		ids[m.MessageID] = struct{}{}
+	}
+	return nil
+}
+
+func (i *memoryIndex) remove(messageID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removeLocked(messageID)
+	return nil
+}
+
+func (i *memoryIndex) removeLocked(messageID string) {
+	doc, ok := i.docs[messageID]
+	if !ok {
+		return
+	}
+	delete(i.docs, messageID)
+	for _, t := range searchTerms(doc.Content) {
+		delete(i.postings[t], messageID)
+		if len(i.postings[t]) == 0 {
+			delete(i.postings, t)
+		}
+	}
+}
+
+func (i *memoryIndex) search(q database.MessageQuery) ([]database.MessageHit, error) {
+	if len(q.Terms) == 0 || len(q.ConversationIDs) == 0 {
+		return nil, nil
+	}
+	convs := map[string]bool{}
+	for _, id := range q.ConversationIDs {
+		convs[id] = true
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// Scan the rarest term, checking the others on each candidate
+	rarest := i.postings[q.Terms[0]]
+	for _, t := range q.Terms[1:] {
+		if len(i.postings[t]) < len(rarest) {
+			rarest = i.postings[t]
+		}
+	}
+	var docs []database.IndexedMessage
+candidates:
+	for id := range rarest {
+		for _, t := range q.Terms {
+			if _, ok := i.postings[t][id]; !ok {
+				continue candidates
+			}
+		}
+		doc := i.docs[id]
+		if !convs[doc.ConversationID] || (q.Before != nil && !olderThan(doc, *q.Before)) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(a, b int) bool {
+		return olderThan(docs[b], database.MessagePosition{Timestamp: docs[a].Timestamp, MessageID: docs[a].MessageID})
+	})
+	if q.Limit > 0 && len(docs) > q.Limit {
+		docs = docs[:q.Limit]
+	}
+
+	hits := make([]database.MessageHit, len(docs))
+	for n, doc := range docs {
+		hits[n] = database.MessageHit{
+			MessageID:      doc.MessageID,
+			ConversationID: doc.ConversationID,
+			Timestamp:      doc.Timestamp,
+			Snippet:        snippet(doc.Content, q.Terms),
+		}
+	}
+	return hits, nil
+}
+
+// olderThan reports whether doc comes after pos in the results, newest first.
+func olderThan(doc database.IndexedMessage, pos database.MessagePosition) bool {
+	if !doc.Timestamp.Equal(pos.Timestamp) {
+		return doc.Timestamp.Before(pos.Timestamp)
+	}
+	return doc.MessageID < pos.MessageID
+}
+
+// snippet returns an excerpt of content around the first match, with the matched terms marked like FTS5 does.
+func snippet(content string, terms []string) string {
+	match := map[string]bool{}
+	for _, t := range terms {
+		match[t] = true
+	}
+	spans := tokenize(content)
+	if len(spans) == 0 {
+		return content
+	}
+
+	first := 0
+	for n, sp := range spans {
+		if match[strings.ToLower(content[sp.start:sp.end])] {
+			first = n
+			break
+		}
+	}
+	// Keep some context before the first match, but fill the snippet if the match is near the end
+	start := first - database.SnippetTokens/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + database.SnippetTokens
+	if end > len(spans) {
+		end = len(spans)
+		if start = end - database.SnippetTokens; start < 0 {
+			start = 0
+		}
+	}
+
+	var b strings.Builder
+	last := 0
+	if start > 0 {
+		b.WriteString("…")
+		last = spans[start].start
+	}
+	for _, sp := range spans[start:end] {
+		b.WriteString(content[last:sp.start])
+		word := content[sp.start:sp.end]
+		if match[strings.ToLower(word)] {
+			b.WriteString(database.HighlightStart + word + database.HighlightEnd)
+		} else {
+			b.WriteString(word)
+		}
+		last = sp.end
+	}
+	if end < len(spans) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(content[last:])
+	}
+	return b.String()
+}
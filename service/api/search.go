@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// Search query limits.
+const (
+	maxQueryLength     = 256
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchRequest is the parsed query string of the search routes.
+type searchRequest struct {
+	terms  []string
+	limit  int
+	before *database.MessagePosition
+}
+
+// parseSearchRequest reads the q, limit and cursor query parameters.
+func parseSearchRequest(r *http.Request) (searchRequest, error) {
+	query := r.URL.Query()
+	req := searchRequest{limit: defaultSearchLimit}
+
+	var v validator
+	q := query.Get("q")
+	if v.required("q", q) {
+		v.length("q", q, 1, maxQueryLength)
+		if req.terms = searchTerms(q); len(req.terms) == 0 {
+			v.fail("q", "must contain at least a letter or a digit")
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			v.fail("limit", "must be an integer between 1 and %d", maxSearchLimit)
+		}
+		req.limit = n
+	}
+	if s := query.Get("cursor"); s != "" {
+		pos, ok := decodeCursor(s)
+		if !ok {
+			v.fail("cursor", "invalid cursor")
+		}
+		req.before = &pos
+	}
+	if len(v.errs) > 0 {
+		return req, errValidation(v.errs...)
+	}
+	return req, nil
+}
+
+// encodeCursor returns an opaque cursor for the results after pos.
+func encodeCursor(pos database.MessagePosition) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(pos.Timestamp.UnixNano(), 10) + ":" + pos.MessageID))
+}
+
+func decodeCursor(s string) (database.MessagePosition, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return database.MessagePosition{}, false
+	}
+	i := strings.IndexByte(string(raw), ':')
+	if i < 0 {
+		return database.MessagePosition{}, false
+	}
+	ns, err := strconv.ParseInt(string(raw[:i]), 10, 64)
+	if err != nil {
+		return database.MessagePosition{}, false
+	}
+	return database.MessagePosition{Timestamp: time.Unix(0, ns).UTC(), MessageID: string(raw[i+1:])}, true
+}
+
+// splitHighlights removes the highlight markers from a snippet, returning the matched ranges.
+func splitHighlights(marked string) (string, []Highlight) {
+	var b strings.Builder
+	highlights := make([]Highlight, 0)
+	pos, start := 0, -1
+	for _, r := range marked {
+		switch string(r) {
+		case database.HighlightStart:
+			start = pos
+		case database.HighlightEnd:
+			if start >= 0 {
+				highlights = append(highlights, Highlight{Start: start, Length: pos - start})
+				start = -1
+			}
+		default:
+			b.WriteRune(r)
+			pos++
+		}
+	}
+	return b.String(), highlights
+}
+
+/* helpers bound to Router */
+
+// indexMessage adds m to the search index. Failures are only logged: the message is stored anyway, it just can't be
+// found by searching.
+func (rt *Router) indexMessage(ctx reqcontext.RequestContext, m *Message) {
+	if m.Type != "text" {
+		return
+	}
+	err := rt.search.index(database.IndexedMessage{
+		MessageID:      m.MessageID,
+		ConversationID: m.ConversationID,
+		Content:        m.Content,
+		Timestamp:      m.Timestamp,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("message", m.MessageID).Warn("indexing message")
+	}
+}
+
+// unindexMessage removes a message from the search index, logging failures.
+func (rt *Router) unindexMessage(ctx reqcontext.RequestContext, messageID string) {
+	if err := rt.search.remove(messageID); err != nil {
+		ctx.Logger.WithError(err).WithField("message", messageID).Warn("removing message from the index")
+	}
+}
+
+// runSearch searches the messages of the given conversations and writes the results.
+func (rt *Router) runSearch(w http.ResponseWriter, ctx reqcontext.RequestContext, req searchRequest, conversationIDs []string) {
+	// One more hit than needed tells if there's a next page
+	hits, err := rt.search.search(database.MessageQuery{
+		Terms:           req.terms,
+		ConversationIDs: conversationIDs,
+		Before:          req.before,
+		Limit:           req.limit + 1,
+	})
+	if err != nil {
+		writeError(w, ctx, errInternal(err))
+		return
+	}
+	var next string
+	if len(hits) > req.limit {
+		hits = hits[:req.limit]
+		last := hits[len(hits)-1]
+		next = encodeCursor(database.MessagePosition{Timestamp: last.Timestamp, MessageID: last.MessageID})
+	}
+
+	out := SearchResults{Results: make([]SearchResult, 0, len(hits)), NextCursor: next}
+	for _, hit := range hits {
+		msg, err := rt.store.message(hit.MessageID)
+		if errors.Is(err, database.ErrNotFound) {
+			// Deleted after the search
+			continue
+		} else if err != nil {
+			writeError(w, ctx, errInternal(fmt.Errorf("reading message: %w", err)))
+			return
+		}
+		res := SearchResult{Message: msg}
+		res.Snippet, res.Highlights = splitHighlights(hit.Snippet)
+		out.Results = append(out.Results, res)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) searchMessages(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	req, err := parseSearchRequest(r)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	conversationIDs, err := rt.store.participantConversations(sess.Username)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("listing conversations: %w", err)))
+		return
+	}
+
+	rt.runSearch(w, ctx, req, conversationIDs)
+}
+
+func (rt *Router) searchConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if _, err := rt.authenticate(r, ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	req, err := parseSearchRequest(r)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	convID := ps.ByName("conversationId")
+
+	_, err = rt.store.conversation(convID)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, errNotFound("conversation not found"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading conversation: %w", err)))
+		return
+	}
+
+	rt.runSearch(w, ctx, req, []string{convID})
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+type searchPage struct {
+	Results []struct {
+		Message    struct{ MessageID, Content string }
+		Snippet    string
+		Highlights []Highlight
+	}
+	NextCursor string
+}
+
+// TestSearch runs the same scenario on the in-memory index and on the FTS5 one. The latter is skipped unless the
+// tests are built with the sqlite_fts5 tag.
+func TestSearch(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testSearch(t, Config{})
+	})
+	t.Run("fts5", func(t *testing.T) {
+		testSearch(t, Config{Database: newFTSDatabase(t)})
+	})
+}
+
+// newFTSDatabase returns an in-memory database with the FTS5 index, skipping the test unless it's built with the
+// sqlite_fts5 tag.
+func newFTSDatabase(t *testing.T) database.AppDatabase {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	conn.SetMaxOpenConns(1) // every connection to :memory: is a different database
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ClearMessageIndex(); errors.Is(err, database.ErrSearchUnavailable) {
+		t.Skip(err)
+	}
+	return db
+}
+
+// TestSearchManyConversations searches more conversations than SQLite accepts parameters in a statement.
+func TestSearchManyConversations(t *testing.T) {
+	db := newFTSDatabase(t)
+	t0 := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+	const conversations = 2500
+	ids := make([]string, conversations)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("chat-%04d", i)
+		// Older messages come later in the list, so that the newest ones are spread across the batches
+		err := db.IndexMessage(database.IndexedMessage{
+			MessageID:      fmt.Sprintf("m-%04d", i),
+			ConversationID: ids[i],
+			Content:        "lunch",
+			Timestamp:      t0.Add(time.Duration((i%7)*conversations-i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	q := database.MessageQuery{Terms: []string{"lunch"}, ConversationIDs: ids, Limit: 300}
+	for {
+		hits, err := db.SearchMessages(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) > q.Limit {
+			t.Fatalf("got %d hits, more than the limit of %d", len(hits), q.Limit)
+		}
+		for _, hit := range hits {
+			got = append(got, hit.MessageID)
+		}
+		if len(hits) < q.Limit {
+			break
+		}
+		last := hits[len(hits)-1]
+		q.Before = &database.MessagePosition{Timestamp: last.Timestamp, MessageID: last.MessageID}
+	}
+
+	want := make([]string, conversations)
+	for i := range want {
+		want[i] = fmt.Sprintf("m-%04d", i)
+	}
+	at := func(id string) time.Duration {
+		var i int
+		_, _ = fmt.Sscanf(id, "m-%d", &i)
+		return time.Duration((i%7)*conversations - i)
+	}
+	sort.Slice(want, func(i, j int) bool { return at(want[i]) > at(want[j]) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d hits, want the %d messages newest first", len(got), len(want))
+	}
+}
+
+func testSearch(t *testing.T, cfg Config) {
+	f := newConformanceFixture(t, cfg)
+	alice := f.login("alice")
+	bob := f.login("bob")
+
+	search := func(token, path string) searchPage {
+		t.Helper()
+		resp, data := f.do(http.MethodGet, path, token, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status %d (body: %s)", path, resp.StatusCode, data)
+		}
+		var page searchPage
+		f.decodeInto(data, &page)
+		return page
+	}
+
+	first := f.sendMessage(alice, "chat-search", "Lunch tomorrow?")
+	second := f.sendMessage(alice, "chat-search", "The meeting is moved: lunch at noon, then the quarterly review")
+	f.sendMessage(alice, "chat-search", "Nothing to see here")
+	f.sendMessage(bob, "chat-bob", "lunch is on me")
+
+	page := search(alice, "/search?q="+url.QueryEscape("LUNCH!"))
+	if len(page.Results) != 2 || page.Results[0].Message.MessageID != second || page.Results[1].Message.MessageID != first {
+		t.Fatalf("got %+v, want the two lunch messages of alice, newest first", page.Results)
+	}
+	res := page.Results[1]
+	if res.Snippet != "Lunch tomorrow?" || len(res.Highlights) != 1 || res.Highlights[0] != (Highlight{Start: 0, Length: 5}) {
+		t.Errorf("got snippet %q with highlights %+v", res.Snippet, res.Highlights)
+	}
+
+	// Every term must match
+	if page := search(alice, "/search?q=lunch+review"); len(page.Results) != 1 || page.Results[0].Message.MessageID != second {
+		t.Errorf("got %+v, want only the message with both terms", page.Results)
+	}
+
+	// Pagination walks the results without repeating any
+	page = search(alice, "/search?q=lunch&limit=1")
+	if len(page.Results) != 1 || page.Results[0].Message.MessageID != second || page.NextCursor == "" {
+		t.Fatalf("first page: got %+v", page)
+	}
+	page = search(alice, "/search?q=lunch&limit=1&cursor="+url.QueryEscape(page.NextCursor))
+	if len(page.Results) != 1 || page.Results[0].Message.MessageID != first || page.NextCursor != "" {
+		t.Fatalf("second page: got %+v", page)
+	}
+
+	// Deleted messages disappear from the results
+	if resp, data := f.do(http.MethodDelete, "/messages/"+first, alice, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting message: status %d (body: %s)", resp.StatusCode, data)
+	}
+	if page := search(alice, "/conversations/chat-search/search?q=lunch"); len(page.Results) != 1 {
+		t.Errorf("got %+v after deleting a message, want one result", page.Results)
+	}
+
+	// Users only find the messages of their conversations
+	if page := search(bob, "/search?q=lunch"); len(page.Results) != 1 || page.Results[0].Message.Content != "lunch is on me" {
+		t.Errorf("got %+v, want only the message of bob", page.Results)
+	}
+	// Conversations are public: everyone can search one
+	if page := search(bob, "/conversations/chat-search/search?q=lunch"); len(page.Results) != 1 {
+		t.Errorf("got %+v searching a conversation of another user, want one result", page.Results)
+	}
+	if resp, _ := f.do(http.MethodGet, "/conversations/nowhere/search?q=lunch", bob, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("searching a missing conversation: got status %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/service/api/reqcontext"
+)
+
+// SessionConfig configures the session lifecycle. Zero values mean "never": sessions don't expire and are never
+// cleaned up.
+type SessionConfig struct {
+	// IdleTTL is how long a session survives without being used
+	IdleTTL time.Duration
+
+	// AbsoluteTTL is how long a session survives after login, regardless of its use
+	AbsoluteTTL time.Duration
+
+	// CleanupInterval is how often expired sessions are removed from the store
+	CleanupInterval time.Duration
+}
+
+// Session is a login of a user on a device. The bearer token is never stored nor shown again after login: sessions
+// are listed and revoked by ID.
+type Session struct {
+	ID         string
+	Username   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+
+	// TokenHash is the hash of the opaque token of the session, empty for signed tokens
+	TokenHash string
+}
+
+// expiresAt returns when the session expires if unused, or the zero time if it never expires.
+func (s *Session) expiresAt(cfg SessionConfig) time.Time {
+	var exp time.Time
+	if cfg.IdleTTL > 0 {
+		exp = s.LastUsedAt.Add(cfg.IdleTTL)
+	}
+	if cfg.AbsoluteTTL > 0 {
+		if abs := s.CreatedAt.Add(cfg.AbsoluteTTL); exp.IsZero() || abs.Before(exp) {
+			exp = abs
+		}
+	}
+	return exp
+}
+
+func (s *Session) expired(cfg SessionConfig, now time.Time) bool {
+	exp := s.expiresAt(cfg)
+	return !exp.IsZero() && !now.Before(exp)
+}
+
+/* helpers bound to Router */
+
+// newSession creates a session for username and returns its bearer token.
+func (rt *Router) newSession(username string) (string, error) {
+	now := rt.clock.Now().UTC()
+	sess := &Session{
+		ID:         uuid.Must(uuid.NewV4()).String(),
+		Username:   username,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	var token string
+	var err error
+	if rt.tokenCfg.Mode == TokenSigned {
+		claims := tokenClaims{SessionID: sess.ID, Username: username, IssuedAt: now.Unix()}
+		if rt.sessionCfg.AbsoluteTTL > 0 {
+			claims.ExpiresAt = now.Add(rt.sessionCfg.AbsoluteTTL).Unix()
+		}
+		token, err = rt.tokenCfg.sign(claims)
+	} else {
+		token, sess.TokenHash, err = newOpaqueToken()
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := rt.store.createSession(*sess); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupSession returns the session of token, or nil if the token is invalid, revoked or expired.
+func (rt *Router) lookupSession(token string, now time.Time) (*Session, error) {
+	var sess Session
+	var err error
+	if rt.tokenCfg.Mode == TokenSigned {
+		claims, verr := rt.tokenCfg.verify(token, now)
+		if verr != nil {
+			return nil, nil
+		}
+		if revoked, err := rt.store.isTokenRevoked(claims.SessionID); err != nil || revoked {
+			return nil, err
+		}
+		sess, err = rt.store.session(claims.SessionID)
+		if errors.Is(err, database.ErrNotFound) {
+			sess, err = rt.restoreSession(claims)
+		}
+	} else {
+		// The lookup is done on the hash: timing differences leak nothing useful about the token
+		sess, err = rt.store.sessionByToken(hashToken(token))
+	}
+
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if sess.expired(rt.sessionCfg, now) {
+		return nil, rt.revoke(sess)
+	}
+	return &sess, nil
+}
+
+// restoreSession recreates the session of a valid signed token that the store lost without revoking it (e.g., a crash
+// lost the last changes, or the store was restored from a backup). Sessions are deleted with a revocation, so they are
+// restored only if their token is newer than the store, and than the last rename of its user: the name in an older
+// token may now belong to someone else. Restored sessions count as last used at login, as the store lost their use.
+// It returns ErrNotFound if the session can't be restored.
+func (rt *Router) restoreSession(claims tokenClaims) (Session, error) {
+	if claims.IssuedAt < rt.sessionEpoch.Unix() {
+		return Session{}, database.ErrNotFound
+	}
+	created := time.Unix(claims.IssuedAt, 0).UTC()
+	if renamed, err := rt.store.userRenamedAt(claims.Username); err != nil {
+		return Session{}, err
+	} else if !renamed.IsZero() && !renamed.Before(created) {
+		return Session{}, database.ErrNotFound
+	}
+
+	sess := Session{ID: claims.SessionID, Username: claims.Username, CreatedAt: created, LastUsedAt: created}
+	err := rt.store.createSession(sess)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		// Restored by a concurrent request
+		return rt.store.session(claims.SessionID)
+	}
+	return sess, err
+}
+
+// revoke deletes a session, so that its token is not accepted anymore.
+func (rt *Router) revoke(sess Session) error {
+	if err := rt.store.deleteSession(sess.ID); err != nil && !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+	return rt.rememberRevoked(sess)
+}
+
+// rememberRevoked records the revocation of signed tokens, which stay valid until they expire.
+func (rt *Router) rememberRevoked(sess Session) error {
+	if rt.tokenCfg.Mode != TokenSigned {
+		return nil
+	}
+	var until time.Time
+	if rt.sessionCfg.AbsoluteTTL > 0 {
+		until = sess.CreatedAt.Add(rt.sessionCfg.AbsoluteTTL)
+	}
+	return rt.store.revokeToken(sess.ID, until)
+}
+
+// authenticate returns the session of the bearer token of r, and marks it as used. Its user is recorded in ctx, for
+// the log of the request. It fails with an unauthorized error if the token is missing, unknown, revoked or expired.
+func (rt *Router) authenticate(r *http.Request, ctx reqcontext.RequestContext) (Session, error) {
+	token := bearer(r)
+	if token == "" {
+		return Session{}, errUnauthorized("missing token")
+	}
+	now := rt.clock.Now().UTC()
+
+	sess, err := rt.lookupSession(token, now)
+	if err != nil {
+		return Session{}, errInternal(fmt.Errorf("looking up session: %w", err))
+	}
+	if sess == nil {
+		return Session{}, errUnauthorized("invalid or expired token")
+	}
+	if err := rt.store.touchSession(sess.ID, now); errors.Is(err, database.ErrNotFound) {
+		// Revoked in the meantime
+		return Session{}, errUnauthorized("invalid or expired token")
+	} else if err != nil {
+		return Session{}, errInternal(fmt.Errorf("updating session: %w", err))
+	}
+	sess.LastUsedAt = now
+	if ctx.Auth != nil {
+		ctx.Auth.Username = sess.Username
+	}
+	return *sess, nil
+}
+
+// sessionUser returns the username that token claims, or an empty string if it claims none. Unlike authenticate, it
+// changes nothing: expired sessions are neither revoked nor restored, and the session isn't marked as used. Signed
+// tokens are only verified, so they still name their user when revoked: the result is not an authentication.
+func (rt *Router) sessionUser(token string) string {
+	if token == "" {
+		return ""
+	}
+	if rt.tokenCfg.Mode == TokenSigned {
+		if claims, err := rt.tokenCfg.verify(token, rt.clock.Now().UTC()); err == nil {
+			return claims.Username
+		}
+		return ""
+	}
+	if sess, err := rt.store.sessionByToken(hashToken(token)); err == nil {
+		return sess.Username
+	}
+	return ""
+}
+
+// removeExpiredSessions deletes expired sessions and returns how many were deleted. Revoked signed tokens that
+// expired in the meantime are forgotten as well.
+func (rt *Router) removeExpiredSessions() (int, error) {
+	now := rt.clock.Now().UTC()
+	var idleBefore, createdBefore time.Time
+	if rt.sessionCfg.IdleTTL > 0 {
+		idleBefore = now.Add(-rt.sessionCfg.IdleTTL)
+	}
+	if rt.sessionCfg.AbsoluteTTL > 0 {
+		createdBefore = now.Add(-rt.sessionCfg.AbsoluteTTL)
+	}
+	if idleBefore.IsZero() && createdBefore.IsZero() {
+		return 0, nil
+	}
+
+	expired, err := rt.store.deleteExpiredSessions(idleBefore, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	for _, sess := range expired {
+		if err := rt.rememberRevoked(sess); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), rt.store.forgetRevokedTokens(now)
+}
+
+// sessionCleanup removes expired sessions every CleanupInterval, until rt.shutdown is closed.
+func (rt *Router) sessionCleanup() {
+	defer rt.background.Done()
+
+	ticker := rt.clock.NewTicker(rt.sessionCfg.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rt.shutdown:
+			return
+		case <-ticker.C():
+			if n, err := rt.removeExpiredSessions(); err != nil {
+				rt.baseLogger.WithError(err).Error("removing expired sessions")
+			} else if n > 0 {
+				rt.baseLogger.WithField("sessions", n).Debug("expired sessions removed")
+			}
+		}
+	}
+}
+
+/* ROUTE HANDLERS */
+
+func (rt *Router) doLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	if err := rt.revoke(sess); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("revoking session: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *Router) getMySessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	sessions, err := rt.store.userSessions(sess.Username)
+	if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("listing sessions: %w", err)))
+		return
+	}
+	list := make([]SessionInfo, 0, len(sessions))
+	now := rt.clock.Now()
+	for _, s := range sessions {
+		if s.expired(rt.sessionCfg, now) {
+			continue
+		}
+		info := SessionInfo{
+			ID:         s.ID,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			Current:    s.ID == sess.ID,
+		}
+		if exp := s.expiresAt(rt.sessionCfg); !exp.IsZero() {
+			info.ExpiresAt = &exp
+		}
+		list = append(list, info)
+	}
+
+	writeJSON(w, http.StatusOK, SessionList{Sessions: list})
+}
+
+func (rt *Router) deleteSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sess, err := rt.authenticate(r, ctx)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	sessionID := ps.ByName("sessionId")
+
+	// Sessions of other users are reported as missing, to avoid leaking their existence
+	s, err := rt.store.session(sessionID)
+	if errors.Is(err, database.ErrNotFound) || (err == nil && s.Username != sess.Username) {
+		writeError(w, ctx, errNotFound("session not found"))
+		return
+	} else if err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("reading session: %w", err)))
+		return
+	}
+	if err := rt.revoke(s); err != nil {
+		writeError(w, ctx, errInternal(fmt.Errorf("revoking session: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
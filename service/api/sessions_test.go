@@ -0,0 +1,137 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/sirupsen/logrus"
+)
+
+// TestSessionExpiry checks that sessions expire when they are not used for IdleTTL, and AbsoluteTTL after login.
+func TestSessionExpiry(t *testing.T) {
+	for name, tokens := range map[string]TokenConfig{"opaque": {}, "signed": testSignedTokens} {
+		t.Run(name, func(t *testing.T) {
+			clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+			cfg := Config{
+				Tokens:   tokens,
+				Sessions: SessionConfig{IdleTTL: time.Hour, AbsoluteTTL: 3 * time.Hour},
+				Clock:    clock,
+			}
+			if tokens.Mode == TokenSigned {
+				cfg.Persistence.Dir = t.TempDir()
+			}
+			rt, f := newRetentionFixture(t, cfg)
+			check := func(what, token string, want int) {
+				t.Helper()
+				if resp, data := f.do(http.MethodGet, "/sessions", token, ""); resp.StatusCode != want {
+					t.Errorf("%s: status %d, want %d (body: %s)", what, resp.StatusCode, want, data)
+				}
+			}
+			active, idle := f.login("alice"), f.login("alice")
+
+			clock.Advance(50 * time.Minute)
+			check("session used in the last hour", active, http.StatusOK)
+			clock.Advance(50 * time.Minute)
+			check("session used in the last hour", active, http.StatusOK)
+			check("session unused for an hour", idle, http.StatusUnauthorized)
+
+			clock.Advance(50 * time.Minute)
+			check("session in use", active, http.StatusOK)
+			bob := f.login("bob")
+			clock.Advance(50 * time.Minute)
+			check("session in use after AbsoluteTTL", active, http.StatusUnauthorized)
+
+			// Expired sessions are removed even if their token is never sent again
+			clock.Advance(time.Hour)
+			if _, err := rt.removeExpiredSessions(); err != nil {
+				t.Fatalf("removing expired sessions: %v", err)
+			}
+			for _, user := range []string{"alice", "bob"} {
+				if sessions, _ := rt.store.userSessions(user); len(sessions) != 0 {
+					t.Errorf("sessions of %s: got %+v", user, sessions)
+				}
+			}
+			check("removed session", bob, http.StatusUnauthorized)
+		})
+	}
+}
+
+// TestSignedTokenRestore loses sessions of signed tokens behind the back of the router, and checks which ones it
+// restores from their tokens.
+func TestSignedTokenRestore(t *testing.T) {
+	clock := globaltime.NewFake(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC))
+	cfg := Config{
+		Storage:  StorageSQLite,
+		Database: newTestDatabase(t),
+		Tokens:   testSignedTokens,
+		Sessions: SessionConfig{IdleTTL: time.Hour, AbsoluteTTL: 3 * time.Hour},
+		Clock:    clock,
+	}
+	rt, f := newRetentionFixture(t, cfg)
+	check := func(what, token string, want int) {
+		t.Helper()
+		if resp, data := f.do(http.MethodGet, "/sessions", token, ""); resp.StatusCode != want {
+			t.Errorf("%s: status %d, want %d (body: %s)", what, resp.StatusCode, want, data)
+		}
+	}
+	// lose deletes every session without revoking their tokens, as a crash losing the last changes would
+	lose := func() {
+		t.Helper()
+		if _, err := rt.store.deleteExpiredSessions(clock.Now().Add(time.Hour), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A lost session is restored, as last used at login: its later use was lost with it
+	recent, used := f.login("alice"), f.login("bob")
+	clock.Advance(30 * time.Minute)
+	check("session in use", used, http.StatusOK)
+	lose()
+	check("lost session", recent, http.StatusOK)
+	clock.Advance(40 * time.Minute)
+	check("restored session in use", recent, http.StatusOK)
+	check("lost session used in the last hour, but not since login", used, http.StatusUnauthorized)
+
+	// The name in a token is not trusted after a rename
+	renamed := f.login("carol")
+	clock.Advance(time.Second)
+	if resp, data := f.do(http.MethodPut, "/user/username", renamed, `{"name":"caroline"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("renaming: status %d (body: %s)", resp.StatusCode, data)
+	}
+	check("renamed session", renamed, http.StatusOK)
+	lose()
+	check("lost session of a renamed user", renamed, http.StatusUnauthorized)
+
+	// Tokens older than the store are not restored
+	older := f.login("dave")
+	clock.Advance(time.Second)
+	cfg.Database = newTestDatabase(t)
+	_, other := newRetentionFixture(t, cfg)
+	check("token of the store", older, http.StatusOK)
+	if resp, data := other.do(http.MethodGet, "/sessions", older, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token older than the store: status %d, want 401 (body: %s)", resp.StatusCode, data)
+	}
+	if resp, data := other.do(http.MethodGet, "/sessions", other.login("dave"), ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("token of the other store: status %d, want 200 (body: %s)", resp.StatusCode, data)
+	}
+}
+
+// TestSignedTokenConfig checks that signed tokens are refused without an absolute TTL or durable storage, which
+// their revocations need.
+func TestSignedTokenConfig(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	for name, cfg := range map[string]Config{
+		"without absolute TTL": {Storage: StorageSQLite, Database: newTestDatabase(t), Tokens: testSignedTokens},
+		"in memory":            {Tokens: testSignedTokens, Sessions: SessionConfig{AbsoluteTTL: time.Hour}},
+	} {
+		cfg.Logger = logger
+		if rt, err := New(cfg); err == nil {
+			_ = rt.Close()
+			t.Errorf("%s: the router was created", name)
+		}
+	}
+}
@@ -0,0 +1,753 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/globaltime"
+	"github.com/mlatsa/WASAProject/internal/service/wal"
+	"github.com/sirupsen/logrus"
+)
+
+// PersistenceConfig makes the memory storage durable, with snapshots and a write-ahead log of its changes. The zero
+// value keeps the state in memory only.
+type PersistenceConfig struct {
+	// Dir is the directory of the snapshots and of the log. Empty disables persistence.
+	Dir string
+
+	// Sync is when the log is flushed to disk. The zero value flushes every change before it's acknowledged.
+	Sync wal.SyncPolicy
+
+	// SyncInterval is how often the log is flushed with wal.SyncInterval (wal.DefaultSyncInterval if zero)
+	SyncInterval time.Duration
+
+	// SnapshotInterval is how often the state is saved in a snapshot, which compacts the log. A snapshot is taken on
+	// Close too. Zero takes snapshots only on Close.
+	SnapshotInterval time.Duration
+}
+
+// Operations of the log. Only the changes that succeeded are logged, so replaying them must succeed.
+const (
+	opSetPassword      = "setPassword"
+	opRenameUser       = "renameUser"
+	opCreateSession    = "createSession"
+	opTouchSession     = "touchSession"
+	opDeleteSessions   = "deleteSessions"
+	opRevokeToken      = "revokeToken"
+	opForgetRevoked    = "forgetRevoked"
+	opSessionEpoch     = "sessionEpoch"
+	opOpenConversation = "openConversation"
+	opAddMessage       = "addMessage"
+	opDeleteMessage    = "deleteMessage"
+	opAddReaction      = "addReaction"
+	opRemoveReaction   = "removeReaction"
+	opImport           = "import"
+	opSetRetention     = "setRetention"
+	opSchedule         = "schedule"
+	opCancelScheduled  = "cancelScheduled"
+	opDeliverScheduled = "deliverScheduled"
+	opPin              = "pin"
+	opUnpin            = "unpin"
+	opStar             = "star"
+	opUnstar           = "unstar"
+	opAddMedia         = "addMedia"
+	opAttachMedia      = "attachMedia"
+	opDeleteMedia      = "deleteMedia"
+)
+
+// logRecord is a change of the store. The fields in use depend on Op.
+type logRecord struct {
+	Op           string        `json:"op"`
+	ID           string        `json:"id,omitempty"` // of the session, conversation or message changed
+	IDs          []string      `json:"ids,omitempty"`
+	Username     string        `json:"username,omitempty"`
+	NewName      string        `json:"newName,omitempty"`
+	Hash         []byte        `json:"hash,omitempty"`
+	Time         time.Time     `json:"time"`
+	Session      *Session      `json:"session,omitempty"`
+	Message      *Message      `json:"message,omitempty"`
+	Reaction     *Reaction     `json:"reaction,omitempty"`
+	Conversation *Conversation `json:"conversation,omitempty"`
+
+	Retention *RetentionPolicy  `json:"retention,omitempty"`
+	Scheduled *ScheduledMessage `json:"scheduled,omitempty"`
+	Pin       *Pin              `json:"pin,omitempty"`
+	Media     *Media            `json:"media,omitempty"`
+}
+
+// storeState is the content of a snapshot.
+type storeState struct {
+	Sessions      []Session            `json:"sessions"`
+	Revoked       map[string]time.Time `json:"revoked"`
+	Credentials   map[string][]byte    `json:"credentials"`
+	Renamed       map[string]time.Time `json:"renamed,omitempty"`
+	SessionEpoch  time.Time            `json:"sessionEpoch"`
+	Conversations []Conversation       `json:"conversations"`
+	Scheduled     []ScheduledMessage   `json:"scheduled,omitempty"`
+
+	Pins  map[string][]Pin                `json:"pins,omitempty"`  // conversation ID -> pins
+	Stars map[string]map[string]time.Time `json:"stars,omitempty"` // username -> starred message ID -> time
+	Media []Media                         `json:"media,omitempty"`
+}
+
+// state returns the content of the store. The messages are shared with the store: they must not be modified.
+func (s *Store) state() storeState {
+	st := storeState{Revoked: map[string]time.Time{}, Credentials: map[string][]byte{}}
+	s.usersMu.Lock()
+	for _, sess := range s.sessions {
+		st.Sessions = append(st.Sessions, *sess)
+	}
+	for id, until := range s.revoked {
+		st.Revoked[id] = until
+	}
+	for name, hash := range s.credentials {
+		st.Credentials[name] = hash
+	}
+	for name, at := range s.renamed {
+		if st.Renamed == nil {
+			st.Renamed = map[string]time.Time{}
+		}
+		st.Renamed[name] = at
+	}
+	st.SessionEpoch = s.epoch
+	s.usersMu.Unlock()
+
+	s.starsMu.Lock()
+	for name, stars := range s.stars {
+		if st.Stars == nil {
+			st.Stars = map[string]map[string]time.Time{}
+		}
+		st.Stars[name] = map[string]time.Time{}
+		for id, t := range stars {
+			st.Stars[name][id] = t
+		}
+	}
+	s.starsMu.Unlock()
+
+	s.mediaMu.Lock()
+	for _, m := range s.media {
+		st.Media = append(st.Media, m)
+	}
+	s.mediaMu.Unlock()
+	sort.Slice(st.Media, func(i, j int) bool { return st.Media[i].URL < st.Media[j].URL })
+
+	for _, sc := range s.snapshotConversations() {
+		st.Conversations = append(st.Conversations, sc.snapshot())
+		sc.mu.RLock()
+		if len(sc.pins) > 0 {
+			if st.Pins == nil {
+				st.Pins = map[string][]Pin{}
+			}
+			st.Pins[sc.conv.ID] = append([]Pin(nil), sc.pins...)
+		}
+		sc.mu.RUnlock()
+	}
+
+	s.scheduledMu.Lock()
+	for _, sm := range s.scheduled {
+		st.Scheduled = append(st.Scheduled, sm)
+	}
+	s.scheduledMu.Unlock()
+	sortScheduled(st.Scheduled)
+	return st
+}
+
+// restore loads st in an empty store.
+func (s *Store) restore(st storeState) error {
+	for _, sess := range st.Sessions {
+		if err := s.createSession(sess); err != nil {
+			return fmt.Errorf("session %s: %w", sess.ID, err)
+		}
+	}
+	for id, until := range st.Revoked {
+		_ = s.revokeToken(id, until)
+	}
+	for name, hash := range st.Credentials {
+		_, _ = s.setPasswordHash(name, hash, time.Time{})
+	}
+	s.usersMu.Lock()
+	for name, at := range st.Renamed {
+		s.renamed[name] = at
+	}
+	s.usersMu.Unlock()
+	_, _ = s.sessionEpoch(st.SessionEpoch)
+	for _, c := range st.Conversations {
+		if err := s.importConversation(c); err != nil {
+			return fmt.Errorf("conversation %s: %w", c.ID, err)
+		}
+	}
+	for _, sm := range st.Scheduled {
+		if err := s.scheduleMessage(sm, 0); err != nil {
+			return fmt.Errorf("scheduled message %s: %w", sm.ScheduledID, err)
+		}
+	}
+	for id, pins := range st.Pins {
+		for _, p := range pins {
+			if err := s.pinMessage(id, p, 0); err != nil {
+				return fmt.Errorf("pin of message %s: %w", p.MessageID, err)
+			}
+		}
+	}
+	for name, stars := range st.Stars {
+		for id, t := range stars {
+			if err := s.starMessage(name, id, t); err != nil {
+				return fmt.Errorf("star of message %s: %w", id, err)
+			}
+		}
+	}
+	for _, m := range st.Media {
+		if err := s.addMedia(m); err != nil {
+			return fmt.Errorf("media %s: %w", m.URL, err)
+		}
+	}
+	return nil
+}
+
+// durableStore is the in-memory store, with its changes logged to disk. A change is applied and logged while
+// holding mu, so that the log replays changes in the order they were made; the reads, and the flushes of the log,
+// run in parallel.
+type durableStore struct {
+	*Store
+
+	mu      sync.Mutex
+	log     *wal.Log
+	changes int // changes logged since the last snapshot
+
+	logger           logrus.FieldLogger
+	clock            globaltime.Clock // ticks the snapshots
+	snapshotInterval time.Duration
+	stop             chan struct{}
+	done             chan struct{}
+}
+
+// openDurableStore restores the store saved in cfg.Dir, and starts logging its changes there. Snapshots are taken
+// every cfg.SnapshotInterval of clock.
+func openDurableStore(cfg PersistenceConfig, clock globaltime.Clock, logger logrus.FieldLogger) (*durableStore, error) {
+	if cfg.SnapshotInterval < 0 {
+		return nil, errors.New("the snapshot interval can't be negative")
+	}
+	log, err := wal.Open(cfg.Dir, wal.Options{Sync: cfg.Sync, SyncInterval: cfg.SyncInterval})
+	if err != nil {
+		return nil, err
+	}
+	d := &durableStore{
+		Store:            newStore(),
+		log:              log,
+		logger:           logger,
+		clock:            clock,
+		snapshotInterval: cfg.SnapshotInterval,
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	restore := func(r io.Reader) error {
+		var st storeState
+		if err := json.NewDecoder(r).Decode(&st); err != nil {
+			return err
+		}
+		return d.Store.restore(st)
+	}
+	recovery, err := log.Load(restore, d.replay)
+	if err != nil {
+		_ = log.Close()
+		return nil, fmt.Errorf("loading the store: %w", err)
+	}
+	d.changes = recovery.Records
+	entry := logger.WithFields(logrus.Fields{"snapshot": recovery.Snapshot, "records": recovery.Records})
+	if recovery.Dropped > 0 {
+		entry.WithField("dropped", recovery.Dropped).Warn("dropped a torn record at the end of the store log")
+	} else {
+		entry.Info("store loaded")
+	}
+
+	go d.snapshotLoop()
+	return d, nil
+}
+
+// replay applies a logged change.
+func (d *durableStore) replay(data []byte) error {
+	var rec logRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return fmt.Errorf("decoding a record: %w", err)
+	}
+	s := d.Store
+	switch rec.Op {
+	case opSetPassword:
+		_, err := s.setPasswordHash(rec.Username, rec.Hash, rec.Time)
+		return err
+	case opRenameUser:
+		return s.renameUser(rec.Username, rec.NewName, rec.Time)
+	case opCreateSession:
+		if rec.Session == nil {
+			break
+		}
+		return s.createSession(*rec.Session)
+	case opTouchSession:
+		return s.touchSession(rec.ID, rec.Time)
+	case opDeleteSessions:
+		for _, id := range rec.IDs {
+			if err := s.deleteSession(id); err != nil {
+				return fmt.Errorf("session %s: %w", id, err)
+			}
+		}
+		return nil
+	case opRevokeToken:
+		return s.revokeToken(rec.ID, rec.Time)
+	case opForgetRevoked:
+		return s.forgetRevokedTokens(rec.Time)
+	case opSessionEpoch:
+		_, err := s.sessionEpoch(rec.Time)
+		return err
+	case opOpenConversation:
+		s.ensureConversation(rec.ID, rec.Username, rec.Time)
+		return nil
+	case opAddMessage:
+		if rec.Message == nil {
+			break
+		}
+		_, err := s.addMessage(*rec.Message, rec.Username)
+		return err
+	case opDeleteMessage:
+		_, err := s.deleteMessage(rec.ID)
+		return err
+	case opAddReaction:
+		if rec.Reaction == nil {
+			break
+		}
+		_, err := s.addReaction(rec.ID, *rec.Reaction)
+		return err
+	case opRemoveReaction:
+		if rec.Reaction == nil {
+			break
+		}
+		_, _, err := s.removeReaction(rec.ID, rec.Reaction.ReactionID)
+		return err
+	case opImport:
+		if rec.Conversation == nil {
+			break
+		}
+		return s.importConversation(*rec.Conversation)
+	case opSetRetention:
+		if rec.Retention == nil {
+			break
+		}
+		_, err := s.setRetention(rec.ID, *rec.Retention)
+		return err
+	case opSchedule:
+		if rec.Scheduled == nil {
+			break
+		}
+		return s.scheduleMessage(*rec.Scheduled, 0)
+	case opCancelScheduled:
+		_, err := s.cancelScheduledMessage(rec.ID, rec.Username)
+		return err
+	case opDeliverScheduled:
+		if rec.Message == nil {
+			break
+		}
+		_, err := s.deliverScheduledMessage(rec.ID, *rec.Message)
+		return err
+	case opPin:
+		if rec.Pin == nil {
+			break
+		}
+		return s.pinMessage(rec.ID, *rec.Pin, 0)
+	case opUnpin:
+		if rec.Pin == nil {
+			break
+		}
+		return s.unpinMessage(rec.ID, rec.Pin.MessageID)
+	case opStar:
+		return s.starMessage(rec.Username, rec.ID, rec.Time)
+	case opUnstar:
+		return s.unstarMessage(rec.Username, rec.ID)
+	case opAddMedia:
+		if rec.Media == nil {
+			break
+		}
+		return s.addMedia(*rec.Media)
+	case opAttachMedia:
+		if rec.Media == nil {
+			break
+		}
+		return s.attachMedia(rec.Media.URL, rec.Media.Owner, rec.Media.MessageID)
+	case opDeleteMedia:
+		return s.deleteMedia(rec.ID)
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return fmt.Errorf("%s record without its value", rec.Op)
+}
+
+// mutate applies a change with apply, which returns the record to log, or nil if nothing changed. It returns once
+// the record is flushed as the sync policy requires.
+func (d *durableStore) mutate(apply func() (*logRecord, error)) error {
+	d.mu.Lock()
+	rec, err := apply()
+	if err != nil || rec == nil {
+		d.mu.Unlock()
+		return err
+	}
+	// If logging fails, the change is kept in memory but lost on restart
+	data, err := json.Marshal(rec)
+	var lsn uint64
+	if err == nil {
+		lsn, err = d.log.Append(data)
+	}
+	if err == nil {
+		d.changes++
+	}
+	d.mu.Unlock()
+	if err == nil {
+		err = d.log.Commit(lsn)
+	}
+	if err != nil {
+		return fmt.Errorf("logging %s: %w", rec.Op, err)
+	}
+	return nil
+}
+
+/* snapshots */
+
+func (d *durableStore) snapshotLoop() {
+	defer close(d.done)
+	var tick <-chan time.Time
+	if d.snapshotInterval > 0 {
+		ticker := d.clock.NewTicker(d.snapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C()
+	}
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-tick:
+			if err := d.snapshot(); err != nil {
+				d.logger.WithError(err).Error("taking a snapshot of the store")
+			}
+		}
+	}
+}
+
+// snapshot saves the state of the store, if it changed since the last snapshot.
+func (d *durableStore) snapshot() error {
+	d.mu.Lock()
+	if d.changes == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	st := d.Store.state()
+	gen, err := d.log.Rotate()
+	if err == nil {
+		d.changes = 0
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The messages of st are immutable: they are encoded without holding mu
+	return d.log.WriteSnapshot(gen, func(w io.Writer) error { return json.NewEncoder(w).Encode(st) })
+}
+
+// Close takes a last snapshot, and closes the log.
+func (d *durableStore) Close() error {
+	close(d.stop)
+	<-d.done
+	err := d.snapshot()
+	if cerr := d.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/* users and sessions */
+
+func (d *durableStore) setPasswordHash(username string, hash []byte, now time.Time) ([]byte, error) {
+	var stored []byte
+	err := d.mutate(func() (*logRecord, error) {
+		had, _ := d.Store.passwordHash(username)
+		var err error
+		if stored, err = d.Store.setPasswordHash(username, hash, now); err != nil || had != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opSetPassword, Username: username, Hash: stored, Time: now}, nil
+	})
+	return stored, err
+}
+
+func (d *durableStore) renameUser(oldName, newName string, at time.Time) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.renameUser(oldName, newName, at); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opRenameUser, Username: oldName, NewName: newName, Time: at}, nil
+	})
+}
+
+func (d *durableStore) createSession(sess Session) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.createSession(sess); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opCreateSession, Session: &sess}, nil
+	})
+}
+
+func (d *durableStore) touchSession(id string, t time.Time) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.touchSession(id, t); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opTouchSession, ID: id, Time: t}, nil
+	})
+}
+
+func (d *durableStore) deleteSession(id string) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.deleteSession(id); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opDeleteSessions, IDs: []string{id}}, nil
+	})
+}
+
+func (d *durableStore) deleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error) {
+	var expired []Session
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if expired, err = d.Store.deleteExpiredSessions(idleBefore, createdBefore); err != nil || len(expired) == 0 {
+			return nil, err
+		}
+		// The sessions are logged rather than the times, which pick them from the sessions as they are now
+		rec := &logRecord{Op: opDeleteSessions}
+		for _, sess := range expired {
+			rec.IDs = append(rec.IDs, sess.ID)
+		}
+		return rec, nil
+	})
+	return expired, err
+}
+
+func (d *durableStore) revokeToken(sessionID string, until time.Time) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.revokeToken(sessionID, until); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opRevokeToken, ID: sessionID, Time: until}, nil
+	})
+}
+
+// sessionEpoch logs the epoch only when it's set.
+func (d *durableStore) sessionEpoch(now time.Time) (time.Time, error) {
+	var epoch time.Time
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if epoch, err = d.Store.sessionEpoch(now); err != nil || !epoch.Equal(now) {
+			return nil, err
+		}
+		return &logRecord{Op: opSessionEpoch, Time: now}, nil
+	})
+	return epoch, err
+}
+
+func (d *durableStore) forgetRevokedTokens(now time.Time) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.forgetRevokedTokens(now); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opForgetRevoked, Time: now}, nil
+	})
+}
+
+/* conversations */
+
+func (d *durableStore) openConversation(id, username string, now time.Time) (Conversation, error) {
+	// Conversations are created holding mu only: without it, they are only read
+	if d.Store.lookupConversation(id) == nil {
+		err := d.mutate(func() (*logRecord, error) {
+			if d.Store.lookupConversation(id) != nil {
+				return nil, nil
+			}
+			d.Store.ensureConversation(id, username, now)
+			return &logRecord{Op: opOpenConversation, ID: id, Username: username, Time: now}, nil
+		})
+		if err != nil {
+			return Conversation{}, err
+		}
+	}
+	return d.Store.openConversation(id, username, now)
+}
+
+func (d *durableStore) addMessage(m Message, author string) (Conversation, error) {
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if c, err = d.Store.addMessage(m, author); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opAddMessage, Username: author, Message: &m}, nil
+	})
+	return c, err
+}
+
+func (d *durableStore) deleteMessage(id string) (Conversation, error) {
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if c, err = d.Store.deleteMessage(id); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opDeleteMessage, ID: id}, nil
+	})
+	return c, err
+}
+
+func (d *durableStore) addReaction(messageID string, rx Reaction) (Conversation, error) {
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if c, err = d.Store.addReaction(messageID, rx); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opAddReaction, ID: messageID, Reaction: &rx}, nil
+	})
+	return c, err
+}
+
+func (d *durableStore) removeReaction(messageID, reactionID string) (Reaction, Conversation, error) {
+	var rx Reaction
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if rx, c, err = d.Store.removeReaction(messageID, reactionID); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opRemoveReaction, ID: messageID, Reaction: &rx}, nil
+	})
+	return rx, c, err
+}
+
+func (d *durableStore) importConversation(c Conversation) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.importConversation(c); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opImport, Conversation: &c}, nil
+	})
+}
+
+func (d *durableStore) setRetention(conversationID string, p RetentionPolicy) (Conversation, error) {
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if c, err = d.Store.setRetention(conversationID, p); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opSetRetention, ID: conversationID, Retention: &p}, nil
+	})
+	return c, err
+}
+
+/* scheduled messages */
+
+func (d *durableStore) scheduleMessage(sm ScheduledMessage, limit int) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.scheduleMessage(sm, limit); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opSchedule, Scheduled: &sm}, nil
+	})
+}
+
+func (d *durableStore) cancelScheduledMessage(id, sender string) (ScheduledMessage, error) {
+	var sm ScheduledMessage
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if sm, err = d.Store.cancelScheduledMessage(id, sender); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opCancelScheduled, ID: id, Username: sender}, nil
+	})
+	return sm, err
+}
+
+// deliverScheduledMessage logs the delivery as a single record: after a crash, the message is either still
+// scheduled, or delivered.
+func (d *durableStore) deliverScheduledMessage(id string, m Message) (Conversation, error) {
+	var c Conversation
+	err := d.mutate(func() (*logRecord, error) {
+		var err error
+		if c, err = d.Store.deliverScheduledMessage(id, m); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opDeliverScheduled, ID: id, Message: &m}, nil
+	})
+	return c, err
+}
+
+func (d *durableStore) pinMessage(conversationID string, p Pin, limit int) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.pinMessage(conversationID, p, limit); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opPin, ID: conversationID, Pin: &p}, nil
+	})
+}
+
+func (d *durableStore) unpinMessage(conversationID, messageID string) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.unpinMessage(conversationID, messageID); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opUnpin, ID: conversationID, Pin: &Pin{MessageID: messageID}}, nil
+	})
+}
+
+func (d *durableStore) starMessage(username, messageID string, t time.Time) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.starMessage(username, messageID, t); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opStar, ID: messageID, Username: username, Time: t}, nil
+	})
+}
+
+func (d *durableStore) unstarMessage(username, messageID string) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.unstarMessage(username, messageID); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opUnstar, ID: messageID, Username: username}, nil
+	})
+}
+
+func (d *durableStore) addMedia(m Media) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.addMedia(m); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opAddMedia, Media: &m}, nil
+	})
+}
+
+func (d *durableStore) attachMedia(url, owner, messageID string) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.attachMedia(url, owner, messageID); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opAttachMedia, Media: &Media{URL: url, Owner: owner, MessageID: messageID}}, nil
+	})
+}
+
+func (d *durableStore) deleteMedia(url string) error {
+	return d.mutate(func() (*logRecord, error) {
+		if err := d.Store.deleteMedia(url); err != nil {
+			return nil, err
+		}
+		return &logRecord{Op: opDeleteMedia, ID: url}, nil
+	})
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mlatsa/WASAProject/internal/service/database"
+)
+
+// dbStore is the repository backed by the SQLite database. It converts between the models of the API and the rows of
+// the database package.
+type dbStore struct {
+	db database.AppDatabase
+
+	// tokenTTL is how long signed tokens are valid, to revoke them with their sessions
+	tokenTTL time.Duration
+}
+
+func toAPISession(s database.Session) Session {
+	return Session{ID: s.ID, Username: s.Username, CreatedAt: s.CreatedAt, LastUsedAt: s.LastUsedAt, TokenHash: s.TokenHash}
+}
+
+func toAPIConversation(c database.Conversation) Conversation {
+	return Conversation{
+		ID:           c.ID,
+		Participants: c.Participants,
+		LastMessage:  c.LastMessage,
+		Timestamp:    c.Timestamp,
+		Name:         c.Name,
+		Photo:        c.Photo,
+		Retention:    RetentionPolicy{Mode: c.Retention.Mode, Days: c.Retention.Days, Hours: c.Retention.Hours},
+	}
+}
+
+func toAPIMessage(m database.Message) Message {
+	msg := Message{
+		MessageID:      m.ID,
+		ConversationID: m.ConversationID,
+		Sender:         m.Sender,
+		Content:        m.Content,
+		Type:           m.Type,
+		Status:         m.Status,
+		Timestamp:      m.Timestamp,
+		ForwardedFrom:  m.ForwardedFrom,
+	}
+	for _, r := range m.Reactions {
+		msg.Reactions = append(msg.Reactions, Reaction{ReactionID: r.ID, Emoji: r.Emoji})
+	}
+	return msg
+}
+
+func toDBMessage(m Message) database.Message {
+	msg := database.Message{
+		ID:             m.MessageID,
+		ConversationID: m.ConversationID,
+		Sender:         m.Sender,
+		Content:        m.Content,
+		Type:           m.Type,
+		Status:         m.Status,
+		Timestamp:      m.Timestamp,
+		ForwardedFrom:  m.ForwardedFrom,
+	}
+	for _, r := range m.Reactions {
+		msg.Reactions = append(msg.Reactions, database.Reaction{ID: r.ReactionID, Emoji: r.Emoji})
+	}
+	return msg
+}
+
+func (s *dbStore) passwordHash(username string) ([]byte, error) {
+	u, err := s.db.GetUser(username)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	}
+	return u.PasswordHash, err
+}
+
+func (s *dbStore) setPasswordHash(username string, hash []byte, now time.Time) ([]byte, error) {
+	return s.db.SetPasswordHash(username, hash, now)
+}
+
+func (s *dbStore) renameUser(oldName, newName string, at time.Time) error {
+	return s.db.RenameUser(oldName, newName, at)
+}
+
+func (s *dbStore) knownUsers() (map[string]bool, error) {
+	names, err := s.db.KnownUsers()
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	return known, err
+}
+
+func (s *dbStore) createSession(sess Session) error {
+	return s.db.CreateSession(database.Session{
+		ID:         sess.ID,
+		Username:   sess.Username,
+		TokenHash:  sess.TokenHash,
+		CreatedAt:  sess.CreatedAt,
+		LastUsedAt: sess.LastUsedAt,
+	})
+}
+
+func (s *dbStore) session(id string) (Session, error) {
+	sess, err := s.db.GetSession(id)
+	return toAPISession(sess), err
+}
+
+func (s *dbStore) sessionByToken(tokenHash string) (Session, error) {
+	sess, err := s.db.GetSessionByToken(tokenHash)
+	return toAPISession(sess), err
+}
+
+func (s *dbStore) touchSession(id string, t time.Time) error { return s.db.TouchSession(id, t) }
+func (s *dbStore) deleteSession(id string) error             { return s.db.RevokeSession(id, s.tokenTTL) }
+
+func (s *dbStore) userSessions(username string) ([]Session, error) {
+	sessions, err := s.db.ListSessions(username)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Session, len(sessions))
+	for i, sess := range sessions {
+		list[i] = toAPISession(sess)
+	}
+	return list, nil
+}
+
+func (s *dbStore) deleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error) {
+	sessions, err := s.db.DeleteExpiredSessions(idleBefore, createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Session, len(sessions))
+	for i, sess := range sessions {
+		list[i] = toAPISession(sess)
+	}
+	return list, nil
+}
+
+func (s *dbStore) revokeToken(sessionID string, until time.Time) error {
+	return s.db.RevokeToken(sessionID, until)
+}
+
+func (s *dbStore) isTokenRevoked(sessionID string) (bool, error) {
+	return s.db.IsTokenRevoked(sessionID)
+}
+func (s *dbStore) forgetRevokedTokens(now time.Time) error { return s.db.ForgetRevokedTokens(now) }
+
+func (s *dbStore) listConversations() ([]Conversation, error) {
+	convs, err := s.db.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Conversation, len(convs))
+	for i, c := range convs {
+		list[i] = toAPIConversation(c)
+	}
+	return list, nil
+}
+
+func (s *dbStore) conversation(id string) (Conversation, error) {
+	c, err := s.db.GetConversation(id)
+	return toAPIConversation(c), err
+}
+
+func (s *dbStore) openConversation(id, username string, now time.Time) (Conversation, error) {
+	c, err := s.db.EnsureConversation(id, username, now)
+	if err != nil {
+		return Conversation{}, err
+	}
+	msgs, err := s.db.MessagesAfter(id, database.MessagePosition{}, 0)
+	if err != nil {
+		return Conversation{}, err
+	}
+	conv := toAPIConversation(c)
+	conv.Messages = make([]*Message, len(msgs))
+	for i, m := range msgs {
+		m := toAPIMessage(m)
+		conv.Messages[i] = &m
+	}
+	return conv, nil
+}
+
+func (s *dbStore) participantConversations(username string) ([]string, error) {
+	return s.db.ParticipantConversations(username)
+}
+
+func (s *dbStore) addMessage(m Message, author string) (Conversation, error) {
+	c, err := s.db.AddMessage(toDBMessage(m), author)
+	return toAPIConversation(c), err
+}
+
+func (s *dbStore) message(id string) (Message, error) {
+	m, err := s.db.GetMessage(id)
+	return toAPIMessage(m), err
+}
+
+func (s *dbStore) deleteMessage(id string) (Conversation, error) {
+	m, err := s.db.DeleteMessage(id)
+	if err != nil {
+		return Conversation{}, err
+	}
+	return s.conversation(m.ConversationID)
+}
+
+func (s *dbStore) addReaction(messageID string, rx Reaction) (Conversation, error) {
+	if err := s.db.AddReaction(messageID, database.Reaction{ID: rx.ReactionID, Emoji: rx.Emoji}); err != nil {
+		return Conversation{}, err
+	}
+	m, err := s.db.GetMessage(messageID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	return s.conversation(m.ConversationID)
+}
+
+func (s *dbStore) removeReaction(messageID, reactionID string) (Reaction, Conversation, error) {
+	r, err := s.db.RemoveReaction(messageID, reactionID)
+	if err != nil {
+		return Reaction{}, Conversation{}, err
+	}
+	m, err := s.db.GetMessage(messageID)
+	if err != nil {
+		return Reaction{}, Conversation{}, err
+	}
+	c, err := s.conversation(m.ConversationID)
+	return Reaction{ReactionID: r.ID, Emoji: r.Emoji}, c, err
+}
+
+func (s *dbStore) messagesAfter(conversationID string, after database.MessagePosition, limit int) ([]Message, error) {
+	msgs, err := s.db.MessagesAfter(conversationID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Message, len(msgs))
+	for i, m := range msgs {
+		list[i] = toAPIMessage(m)
+	}
+	return list, nil
+}
+
+func (s *dbStore) importConversation(c Conversation) error {
+	msgs := make([]database.Message, len(c.Messages))
+	for i, m := range c.Messages {
+		msgs[i] = toDBMessage(*m)
+	}
+	return s.db.ImportConversation(database.Conversation{
+		ID:           c.ID,
+		Name:         c.Name,
+		Photo:        c.Photo,
+		LastMessage:  c.LastMessage,
+		Timestamp:    c.Timestamp,
+		Participants: c.Participants,
+		Retention:    toDBRetention(c.Retention),
+	}, msgs)
+}
+
+func toDBRetention(p RetentionPolicy) database.Retention {
+	return database.Retention{Mode: p.Mode, Days: p.Days, Hours: p.Hours}
+}
+
+func (s *dbStore) setRetention(conversationID string, p RetentionPolicy) (Conversation, error) {
+	if err := s.db.SetRetention(conversationID, toDBRetention(p)); err != nil {
+		return Conversation{}, err
+	}
+	return s.conversation(conversationID)
+}
+
+func (s *dbStore) imageInUse(url string) (bool, error) {
+	return s.db.ImageInUse(url)
+}
+
+func (s *dbStore) userRenamedAt(name string) (time.Time, error) {
+	return s.db.UserRenamedAt(name)
+}
+
+func (s *dbStore) sessionEpoch(now time.Time) (time.Time, error) {
+	return s.db.SessionEpoch(now)
+}
+
+func (s *dbStore) addMedia(m Media) error {
+	return s.db.AddMedia(database.Media{URL: m.URL, Owner: m.Owner, MessageID: m.MessageID, CreatedAt: m.CreatedAt})
+}
+
+func (s *dbStore) attachMedia(url, owner, messageID string) error {
+	return s.db.AttachMedia(url, owner, messageID)
+}
+
+func (s *dbStore) messageMedia(messageID string) (Media, error) {
+	m, err := s.db.MessageMedia(messageID)
+	return Media{URL: m.URL, Owner: m.Owner, MessageID: m.MessageID, CreatedAt: m.CreatedAt}, err
+}
+
+func (s *dbStore) deleteMedia(url string) error {
+	return s.db.DeleteMedia(url)
+}
+
+func toAPIScheduled(m database.ScheduledMessage) ScheduledMessage {
+	return ScheduledMessage{
+		ScheduledID:    m.ID,
+		ConversationID: m.ConversationID,
+		Sender:         m.Sender,
+		Content:        m.Content,
+		Type:           m.Type,
+		SendAt:         m.SendAt,
+		CreatedAt:      m.CreatedAt,
+	}
+}
+
+func toAPIScheduledList(list []database.ScheduledMessage) []ScheduledMessage {
+	var out []ScheduledMessage
+	for _, m := range list {
+		out = append(out, toAPIScheduled(m))
+	}
+	return out
+}
+
+func (s *dbStore) scheduleMessage(sm ScheduledMessage, limit int) error {
+	return s.db.ScheduleMessage(database.ScheduledMessage{
+		ID:             sm.ScheduledID,
+		ConversationID: sm.ConversationID,
+		Sender:         sm.Sender,
+		Content:        sm.Content,
+		Type:           sm.Type,
+		SendAt:         sm.SendAt,
+		CreatedAt:      sm.CreatedAt,
+	}, limit)
+}
+
+func (s *dbStore) scheduledMessages(sender string) ([]ScheduledMessage, error) {
+	list, err := s.db.ScheduledMessages(sender)
+	return toAPIScheduledList(list), err
+}
+
+func (s *dbStore) dueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	list, err := s.db.DueScheduledMessages(now, limit)
+	return toAPIScheduledList(list), err
+}
+
+func (s *dbStore) cancelScheduledMessage(id, sender string) (ScheduledMessage, error) {
+	m, err := s.db.CancelScheduledMessage(id, sender)
+	return toAPIScheduled(m), err
+}
+
+func (s *dbStore) deliverScheduledMessage(id string, m Message) (Conversation, error) {
+	c, err := s.db.DeliverScheduledMessage(id, toDBMessage(m))
+	return toAPIConversation(c), err
+}
+
+func (s *dbStore) pins(conversationID string) ([]Pin, error) {
+	list, err := s.db.PinnedMessages(conversationID)
+	var pins []Pin
+	for _, p := range list {
+		pins = append(pins, Pin{MessageID: p.MessageID, PinnedBy: p.PinnedBy, PinnedAt: p.PinnedAt})
+	}
+	return pins, err
+}
+
+func (s *dbStore) pinMessage(conversationID string, p Pin, limit int) error {
+	return s.db.PinMessage(database.Pin{MessageID: p.MessageID, ConversationID: conversationID, PinnedBy: p.PinnedBy, PinnedAt: p.PinnedAt}, limit)
+}
+
+func (s *dbStore) unpinMessage(conversationID, messageID string) error {
+	return s.db.UnpinMessage(conversationID, messageID)
+}
+
+func (s *dbStore) starMessage(username, messageID string, t time.Time) error {
+	return s.db.StarMessage(database.Star{Username: username, MessageID: messageID, StarredAt: t})
+}
+
+func (s *dbStore) unstarMessage(username, messageID string) error {
+	return s.db.UnstarMessage(username, messageID)
+}
+
+func (s *dbStore) starredMessages(username string) ([]StarredMessage, error) {
+	list, err := s.db.StarredMessages(username)
+	var starred []StarredMessage
+	for _, sm := range list {
+		starred = append(starred, StarredMessage{Message: toAPIMessage(sm.Message), StarredAt: sm.StarredAt})
+	}
+	return starred, err
+}
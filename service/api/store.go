@@ -1,107 +1,122 @@
 package api
 
 import (
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/mlatsa/WASAProject/internal/service/database"
 )
 
 /* In-memory store */
 
+// Store is the in-memory repository. Users and sessions share a lock, while every conversation has its own, so that
+// independent conversations are served in parallel. To avoid deadlocks, mu is never acquired while holding the lock of
+// a conversation, starsMu is acquired before the locks of conversations, and no lock is acquired holding mediaMu.
 type Store struct {
-	mu            sync.Mutex
-	sessions      map[string]string       // token -> username
-	usernames     map[string]string       // token -> username override
-	conversations map[string]*Conversation
-	messages      map[string]*Message
+	usersMu     sync.Mutex
+	sessions    map[string]*Session  // session ID -> session
+	tokens      map[string]string    // opaque token hash -> session ID
+	revoked     map[string]time.Time // revoked signed session ID -> expiration (zero if none)
+	credentials map[string][]byte    // username -> bcrypt password hash, in password mode
+	renamed     map[string]time.Time // username given up by a rename -> time of the rename
+	epoch       time.Time            // when the store started keeping sessions, zero until asked
+
+	// mu guards the maps of conversations, not their content
+	mu            sync.RWMutex
+	conversations map[string]*storedConversation
+	messages      map[string]*storedConversation // message ID -> its conversation
+
+	scheduledMu sync.Mutex
+	scheduled   map[string]ScheduledMessage // scheduled message ID -> message
+
+	starsMu sync.Mutex
+	stars   map[string]map[string]time.Time // username -> starred message ID -> time of the star
+
+	mediaMu sync.Mutex
+	media   map[string]Media // URL -> uploaded media file
+}
+
+// storedConversation is a conversation of the Store with its lock. Messages are immutable once stored: changes
+// replace them with modified copies. Readers take snapshots, copying the slice of messages under the lock, and can
+// then read them without it.
+type storedConversation struct {
+	mu   sync.RWMutex
+	conv Conversation        // messages in timestamp order
+	byID map[string]*Message // message ID -> message of conv.Messages
+	pins []Pin               // oldest first
 }
 
 func newStore() *Store {
 	return &Store{
-		sessions:      map[string]string{},
-		usernames:     map[string]string{},
-		conversations: map[string]*Conversation{},
-		messages:      map[string]*Message{},
+		sessions:      map[string]*Session{},
+		tokens:        map[string]string{},
+		revoked:       map[string]time.Time{},
+		credentials:   map[string][]byte{},
+		renamed:       map[string]time.Time{},
+		conversations: map[string]*storedConversation{},
+		messages:      map[string]*storedConversation{},
+		scheduled:     map[string]ScheduledMessage{},
+		stars:         map[string]map[string]time.Time{},
+		media:         map[string]Media{},
 	}
 }
 
 /* Models */
 
-type Reaction struct {
-	ReactionID string `json:"reactionId"`
-	Emoji      string `json:"emoji"`
-}
-
-type Message struct {
-	MessageID      string     `json:"messageId"`
-	ConversationID string     `json:"conversationId"`
-	Sender         string     `json:"sender"`
-	Content        string     `json:"content"`
-	Type           string     `json:"type"`
-	Status         string     `json:"status"`
-	Timestamp      time.Time  `json:"timestamp"`
-	Reactions      []Reaction `json:"reactions,omitempty"`
-}
-
 type Conversation struct {
 	ID           string     `json:"id"`
 	Participants []string   `json:"participants"`
 	Messages     []*Message `json:"messages"`
-	LastMessage  string     `json:"lastMessage"`
-	Timestamp    time.Time  `json:"timestamp"`
-	Name         string     `json:"name,omitempty"`
-	Photo        string     `json:"photo,omitempty"`
-}
-
-type ConversationDTO struct {
-	ID           string     `json:"id"`
-	Participants []string   `json:"participants"`
-	Messages     []*Message `json:"messages,omitempty"`
-	LastMessage  string     `json:"lastMessage"`
+	LastMessage  string     `json:"lastMessage,omitempty"`
 	Timestamp    time.Time  `json:"timestamp"`
 	Name         string     `json:"name,omitempty"`
 	Photo        string     `json:"photo,omitempty"`
-}
 
-type ConversationSummary struct {
-	ID           string    `json:"id"`
-	Participants []string  `json:"participants"`
-	LastMessage  string    `json:"lastMessage"`
-	Timestamp    time.Time `json:"timestamp"`
-	Name         string    `json:"name,omitempty"`
-	Photo        string    `json:"photo,omitempty"`
+	Retention RetentionPolicy `json:"retention"`
 }
 
-/* helpers bound to Router */
+/* helpers */
 
-func (rt *Router) username(token string) string {
-	rt.store.mu.Lock()
-	defer rt.store.mu.Unlock()
-	return rt.usernameLocked(token)
+// cloneMessage returns a copy of m that shares no memory with it.
+func cloneMessage(m *Message) Message {
+	cp := *m
+	cp.Reactions = append([]Reaction(nil), m.Reactions...)
+	return cp
 }
 
-func (rt *Router) usernameLocked(token string) string {
-	if u := rt.store.usernames[token]; u != "" {
-		return u
+// forwardMessage returns a copy of m for conversationID, sent at t, that shares no memory with it. Reactions are
+// copied as new ones, as reaction IDs are unique across messages.
+func forwardMessage(m *Message, conversationID string, t time.Time) Message {
+	fwd := cloneMessage(m)
+	fwd.MessageID = uuid.Must(uuid.NewV4()).String()
+	fwd.ConversationID = conversationID
+	fwd.ForwardedFrom = m.MessageID
+	fwd.Timestamp = t
+	for i := range fwd.Reactions {
+		fwd.Reactions[i].ReactionID = uuid.Must(uuid.NewV4()).String()
 	}
-	if u := rt.store.sessions[token]; u != "" {
-		return u
-	}
-	return "User"
+	return fwd
 }
 
-func (rt *Router) ensureConversationLocked(cid, username string) *Conversation {
-	if c := rt.store.conversations[cid]; c != nil {
-		return c
-	}
-	c := &Conversation{
-		ID:           cid,
-		Participants: []string{username},
-		Messages:     []*Message{},
-		LastMessage:  "",
-		Timestamp:    time.Now().UTC(),
+// summary returns a copy of c without its messages.
+func (c *Conversation) summary() Conversation {
+	cp := *c
+	cp.Participants = append([]string(nil), c.Participants...)
+	cp.Messages = nil
+	return cp
+}
+
+// withMessages returns a copy of c with copies of its messages.
+func (c *Conversation) withMessages() Conversation {
+	cp := c.summary()
+	cp.Messages = make([]*Message, len(c.Messages))
+	for i, m := range c.Messages {
+		m := cloneMessage(m)
+		cp.Messages[i] = &m
 	}
-	rt.store.conversations[cid] = c
-	return c
+	return cp
 }
 
 func (c *Conversation) toDTO() *ConversationDTO {
@@ -113,5 +128,829 @@ func (c *Conversation) toDTO() *ConversationDTO {
 		Timestamp:    c.Timestamp,
 		Name:         c.Name,
 		Photo:        c.Photo,
+		Retention:    retentionWithDefault(c.Retention),
+	}
+}
+
+// isParticipant reports whether username takes part in c.
+func isParticipant(c *Conversation, username string) bool {
+	for _, p := range c.Participants {
+		if p == username {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds username to the participants of c, if needed.
+func join(c *Conversation, username string) {
+	if !isParticipant(c, username) {
+		c.Participants = append(c.Participants, username)
+	}
+}
+
+/* users and sessions */
+
+func (s *Store) passwordHash(username string) ([]byte, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	return append([]byte(nil), s.credentials[username]...), nil
+}
+
+// setPasswordHash ignores the time: the memory store doesn't record when users are created.
+func (s *Store) setPasswordHash(username string, hash []byte, _ time.Time) ([]byte, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if s.credentials[username] == nil {
+		s.credentials[username] = append([]byte(nil), hash...)
+	}
+	return append([]byte(nil), s.credentials[username]...), nil
+}
+
+func (s *Store) renameUser(oldName, newName string, at time.Time) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if oldName == newName {
+		return nil
+	}
+	// In password mode, taking the name of a registered user would mean taking over their account
+	if s.credentials[newName] != nil {
+		return database.ErrAlreadyExists
+	}
+	s.renamed[oldName] = at
+	for _, sess := range s.sessions {
+		if sess.Username == oldName {
+			sess.Username = newName
+		}
+	}
+	if hash, ok := s.credentials[oldName]; ok {
+		delete(s.credentials, oldName)
+		s.credentials[newName] = hash
+	}
+
+	s.scheduledMu.Lock()
+	for id, sm := range s.scheduled {
+		if sm.Sender == oldName {
+			sm.Sender = newName
+			s.scheduled[id] = sm
+		}
+	}
+	s.scheduledMu.Unlock()
+
+	s.starsMu.Lock()
+	defer s.starsMu.Unlock()
+	if stars := s.stars[oldName]; stars != nil {
+		delete(s.stars, oldName)
+		if s.stars[newName] == nil {
+			s.stars[newName] = map[string]time.Time{}
+		}
+		for id, t := range stars {
+			if _, ok := s.stars[newName][id]; !ok {
+				s.stars[newName][id] = t
+			}
+		}
+	}
+
+	s.mediaMu.Lock()
+	defer s.mediaMu.Unlock()
+	for url, m := range s.media {
+		if m.Owner == oldName {
+			m.Owner = newName
+			s.media[url] = m
+		}
+	}
+	return nil
+}
+
+func (s *Store) userRenamedAt(name string) (time.Time, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	return s.renamed[name], nil
+}
+
+func (s *Store) knownUsers() (map[string]bool, error) {
+	s.usersMu.Lock()
+	known := map[string]bool{}
+	for _, sess := range s.sessions {
+		known[sess.Username] = true
+	}
+	for name := range s.credentials {
+		known[name] = true
+	}
+	s.usersMu.Unlock()
+
+	for _, sc := range s.snapshotConversations() {
+		sc.mu.RLock()
+		for _, p := range sc.conv.Participants {
+			known[p] = true
+		}
+		sc.mu.RUnlock()
+	}
+	return known, nil
+}
+
+func (s *Store) createSession(sess Session) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if s.sessions[sess.ID] != nil {
+		return database.ErrAlreadyExists
+	}
+	s.sessions[sess.ID] = &sess
+	if sess.TokenHash != "" {
+		s.tokens[sess.TokenHash] = sess.ID
+	}
+	return nil
+}
+
+func (s *Store) session(id string) (Session, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if sess := s.sessions[id]; sess != nil {
+		return *sess, nil
+	}
+	return Session{}, database.ErrNotFound
+}
+
+func (s *Store) sessionByToken(tokenHash string) (Session, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if sess := s.sessions[s.tokens[tokenHash]]; sess != nil {
+		return *sess, nil
+	}
+	return Session{}, database.ErrNotFound
+}
+
+func (s *Store) touchSession(id string, t time.Time) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	sess := s.sessions[id]
+	if sess == nil {
+		return database.ErrNotFound
+	}
+	sess.LastUsedAt = t
+	return nil
+}
+
+func (s *Store) deleteSession(id string) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	sess := s.sessions[id]
+	if sess == nil {
+		return database.ErrNotFound
+	}
+	s.deleteSessionLocked(sess)
+	return nil
+}
+
+func (s *Store) deleteSessionLocked(sess *Session) {
+	delete(s.sessions, sess.ID)
+	if sess.TokenHash != "" {
+		delete(s.tokens, sess.TokenHash)
+	}
+}
+
+func (s *Store) userSessions(username string) ([]Session, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	var list []Session
+	for _, sess := range s.sessions {
+		if sess.Username == username {
+			list = append(list, *sess)
+		}
+	}
+	return list, nil
+}
+
+func (s *Store) deleteExpiredSessions(idleBefore, createdBefore time.Time) ([]Session, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	var expired []Session
+	for _, sess := range s.sessions {
+		if (!idleBefore.IsZero() && !sess.LastUsedAt.After(idleBefore)) ||
+			(!createdBefore.IsZero() && !sess.CreatedAt.After(createdBefore)) {
+			s.deleteSessionLocked(sess)
+			expired = append(expired, *sess)
+		}
+	}
+	return expired, nil
+}
+
+func (s *Store) revokeToken(sessionID string, until time.Time) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	s.revoked[sessionID] = until
+	return nil
+}
+
+func (s *Store) isTokenRevoked(sessionID string) (bool, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	_, revoked := s.revoked[sessionID]
+	return revoked, nil
+}
+
+func (s *Store) forgetRevokedTokens(now time.Time) error {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	for id, until := range s.revoked {
+		if !until.IsZero() && now.After(until) {
+			delete(s.revoked, id)
+		}
+	}
+	return nil
+}
+
+func (s *Store) sessionEpoch(now time.Time) (time.Time, error) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if s.epoch.IsZero() {
+		s.epoch = now
+	}
+	return s.epoch, nil
+}
+
+/* conversations */
+
+func newStoredConversation(c Conversation) *storedConversation {
+	sc := &storedConversation{conv: c, byID: make(map[string]*Message, len(c.Messages))}
+	for _, m := range c.Messages {
+		sc.byID[m.MessageID] = m
+	}
+	return sc
+}
+
+// snapshot returns a copy of the conversation, whose messages are shared with the store: they must not be modified.
+func (sc *storedConversation) snapshot() Conversation {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	cp := sc.conv
+	cp.Participants = append([]string(nil), sc.conv.Participants...)
+	cp.Messages = append([]*Message(nil), sc.conv.Messages...)
+	return cp
+}
+
+func (sc *storedConversation) summary() Conversation {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.conv.summary()
+}
+
+// indexLocked returns the position of message m in the conversation, or -1 if m is nil or missing.
+func (sc *storedConversation) indexLocked(m *Message) int {
+	if m == nil {
+		return -1
+	}
+	msgs := sc.conv.Messages
+	i := sort.Search(len(msgs), func(n int) bool { return !msgs[n].Timestamp.Before(m.Timestamp) })
+	for ; i < len(msgs) && msgs[i].Timestamp.Equal(m.Timestamp); i++ {
+		if msgs[i] == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceLocked stores m in place of the message with the same ID.
+func (sc *storedConversation) replaceLocked(m *Message) {
+	if i := sc.indexLocked(sc.byID[m.MessageID]); i >= 0 {
+		sc.conv.Messages[i] = m
+	}
+	sc.byID[m.MessageID] = m
+}
+
+// lookupConversation returns the stored conversation id, or nil.
+func (s *Store) lookupConversation(id string) *storedConversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conversations[id]
+}
+
+// ensureConversation returns conversation id, creating it at t with username as only participant if needed.
+func (s *Store) ensureConversation(id, username string, t time.Time) *storedConversation {
+	if sc := s.lookupConversation(id); sc != nil {
+		return sc
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc := s.conversations[id]; sc != nil {
+		// Created in the meantime
+		return sc
+	}
+	sc := newStoredConversation(Conversation{
+		ID:           id,
+		Participants: []string{username},
+		Messages:     []*Message{},
+		Timestamp:    t,
+	})
+	s.conversations[id] = sc
+	return sc
+}
+
+// messageConversation returns the conversation of a message, or nil.
+func (s *Store) messageConversation(messageID string) *storedConversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.messages[messageID]
+}
+
+// snapshotConversations returns the stored conversations, which can then be locked one at a time.
+func (s *Store) snapshotConversations() []*storedConversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*storedConversation, 0, len(s.conversations))
+	for _, sc := range s.conversations {
+		list = append(list, sc)
+	}
+	return list
+}
+
+func (s *Store) listConversations() ([]Conversation, error) {
+	scs := s.snapshotConversations()
+	list := make([]Conversation, len(scs))
+	for i, sc := range scs {
+		list[i] = sc.summary()
+	}
+	return list, nil
+}
+
+func (s *Store) conversation(id string) (Conversation, error) {
+	if sc := s.lookupConversation(id); sc != nil {
+		return sc.summary(), nil
+	}
+	return Conversation{}, database.ErrNotFound
+}
+
+func (s *Store) openConversation(id, username string, now time.Time) (Conversation, error) {
+	// The messages are copied without holding the lock: they are immutable
+	c := s.ensureConversation(id, username, now).snapshot()
+	return c.withMessages(), nil
+}
+
+func (s *Store) participantConversations(username string) ([]string, error) {
+	var ids []string
+	for _, sc := range s.snapshotConversations() {
+		sc.mu.RLock()
+		if isParticipant(&sc.conv, username) {
+			ids = append(ids, sc.conv.ID)
+		}
+		sc.mu.RUnlock()
+	}
+	return ids, nil
+}
+
+func (s *Store) addMessage(m Message, author string) (Conversation, error) {
+	// A new conversation takes the timestamp of its first message anyway
+	sc := s.ensureConversation(m.ConversationID, author, m.Timestamp)
+	msg := cloneMessage(&m)
+	// The message is findable before it's in the conversation: until then, it's reported as missing
+	s.mu.Lock()
+	s.messages[msg.MessageID] = sc
+	s.mu.Unlock()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c := &sc.conv
+	// Messages are kept in timestamp order, even if the clock goes back
+	i := sort.Search(len(c.Messages), func(n int) bool { return c.Messages[n].Timestamp.After(msg.Timestamp) })
+	c.Messages = append(c.Messages, nil)
+	copy(c.Messages[i+1:], c.Messages[i:])
+	c.Messages[i] = &msg
+	sc.byID[msg.MessageID] = &msg
+	if i == len(c.Messages)-1 {
+		c.LastMessage = msg.Content
+		c.Timestamp = msg.Timestamp
+	}
+	join(c, author)
+	return c.summary(), nil
+}
+
+func (s *Store) message(id string) (Message, error) {
+	sc := s.messageConversation(id)
+	if sc == nil {
+		return Message{}, database.ErrNotFound
+	}
+	sc.mu.RLock()
+	m := sc.byID[id]
+	sc.mu.RUnlock()
+	if m == nil {
+		return Message{}, database.ErrNotFound
+	}
+	return cloneMessage(m), nil
+}
+
+func (s *Store) deleteMessage(id string) (Conversation, error) {
+	sc := s.messageConversation(id)
+	if sc == nil {
+		return Conversation{}, database.ErrNotFound
+	}
+	c, err := sc.deleteMessage(id)
+	if err == nil {
+		s.mu.Lock()
+		delete(s.messages, id)
+		s.mu.Unlock()
+
+		// Stars are added holding starsMu after checking that the message exists: none are added from now on
+		s.starsMu.Lock()
+		for name, stars := range s.stars {
+			delete(stars, id)
+			if len(stars) == 0 {
+				delete(s.stars, name)
+			}
+		}
+		s.starsMu.Unlock()
+	}
+	return c, err
+}
+
+func (sc *storedConversation) deleteMessage(id string) (Conversation, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	i := sc.indexLocked(sc.byID[id])
+	if i < 0 {
+		return Conversation{}, database.ErrNotFound
+	}
+	c := &sc.conv
+	c.Messages = append(c.Messages[:i], c.Messages[i+1:]...)
+	delete(sc.byID, id)
+	sc.unpinLocked(id)
+	// The preview shows the last message left
+	if len(c.Messages) > 0 {
+		c.LastMessage = c.Messages[len(c.Messages)-1].Content
+		c.Timestamp = c.Messages[len(c.Messages)-1].Timestamp
+	} else {
+		c.LastMessage = ""
+	}
+	return c.summary(), nil
+}
+
+func (s *Store) addReaction(messageID string, rx Reaction) (Conversation, error) {
+	sc := s.messageConversation(messageID)
+	if sc == nil {
+		return Conversation{}, database.ErrNotFound
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	m := sc.byID[messageID]
+	if m == nil {
+		return Conversation{}, database.ErrNotFound
+	}
+	cp := cloneMessage(m)
+	cp.Reactions = append(cp.Reactions, rx)
+	sc.replaceLocked(&cp)
+	return sc.conv.summary(), nil
+}
+
+func (s *Store) removeReaction(messageID, reactionID string) (Reaction, Conversation, error) {
+	sc := s.messageConversation(messageID)
+	if sc == nil {
+		return Reaction{}, Conversation{}, database.ErrNotFound
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	m := sc.byID[messageID]
+	if m == nil {
+		return Reaction{}, Conversation{}, database.ErrNotFound
+	}
+	cp := cloneMessage(m)
+	for i, rx := range cp.Reactions {
+		if rx.ReactionID == reactionID {
+			cp.Reactions = append(cp.Reactions[:i], cp.Reactions[i+1:]...)
+			sc.replaceLocked(&cp)
+			return rx, sc.conv.summary(), nil
+		}
+	}
+	return Reaction{}, Conversation{}, database.ErrNotFound
+}
+
+func (s *Store) messagesAfter(conversationID string, after database.MessagePosition, limit int) ([]Message, error) {
+	sc := s.lookupConversation(conversationID)
+	if sc == nil {
+		return nil, nil
+	}
+	sc.mu.RLock()
+	msgs := sc.conv.Messages
+	// The position is looked up among the messages with its timestamp. If it was deleted, paging resumes after it in
+	// (timestamp, ID) order, like in the database.
+	i, found := 0, false
+	if after.MessageID != "" {
+		i = sort.Search(len(msgs), func(n int) bool { return !msgs[n].Timestamp.Before(after.Timestamp) })
+		for j := i; j < len(msgs) && msgs[j].Timestamp.Equal(after.Timestamp); j++ {
+			if msgs[j].MessageID == after.MessageID {
+				i, found = j+1, true
+				break
+			}
+		}
+	}
+	var page []*Message
+	for _, m := range msgs[i:] {
+		if limit > 0 && len(page) == limit {
+			break
+		}
+		if after.MessageID != "" && !found && m.Timestamp.Equal(after.Timestamp) && m.MessageID <= after.MessageID {
+			continue
+		}
+		page = append(page, m)
+	}
+	sc.mu.RUnlock()
+
+	// The messages are copied without holding the lock: they are immutable
+	var out []Message
+	for _, m := range page {
+		out = append(out, cloneMessage(m))
+	}
+	return out, nil
+}
+
+func (s *Store) setRetention(conversationID string, p RetentionPolicy) (Conversation, error) {
+	sc := s.lookupConversation(conversationID)
+	if sc == nil {
+		return Conversation{}, database.ErrNotFound
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.conv.Retention = p
+	return sc.conv.summary(), nil
+}
+
+func (s *Store) imageInUse(url string) (bool, error) {
+	for _, sc := range s.snapshotConversations() {
+		sc.mu.RLock()
+		used := sc.conv.Photo == url
+		for _, m := range sc.conv.Messages {
+			if m.Type == "image" && m.Content == url {
+				used = true
+				break
+			}
+		}
+		sc.mu.RUnlock()
+		if used {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) importConversation(c Conversation) error {
+	sc := newStoredConversation(c.withMessages())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conversations[c.ID] != nil {
+		return database.ErrAlreadyExists
+	}
+	s.conversations[c.ID] = sc
+	for _, m := range sc.conv.Messages {
+		s.messages[m.MessageID] = sc
+	}
+	return nil
+}
+
+/* scheduled messages */
+
+func (s *Store) scheduleMessage(sm ScheduledMessage, limit int) error {
+	s.scheduledMu.Lock()
+	defer s.scheduledMu.Unlock()
+	if _, ok := s.scheduled[sm.ScheduledID]; ok {
+		return database.ErrAlreadyExists
+	}
+	if limit > 0 {
+		n := 0
+		for _, other := range s.scheduled {
+			if other.Sender == sm.Sender {
+				n++
+			}
+		}
+		if n >= limit {
+			return database.ErrLimitReached
+		}
+	}
+	s.scheduled[sm.ScheduledID] = sm
+	return nil
+}
+
+// sortScheduled sorts scheduled messages by time to send, then by ID.
+func sortScheduled(list []ScheduledMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].SendAt.Equal(list[j].SendAt) {
+			return list[i].SendAt.Before(list[j].SendAt)
+		}
+		return list[i].ScheduledID < list[j].ScheduledID
+	})
+}
+
+func (s *Store) scheduledMessages(sender string) ([]ScheduledMessage, error) {
+	s.scheduledMu.Lock()
+	var list []ScheduledMessage
+	for _, sm := range s.scheduled {
+		if sm.Sender == sender {
+			list = append(list, sm)
+		}
+	}
+	s.scheduledMu.Unlock()
+	sortScheduled(list)
+	return list, nil
+}
+
+func (s *Store) dueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	s.scheduledMu.Lock()
+	var list []ScheduledMessage
+	for _, sm := range s.scheduled {
+		if !sm.SendAt.After(now) {
+			list = append(list, sm)
+		}
+	}
+	s.scheduledMu.Unlock()
+	sortScheduled(list)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (s *Store) cancelScheduledMessage(id, sender string) (ScheduledMessage, error) {
+	s.scheduledMu.Lock()
+	defer s.scheduledMu.Unlock()
+	sm, ok := s.scheduled[id]
+	if !ok || sm.Sender != sender {
+		return ScheduledMessage{}, database.ErrNotFound
+	}
+	delete(s.scheduled, id)
+	return sm, nil
+}
+
+func (s *Store) deliverScheduledMessage(id string, m Message) (Conversation, error) {
+	s.scheduledMu.Lock()
+	_, ok := s.scheduled[id]
+	delete(s.scheduled, id)
+	s.scheduledMu.Unlock()
+	if !ok {
+		return Conversation{}, database.ErrNotFound
+	}
+	return s.addMessage(m, m.Sender)
+}
+
+/* pinned and starred messages */
+
+func (s *Store) pins(conversationID string) ([]Pin, error) {
+	sc := s.lookupConversation(conversationID)
+	if sc == nil {
+		return nil, nil
+	}
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return append([]Pin(nil), sc.pins...), nil
+}
+
+func (s *Store) pinMessage(conversationID string, p Pin, limit int) error {
+	sc := s.lookupConversation(conversationID)
+	if sc == nil {
+		return database.ErrNotFound
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.byID[p.MessageID] == nil {
+		return database.ErrNotFound
+	}
+	for _, pin := range sc.pins {
+		if pin.MessageID == p.MessageID {
+			return database.ErrAlreadyExists
+		}
+	}
+	if limit > 0 && len(sc.pins) >= limit {
+		return database.ErrLimitReached
+	}
+	// Pins are kept in (time, message ID) order, like in the database
+	i := sort.Search(len(sc.pins), func(n int) bool {
+		q := sc.pins[n]
+		return q.PinnedAt.After(p.PinnedAt) || (q.PinnedAt.Equal(p.PinnedAt) && q.MessageID > p.MessageID)
+	})
+	sc.pins = append(sc.pins, Pin{})
+	copy(sc.pins[i+1:], sc.pins[i:])
+	sc.pins[i] = p
+	return nil
+}
+
+func (s *Store) unpinMessage(conversationID, messageID string) error {
+	sc := s.lookupConversation(conversationID)
+	if sc == nil {
+		return database.ErrNotFound
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.unpinLocked(messageID) {
+		return database.ErrNotFound
+	}
+	return nil
+}
+
+// unpinLocked removes the pin of a message, and reports whether it was pinned.
+func (sc *storedConversation) unpinLocked(messageID string) bool {
+	for i, p := range sc.pins {
+		if p.MessageID == messageID {
+			sc.pins = append(sc.pins[:i], sc.pins[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) starMessage(username, messageID string, t time.Time) error {
+	s.starsMu.Lock()
+	defer s.starsMu.Unlock()
+	if _, err := s.message(messageID); err != nil {
+		return err
+	}
+	stars := s.stars[username]
+	if stars == nil {
+		stars = map[string]time.Time{}
+		s.stars[username] = stars
+	}
+	if _, ok := stars[messageID]; ok {
+		return database.ErrAlreadyExists
+	}
+	stars[messageID] = t
+	return nil
+}
+
+func (s *Store) unstarMessage(username, messageID string) error {
+	s.starsMu.Lock()
+	defer s.starsMu.Unlock()
+	if _, ok := s.stars[username][messageID]; !ok {
+		return database.ErrNotFound
+	}
+	delete(s.stars[username], messageID)
+	if len(s.stars[username]) == 0 {
+		delete(s.stars, username)
+	}
+	return nil
+}
+
+func (s *Store) starredMessages(username string) ([]StarredMessage, error) {
+	s.starsMu.Lock()
+	defer s.starsMu.Unlock()
+	var list []StarredMessage
+	for id, t := range s.stars[username] {
+		m, err := s.message(id)
+		if err != nil {
+			// Deleted: its stars are being removed
+			continue
+		}
+		list = append(list, StarredMessage{Message: m, StarredAt: t})
+	}
+	sortStarred(list)
+	return list, nil
+}
+
+// sortStarred sorts starred messages by time of the star, the last first, then by message ID.
+func sortStarred(list []StarredMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StarredAt.Equal(list[j].StarredAt) {
+			return list[i].StarredAt.After(list[j].StarredAt)
+		}
+		return list[i].Message.MessageID < list[j].Message.MessageID
+	})
+}
+
+/* uploaded media */
+
+func (s *Store) addMedia(m Media) error {
+	s.mediaMu.Lock()
+	defer s.mediaMu.Unlock()
+	if _, ok := s.media[m.URL]; ok {
+		return database.ErrAlreadyExists
+	}
+	s.media[m.URL] = m
+	return nil
+}
+
+func (s *Store) attachMedia(url, owner, messageID string) error {
+	s.mediaMu.Lock()
+	defer s.mediaMu.Unlock()
+	m, ok := s.media[url]
+	if !ok || m.Owner != owner || m.MessageID != "" {
+		return database.ErrNotFound
+	}
+	m.MessageID = messageID
+	s.media[url] = m
+	return nil
+}
+
+func (s *Store) messageMedia(messageID string) (Media, error) {
+	s.mediaMu.Lock()
+	defer s.mediaMu.Unlock()
+	for _, m := range s.media {
+		if m.MessageID == messageID && messageID != "" {
+			return m, nil
+		}
+	}
+	return Media{}, database.ErrNotFound
+}
+
+func (s *Store) deleteMedia(url string) error {
+	s.mediaMu.Lock()
+	defer s.mediaMu.Unlock()
+	if _, ok := s.media[url]; !ok {
+		return database.ErrNotFound
 	}
+	delete(s.media, url)
+	return nil
 }
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// concurrentSenders is the number of goroutines per CPU of the parallel benchmarks.
+const concurrentSenders = 16
+
+// BenchmarkStoreSend measures the throughput of the store with many concurrent senders, writing to one shared
+// conversation or each to its own. Only the latter scales with the CPUs: conversations have their own lock.
+func BenchmarkStoreSend(b *testing.B) {
+	for _, shared := range []bool{true, false} {
+		name := "separate"
+		if shared {
+			name = "shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newStore()
+			var senders int64
+			b.SetParallelism(concurrentSenders)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				sender := fmt.Sprintf("user%d", atomic.AddInt64(&senders, 1))
+				conv := "shared"
+				if !shared {
+					conv = "conv-" + sender
+				}
+				for pb.Next() {
+					m := Message{
+						MessageID:      uuid.Must(uuid.NewV4()).String(),
+						ConversationID: conv,
+						Sender:         sender,
+						Content:        "hello",
+						Type:           "text",
+						Status:         "delivered",
+						Timestamp:      time.Now().UTC(),
+					}
+					if _, err := s.addMessage(m, sender); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStoreReadWhileSending reads a long conversation while other goroutines send to their own conversations.
+// Readers copy a snapshot of the messages, so they don't hold back the senders.
+func BenchmarkStoreReadWhileSending(b *testing.B) {
+	s := newStore()
+	for i := 0; i < 1000; i++ {
+		_, _ = s.addMessage(Message{
+			MessageID:      uuid.Must(uuid.NewV4()).String(),
+			ConversationID: "history",
+			Sender:         "reader",
+			Content:        "old message",
+			Type:           "text",
+			Timestamp:      time.Now().UTC(),
+		}, "reader")
+	}
+
+	var workers int64
+	b.SetParallelism(concurrentSenders)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddInt64(&workers, 1)
+		reader := n%2 == 0
+		conv := fmt.Sprintf("conv-%d", n)
+		for pb.Next() {
+			var err error
+			if reader {
+				_, err = s.openConversation("history", "reader", time.Now().UTC())
+			} else {
+				_, err = s.addMessage(Message{
+					MessageID:      uuid.Must(uuid.NewV4()).String(),
+					ConversationID: conv,
+					Sender:         "sender",
+					Content:        "new message",
+					Type:           "text",
+					Timestamp:      time.Now().UTC(),
+				}, "sender")
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkSendMessage measures POST /conversations/{conversationId}/messages end to end, without the network, with
+// every sender in its own conversation.
+func BenchmarkSendMessage(b *testing.B) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rt, err := New(Config{Logger: logger})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = rt.Close() })
+	handler := rt.Handler()
+
+	serve := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var senders int64
+	b.SetParallelism(concurrentSenders)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		name := fmt.Sprintf("user%d", atomic.AddInt64(&senders, 1))
+		var login LoginResponse
+		w := serve(http.MethodPost, "/session", "", fmt.Sprintf(`{"name":%q}`, name))
+		if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+			b.Errorf("logging in: %v (body: %s)", err, w.Body)
+			return
+		}
+		path := "/conversations/conv-" + name + "/messages"
+		for pb.Next() {
+			if w := serve(http.MethodPost, path, login.Identifier, `{"content":"hello"}`); w.Code != http.StatusCreated {
+				b.Errorf("sending a message: status %d (body: %s)", w.Code, w.Body)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/mlatsa/WASAProject/internal/service/database"
+	"github.com/mlatsa/WASAProject/internal/service/wal"
+)
+
+// maxStressMessages is how many live messages the stress tests keep at most.
+const maxStressMessages = 64
+
+// TestRepositoryStress calls the repository from many goroutines at once, encoding every result it reads while
+// the others modify the same messages. Run it with -race to check that the results share no memory with the store.
+func TestRepositoryStress(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testRepositoryStress(t, newStore(), 500)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		repo, err := newRepository(Config{Database: newTestDatabase(t), Storage: StorageSQLite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRepositoryStress(t, repo, 100)
+	})
+	t.Run("durable", func(t *testing.T) {
+		cfg := PersistenceConfig{Dir: t.TempDir(), Sync: wal.SyncNever}
+		d := newTestDurableStore(t, cfg)
+		testRepositoryStress(t, d, 500)
+		// Concurrent changes are logged in the order they were made
+		want := encodedState(t, d.Store)
+		if got := encodedState(t, newTestDurableStore(t, cfg).Store); got != want {
+			t.Error("the replayed state differs from the state of the store")
+		}
+	})
+}
+
+// testRepositoryStress runs ops operations on each worker.
+func testRepositoryStress(t *testing.T, repo repository, ops int) {
+	const workers = 8
+	if testing.Short() {
+		t.Skip("stress test skipped in short mode")
+	}
+	state := newStressState()
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(i)))
+			user := fmt.Sprintf("worker%d", i)
+			for n := 0; n < ops; n++ {
+				conv := fmt.Sprintf("stress-%d", rnd.Intn(2))
+				msgID, found, full := state.pick(rnd)
+				var result interface{}
+				var err error
+				switch op := rnd.Intn(8); {
+				case !found || (op < 2 && !full):
+					m := Message{MessageID: uuid.Must(uuid.NewV4()).String(), ConversationID: conv, Sender: user, Content: "stress", Type: "text", Timestamp: time.Now().UTC()}
+					if result, err = repo.addMessage(m, user); err == nil {
+						state.add(m.MessageID, conv)
+					}
+				case op < 4:
+					rx := Reaction{ReactionID: uuid.Must(uuid.NewV4()).String(), Emoji: "👍"}
+					if result, err = repo.addReaction(msgID, rx); err == nil && rnd.Intn(2) == 0 {
+						_, result, err = repo.removeReaction(msgID, rx.ReactionID)
+					}
+				case op == 4:
+					var orig Message
+					if orig, err = repo.message(msgID); err == nil {
+						fwd := forwardMessage(&orig, conv, time.Now().UTC())
+						if result, err = repo.addMessage(fwd, user); err == nil {
+							state.add(fwd.MessageID, conv)
+						}
+					}
+				case op < 2 || op == 5:
+					result, err = repo.deleteMessage(msgID)
+					state.delete(msgID)
+				case op == 6:
+					result, err = repo.openConversation(conv, user, time.Now().UTC())
+				default:
+					result, err = repo.messagesAfter(conv, database.MessagePosition{}, 0)
+				}
+				if errors.Is(err, database.ErrNotFound) {
+					// Deleted by another worker
+					continue
+				} else if err == nil {
+					// Reading and writing the results races with the other workers if they share memory with the store
+					_, err = json.Marshal(result)
+					scribble(result)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// scribble overwrites the messages of a result of the repository.
+func scribble(result interface{}) {
+	var msgs []*Message
+	switch r := result.(type) {
+	case Conversation:
+		msgs = r.Messages
+		for i := range r.Participants {
+			r.Participants[i] = "scribbled"
+		}
+	case []Message:
+		for i := range r {
+			msgs = append(msgs, &r[i])
+		}
+	}
+	for _, m := range msgs {
+		m.Content = "scribbled"
+		for i := range m.Reactions {
+			m.Reactions[i].Emoji = "✎"
+		}
+	}
+}
+
+// stressClient sends requests from many goroutines: unlike the fixture, it reports failures as errors, as t.Fatal
+// can't be called outside of the test goroutine.
+type stressClient struct {
+	f *conformanceFixture
+}
+
+func (c stressClient) do(method, path, token, body string, want ...int) ([]byte, int, error) {
+	req, err := http.NewRequest(method, c.f.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.f.server.Client().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, status := range want {
+		if resp.StatusCode == status {
+			return data, status, nil
+		}
+	}
+	return nil, resp.StatusCode, fmt.Errorf("%s %s: status %d, want %v (body: %s)", method, path, resp.StatusCode, want, data)
+}
+
+// stressState is what the workers know about the messages: the live ones, and the ones deleted.
+type stressState struct {
+	mu      sync.Mutex
+	ids     []string          // live message IDs, in no particular order
+	live    map[string]string // live message ID -> conversation ID
+	deleted map[string]bool
+}
+
+func newStressState() *stressState {
+	return &stressState{live: map[string]string{}, deleted: map[string]bool{}}
+}
+
+func (s *stressState) add(id, conv string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = append(s.ids, id)
+	s.live[id] = conv
+}
+
+func (s *stressState) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.live[id]; !ok {
+		return
+	}
+	for i := range s.ids {
+		if s.ids[i] == id {
+			s.ids[i] = s.ids[len(s.ids)-1]
+			s.ids = s.ids[:len(s.ids)-1]
+			break
+		}
+	}
+	delete(s.live, id)
+	s.deleted[id] = true
+}
+
+// pick returns a random live message, if any, and whether there are enough live messages to stop sending new ones.
+// Keeping conversations short keeps the workers on the same messages.
+func (s *stressState) pick(rnd *rand.Rand) (id string, found, full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ids) == 0 {
+		return "", false, false
+	}
+	return s.ids[rnd.Intn(len(s.ids))], true, len(s.ids) >= maxStressMessages
+}
+
+// TestStress sends, reacts to, forwards, deletes and reads messages of a few conversations from many goroutines at
+// once, then checks that the conversations hold exactly the messages that weren't deleted. Run it with -race to check
+// that the store shares no memory with the responses.
+func TestStress(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStress(t, Config{}, 100)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		// Every write is a transaction on disk: fewer operations are enough to exercise the conversions of dbStore
+		testStress(t, Config{Database: newTestDatabase(t), Storage: StorageSQLite}, 40)
+	})
+}
+
+// testStress runs ops operations on each worker.
+func testStress(t *testing.T, cfg Config, ops int) {
+	const workers = 8
+	conversations := []string{"stress-1", "stress-2"}
+	if testing.Short() {
+		t.Skip("stress test skipped in short mode")
+	}
+
+	f := newConformanceFixture(t, cfg)
+	c := stressClient{f: f}
+	// The workers are sessions of the same user, as only the sender of a message can delete it
+	tokens := make([]string, workers)
+	for i := range tokens {
+		tokens[i] = f.login("worker")
+	}
+	state := newStressState()
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(i)))
+			token := tokens[i]
+			for n := 0; n < ops; n++ {
+				conv := conversations[rnd.Intn(len(conversations))]
+				msgID, found, full := state.pick(rnd)
+				var err error
+				switch op := rnd.Intn(8); {
+				case !found || (op < 2 && !full):
+					var data []byte
+					data, _, err = c.do(http.MethodPost, "/conversations/"+conv+"/messages", token, `{"content":"stress"}`, http.StatusCreated)
+					var m Message
+					if err == nil {
+						err = json.Unmarshal(data, &m)
+						state.add(m.MessageID, conv)
+					}
+				case op < 4:
+					var data []byte
+					var status int
+					data, status, err = c.do(http.MethodPost, "/messages/"+msgID+"/reactions", token, `{"reaction":"👍"}`, http.StatusCreated, http.StatusNotFound)
+					var rx ReactionCreated
+					if err == nil && status == http.StatusCreated {
+						if err = json.Unmarshal(data, &rx); err == nil && rnd.Intn(2) == 0 {
+							_, _, err = c.do(http.MethodDelete, "/messages/"+msgID+"/reactions/"+rx.ReactionID, token, "", http.StatusNoContent)
+						}
+					}
+				case op == 4:
+					var data []byte
+					var status int
+					body := fmt.Sprintf(`{"conversationId":%q}`, conv)
+					data, status, err = c.do(http.MethodPost, "/messages/"+msgID+"/forward", token, body, http.StatusCreated, http.StatusNotFound)
+					var m Message
+					if err == nil && status == http.StatusCreated {
+						err = json.Unmarshal(data, &m)
+						state.add(m.MessageID, conv)
+					}
+				case op < 2 || op == 5:
+					_, _, err = c.do(http.MethodDelete, "/messages/"+msgID, token, "", http.StatusNoContent)
+					state.delete(msgID)
+				case op == 6:
+					_, _, err = c.do(http.MethodGet, "/conversations/"+conv, token, "", http.StatusOK)
+				default:
+					_, _, err = c.do(http.MethodGet, "/conversations/"+conv+"/export", token, "", http.StatusOK, http.StatusNotFound)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	// Every live message is in its conversation, in timestamp order, and no deleted one is
+	for _, conv := range conversations {
+		data, _, err := c.do(http.MethodGet, "/conversations/"+conv, tokens[0], "", http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out ConversationResponse
+		f.decodeInto(data, &out)
+		got := map[string]bool{}
+		for i, m := range out.Conversation.Messages {
+			got[m.MessageID] = true
+			if state.deleted[m.MessageID] {
+				t.Errorf("%s: deleted message %s is still there", conv, m.MessageID)
+			}
+			if i > 0 && m.Timestamp.Before(out.Conversation.Messages[i-1].Timestamp) {
+				t.Errorf("%s: message %s is out of order", conv, m.MessageID)
+			}
+		}
+		for id, in := range state.live {
+			if in == conv && !got[id] {
+				t.Errorf("%s: message %s is missing", conv, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TokenMode selects how bearer tokens are issued and verified.
+type TokenMode string
+
+const (
+	// TokenOpaque tokens are random strings. The server stores only their SHA-256 hash, so a dump of the store
+	// doesn't leak usable credentials.
+	TokenOpaque TokenMode = "opaque"
+
+	// TokenSigned tokens carry the session ID, the username and the expiration, signed with HMAC-SHA256. Revoked
+	// sessions are remembered until their tokens expire, so they need an absolute session TTL and durable storage.
+	TokenSigned TokenMode = "signed"
+)
+
+// minSecretSize is the minimum size of an HMAC secret, as long as the hash output.
+const minSecretSize = sha256.Size
+
+// SigningKey is an HMAC key for signed tokens. The ID is embedded in tokens so that keys can be rotated.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// TokenConfig configures bearer tokens. The zero value issues opaque tokens.
+type TokenConfig struct {
+	Mode TokenMode
+
+	// Keys are the signing keys, used only in signed mode. The first key signs new tokens; the others are accepted
+	// for verification only, so that tokens signed with a retired key keep working until they expire.
+	Keys []SigningKey
+}
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// validate checks the configuration, returning the first problem found.
+func (c TokenConfig) validate() error {
+	switch c.Mode {
+	case "", TokenOpaque:
+		return nil
+	case TokenSigned:
+	default:
+		return fmt.Errorf("unknown token mode %q", c.Mode)
+	}
+	if len(c.Keys) == 0 {
+		return errors.New("signed tokens require at least one signing key")
+	}
+	seen := map[string]bool{}
+	for _, k := range c.Keys {
+		if !keyIDPattern.MatchString(k.ID) {
+			return fmt.Errorf("invalid signing key ID %q", k.ID)
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("duplicate signing key ID %q", k.ID)
+		}
+		seen[k.ID] = true
+		if len(k.Secret) < minSecretSize {
+			return fmt.Errorf("signing key %q must be at least %d bytes long", k.ID, minSecretSize)
+		}
+	}
+	return nil
+}
+
+// ParseSigningKey parses a key in the "id:secret" format used in the configuration.
+func ParseSigningKey(s string) (SigningKey, error) {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return SigningKey{}, errors.New(`signing key must be in the "id:secret" format`)
+	}
+	return SigningKey{ID: s[:i], Secret: []byte(s[i+1:])}, nil
+}
+
+// newOpaqueToken returns a random token and the hash to store in its place.
+func newOpaqueToken() (token, hash string, err error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", "", fmt.Errorf("generating token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf[:])
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash under which an opaque token is stored. Tokens are long random strings, so a fast hash
+// without salt is enough: there's nothing to brute-force.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenClaims is the payload of signed tokens.
+type tokenClaims struct {
+	SessionID string `json:"sid"`
+	Username  string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// signedTokenPrefix identifies the format version of signed tokens: "v1.<key id>.<payload>.<signature>".
+const signedTokenPrefix = "v1."
+
+func (c TokenConfig) sign(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encoding token claims: %w", err)
+	}
+	key := c.Keys[0]
+	unsigned := signedTokenPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac(key.Secret, unsigned)), nil
+}
+
+// verify checks the signature and the expiration of a signed token, and returns its claims.
+func (c TokenConfig) verify(token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	if !strings.HasPrefix(token, signedTokenPrefix) {
+		return claims, errors.New("not a signed token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return claims, errors.New("malformed token")
+	}
+	var secret []byte
+	for _, k := range c.Keys {
+		if k.ID == parts[1] {
+			secret = k.Secret
+			break
+		}
+	}
+	if secret == nil {
+		return claims, errors.New("unknown signing key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return claims, errors.New("malformed signature")
+	}
+	unsigned := token[:len(token)-len(parts[3])-1]
+	if !hmac.Equal(sig, mac(secret, unsigned)) {
+		return claims, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed payload")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.SessionID == "" {
+		return claims, errors.New("malformed payload")
+	}
+	if claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func mac(secret []byte, msg string) []byte {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write([]byte(msg))
+	return h.Sum(nil)
+}
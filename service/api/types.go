@@ -0,0 +1,77 @@
+package api
+
+import "github.com/mlatsa/WASAProject/service/api/types"
+
+// The models of the API are defined in the types package, which clients import without the server and its
+// dependencies. They are aliased here, so that the server and the tools built on it use them as part of this package.
+type (
+	ErrorCode  = types.ErrorCode
+	FieldError = types.FieldError
+
+	Event = types.Event
+
+	MessageOk            = types.MessageOk
+	Health               = types.Health
+	LoginBody            = types.LoginBody
+	LoginResponse        = types.LoginResponse
+	SetNameBody          = types.SetNameBody
+	PhotoBody            = types.PhotoBody
+	ConversationList     = types.ConversationList
+	ConversationResponse = types.ConversationResponse
+	SendMessageInput     = types.SendMessageInput
+	ForwardBody          = types.ForwardBody
+	ReactionBody         = types.ReactionBody
+	ReactionCreated      = types.ReactionCreated
+	GroupAddBody         = types.GroupAddBody
+	GroupNameBody        = types.GroupNameBody
+
+	Reaction             = types.Reaction
+	Message              = types.Message
+	ConversationDTO      = types.ConversationDTO
+	ConversationSummary  = types.ConversationSummary
+	RetentionPolicy      = types.RetentionPolicy
+	Pin                  = types.Pin
+	StarredMessage       = types.StarredMessage
+	StarredMessageList   = types.StarredMessageList
+	ScheduledMessage     = types.ScheduledMessage
+	ScheduledMessageList = types.ScheduledMessageList
+	Media                = types.Media
+	UploadedMedia        = types.UploadedMedia
+	Highlight            = types.Highlight
+	SearchResult         = types.SearchResult
+	SearchResults        = types.SearchResults
+	SessionInfo          = types.SessionInfo
+	SessionList          = types.SessionList
+	ImportSender         = types.ImportSender
+	ImportReport         = types.ImportReport
+)
+
+const (
+	ErrCodeBadRequest           = types.ErrCodeBadRequest
+	ErrCodeValidation           = types.ErrCodeValidation
+	ErrCodeUnauthorized         = types.ErrCodeUnauthorized
+	ErrCodeForbidden            = types.ErrCodeForbidden
+	ErrCodeNotFound             = types.ErrCodeNotFound
+	ErrCodeMethodNotAllowed     = types.ErrCodeMethodNotAllowed
+	ErrCodeConflict             = types.ErrCodeConflict
+	ErrCodePayloadTooLarge      = types.ErrCodePayloadTooLarge
+	ErrCodeUnsupportedMediaType = types.ErrCodeUnsupportedMediaType
+	ErrCodeTooManyRequests      = types.ErrCodeTooManyRequests
+	ErrCodeInternal             = types.ErrCodeInternal
+)
+
+const (
+	EventMessageCreated  = types.EventMessageCreated
+	EventMessageDeleted  = types.EventMessageDeleted
+	EventReactionAdded   = types.EventReactionAdded
+	EventReactionRemoved = types.EventReactionRemoved
+	EventMessagePinned   = types.EventMessagePinned
+	EventMessageUnpinned = types.EventMessageUnpinned
+	EventResync          = types.EventResync
+)
+
+const (
+	RetentionKeep         = types.RetentionKeep
+	RetentionDeleteAfter  = types.RetentionDeleteAfter
+	RetentionDisappearing = types.RetentionDisappearing
+)
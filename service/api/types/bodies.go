@@ -0,0 +1,73 @@
+package types
+
+import "time"
+
+// MessageOk is the MessageOk payload of doc/api.yaml.
+type MessageOk struct {
+	Message string `json:"message"`
+}
+
+// Health is the response of GET /health.
+type Health struct {
+	Status string `json:"status"`
+}
+
+// LoginBody is the LoginBody payload of doc/api.yaml.
+type LoginBody struct {
+	Name string `json:"name"`
+
+	// Password is required in password mode, and ignored otherwise. Its length is checked by the server, as it
+	// depends on the mode.
+	Password string `json:"password"`
+}
+
+// LoginResponse is the response of POST /session: Identifier is the bearer token of the new session.
+type LoginResponse struct{ Identifier string `json:"identifier"` }
+
+// SetNameBody is the SetNameBody payload of doc/api.yaml.
+type SetNameBody struct{ Name string `json:"name"` }
+
+// PhotoBody is the PhotoBody payload of doc/api.yaml.
+type PhotoBody struct {
+	MediaURL string `json:"mediaUrl"`
+}
+
+// ConversationList is the response of GET /conversations.
+type ConversationList struct {
+	Conversations []*ConversationSummary `json:"conversations"`
+}
+
+// ConversationResponse is the response of GET /conversations/{conversationId}.
+type ConversationResponse struct {
+	Conversation *ConversationDTO `json:"conversation"`
+}
+
+// SendMessageInput is the SendMessageInput payload of doc/api.yaml.
+type SendMessageInput struct {
+	Content string `json:"content"`
+	Type    string `json:"type"` // "text" | "image"
+
+	// SendAt schedules the message, if it's in the future: it's sent then instead of now
+	SendAt *time.Time `json:"sendAt,omitempty"`
+}
+
+// ForwardBody is the ForwardBody payload of doc/api.yaml.
+type ForwardBody struct{ ConversationID string `json:"conversationId"` }
+
+// ReactionBody is the ReactionBody payload of doc/api.yaml.
+type ReactionBody struct{ Reaction string `json:"reaction"` }
+
+// ReactionCreated is the response of POST /messages/{messageId}/reactions.
+type ReactionCreated struct {
+	MessageID  string `json:"messageId"`
+	ReactionID string `json:"reactionId"`
+	Emoji      string `json:"emoji"`
+}
+
+// GroupAddBody is the GroupAddBody payload of doc/api.yaml.
+type GroupAddBody struct {
+	ID string `json:"id"`
+}
+
+// GroupNameBody is the GroupNameBody payload of doc/api.yaml.
+type GroupNameBody struct{ Name string `json:"name"` }
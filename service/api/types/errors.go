@@ -0,0 +1,25 @@
+package types
+
+// ErrorCode is a stable, machine-readable identifier for a class of errors. Clients should switch on the code, never on
+// the human-readable message.
+type ErrorCode string
+
+const (
+	ErrCodeBadRequest           ErrorCode = "bad_request"
+	ErrCodeValidation           ErrorCode = "validation_failed"
+	ErrCodeUnauthorized         ErrorCode = "unauthorized"
+	ErrCodeForbidden            ErrorCode = "forbidden"
+	ErrCodeNotFound             ErrorCode = "not_found"
+	ErrCodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	ErrCodeConflict             ErrorCode = "conflict"
+	ErrCodePayloadTooLarge      ErrorCode = "payload_too_large"
+	ErrCodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	ErrCodeTooManyRequests      ErrorCode = "too_many_requests"
+	ErrCodeInternal             ErrorCode = "internal_error"
+)
+
+// FieldError describes why a single field of the request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
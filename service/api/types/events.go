@@ -0,0 +1,28 @@
+package types
+
+import "time"
+
+// Event types.
+const (
+	EventMessageCreated  = "message.created"
+	EventMessageDeleted  = "message.deleted"
+	EventReactionAdded   = "reaction.added"
+	EventReactionRemoved = "reaction.removed"
+	EventMessagePinned   = "message.pinned"
+	EventMessageUnpinned = "message.unpinned"
+
+	// EventResync means that events were lost, e.g. the client reconnected too late: it must reload its state
+	EventResync = "resync"
+)
+
+// Event is a change in a conversation, pushed to its participants by GET /events. Message is set for
+// message.created, MessageID for the other types, Reaction for the reaction ones.
+type Event struct {
+	ID             uint64    `json:"id"`
+	Type           string    `json:"type"`
+	ConversationID string    `json:"conversationId,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+	Message        *Message  `json:"message,omitempty"`
+	MessageID      string    `json:"messageId,omitempty"`
+	Reaction       *Reaction `json:"reaction,omitempty"`
+}
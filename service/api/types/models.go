@@ -0,0 +1,168 @@
+/*
+Package types has the models of the WASAText API described in doc/api.yaml: the request and response bodies, the
+events and the error codes. The server (service/api) and its clients (pkg/client) both use them, so that they stay in
+sync. The package depends on the standard library only, so that clients can import it without the server.
+*/
+package types
+
+import "time"
+
+// Reaction is a reaction to a message.
+type Reaction struct {
+	ReactionID string `json:"reactionId"`
+	Emoji      string `json:"emoji"`
+}
+
+// Message is a message of a conversation. Its type is "text" or "image", whose content is the URL of the image, or
+// "system" for the announcements of the server, like changes of the retention policy.
+type Message struct {
+	MessageID      string     `json:"messageId"`
+	ConversationID string     `json:"conversationId"`
+	Sender         string     `json:"sender"`
+	Content        string     `json:"content"`
+	Type           string     `json:"type"`
+	Status         string     `json:"status"`
+	Timestamp      time.Time  `json:"timestamp"`
+	Reactions      []Reaction `json:"reactions,omitempty"`
+	ForwardedFrom  string     `json:"forwardedFrom,omitempty"` // ID of the original message, for forwards
+}
+
+// ConversationDTO is a conversation with its messages and pins, as returned by GET /conversations/{conversationId}.
+type ConversationDTO struct {
+	ID           string     `json:"id"`
+	Participants []string   `json:"participants"`
+	Messages     []*Message `json:"messages,omitempty"`
+	LastMessage  string     `json:"lastMessage,omitempty"`
+	Timestamp    time.Time  `json:"timestamp"`
+	Name         string     `json:"name,omitempty"`
+	Photo        string     `json:"photo,omitempty"`
+
+	Retention RetentionPolicy `json:"retention"`
+	Pinned    []Pin           `json:"pinned,omitempty"`
+}
+
+// ConversationSummary is a conversation without its messages, as listed by GET /conversations.
+type ConversationSummary struct {
+	ID           string    `json:"id"`
+	Participants []string  `json:"participants"`
+	LastMessage  string    `json:"lastMessage,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	Name         string    `json:"name,omitempty"`
+	Photo        string    `json:"photo,omitempty"`
+}
+
+// Modes of RetentionPolicy.
+const (
+	RetentionKeep         = "keep"
+	RetentionDeleteAfter  = "delete-after"
+	RetentionDisappearing = "disappearing"
+)
+
+// RetentionPolicy is the RetentionPolicy schema of doc/api.yaml: how long the messages of a conversation are kept
+// after they are sent. The zero value keeps them forever, like the keep mode.
+type RetentionPolicy struct {
+	Mode  string `json:"mode"`
+	Days  int    `json:"days,omitempty"`  // with RetentionDeleteAfter
+	Hours int    `json:"hours,omitempty"` // with RetentionDisappearing
+}
+
+// Pin is a message pinned in its conversation, shown to every participant.
+type Pin struct {
+	MessageID string    `json:"messageId"`
+	PinnedBy  string    `json:"pinnedBy"`
+	PinnedAt  time.Time `json:"pinnedAt"`
+}
+
+// StarredMessage is a message that a user starred, to find it again with GET /starred.
+type StarredMessage struct {
+	Message   Message   `json:"message"`
+	StarredAt time.Time `json:"starredAt"`
+}
+
+// StarredMessageList is the response of GET /starred.
+type StarredMessageList struct {
+	Messages []StarredMessage `json:"messages"`
+}
+
+// ScheduledMessage is a message that its sender wrote to be sent at SendAt. Once delivered, the message has the same
+// ID.
+type ScheduledMessage struct {
+	ScheduledID    string    `json:"scheduledId"`
+	ConversationID string    `json:"conversationId"`
+	Sender         string    `json:"sender"`
+	Content        string    `json:"content"`
+	Type           string    `json:"type"`
+	SendAt         time.Time `json:"sendAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// ScheduledMessageList is the response of GET /scheduled-messages.
+type ScheduledMessageList struct {
+	ScheduledMessages []ScheduledMessage `json:"scheduledMessages"`
+}
+
+// Media is a file uploaded to the media directory. The server deletes only the files it tracks this way, and only with
+// the message that they were uploaded for.
+type Media struct {
+	URL       string    `json:"url"`
+	Owner     string    `json:"owner"`
+	MessageID string    `json:"messageId,omitempty"` // the message that shows the file, empty until it's sent
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UploadedMedia is the response of POST /media.
+type UploadedMedia struct {
+	MediaURL string `json:"mediaUrl"`
+}
+
+// Highlight is a matched term in a snippet. Offsets are in Unicode code points.
+type Highlight struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+}
+
+// SearchResult is a message matching a search, with the snippet of its content that matches.
+type SearchResult struct {
+	Message    Message     `json:"message"`
+	Snippet    string      `json:"snippet"`
+	Highlights []Highlight `json:"highlights"`
+}
+
+// SearchResults is the response of the search routes. NextCursor, if set, fetches the next page.
+type SearchResults struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// SessionInfo is the public view of a session.
+type SessionInfo struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Current    bool       `json:"current"`
+}
+
+// SessionList is the response of GET /sessions.
+type SessionList struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// ImportSender tells who the messages of a sender of the archive are attributed to.
+type ImportSender struct {
+	Name        string `json:"name"`
+	User        string `json:"user"`
+	Placeholder bool   `json:"placeholder"`
+	Messages    int    `json:"messages"`
+}
+
+// ImportReport describes what an import created or, in dry-run mode, would create.
+type ImportReport struct {
+	DryRun         bool           `json:"dryRun"`
+	ConversationID string         `json:"conversationId"`
+	Name           string         `json:"name,omitempty"`
+	Messages       int            `json:"messages"`
+	Skipped        int            `json:"skipped"`
+	Senders        []ImportSender `json:"senders"`
+	Warnings       []string       `json:"warnings,omitempty"`
+}
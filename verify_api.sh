@@ -12,17 +12,22 @@ call(){ curl -s -o /dev/null -w "%{http_code}  $1 $2\n" -X "$1" "$2" "${@:3}" ||
 
 call GET  "$BASE/health"
 call POST "$BASE/session" -H 'Content-Type: application/json' -d '{"name":"Bob"}'
-call PUT  "$BASE/user/username" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"username":"bob_01"}'
-call PUT  "$BASE/user/photo" "${AUTH[@]}"
+call PUT  "$BASE/user/username" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"name":"bob_01"}'
+call PUT  "$BASE/user/photo" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"mediaUrl":"https://example.com/me.jpg"}'
 call GET  "$BASE/conversations" "${AUTH[@]}"
-call GET  "$BASE/conversations/c1" "${AUTH[@]}"
-MSG=$(curl -s -X POST "$BASE/conversations/c1/messages" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"content":"hi","type":"text"}')
+call GET  "$BASE/conversations/chat1" "${AUTH[@]}"
+MSG=$(curl -s -X POST "$BASE/conversations/chat1/messages" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"content":"hi","type":"text"}')
 MID=$(echo "$MSG" | sed -n 's/.*"messageId":"\([^"]*\)".*/\1/p'); echo "MID=$MID"
-call POST "$BASE/messages/$MID/forward"   "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"conversationId":"c2"}'
-call POST "$BASE/messages/$MID/reactions" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"emoji":"👍"}'
+call GET  "$BASE/search?q=hi" "${AUTH[@]}"
+call GET  "$BASE/conversations/chat1/search?q=hi" "${AUTH[@]}"
+call GET  "$BASE/conversations/chat1/export?format=html" "${AUTH[@]}"
+call POST "$BASE/messages/$MID/forward"   "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"conversationId":"chat2"}'
+call POST "$BASE/messages/$MID/reactions" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"reaction":"👍"}'
 call DELETE "$BASE/messages/$MID/reactions/any" "${AUTH[@]}"
 call DELETE "$BASE/messages/$MID" "${AUTH[@]}"
-call POST "$BASE/groups/c1/members" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"member":"Charlie"}'
-call POST "$BASE/groups/c1/leave"   "${AUTH[@]}"
-call PUT  "$BASE/groups/c1/name"    "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"name":"Chat Group"}'
-call PUT  "$BASE/groups/c1/photo"   "${AUTH[@]}"
+call POST "$BASE/groups/chat1/members" "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"id":"Charlie"}'
+call POST "$BASE/groups/chat1/leave"   "${AUTH[@]}"
+call PUT  "$BASE/groups/chat1/name"    "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"name":"Chat Group"}'
+call PUT  "$BASE/groups/chat1/photo"   "${AUTH[@]}" -H 'Content-Type: application/json' -d '{"mediaUrl":"https://example.com/group.jpg"}'
+call GET  "$BASE/sessions" "${AUTH[@]}"
+call DELETE "$BASE/session" "${AUTH[@]}"